@@ -133,8 +133,9 @@ func (s *Server) Serve(iface *Interface) error {
 
 	fmt.Printf("Attached to AoE device (%s, Major: %d, Minor: %d). Server loop begins ... \n", iface.Name, s.major, s.minor)
 
-	// Start goroutine to sync device at regular intervals, and halt when
-	// the Server's Close method is called.
+	// Start goroutine to sync device and carry out requests to resize it
+	// at regular intervals, and halt when the Server's Close method is
+	// called.
 	s.wg.Add(1)
 	go func() {
 		for {
@@ -142,6 +143,16 @@ func (s *Server) Serve(iface *Interface) error {
 				clog.Warningf("failed to sync %s: %v", s.dev, err)
 			}
 
+			// The new size is reported the next time a client
+			// identifies the device, e.g. with aoe-revalidate.
+			if fd, ok := s.dev.(*FileDevice); ok {
+				if resized, err := fd.CheckResize(); err != nil {
+					clog.Warningf("failed to resize %s: %v", s.dev, err)
+				} else if resized {
+					clog.Infof("resized %s to %d bytes", s.dev, fd.Size())
+				}
+			}
+
 			select {
 			case <-time.After(5 * time.Second):
 			case <-s.ctx.Done():
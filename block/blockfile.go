@@ -3,12 +3,22 @@ package block
 import (
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/blockset"
+	"github.com/coreos/torus/models"
+	"github.com/pborman/uuid"
 	"golang.org/x/net/context"
 )
 
 type BlockFile struct {
 	*torus.File
 	vol *BlockVolume
+
+	// unlocked is set for files opened without taking the volume's lock:
+	// read-only attaches and snapshots.
+	unlocked bool
+	// ref is the INode a read-only attach is currently showing, and
+	// readerID what it's registered under so the GC keeps that INode.
+	ref      torus.INodeRef
+	readerID string
 }
 
 func (s *BlockVolume) OpenBlockFile() (file *BlockFile, err error) {
@@ -41,29 +51,135 @@ func (s *BlockVolume) OpenBlockFile() (file *BlockFile, err error) {
 	if err != nil {
 		return nil, err
 	}
-	return &BlockFile{
+	s.applyQoS(f)
+	file = &BlockFile{
 		File: f,
 		vol:  s,
-	}, nil
+	}
+	// Carry out any resize asked for while the volume was attached elsewhere.
+	if _, err := file.CheckResize(); err != nil {
+		clog.Errorf("couldn't resize block volume %s: %v", s.volume.Name, err)
+	}
+	return file, nil
 }
 
-func (s *BlockVolume) OpenSnapshot(name string) (*BlockFile, error) {
+// OpenBlockFileReadOnly opens the volume as of its last sync, without taking
+// its lock, so it may be open read-only in any number of places alongside one
+// writer. The file doesn't see later syncs until it's refreshed.
+func (s *BlockVolume) OpenBlockFileReadOnly() (file *BlockFile, err error) {
 	if s.volume.Type != VolumeType {
 		panic("wrong type")
 	}
-	snaps, err := s.mds.GetSnapshots()
+	id := uuid.New()
+	ref, err := s.registerReader(id)
 	if err != nil {
 		return nil, err
 	}
-	var found Snapshot
-	for _, x := range snaps {
-		if x.Name == name {
-			found = x
-			break
+	defer func() {
+		if err != nil {
+			s.mds.UnregisterReader(id)
 		}
+	}()
+	inode, bs, err := s.openINode(ref)
+	if err != nil {
+		return nil, err
 	}
-	if found.Name != name {
-		return nil, torus.ErrNotExist
+	f, err := s.srv.CreateFile(s.volume, inode, bs)
+	if err != nil {
+		return nil, err
+	}
+	f.ReadOnly = true
+	s.applyQoS(f)
+	return &BlockFile{
+		File:     f,
+		vol:      s,
+		unlocked: true,
+		ref:      ref,
+		readerID: id,
+	}, nil
+}
+
+// registerReader registers the read-only attach id as reading the volume's
+// current INode, and returns it. The INode is looked up again afterwards, in
+// case a sync replaced it, and the GC collected it, in between.
+func (s *BlockVolume) registerReader(id string) (torus.INodeRef, error) {
+	ref, err := s.mds.GetINode()
+	if err != nil {
+		return ref, err
+	}
+	for {
+		err = s.mds.RegisterReader(s.srv.Lease(), id, ref)
+		if err != nil {
+			return ref, err
+		}
+		cur, err := s.mds.GetINode()
+		if err != nil || cur == ref {
+			return ref, err
+		}
+		ref = cur
+	}
+}
+
+// applyQoS limits I/O through f to the volume's QoS limits, as they stand
+// now. Failing to look them up isn't worth failing the open for.
+func (s *BlockVolume) applyQoS(f *torus.File) {
+	q, err := s.srv.MDS.GetVolumeQoS(torus.VolumeID(s.volume.Id))
+	if err != nil {
+		clog.Errorf("couldn't get QoS limits of block volume %s: %v", s.volume.Name, err)
+		return
+	}
+	f.SetQoS(q)
+}
+
+// Refresh moves a file opened with OpenBlockFileReadOnly on to the volume's
+// latest sync, and returns whether that changed anything.
+func (f *BlockFile) Refresh() (bool, error) {
+	if !f.unlocked || f.ref == torus.ZeroINode() {
+		return false, torus.ErrInvalid
+	}
+	cur, err := f.vol.mds.GetINode()
+	if err != nil || cur == f.ref {
+		return false, err
+	}
+	ref, err := f.vol.registerReader(f.readerID)
+	if err == nil {
+		var inode *models.INode
+		var bs torus.Blockset
+		inode, bs, err = f.vol.openINode(ref)
+		if err == nil {
+			err = f.File.Reopen(inode, bs)
+		}
+	}
+	if err != nil {
+		// Keep the INode still being shown.
+		if rerr := f.vol.mds.RegisterReader(f.vol.srv.Lease(), f.readerID, f.ref); rerr != nil {
+			clog.Errorf("couldn't register reader of block volume %s: %v", f.vol.volume.Name, rerr)
+		}
+		return false, err
+	}
+	f.ref = ref
+	return true, nil
+}
+
+func (s *BlockVolume) openINode(ref torus.INodeRef) (*models.INode, torus.Blockset, error) {
+	inode, err := s.getOrCreateBlockINode(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), s.srv.Blocks)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inode, bs, nil
+}
+
+func (s *BlockVolume) OpenSnapshot(name string) (*BlockFile, error) {
+	if s.volume.Type != VolumeType {
+		panic("wrong type")
+	}
+	found, err := s.findSnapshot(name)
+	if err != nil {
+		return nil, err
 	}
 	ref := torus.INodeRefFromBytes(found.INodeRef)
 	inode, err := s.getOrCreateBlockINode(ref)
@@ -80,8 +196,9 @@ func (s *BlockVolume) OpenSnapshot(name string) (*BlockFile, error) {
 	}
 	f.ReadOnly = true
 	return &BlockFile{
-		File: f,
-		vol:  s,
+		File:     f,
+		vol:      s,
+		unlocked: true,
 	}, nil
 }
 
@@ -93,25 +210,31 @@ func (s *BlockVolume) RestoreSnapshot(name string) (err error) {
 		return err
 	}
 	defer s.mds.Unlock()
-	snaps, err := s.mds.GetSnapshots()
+	found, err := s.findSnapshot(name)
 	if err != nil {
 		return err
 	}
-	var found Snapshot
-	for _, x := range snaps {
-		if x.Name == name {
-			found = x
-			break
-		}
+	ref := torus.INodeRefFromBytes(found.INodeRef)
+	inode, err := s.getOrCreateBlockINode(ref)
+	if err != nil {
+		return err
 	}
-	if found.Name != name {
-		return torus.ErrNotExist
+	allocated, err := s.allocated(inode)
+	if err != nil {
+		return err
 	}
-	ref := torus.INodeRefFromBytes(found.INodeRef)
-	return s.mds.SyncINode(ref)
+	return s.mds.SyncINode(ref, allocated)
 }
 
 func (f *BlockFile) Close() (err error) {
+	if f.unlocked {
+		if f.readerID != "" {
+			if err := f.vol.mds.UnregisterReader(f.readerID); err != nil {
+				clog.Errorf("couldn't unregister reader of block volume %s: %v", f.vol.volume.Name, err)
+			}
+		}
+		return f.File.Close()
+	}
 	defer func() {
 		// No matter what attempt to release the lock.
 		unlockErr := f.vol.mds.Unlock()
@@ -145,5 +268,5 @@ func (f *BlockFile) Sync() error {
 	if err != nil {
 		return err
 	}
-	return f.vol.mds.SyncINode(ref)
+	return f.vol.mds.SyncINode(ref, f.File.Allocated())
 }
@@ -0,0 +1,196 @@
+package block
+
+import (
+	"errors"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+	"github.com/coreos/torus/models"
+)
+
+// ErrOvercommitted is returned when creating a volume would provision more
+// than the cluster's overcommit ratio allows.
+var ErrOvercommitted = errors.New("block: not enough storage in the cluster for the volume")
+
+// Capacity is how much of the cluster's storage the block volumes have been
+// given. Provisioned sizes count every replica, so that they compare with
+// Storage.
+type Capacity struct {
+	// Storage is the total size of the storage nodes in the ring.
+	Storage uint64
+	// Provisioned is the sum of the volumes' sizes, times their
+	// replication.
+	Provisioned uint64
+	// Limit is the most that may be provisioned, or 0 if there's no limit.
+	Limit uint64
+}
+
+// GetCapacity adds up the storage in the cluster and the sizes of its
+// volumes, counting those in the trash, whose blocks are still kept.
+func GetCapacity(mds torus.MetadataService) (Capacity, error) {
+	c, ringRep, err := getStorage(mds)
+	if err != nil {
+		return c, err
+	}
+	vols, _, err := mds.GetVolumes()
+	if err != nil {
+		return c, err
+	}
+	trash, err := mds.GetTrash()
+	if err != nil {
+		return c, err
+	}
+	for _, tv := range trash {
+		vols = append(vols, tv.Volume)
+	}
+	for _, vol := range vols {
+		if vol.Type != VolumeType {
+			continue
+		}
+		rep, err := mds.GetVolumeReplication(torus.VolumeID(vol.Id))
+		if err != nil {
+			return c, err
+		}
+		if rep == 0 {
+			rep = ringRep
+		}
+		c.Provisioned += vol.MaxBytes * uint64(rep)
+	}
+	return c, nil
+}
+
+// getStorage returns the cluster's storage and the limit on provisioning it,
+// with nothing provisioned yet, and the ring's replication factor.
+func getStorage(mds torus.MetadataService) (Capacity, int, error) {
+	var c Capacity
+	r, err := mds.GetRing()
+	if err != nil {
+		return c, 0, err
+	}
+	peers, err := mds.GetPeers()
+	if err != nil {
+		return c, 0, err
+	}
+	gmd := mds.GlobalMetadata()
+	members := r.Members()
+	for _, p := range peers {
+		if members.Has(p.UUID) {
+			c.Storage += p.TotalBlocks * gmd.BlockSize
+		}
+	}
+	if gmd.OvercommitRatio > 0 {
+		c.Limit = uint64(float64(c.Storage) * gmd.OvercommitRatio)
+	}
+	return c, ringReplication(r), nil
+}
+
+// ringReplication returns the replication factor of a ring, which is the
+// same for every block.
+func ringReplication(r torus.Ring) int {
+	perm, err := r.GetPeers(torus.BlockRef{})
+	if err != nil || perm.Replication == 0 {
+		return 1
+	}
+	return perm.Replication
+}
+
+// provisioned is how much the block volumes, including those in the trash,
+// have been provisioned. It's kept in the metadata and updated along with
+// the volumes, so that creating and growing them can be checked against the
+// overcommit ratio in the same transaction.
+type provisioned struct {
+	// Ring is the sum of the sizes of the volumes that have the ring's
+	// replication factor, which is counted when checking, as it may
+	// change.
+	Ring uint64 `json:"ring"`
+	// Replicated is the sum of the sizes of the other volumes, times their
+	// own replication factor.
+	Replicated uint64 `json:"replicated"`
+}
+
+func (p *provisioned) add(size uint64, rep int) {
+	if rep == 0 {
+		p.Ring += size
+		return
+	}
+	p.Replicated += size * uint64(rep)
+}
+
+func (p *provisioned) sub(size uint64, rep int) {
+	if rep == 0 {
+		p.Ring -= min64(p.Ring, size)
+		return
+	}
+	p.Replicated -= min64(p.Replicated, size*uint64(rep))
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// provisioning is the limit on how much may be provisioned.
+type provisioning struct {
+	// limited is false if there's no limit.
+	limited bool
+	limit   uint64
+	ringRep int
+}
+
+// getProvisioning returns the cluster's limit on provisioning, as set by its
+// overcommit ratio.
+func getProvisioning(mds torus.MetadataService) (provisioning, error) {
+	if mds.GlobalMetadata().OvercommitRatio <= 0 {
+		return provisioning{}, nil
+	}
+	c, ringRep, err := getStorage(mds)
+	if err != nil {
+		return provisioning{}, err
+	}
+	return provisioning{limited: true, limit: c.Limit, ringRep: ringRep}, nil
+}
+
+// allows returns whether p is within the limit.
+func (l provisioning) allows(p *provisioned) bool {
+	if !l.limited {
+		return true
+	}
+	return p.Ring*uint64(l.ringRep)+p.Replicated <= l.limit
+}
+
+// checkCapacity returns ErrOvercommitted if provisioning another size bytes
+// at the given replication factor would go past the cluster's overcommit
+// ratio. It's only a quick check, before asking for a volume to be resized;
+// the volume's metadata checks again as the size is changed.
+func checkCapacity(mds torus.MetadataService, size uint64, rep int) error {
+	if mds.GlobalMetadata().OvercommitRatio <= 0 {
+		return nil
+	}
+	c, err := GetCapacity(mds)
+	if err != nil {
+		return err
+	}
+	if rep == 0 {
+		r, err := mds.GetRing()
+		if err != nil {
+			return err
+		}
+		rep = ringReplication(r)
+	}
+	if c.Provisioned+size*uint64(rep) > c.Limit {
+		return ErrOvercommitted
+	}
+	return nil
+}
+
+// allocated returns the number of bytes of a volume's INode that are backed
+// by written blocks.
+func (s *BlockVolume) allocated(inode *models.INode) (uint64, error) {
+	bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), nil)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(torus.AllocatedBlocks(bs)) * s.mds.GlobalMetadata().BlockSize, nil
+}
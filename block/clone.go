@@ -0,0 +1,94 @@
+package block
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+// CloneSnapshot creates a new, writable block volume named newVolume that
+// starts out with the contents of the named snapshot. The clone shares the
+// snapshot's blocks rather than copying them; as blocks are never rewritten
+// in place, writes to either volume only ever add blocks of their own. The
+// shared blocks are kept alive by the GC for as long as any volume still
+// references them, even after the snapshot or its volume is deleted.
+//
+// A clone of an encrypted volume keeps reading and writing with its origin's
+// keys, and rotating its key makes a new version of its origin's. A clone
+// also takes its origin's block spec and replication factor.
+func (s *BlockVolume) CloneSnapshot(name string, newVolume string) (err error) {
+	if s.volume.Type != VolumeType {
+		panic("wrong type")
+	}
+	found, err := s.findSnapshot(name)
+	if err != nil {
+		return err
+	}
+	inode, err := s.getOrCreateBlockINode(torus.INodeRefFromBytes(found.INodeRef))
+	if err != nil {
+		return err
+	}
+	spec, err := s.mds.GetBlockSpec()
+	if err != nil {
+		return err
+	}
+	rep, err := s.srv.MDS.GetVolumeReplication(torus.VolumeID(s.volume.Id))
+	if err != nil {
+		return err
+	}
+	vid, err := createBlockVolume(s.srv.MDS, newVolume, s.volume.MaxBytes, VolumeOptions{Spec: spec, Replication: rep})
+	if err != nil {
+		return err
+	}
+	mds, err := createBlockMetadata(s.srv.MDS, newVolume, vid)
+	if err != nil {
+		return err
+	}
+	locked := false
+	defer func() {
+		if locked {
+			unlockErr := mds.Unlock()
+			if err == nil {
+				err = unlockErr
+			}
+		}
+		if err != nil {
+			// Don't leave a half-made clone behind.
+			mds.DeleteVolume()
+		}
+	}()
+	if err = mds.Lock(s.srv.Lease()); err != nil {
+		return err
+	}
+	locked = true
+	newINode, err := s.srv.MDS.CommitINodeIndex(vid)
+	if err != nil {
+		return err
+	}
+	newRef := torus.NewINodeRef(vid, newINode)
+	inode.Volume = uint64(vid)
+	inode.INode = uint64(newINode)
+	ctx := context.WithValue(s.getContext(), torus.CtxWriteLevel, torus.WriteAll)
+	err = s.srv.INodes.WriteINode(ctx, newRef, inode)
+	if err != nil {
+		return err
+	}
+	allocated, err := s.allocated(inode)
+	if err != nil {
+		return err
+	}
+	return mds.SyncINode(newRef, allocated)
+}
+
+func (s *BlockVolume) findSnapshot(name string) (Snapshot, error) {
+	snaps, err := s.mds.GetSnapshots()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, x := range snaps {
+		if x.Name == name {
+			return x, nil
+		}
+	}
+	return Snapshot{}, torus.ErrNotExist
+}
@@ -0,0 +1,72 @@
+package block
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+)
+
+// CreateEncryptedBlockVolume creates a block volume whose blocks are
+// encrypted at rest, and creates its first key with the configured
+// KeyProvider.
+func CreateEncryptedBlockVolume(mds torus.MetadataService, volume string, size uint64) error {
+	_, err := createBlockVolume(mds, volume, size, VolumeOptions{Encrypt: true})
+	return err
+}
+
+// RotateKey re-encrypts the current contents of an encrypted volume under a
+// new key version, which it returns. Existing snapshots still reference
+// blocks sealed with older keys, so those keys must be kept until the
+// snapshots are deleted.
+func (s *BlockVolume) RotateKey() (version uint32, err error) {
+	if s.volume.Type != VolumeType {
+		panic("wrong type")
+	}
+	if err = s.mds.Lock(s.srv.Lease()); err != nil {
+		return 0, err
+	}
+	defer func() {
+		unlockErr := s.mds.Unlock()
+		if err == nil {
+			err = unlockErr
+		}
+	}()
+	ref, err := s.mds.GetINode()
+	if err != nil {
+		return 0, err
+	}
+	inode, err := s.getOrCreateBlockINode(ref)
+	if err != nil {
+		return 0, err
+	}
+	bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), s.srv.Blocks)
+	if err != nil {
+		return 0, err
+	}
+	vid := torus.VolumeID(s.volume.Id)
+	newINode, err := s.srv.MDS.CommitINodeIndex(vid)
+	if err != nil {
+		return 0, err
+	}
+	newRef := torus.NewINodeRef(vid, newINode)
+	version, err = blockset.RotateKey(s.getContext(), bs, newRef)
+	if err != nil {
+		return 0, err
+	}
+	err = s.srv.Blocks.Flush()
+	if err != nil {
+		return 0, err
+	}
+	inode.INode = uint64(newINode)
+	inode.Blocks, err = torus.MarshalBlocksetToProto(bs)
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.WithValue(s.getContext(), torus.CtxWriteLevel, torus.WriteAll)
+	err = s.srv.INodes.WriteINode(ctx, newRef, inode)
+	if err != nil {
+		return 0, err
+	}
+	return version, s.mds.SyncINode(newRef, uint64(torus.AllocatedBlocks(bs))*s.mds.GlobalMetadata().BlockSize)
+}
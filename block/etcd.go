@@ -19,49 +19,414 @@ type blockEtcd struct {
 	vid  torus.VolumeID
 }
 
-func (b *blockEtcd) CreateBlockVolume(volume *models.Volume) error {
+func (b *blockEtcd) CreateBlockVolume(volume *models.Volume, spec torus.BlockLayerSpec, replication int, meta *torus.VolumeMeta, lim provisioning) error {
 	vbytes, err := volume.Marshal()
 	if err != nil {
 		return err
 	}
 	inodeBytes := torus.NewINodeRef(torus.VolumeID(volume.Id), 1).ToBytes()
 
-	do := b.Etcd.Client.Txn(b.getContext()).If(
-		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumes", volume.Name)), "=", 0),
-	).Then(
+	ops := []etcdv3.Op{
 		etcdv3.OpPut(etcd.MkKey("volumes", volume.Name), string(etcd.Uint64ToBytes(volume.Id))),
 		etcdv3.OpPut(etcd.MkKey("volumeid", etcd.Uint64ToHex(volume.Id)), string(vbytes)),
 		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "inode"), string(etcd.Uint64ToBytes(1))),
 		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "blockinode"), string(inodeBytes)),
-	)
-	resp, err := do.Commit()
+	}
+	if spec != nil {
+		specBytes, err := json.Marshal(spec)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "blockspec"), string(specBytes)))
+	}
+	if replication != 0 {
+		ops = append(ops, etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "replication"), string(etcd.Uint64ToBytes(uint64(replication)))))
+	}
+	if meta != nil {
+		metaBytes, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "labels"), string(metaBytes)))
+	}
+	nameKey := etcd.MkKey("volumes", volume.Name)
+	for {
+		p, cmp, err := b.getProvisioned()
+		if err != nil {
+			return err
+		}
+		p.add(volume.MaxBytes, replication)
+		if !lim.allows(p) {
+			return ErrOvercommitted
+		}
+		pop, err := putProvisioned(p)
+		if err != nil {
+			return err
+		}
+		resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.Version(nameKey), "=", 0),
+			cmp,
+		).Then(
+			append([]etcdv3.Op{pop}, ops...)...,
+		).Else(
+			etcdv3.OpGet(nameKey),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		if len(resp.Responses[0].GetResponseRange().Kvs) != 0 {
+			return torus.ErrExists
+		}
+		// Another volume was provisioned meanwhile; try again.
+	}
+}
+
+// provisionedKey holds how much the block volumes have been provisioned.
+var provisionedKey = etcd.MkKey("meta", "provisioned")
+
+// getProvisioned returns how much the block volumes have been provisioned,
+// and a comparison that holds for as long as that hasn't changed. If it
+// hasn't been kept yet, as in a cluster created before it was, it's added up
+// from the volumes and the trash.
+func (b *blockEtcd) getProvisioned() (*provisioned, etcdv3.Cmp, error) {
+	p := &provisioned{}
+	resp, err := b.Etcd.Client.Get(b.getContext(), provisionedKey)
 	if err != nil {
-		return err
+		return nil, etcdv3.Cmp{}, err
 	}
-	if !resp.Succeeded {
-		return torus.ErrExists
+	if len(resp.Kvs) != 0 {
+		err = json.Unmarshal(resp.Kvs[0].Value, p)
+		return p, etcdv3.Compare(etcdv3.ModRevision(provisionedKey), "=", resp.Kvs[0].ModRevision), err
 	}
-	return nil
+	tx, err := b.Etcd.Client.Txn(b.getContext()).Then(
+		etcdv3.OpGet(etcd.MkKey("volumeid"), etcdv3.WithPrefix()),
+		etcdv3.OpGet(etcd.MkKey("trash"), etcdv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return nil, etcdv3.Cmp{}, err
+	}
+	var vols []*models.Volume
+	for _, kv := range tx.Responses[0].GetResponseRange().Kvs {
+		vol := &models.Volume{}
+		err = vol.Unmarshal(kv.Value)
+		if err != nil {
+			return nil, etcdv3.Cmp{}, err
+		}
+		vols = append(vols, vol)
+	}
+	for _, kv := range tx.Responses[1].GetResponseRange().Kvs {
+		var tv torus.TrashedVolume
+		err = json.Unmarshal(kv.Value, &tv)
+		if err != nil {
+			return nil, etcdv3.Cmp{}, err
+		}
+		vols = append(vols, tv.Volume)
+	}
+	for _, vol := range vols {
+		if vol.Type != VolumeType {
+			continue
+		}
+		rep, err := b.GetVolumeReplication(torus.VolumeID(vol.Id))
+		if err != nil {
+			return nil, etcdv3.Cmp{}, err
+		}
+		p.add(vol.MaxBytes, rep)
+	}
+	return p, etcdv3.Compare(etcdv3.Version(provisionedKey), "=", 0), nil
+}
+
+func putProvisioned(p *provisioned) (etcdv3.Op, error) {
+	pbytes, err := json.Marshal(p)
+	if err != nil {
+		return etcdv3.Op{}, err
+	}
+	return etcdv3.OpPut(provisionedKey, string(pbytes)), nil
 }
 
 func (b *blockEtcd) DeleteVolume() error {
 	vid := uint64(b.vid)
-	tx := b.Etcd.Client.Txn(b.getContext()).If(
-		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")), "=", 0),
+	volKey := etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))
+	lockKey := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")
+	rep, err := b.GetVolumeReplication(b.vid)
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := b.Etcd.Client.Get(b.getContext(), volKey)
+		if err != nil {
+			return err
+		}
+		cmps := []etcdv3.Cmp{
+			etcdv3.Compare(etcdv3.Version(lockKey), "=", 0),
+		}
+		ops := []etcdv3.Op{
+			etcdv3.OpDelete(etcd.MkKey("volumes", b.name)),
+			etcdv3.OpDelete(volKey),
+			etcdv3.OpDelete(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid)), etcdv3.WithPrefix()),
+		}
+		if len(resp.Kvs) != 0 {
+			vol := &models.Volume{}
+			err = vol.Unmarshal(resp.Kvs[0].Value)
+			if err != nil {
+				return err
+			}
+			p, cmp, err := b.getProvisioned()
+			if err != nil {
+				return err
+			}
+			p.sub(vol.MaxBytes, rep)
+			pop, err := putProvisioned(p)
+			if err != nil {
+				return err
+			}
+			cmps = append(cmps, etcdv3.Compare(etcdv3.ModRevision(volKey), "=", resp.Kvs[0].ModRevision), cmp)
+			ops = append(ops, pop)
+		}
+		tx, err := b.Etcd.Client.Txn(b.getContext()).If(cmps...).Then(ops...).Else(
+			etcdv3.OpGet(lockKey),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		if tx.Succeeded {
+			return nil
+		}
+		if len(tx.Responses[0].GetResponseRange().Kvs) != 0 {
+			return torus.ErrLocked
+		}
+		// The volume or the provisioned sizes changed under us; try again.
+	}
+}
+
+func (b *blockEtcd) RenameVolume(newName string) error {
+	vid := uint64(b.vid)
+	volKey := etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))
+	oldKey := etcd.MkKey("volumes", b.name)
+	newKey := etcd.MkKey("volumes", newName)
+	lockKey := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")
+	for {
+		resp, err := b.Etcd.Client.Get(b.getContext(), volKey)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return torus.ErrNotExist
+		}
+		vol := &models.Volume{}
+		err = vol.Unmarshal(resp.Kvs[0].Value)
+		if err != nil {
+			return err
+		}
+		vol.Name = newName
+		vbytes, err := vol.Marshal()
+		if err != nil {
+			return err
+		}
+		tx, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.Value(oldKey), "=", string(etcd.Uint64ToBytes(vid))),
+			etcdv3.Compare(etcdv3.Version(newKey), "=", 0),
+			etcdv3.Compare(etcdv3.Version(lockKey), "=", 0),
+			etcdv3.Compare(etcdv3.ModRevision(volKey), "=", resp.Kvs[0].ModRevision),
+		).Then(
+			etcdv3.OpDelete(oldKey),
+			etcdv3.OpPut(newKey, string(etcd.Uint64ToBytes(vid))),
+			etcdv3.OpPut(volKey, string(vbytes)),
+		).Else(
+			etcdv3.OpGet(oldKey),
+			etcdv3.OpGet(newKey),
+			etcdv3.OpGet(lockKey),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		if tx.Succeeded {
+			b.Etcd.ForgetVolume(b.name)
+			b.name = newName
+			return nil
+		}
+		if kvs := tx.Responses[0].GetResponseRange().Kvs; len(kvs) == 0 || etcd.BytesToUint64(kvs[0].Value) != vid {
+			return torus.ErrNotExist
+		}
+		if len(tx.Responses[1].GetResponseRange().Kvs) != 0 {
+			return torus.ErrExists
+		}
+		if len(tx.Responses[2].GetResponseRange().Kvs) != 0 {
+			return torus.ErrLocked
+		}
+		// The volume changed under us; try again.
+	}
+}
+
+func (b *blockEtcd) TrashVolume(expires time.Time) error {
+	vid := uint64(b.vid)
+	volKey := etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))
+	nameKey := etcd.MkKey("volumes", b.name)
+	lockKey := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")
+	trashKey := etcd.MkKey("trash", etcd.Uint64ToHex(vid))
+	for {
+		resp, err := b.Etcd.Client.Get(b.getContext(), volKey)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return torus.ErrNotExist
+		}
+		vol := &models.Volume{}
+		err = vol.Unmarshal(resp.Kvs[0].Value)
+		if err != nil {
+			return err
+		}
+		tbytes, err := json.Marshal(torus.TrashedVolume{
+			Volume:    vol,
+			DeletedAt: time.Now(),
+			ExpiresAt: expires,
+		})
+		if err != nil {
+			return err
+		}
+		tx, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.Value(nameKey), "=", string(etcd.Uint64ToBytes(vid))),
+			etcdv3.Compare(etcdv3.Version(lockKey), "=", 0),
+			etcdv3.Compare(etcdv3.ModRevision(volKey), "=", resp.Kvs[0].ModRevision),
+		).Then(
+			etcdv3.OpDelete(nameKey),
+			etcdv3.OpDelete(volKey),
+			etcdv3.OpPut(trashKey, string(tbytes)),
+		).Else(
+			etcdv3.OpGet(nameKey),
+			etcdv3.OpGet(lockKey),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		if tx.Succeeded {
+			b.Etcd.ForgetVolume(b.name)
+			return nil
+		}
+		if kvs := tx.Responses[0].GetResponseRange().Kvs; len(kvs) == 0 || etcd.BytesToUint64(kvs[0].Value) != vid {
+			return torus.ErrNotExist
+		}
+		if len(tx.Responses[1].GetResponseRange().Kvs) != 0 {
+			return torus.ErrLocked
+		}
+		// The volume changed under us; try again.
+	}
+}
+
+func (b *blockEtcd) RestoreVolume(newName string) error {
+	vid := uint64(b.vid)
+	trashKey := etcd.MkKey("trash", etcd.Uint64ToHex(vid))
+	newKey := etcd.MkKey("volumes", newName)
+	resp, err := b.Etcd.Client.Get(b.getContext(), trashKey)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return torus.ErrNotExist
+	}
+	var tv torus.TrashedVolume
+	err = json.Unmarshal(resp.Kvs[0].Value, &tv)
+	if err != nil {
+		return err
+	}
+	if tv.Expired(time.Now()) {
+		// It's due to be purged, and its blocks may be gone already.
+		return torus.ErrNotExist
+	}
+	tv.Volume.Name = newName
+	vbytes, err := tv.Volume.Marshal()
+	if err != nil {
+		return err
+	}
+	tx, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.ModRevision(trashKey), "=", resp.Kvs[0].ModRevision),
+		etcdv3.Compare(etcdv3.Version(newKey), "=", 0),
 	).Then(
-		etcdv3.OpDelete(etcd.MkKey("volumes", b.name)),
-		etcdv3.OpDelete(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))),
-		etcdv3.OpDelete(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid)), etcdv3.WithPrefix()),
-	)
-	resp, err := tx.Commit()
+		etcdv3.OpDelete(trashKey),
+		etcdv3.OpPut(newKey, string(etcd.Uint64ToBytes(vid))),
+		etcdv3.OpPut(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid)), string(vbytes)),
+	).Else(
+		etcdv3.OpGet(newKey),
+	).Commit()
 	if err != nil {
 		return err
 	}
-	if !resp.Succeeded {
-		return torus.ErrLocked
+	if tx.Succeeded {
+		b.name = newName
+		return nil
 	}
-	return nil
+	if len(tx.Responses[0].GetResponseRange().Kvs) != 0 {
+		return torus.ErrExists
+	}
+	// Restored or purged by someone else in the meantime.
+	return torus.ErrNotExist
+}
 
+func (b *blockEtcd) PurgeVolume() error {
+	vid := uint64(b.vid)
+	trashKey := etcd.MkKey("trash", etcd.Uint64ToHex(vid))
+	rep, err := b.GetVolumeReplication(b.vid)
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := b.Etcd.Client.Get(b.getContext(), trashKey)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return torus.ErrNotExist
+		}
+		var tv torus.TrashedVolume
+		err = json.Unmarshal(resp.Kvs[0].Value, &tv)
+		if err != nil {
+			return err
+		}
+		p, cmp, err := b.getProvisioned()
+		if err != nil {
+			return err
+		}
+		p.sub(tv.Volume.MaxBytes, rep)
+		pop, err := putProvisioned(p)
+		if err != nil {
+			return err
+		}
+		tx, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(trashKey), "=", resp.Kvs[0].ModRevision),
+			cmp,
+		).Then(
+			etcdv3.OpDelete(trashKey),
+			etcdv3.OpDelete(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid)), etcdv3.WithPrefix()),
+			pop,
+		).Commit()
+		if err != nil {
+			return err
+		}
+		if tx.Succeeded {
+			return nil
+		}
+		// Purged or restored by someone else, or the provisioned sizes
+		// changed, in the meantime; try again.
+	}
+}
+
+func (b *blockEtcd) GetBlockSpec() (torus.BlockLayerSpec, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blockspec"))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	var spec torus.BlockLayerSpec
+	err = json.Unmarshal(resp.Kvs[0].Value, &spec)
+	if err != nil {
+		return nil, err
+	}
+	return spec, nil
 }
 
 func (b *blockEtcd) getContext() context.Context {
@@ -99,7 +464,7 @@ func (b *blockEtcd) GetINode() (torus.INodeRef, error) {
 	return torus.INodeRefFromBytes(resp.Kvs[0].Value), nil
 }
 
-func (b *blockEtcd) SyncINode(inode torus.INodeRef) error {
+func (b *blockEtcd) SyncINode(inode torus.INodeRef, allocated uint64) error {
 	vid := uint64(inode.Volume())
 	inodeBytes := string(inode.ToBytes())
 	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")
@@ -108,6 +473,7 @@ func (b *blockEtcd) SyncINode(inode torus.INodeRef) error {
 		etcdv3.Compare(etcdv3.Value(k), "=", b.Etcd.UUID()),
 	).Then(
 		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blockinode"), inodeBytes),
+		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "allocated"), string(etcd.Uint64ToBytes(allocated))),
 	)
 	resp, err := tx.Commit()
 	if err != nil {
@@ -138,6 +504,171 @@ func (b *blockEtcd) Unlock() error {
 	return nil
 }
 
+func (b *blockEtcd) SetVolumeSize(size uint64, lim provisioning) error {
+	vid := etcd.Uint64ToHex(uint64(b.vid))
+	volKey := etcd.MkKey("volumeid", vid)
+	reqKey := etcd.MkKey("volumemeta", vid, "resize")
+	lockKey := etcd.MkKey("volumemeta", vid, "blocklock")
+	rep, err := b.GetVolumeReplication(b.vid)
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := b.Etcd.Client.Txn(b.getContext()).Then(
+			etcdv3.OpGet(volKey),
+			etcdv3.OpGet(reqKey),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		volKvs := resp.Responses[0].GetResponseRange().Kvs
+		if len(volKvs) == 0 {
+			return torus.ErrNotExist
+		}
+		vol := &models.Volume{}
+		err = vol.Unmarshal(volKvs[0].Value)
+		if err != nil {
+			return err
+		}
+		p, cmp, err := b.getProvisioned()
+		if err != nil {
+			return err
+		}
+		p.sub(vol.MaxBytes, rep)
+		p.add(size, rep)
+		if size > vol.MaxBytes && !lim.allows(p) {
+			return ErrOvercommitted
+		}
+		pop, err := putProvisioned(p)
+		if err != nil {
+			return err
+		}
+		vol.MaxBytes = size
+		vbytes, err := vol.Marshal()
+		if err != nil {
+			return err
+		}
+		cmps := []etcdv3.Cmp{
+			etcdv3.Compare(etcdv3.Version(lockKey), ">", 0),
+			etcdv3.Compare(etcdv3.Value(lockKey), "=", b.Etcd.UUID()),
+			etcdv3.Compare(etcdv3.ModRevision(volKey), "=", volKvs[0].ModRevision),
+			cmp,
+		}
+		ops := []etcdv3.Op{
+			etcdv3.OpPut(volKey, string(vbytes)),
+			pop,
+		}
+		reqKvs := resp.Responses[1].GetResponseRange().Kvs
+		if len(reqKvs) != 0 && etcd.BytesToUint64(reqKvs[0].Value) == size {
+			cmps = append(cmps, etcdv3.Compare(etcdv3.ModRevision(reqKey), "=", reqKvs[0].ModRevision))
+			ops = append(ops, etcdv3.OpDelete(reqKey))
+		}
+		resp, err = b.Etcd.Client.Txn(b.getContext()).If(cmps...).Then(ops...).Else(
+			etcdv3.OpGet(lockKey),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			b.Etcd.ForgetVolume(b.name)
+			return nil
+		}
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		if len(kvs) == 0 || string(kvs[0].Value) != b.Etcd.UUID() {
+			return torus.ErrLocked
+		}
+		// The volume, its resize request or the provisioned sizes changed
+		// under us; try again.
+	}
+}
+
+func (b *blockEtcd) RequestResize(size uint64) error {
+	tx := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumes", b.name)), ">", 0),
+	).Then(
+		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "resize"), string(etcd.Uint64ToBytes(size))),
+	)
+	resp, err := tx.Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrNotExist
+	}
+	return nil
+}
+
+func (b *blockEtcd) GetResizeRequest() (uint64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "resize"))
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return etcd.BytesToUint64(resp.Kvs[0].Value), nil
+}
+
+func (b *blockEtcd) GetLockHolder() (string, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blocklock"))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+func (b *blockEtcd) BreakLock(holder string) error {
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blocklock")
+	resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Value(k), "=", holder),
+	).Then(
+		etcdv3.OpDelete(k),
+	).Else(
+		etcdv3.OpGet(k),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if resp.Succeeded {
+		return nil
+	}
+	if len(resp.Responses[0].GetResponseRange().Kvs) == 0 {
+		return torus.ErrNotExist
+	}
+	return torus.ErrLocked
+}
+
+func (b *blockEtcd) RegisterReader(lease int64, id string, ref torus.INodeRef) error {
+	if lease == 0 {
+		return torus.ErrInvalid
+	}
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "readers", id)
+	_, err := b.Etcd.Client.Put(b.getContext(), k, string(ref.ToBytes()), etcdv3.WithLease(etcdv3.LeaseID(lease)))
+	return err
+}
+
+func (b *blockEtcd) UnregisterReader(id string) error {
+	_, err := b.Etcd.Client.Delete(b.getContext(), etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "readers", id))
+	return err
+}
+
+func (b *blockEtcd) GetReaders() ([]torus.INodeRef, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(),
+		etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "readers"),
+		etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]torus.INodeRef, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		out[i] = torus.INodeRefFromBytes(kv.Value)
+	}
+	return out, nil
+}
+
 func (b *blockEtcd) SaveSnapshot(name string) error {
 	vid := uint64(b.vid)
 	for {
@@ -217,6 +748,71 @@ func (b *blockEtcd) DeleteSnapshot(name string) error {
 	return nil
 }
 
+func (b *blockEtcd) GetSnapshotSchedule() (*SnapshotSchedule, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "snapschedule"))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	var sched SnapshotSchedule
+	err = json.Unmarshal(resp.Kvs[0].Value, &sched)
+	if err != nil {
+		return nil, err
+	}
+	return &sched, nil
+}
+
+func (b *blockEtcd) SetSnapshotSchedule(sched *SnapshotSchedule) error {
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "snapschedule")
+	if sched == nil {
+		_, err := b.Etcd.Client.Delete(b.getContext(), k)
+		return err
+	}
+	bytes, err := json.Marshal(sched)
+	if err != nil {
+		return err
+	}
+	// Don't resurrect the schedule of a volume deleted in the meantime.
+	tx := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumes", b.name)), ">", 0),
+	).Then(
+		etcdv3.OpPut(k, string(bytes)),
+	)
+	resp, err := tx.Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrNotExist
+	}
+	return nil
+}
+
+func (b *blockEtcd) ElectLeader(task string, lease int64) (bool, error) {
+	if lease == 0 {
+		return false, torus.ErrInvalid
+	}
+	k := etcd.MkKey("meta", task)
+	tx := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(k), "=", 0),
+	).Then(
+		etcdv3.OpPut(k, b.Etcd.UUID(), etcdv3.WithLease(etcdv3.LeaseID(lease))),
+	).Else(
+		etcdv3.OpGet(k),
+	)
+	resp, err := tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	if resp.Succeeded {
+		return true, nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	return len(kvs) == 1 && string(kvs[0].Value) == b.Etcd.UUID(), nil
+}
+
 func createBlockEtcdMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (blockMetadata, error) {
 	if e, ok := mds.(*etcd.Etcd); ok {
 		return &blockEtcd{
@@ -38,33 +38,60 @@ func (b *blockvolGC) getContext() context.Context {
 	return b.srv.ExtendContext(ctx)
 }
 
-func (b *blockvolGC) PrepVolume(vol *models.Volume) error {
-	if vol.Type != VolumeType {
-		return nil
-	}
+// liveINodes returns the volume's current INode, and the INodes that keep
+// its blocks alive: the current one, those of its snapshots, and those its
+// read-only attaches are reading. The latter are nil until the volume has
+// first been synced.
+func (b *blockvolGC) liveINodes(vol *models.Volume) (torus.INodeRef, []torus.INodeRef, error) {
 	mds, err := createBlockMetadata(b.srv.MDS, vol.Name, torus.VolumeID(vol.Id))
 	if err != nil {
-		return err
+		return torus.ZeroINode(), nil, err
 	}
 	curRef, err := mds.GetINode()
 	if err != nil {
-		return err
+		return torus.ZeroINode(), nil, err
 	}
-	b.highwaters[curRef.Volume()] = 0
 	if curRef.INode <= 1 {
-		return nil
+		return curRef, nil, nil
 	}
-
 	snaps, err := mds.GetSnapshots()
 	if err != nil {
-		return err
+		return torus.ZeroINode(), nil, err
 	}
-
-	curINodes := make([]torus.INodeRef, 0, len(snaps)+1)
+	readers, err := mds.GetReaders()
+	if err != nil {
+		return torus.ZeroINode(), nil, err
+	}
+	curINodes := make([]torus.INodeRef, 0, len(snaps)+len(readers)+1)
 	curINodes = append(curINodes, curRef)
 	for _, x := range snaps {
 		curINodes = append(curINodes, torus.INodeRefFromBytes(x.INodeRef))
 	}
+	curINodes = append(curINodes, readers...)
+	return curRef, curINodes, nil
+}
+
+// LiveINodes returns the INodes that keep the blocks of a block volume alive.
+func (b *blockvolGC) LiveINodes(vol *models.Volume) ([]torus.INodeRef, error) {
+	if vol.Type != VolumeType {
+		return nil, nil
+	}
+	_, curINodes, err := b.liveINodes(vol)
+	return curINodes, err
+}
+
+func (b *blockvolGC) PrepVolume(vol *models.Volume) error {
+	if vol.Type != VolumeType {
+		return nil
+	}
+	curRef, curINodes, err := b.liveINodes(vol)
+	if err != nil {
+		return err
+	}
+	b.highwaters[curRef.Volume()] = 0
+	if curINodes == nil {
+		return nil
+	}
 
 	for _, x := range curINodes {
 		inode, err := b.inodes.GetINode(b.getContext(), x)
@@ -80,7 +107,10 @@ func (b *blockvolGC) PrepVolume(vol *models.Volume) error {
 			if ref.IsZero() {
 				continue
 			}
-			if ref.INode > b.highwaters[ref.Volume()] {
+			// A clone references blocks of the volume it was cloned
+			// from; those are kept alive by the set alone, as it's
+			// the volume's own blocks that set its highwater.
+			if ref.Volume() == curRef.Volume() && ref.INode > b.highwaters[ref.Volume()] {
 				b.highwaters[ref.Volume()] = ref.INode
 			}
 			b.set[ref] = true
@@ -93,10 +123,17 @@ func (b *blockvolGC) PrepVolume(vol *models.Volume) error {
 func (b *blockvolGC) IsDead(ref torus.BlockRef) bool {
 	v, ok := b.highwaters[ref.Volume()]
 	if !ok {
+		// Volume doesn't exist anymore, but clones of it may still be
+		// using its blocks.
+		if b.set[ref] {
+			if clog.LevelAt(capnslog.TRACE) {
+				clog.Tracef("%s is shared with a clone", ref)
+			}
+			return false
+		}
 		if clog.LevelAt(capnslog.TRACE) {
 			clog.Tracef("%s doesn't exist anymore", ref)
 		}
-		// Volume doesn't exist anymore
 		return true
 	}
 	// If it's a new block or INode, let it be.
@@ -0,0 +1,86 @@
+package block
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+// leaderTask runs a task for the whole cluster, such as the snapshot
+// schedules, on whichever client holds the task's election, checking every
+// interval. Every torusd may take part; if the leader goes away, another
+// takes over once its lease expires.
+type leaderTask struct {
+	srv      *torus.Server
+	task     string
+	what     string
+	interval time.Duration
+	run      func(now time.Time)
+	leader   bool
+	closer   chan bool
+	wg       sync.WaitGroup
+}
+
+// startLeaderTask starts running task, which does what, by calling run
+// every interval while this client is the leader.
+func startLeaderTask(srv *torus.Server, task, what string, interval time.Duration, run func(now time.Time)) *leaderTask {
+	t := &leaderTask{
+		srv:      srv,
+		task:     task,
+		what:     what,
+		interval: interval,
+		run:      run,
+		closer:   make(chan bool),
+	}
+	t.wg.Add(1)
+	go t.loop()
+	return t
+}
+
+func (t *leaderTask) loop() {
+	defer t.wg.Done()
+	for {
+		t.tick(time.Now())
+		select {
+		case <-t.closer:
+			return
+		case <-time.After(t.interval):
+		}
+	}
+}
+
+func (t *leaderTask) tick(now time.Time) {
+	lease := t.srv.Lease()
+	if lease == 0 {
+		// Not heartbeating yet.
+		return
+	}
+	mds, err := createBlockMetadata(t.srv.MDS, "", 0)
+	if err != nil {
+		clog.Errorf("%s: %v", t.task, err)
+		return
+	}
+	leader, err := mds.ElectLeader(t.task, lease)
+	if err != nil {
+		clog.Errorf("%s: couldn't run election: %v", t.task, err)
+		return
+	}
+	if leader != t.leader {
+		if leader {
+			clog.Infof("%s for the cluster", t.what)
+		} else {
+			clog.Infof("no longer %s", t.what)
+		}
+		t.leader = leader
+	}
+	if leader {
+		t.run(now)
+	}
+}
+
+// Close stops the task.
+func (t *leaderTask) Close() {
+	close(t.closer)
+	t.wg.Wait()
+}
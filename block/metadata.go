@@ -22,16 +22,80 @@ type blockMetadata interface {
 
 	Lock(lease int64) error
 	Unlock() error
+	// GetLockHolder returns the UUID of the client holding the volume's
+	// lock, or "" if it's free.
+	GetLockHolder() (string, error)
+	// BreakLock releases the volume's lock, as long as holder still holds
+	// it. It returns ErrLocked if someone else holds it now, and
+	// ErrNotExist if nobody does.
+	BreakLock(holder string) error
+
+	// RegisterReader records that the read-only attach id is reading ref,
+	// for as long as lease lasts, so that the GC keeps the INode's blocks.
+	// Registering id again moves it on to another INode.
+	RegisterReader(lease int64, id string, ref torus.INodeRef) error
+	UnregisterReader(id string) error
+	// GetReaders returns the INodes the volume's read-only attaches are
+	// reading.
+	GetReaders() ([]torus.INodeRef, error)
 
 	GetINode() (torus.INodeRef, error)
-	SyncINode(torus.INodeRef) error
+	// SyncINode makes ref the volume's current INode, which has allocated
+	// bytes backed by written blocks.
+	SyncINode(ref torus.INodeRef, allocated uint64) error
 
-	CreateBlockVolume(vol *models.Volume) error
+	// CreateBlockVolume creates the volume. If spec is non-nil, it is
+	// stored as the volume's block layer spec in place of the global default,
+	// and if replication is non-zero, as its replication factor in place of
+	// the ring's. If meta is non-nil, the volume is created with that owner
+	// and labels. It returns ErrOvercommitted if the volume would take the
+	// provisioned sizes past lim.
+	CreateBlockVolume(vol *models.Volume, spec torus.BlockLayerSpec, replication int, meta *torus.VolumeMeta, lim provisioning) error
+	// DeleteVolume deletes the volume for good, as long as nobody holds its
+	// lock.
 	DeleteVolume() error
+	// RenameVolume gives the volume a new name, as long as nobody holds
+	// its lock.
+	RenameVolume(newName string) error
+	// TrashVolume moves the volume to the trash, to be kept until expires,
+	// as long as nobody holds its lock.
+	TrashVolume(expires time.Time) error
+	// RestoreVolume brings the volume back from the trash as newName,
+	// unless it has expired.
+	RestoreVolume(newName string) error
+	// PurgeVolume deletes the volume in the trash for good.
+	PurgeVolume() error
+
+	// GetBlockSpec returns the volume's own block layer spec, or nil if the
+	// volume uses the global default.
+	GetBlockSpec() (torus.BlockLayerSpec, error)
+
+	// SetVolumeSize records the volume's new size, and drops any request to
+	// resize it to that size. The caller must hold the volume's lock. It
+	// returns ErrOvercommitted if growing the volume would take the
+	// provisioned sizes past lim.
+	SetVolumeSize(size uint64, lim provisioning) error
+	// RequestResize asks whoever holds the volume's lock to resize it.
+	RequestResize(size uint64) error
+	// GetResizeRequest returns the size the volume has been asked to be
+	// resized to, or 0 if there's no such request.
+	GetResizeRequest() (uint64, error)
 
 	SaveSnapshot(name string) error
 	GetSnapshots() ([]Snapshot, error)
 	DeleteSnapshot(name string) error
+
+	// GetSnapshotSchedule returns the volume's snapshot schedule, or nil if
+	// it has none.
+	GetSnapshotSchedule() (*SnapshotSchedule, error)
+	// SetSnapshotSchedule sets the volume's snapshot schedule; nil clears
+	// it.
+	SetSnapshotSchedule(*SnapshotSchedule) error
+
+	// ElectLeader tries to make this client the one that runs task for the
+	// whole cluster, such as the snapshot schedules, for as long as lease
+	// lives, and returns whether it is.
+	ElectLeader(task string, lease int64) (bool, error)
 }
 
 func createBlockMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (blockMetadata, error) {
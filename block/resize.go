@@ -0,0 +1,152 @@
+package block
+
+import (
+	"errors"
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+var (
+	// ErrResizePending is returned by Resize when the volume is attached and
+	// its holder hasn't carried out the resize in time. The request stands,
+	// and is carried out when the holder next checks, or when the volume is
+	// next opened.
+	ErrResizePending = errors.New("block: volume is in use and hasn't been resized yet")
+
+	// resizeCheckInterval is how often WatchResize checks for requests.
+	resizeCheckInterval = 5 * time.Second
+	// resizeWait is how long Resize waits for an attached volume's holder.
+	resizeWait = 3 * resizeCheckInterval
+)
+
+// Resize grows or shrinks the volume to size bytes. Shrinking drops the data
+// past the new end for good, though snapshots taken before keep it.
+//
+// Growing the volume is subject to the cluster's overcommit ratio, like
+// creating one. If the volume isn't attached, it's resized straight away. If it is, its
+// holder is asked to resize it, and Resize waits for it to do so; see
+// WatchResize.
+func (s *BlockVolume) Resize(size uint64) error {
+	if s.volume.Type != VolumeType {
+		panic("wrong type")
+	}
+	if size == 0 {
+		return torus.ErrInvalid
+	}
+	// The volume may have been resized since it was opened.
+	cur, err := s.srv.MDS.GetVolume(s.volume.Name)
+	if err != nil {
+		return err
+	}
+	if cur.Id != s.volume.Id {
+		return torus.ErrNotExist
+	}
+	if size > cur.MaxBytes {
+		rep, err := s.srv.MDS.GetVolumeReplication(torus.VolumeID(cur.Id))
+		if err != nil {
+			return err
+		}
+		err = checkCapacity(s.srv.MDS, size-cur.MaxBytes, rep)
+		if err != nil {
+			return err
+		}
+	}
+	f, err := s.OpenBlockFile()
+	if err == nil {
+		err = f.Resize(size)
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	if err != torus.ErrLocked {
+		return err
+	}
+	err = s.mds.RequestResize(size)
+	if err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(resizeWait); time.Now().Before(deadline); {
+		time.Sleep(time.Second)
+		req, err := s.mds.GetResizeRequest()
+		if err != nil {
+			return err
+		}
+		if req != size {
+			// Done, or asked for again since.
+			return nil
+		}
+	}
+	return ErrResizePending
+}
+
+// Resize grows or shrinks the open volume to size bytes, and syncs it. It's
+// safe to call while the file is in use.
+func (f *BlockFile) Resize(size uint64) error {
+	if size == 0 {
+		return torus.ErrInvalid
+	}
+	lim, err := getProvisioning(f.vol.srv.MDS)
+	if err != nil {
+		return err
+	}
+	if size <= f.Size() {
+		// Shrink the INode before giving the space back.
+		err = f.resize(size)
+		if err != nil {
+			return err
+		}
+		return f.vol.mds.SetVolumeSize(size, lim)
+	}
+	// Claim the space before using it.
+	err = f.vol.mds.SetVolumeSize(size, lim)
+	if err != nil {
+		return err
+	}
+	return f.resize(size)
+}
+
+func (f *BlockFile) resize(size uint64) error {
+	if size == f.Size() {
+		return nil
+	}
+	clog.Infof("resizing block volume %s from %d to %d bytes", f.vol.volume.Name, f.Size(), size)
+	err := f.File.Resize(int64(size))
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// CheckResize carries out any pending request to resize the open volume, and
+// returns whether there was one.
+func (f *BlockFile) CheckResize() (bool, error) {
+	size, err := f.vol.mds.GetResizeRequest()
+	if err != nil || size == 0 {
+		return false, err
+	}
+	return true, f.Resize(size)
+}
+
+// WatchResize checks for requests to resize the open volume every few seconds
+// until closer is closed, carrying them out and then calling resized with the
+// new size, so that the caller can tell its clients.
+func (f *BlockFile) WatchResize(closer chan bool, resized func(size uint64)) {
+	for {
+		select {
+		case <-closer:
+			return
+		case <-time.After(resizeCheckInterval):
+		}
+		ok, err := f.CheckResize()
+		if err != nil {
+			clog.Errorf("couldn't resize block volume %s: %v", f.vol.volume.Name, err)
+			continue
+		}
+		if ok && resized != nil {
+			resized(f.Size())
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package block
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+// SnapshotSchedule is how many snapshots of a volume to take and keep
+// automatically, for each period. A count of zero takes none for that
+// period.
+type SnapshotSchedule struct {
+	Hourly int `json:"hourly,omitempty"`
+	Daily  int `json:"daily,omitempty"`
+	Weekly int `json:"weekly,omitempty"`
+}
+
+type schedulePeriod struct {
+	name  string
+	every time.Duration
+	keep  func(*SnapshotSchedule) int
+}
+
+var schedulePeriods = []schedulePeriod{
+	{"hourly", time.Hour, func(s *SnapshotSchedule) int { return s.Hourly }},
+	{"daily", 24 * time.Hour, func(s *SnapshotSchedule) int { return s.Daily }},
+	{"weekly", 7 * 24 * time.Hour, func(s *SnapshotSchedule) int { return s.Weekly }},
+}
+
+// autoSnapshotPrefix starts the names of scheduled snapshots, which are
+// followed by their period and when they were taken.
+const autoSnapshotPrefix = "auto-"
+
+func autoSnapshotName(period string, t time.Time) string {
+	return fmt.Sprintf("%s%s-%s", autoSnapshotPrefix, period, t.UTC().Format("20060102-150405"))
+}
+
+// ScheduleStatus is the state of one period of a volume's snapshot schedule.
+type ScheduleStatus struct {
+	Period string
+	Keep   int
+	// Count is the number of snapshots taken for the period that still
+	// exist.
+	Count int
+	// Last is when the latest of them was taken, or zero if there are none.
+	Last time.Time
+	// Next is when the next one is due.
+	Next time.Time
+}
+
+func (s *BlockVolume) GetSnapshotSchedule() (*SnapshotSchedule, error) {
+	return s.mds.GetSnapshotSchedule()
+}
+
+// SetSnapshotSchedule sets the volume's snapshot schedule; nil clears it.
+// Snapshots already taken for a period that's turned off are left alone.
+func (s *BlockVolume) SetSnapshotSchedule(sched *SnapshotSchedule) error {
+	if sched != nil {
+		if sched.Hourly < 0 || sched.Daily < 0 || sched.Weekly < 0 {
+			return torus.ErrInvalid
+		}
+		if *sched == (SnapshotSchedule{}) {
+			sched = nil
+		}
+	}
+	return s.mds.SetSnapshotSchedule(sched)
+}
+
+// autoSnapshots returns the volume's scheduled snapshots for a period, oldest
+// first.
+func autoSnapshots(snaps []Snapshot, period string) []Snapshot {
+	prefix := autoSnapshotPrefix + period + "-"
+	var out []Snapshot
+	for _, x := range snaps {
+		if strings.HasPrefix(x.Name, prefix) {
+			out = append(out, x)
+		}
+	}
+	sort.Sort(snapshotsByTime(out))
+	return out
+}
+
+type snapshotsByTime []Snapshot
+
+func (s snapshotsByTime) Len() int           { return len(s) }
+func (s snapshotsByTime) Less(i, j int) bool { return s[i].When.Before(s[j].When) }
+func (s snapshotsByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// SnapshotScheduleStatus returns the state of each period of the volume's
+// snapshot schedule that's turned on, or nothing if it has none.
+func (s *BlockVolume) SnapshotScheduleStatus() ([]ScheduleStatus, error) {
+	sched, err := s.mds.GetSnapshotSchedule()
+	if err != nil || sched == nil {
+		return nil, err
+	}
+	snaps, err := s.mds.GetSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	var out []ScheduleStatus
+	for _, p := range schedulePeriods {
+		keep := p.keep(sched)
+		if keep == 0 {
+			continue
+		}
+		st := ScheduleStatus{
+			Period: p.name,
+			Keep:   keep,
+		}
+		auto := autoSnapshots(snaps, p.name)
+		st.Count = len(auto)
+		if len(auto) != 0 {
+			st.Last = auto[len(auto)-1].When
+			st.Next = st.Last.Add(p.every)
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// RunSnapshotSchedule takes the snapshots of the volume that are due as of
+// now, and deletes the oldest scheduled snapshots of each period beyond the
+// number to keep.
+func (s *BlockVolume) RunSnapshotSchedule(now time.Time) error {
+	sched, err := s.mds.GetSnapshotSchedule()
+	if err != nil || sched == nil {
+		return err
+	}
+	snaps, err := s.mds.GetSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, p := range schedulePeriods {
+		keep := p.keep(sched)
+		if keep == 0 {
+			continue
+		}
+		auto := autoSnapshots(snaps, p.name)
+		if len(auto) == 0 || !now.Before(auto[len(auto)-1].When.Add(p.every)) {
+			name := autoSnapshotName(p.name, now)
+			clog.Infof("taking scheduled snapshot %s@%s", s.volume.Name, name)
+			err = s.mds.SaveSnapshot(name)
+			if err != nil && err != torus.ErrExists {
+				return err
+			}
+			auto = append(auto, Snapshot{Name: name, When: now})
+		}
+		for len(auto) > keep {
+			clog.Infof("deleting expired snapshot %s@%s", s.volume.Name, auto[0].Name)
+			err = s.mds.DeleteSnapshot(auto[0].Name)
+			// Someone else may have deleted it first.
+			if err != nil && err != torus.ErrLocked && err != torus.ErrNotExist {
+				return err
+			}
+			auto = auto[1:]
+		}
+	}
+	return nil
+}
+
+// SnapshotScheduler runs the snapshot schedules of all the block volumes in
+// the cluster. Every torusd may run one; only the one holding the
+// cluster-wide election takes snapshots.
+type SnapshotScheduler struct {
+	*leaderTask
+}
+
+// StartSnapshotScheduler starts a SnapshotScheduler that checks for due
+// snapshots every interval.
+func StartSnapshotScheduler(srv *torus.Server, interval time.Duration) *SnapshotScheduler {
+	return &SnapshotScheduler{
+		startLeaderTask(srv, "snapshot-scheduler", "running snapshot schedules", interval, func(now time.Time) {
+			runSnapshotSchedules(srv, now)
+		}),
+	}
+}
+
+func runSnapshotSchedules(srv *torus.Server, now time.Time) {
+	vols, _, err := srv.MDS.GetVolumes()
+	if err != nil {
+		clog.Errorf("snapshot-scheduler: couldn't get volumes: %v", err)
+		return
+	}
+	for _, vol := range vols {
+		if vol.Type != VolumeType {
+			continue
+		}
+		bv, err := OpenBlockVolume(srv, vol.Name)
+		if err == nil {
+			err = bv.RunSnapshotSchedule(now)
+		}
+		if err != nil {
+			clog.Errorf("snapshot-scheduler: volume %s: %v", vol.Name, err)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package block
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+)
+
+// A send stream carries the changes to a block volume between two snapshots,
+// or all of a snapshot's contents. Its format is described in
+// Documentation/send-receive.md.
+
+const (
+	sendMagic   = "TORUSSND"
+	sendVersion = 1
+
+	sendRecordData = 1
+	sendRecordEnd  = 2
+
+	// sendChunkSize is the most data carried by one record.
+	sendChunkSize = 1024 * 1024
+)
+
+var (
+	// ErrBadStream is returned when receiving a stream that is malformed or
+	// corrupt.
+	ErrBadStream = errors.New("block: malformed send stream")
+	// ErrVolumeModified is returned when receiving an incremental stream
+	// into a volume that was changed since the stream's base snapshot.
+	ErrVolumeModified = errors.New("block: volume modified since base snapshot")
+)
+
+var sendTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Extent is a range of bytes of a block volume.
+type Extent struct {
+	Offset uint64
+	Length uint64
+}
+
+// SendHeader describes a send stream.
+type SendHeader struct {
+	// Size is the size of the volume as of the To snapshot.
+	Size uint64
+	// From is the snapshot the stream is relative to, or empty if the
+	// stream carries the whole volume.
+	From string
+	To   string
+}
+
+// snapshotRefs returns the BlockRef of each block of a snapshot, and the
+// size of the volume as of it.
+func (s *BlockVolume) snapshotRefs(name string) ([]torus.BlockRef, uint64, error) {
+	snap, err := s.findSnapshot(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	inode, err := s.getOrCreateBlockINode(torus.INodeRefFromBytes(snap.INodeRef))
+	if err != nil {
+		return nil, 0, err
+	}
+	bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The data blocks come first, ahead of any that layers like rep add.
+	return bs.GetAllBlockRefs()[:bs.Length()], inode.Filesize, nil
+}
+
+// DiffSnapshots returns the extents of the volume that differ between the
+// snapshots from and to, in order. If from is empty, it returns every extent
+// that has been written as of to.
+//
+// Blocks are never rewritten in place, so a block is unchanged exactly when
+// both snapshots hold the same BlockRef for it.
+func (s *BlockVolume) DiffSnapshots(from, to string) ([]Extent, error) {
+	var fromRefs []torus.BlockRef
+	if from != "" {
+		var err error
+		fromRefs, _, err = s.snapshotRefs(from)
+		if err != nil {
+			return nil, err
+		}
+	}
+	toRefs, size, err := s.snapshotRefs(to)
+	if err != nil {
+		return nil, err
+	}
+	blkSize := s.mds.GlobalMetadata().BlockSize
+	var out []Extent
+	for i, ref := range toRefs {
+		var old torus.BlockRef
+		if i < len(fromRefs) {
+			old = fromRefs[i]
+		}
+		if ref == old || (ref.IsZero() && old.IsZero()) {
+			continue
+		}
+		off := uint64(i) * blkSize
+		if off >= size {
+			break
+		}
+		length := blkSize
+		if off+length > size {
+			length = size - off
+		}
+		if n := len(out); n != 0 && out[n-1].Offset+out[n-1].Length == off {
+			out[n-1].Length += length
+			continue
+		}
+		out = append(out, Extent{Offset: off, Length: length})
+	}
+	return out, nil
+}
+
+// Send writes a stream of the changes between the snapshots from and to to
+// w. If from is empty, the stream carries all of to.
+func (s *BlockVolume) Send(w io.Writer, from, to string) error {
+	if s.volume.Type != VolumeType {
+		panic("wrong type")
+	}
+	extents, err := s.DiffSnapshots(from, to)
+	if err != nil {
+		return err
+	}
+	bf, err := s.OpenSnapshot(to)
+	if err != nil {
+		return err
+	}
+	// The snapshot isn't locked, so only close the file under it.
+	defer bf.File.Close()
+
+	bw := bufio.NewWriter(w)
+	sw := &sendWriter{w: bw, crc: crc32.New(sendTable)}
+	sw.header(SendHeader{Size: bf.Size(), From: from, To: to})
+	buf := make([]byte, sendChunkSize)
+	for _, e := range extents {
+		for done := uint64(0); done < e.Length && sw.err == nil; {
+			n := e.Length - done
+			if n > sendChunkSize {
+				n = sendChunkSize
+			}
+			_, err := bf.ReadAt(buf[:n], int64(e.Offset+done))
+			if err != nil && err != io.EOF {
+				return err
+			}
+			sw.data(e.Offset+done, buf[:n])
+			done += n
+		}
+	}
+	sw.end()
+	if sw.err != nil {
+		return sw.err
+	}
+	return bw.Flush()
+}
+
+type sendWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	err error
+}
+
+func (sw *sendWriter) write(v interface{}) {
+	if sw.err != nil {
+		return
+	}
+	sw.err = binary.Write(io.MultiWriter(sw.w, sw.crc), binary.LittleEndian, v)
+}
+
+func (sw *sendWriter) header(h SendHeader) {
+	sw.write([]byte(sendMagic))
+	sw.write(uint32(sendVersion))
+	sw.write(h.Size)
+	for _, name := range []string{h.From, h.To} {
+		sw.write(uint16(len(name)))
+		sw.write([]byte(name))
+	}
+}
+
+func (sw *sendWriter) data(off uint64, data []byte) {
+	sw.write(uint8(sendRecordData))
+	sw.write(off)
+	sw.write(uint32(len(data)))
+	sw.write(data)
+}
+
+func (sw *sendWriter) end() {
+	sw.write(uint8(sendRecordEnd))
+	sw.write(sw.crc.Sum32())
+}
+
+type sendReader struct {
+	r   io.Reader
+	crc hash.Hash32
+}
+
+func (sr *sendReader) read(v interface{}) error {
+	err := binary.Read(io.TeeReader(sr.r, sr.crc), binary.LittleEndian, v)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrBadStream
+	}
+	return err
+}
+
+func (sr *sendReader) header() (SendHeader, error) {
+	var h SendHeader
+	magic := make([]byte, len(sendMagic))
+	if err := sr.read(magic); err != nil {
+		return h, err
+	}
+	var version uint32
+	if err := sr.read(&version); err != nil {
+		return h, err
+	}
+	if string(magic) != sendMagic || version != sendVersion {
+		return h, ErrBadStream
+	}
+	if err := sr.read(&h.Size); err != nil {
+		return h, err
+	}
+	for _, name := range []*string{&h.From, &h.To} {
+		var l uint16
+		if err := sr.read(&l); err != nil {
+			return h, err
+		}
+		b := make([]byte, l)
+		if err := sr.read(b); err != nil {
+			return h, err
+		}
+		*name = string(b)
+	}
+	if h.To == "" {
+		return h, ErrBadStream
+	}
+	return h, nil
+}
+
+// ReceiveBlockVolume applies a send stream to the named volume, and then
+// saves the stream's To snapshot of it. A stream carrying a whole volume
+// creates it. An incremental stream needs the volume to have the stream's
+// From snapshot, and to be unchanged since; if force is set, it's restored
+// to that snapshot first instead. The volume is resized to match the
+// stream if need be, once the whole stream has been checked. Nothing is
+// synced to the volume before then, so a corrupt stream leaves it as it was.
+func ReceiveBlockVolume(srv *torus.Server, volume string, r io.Reader, force bool) (SendHeader, error) {
+	sr := &sendReader{r: bufio.NewReader(r), crc: crc32.New(sendTable)}
+	h, err := sr.header()
+	if err != nil {
+		return h, err
+	}
+	if h.From == "" {
+		err = CreateBlockVolume(srv.MDS, volume, h.Size)
+		if err != nil {
+			return h, err
+		}
+	}
+	vol, err := OpenBlockVolume(srv, volume)
+	if err != nil {
+		return h, err
+	}
+	if h.From != "" {
+		err = vol.checkReceiveBase(h, force)
+		if err != nil {
+			return h, err
+		}
+	}
+	err = vol.receive(sr, h)
+	if err != nil {
+		if h.From == "" {
+			DeleteBlockVolume(srv.MDS, volume)
+		}
+		return h, err
+	}
+	return h, vol.SaveSnapshot(h.To)
+}
+
+func (s *BlockVolume) checkReceiveBase(h SendHeader, force bool) error {
+	snaps, err := s.GetSnapshots()
+	if err != nil {
+		return err
+	}
+	var base *Snapshot
+	for i, x := range snaps {
+		if x.Name == h.To {
+			return torus.ErrExists
+		}
+		if x.Name == h.From {
+			base = &snaps[i]
+		}
+	}
+	if base == nil {
+		return torus.ErrNotExist
+	}
+	cur, err := s.mds.GetINode()
+	if err != nil {
+		return err
+	}
+	if cur == torus.INodeRefFromBytes(base.INodeRef) {
+		return nil
+	}
+	if !force {
+		return ErrVolumeModified
+	}
+	return s.RestoreSnapshot(h.From)
+}
+
+func (s *BlockVolume) receive(sr *sendReader, h SendHeader) (err error) {
+	f, err := s.OpenBlockFile()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// Nothing written is part of the volume until it's synced,
+			// so just let go of it.
+			f.File.Close()
+			s.mds.Unlock()
+			return
+		}
+		err = f.Close()
+	}()
+	buf := make([]byte, sendChunkSize)
+	for {
+		var kind uint8
+		if err := sr.read(&kind); err != nil {
+			return err
+		}
+		switch kind {
+		case sendRecordData:
+			var off uint64
+			var length uint32
+			if err := sr.read(&off); err != nil {
+				return err
+			}
+			if err := sr.read(&length); err != nil {
+				return err
+			}
+			if length > sendChunkSize || off+uint64(length) > h.Size {
+				return ErrBadStream
+			}
+			if err := sr.read(buf[:length]); err != nil {
+				return err
+			}
+			if _, err := f.WriteAt(buf[:length], int64(off)); err != nil {
+				return err
+			}
+		case sendRecordEnd:
+			want := sr.crc.Sum32()
+			var sum uint32
+			if err := binary.Read(sr.r, binary.LittleEndian, &sum); err != nil {
+				return ErrBadStream
+			}
+			if sum != want {
+				return ErrBadStream
+			}
+			// The volume may have been resized between the snapshots.
+			// Writes past its old end have grown it as far as they
+			// reach, but it's only sized to match now the stream is
+			// known to be good.
+			return f.Resize(h.Size)
+		default:
+			return ErrBadStream
+		}
+	}
+}
@@ -19,23 +19,70 @@ type blockTempVolumeData struct {
 	locked string
 	id     torus.INodeRef
 	snaps  []Snapshot
+	spec   torus.BlockLayerSpec
+	sched  *SnapshotSchedule
+	resize uint64
+	// size and rep are what the volume counts for in the provisioned
+	// sizes.
+	size uint64
+	rep  int
+	// readers maps read-only attaches to the INodes they're reading.
+	readers map[string]torus.INodeRef
 }
 
-func (b *blockTempMetadata) CreateBlockVolume(volume *models.Volume) error {
+func (b *blockTempMetadata) CreateBlockVolume(volume *models.Volume, spec torus.BlockLayerSpec, replication int, meta *torus.VolumeMeta, lim provisioning) error {
 	b.LockData()
 	defer b.UnlockData()
 	_, ok := b.GetData(fmt.Sprint(volume.Id))
 	if ok {
 		return torus.ErrExists
 	}
-	b.CreateVolume(volume)
+	p := *b.provisioned()
+	p.add(volume.MaxBytes, replication)
+	if !lim.allows(&p) {
+		return ErrOvercommitted
+	}
+	err := b.CreateVolume(volume)
+	if err != nil {
+		return err
+	}
+	*b.provisioned() = p
+	b.SetVolumeReplication(torus.VolumeID(volume.Id), replication)
+	if meta != nil {
+		b.CreateVolumeMeta(torus.VolumeID(volume.Id), meta)
+	}
 	b.SetData(fmt.Sprint(volume.Id), &blockTempVolumeData{
 		locked: "",
 		id:     torus.NewINodeRef(torus.VolumeID(volume.Id), 1),
+		spec:   spec,
+		size:   volume.MaxBytes,
+		rep:    replication,
 	})
 	return nil
 }
 
+// provisioned returns how much the block volumes have been provisioned. The
+// data lock must be held.
+func (b *blockTempMetadata) provisioned() *provisioned {
+	v, ok := b.GetData("provisioned")
+	if !ok {
+		v = &provisioned{}
+		b.SetData("provisioned", v)
+	}
+	return v.(*provisioned)
+}
+
+func (b *blockTempMetadata) GetBlockSpec() (torus.BlockLayerSpec, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	return d.spec, nil
+}
+
 func (b *blockTempMetadata) Lock(lease int64) error {
 	b.LockData()
 	defer b.UnlockData()
@@ -62,7 +109,7 @@ func (b *blockTempMetadata) GetINode() (torus.INodeRef, error) {
 	return d.id, nil
 }
 
-func (b *blockTempMetadata) SyncINode(inode torus.INodeRef) error {
+func (b *blockTempMetadata) SyncINode(inode torus.INodeRef, allocated uint64) error {
 	b.LockData()
 	defer b.UnlockData()
 	v, ok := b.GetData(fmt.Sprint(b.vid))
@@ -74,6 +121,7 @@ func (b *blockTempMetadata) SyncINode(inode torus.INodeRef) error {
 		return torus.ErrLocked
 	}
 	d.id = inode
+	b.SetVolumeAllocated(b.vid, allocated)
 	return nil
 }
 
@@ -92,7 +140,156 @@ func (b *blockTempMetadata) Unlock() error {
 	return nil
 }
 
+func (b *blockTempMetadata) GetLockHolder() (string, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return "", torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	return d.locked, nil
+}
+
+func (b *blockTempMetadata) BreakLock(holder string) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	switch d.locked {
+	case "":
+		return torus.ErrNotExist
+	case holder:
+		d.locked = ""
+		return nil
+	default:
+		return torus.ErrLocked
+	}
+}
+
+func (b *blockTempMetadata) RegisterReader(lease int64, id string, ref torus.INodeRef) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	if d.readers == nil {
+		d.readers = make(map[string]torus.INodeRef)
+	}
+	d.readers[id] = ref
+	return nil
+}
+
+func (b *blockTempMetadata) UnregisterReader(id string) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	delete(v.(*blockTempVolumeData).readers, id)
+	return nil
+}
+
+func (b *blockTempMetadata) GetReaders() ([]torus.INodeRef, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	var out []torus.INodeRef
+	for _, ref := range v.(*blockTempVolumeData).readers {
+		out = append(out, ref)
+	}
+	return out, nil
+}
+
 func (b *blockTempMetadata) DeleteVolume() error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	if d.locked != "" {
+		return torus.ErrLocked
+	}
+	err := b.Client.DeleteVolume(b.name)
+	if err != nil {
+		return err
+	}
+	b.provisioned().sub(d.size, d.rep)
+	b.DeleteData(fmt.Sprint(b.vid))
+	return nil
+}
+
+func (b *blockTempMetadata) TrashVolume(expires time.Time) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	if d.locked != "" {
+		return torus.ErrLocked
+	}
+	return b.Client.TrashVolume(b.name, expires)
+}
+
+func (b *blockTempMetadata) RestoreVolume(newName string) error {
+	b.LockData()
+	defer b.UnlockData()
+	err := b.Client.RestoreVolume(b.vid, newName)
+	if err != nil {
+		return err
+	}
+	b.name = newName
+	return nil
+}
+
+func (b *blockTempMetadata) PurgeVolume() error {
+	b.LockData()
+	defer b.UnlockData()
+	err := b.Client.PurgeVolume(b.vid)
+	if err != nil {
+		return err
+	}
+	if v, ok := b.GetData(fmt.Sprint(b.vid)); ok {
+		d := v.(*blockTempVolumeData)
+		b.provisioned().sub(d.size, d.rep)
+	}
+	b.DeleteData(fmt.Sprint(b.vid))
+	return nil
+}
+
+func (b *blockTempMetadata) RenameVolume(newName string) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	if d.locked != "" {
+		return torus.ErrLocked
+	}
+	err := b.Client.RenameVolume(b.name, newName)
+	if err != nil {
+		return err
+	}
+	b.name = newName
+	return nil
+}
+
+func (b *blockTempMetadata) SetVolumeSize(size uint64, lim provisioning) error {
 	b.LockData()
 	defer b.UnlockData()
 	v, ok := b.GetData(fmt.Sprint(b.vid))
@@ -103,7 +300,45 @@ func (b *blockTempMetadata) DeleteVolume() error {
 	if d.locked != b.UUID() {
 		return torus.ErrLocked
 	}
-	return b.Client.DeleteVolume(b.name)
+	p := *b.provisioned()
+	p.sub(d.size, d.rep)
+	p.add(size, d.rep)
+	if size > d.size && !lim.allows(&p) {
+		return ErrOvercommitted
+	}
+	err := b.Client.SetVolumeSize(b.name, size)
+	if err != nil {
+		return err
+	}
+	*b.provisioned() = p
+	d.size = size
+	if d.resize == size {
+		d.resize = 0
+	}
+	return nil
+}
+
+func (b *blockTempMetadata) RequestResize(size uint64) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	d.resize = size
+	return nil
+}
+
+func (b *blockTempMetadata) GetResizeRequest() (uint64, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return 0, torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	return d.resize, nil
 }
 
 func (b *blockTempMetadata) SaveSnapshot(name string) error {
@@ -157,6 +392,42 @@ func (b *blockTempMetadata) DeleteSnapshot(name string) error {
 	return torus.ErrNotExist
 }
 
+func (b *blockTempMetadata) GetSnapshotSchedule() (*SnapshotSchedule, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	if d.sched == nil {
+		return nil, nil
+	}
+	sched := *d.sched
+	return &sched, nil
+}
+
+func (b *blockTempMetadata) SetSnapshotSchedule(sched *SnapshotSchedule) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	d.sched = nil
+	if sched != nil {
+		s := *sched
+		d.sched = &s
+	}
+	return nil
+}
+
+// ElectLeader always succeeds, as there's only the one process.
+func (b *blockTempMetadata) ElectLeader(task string, lease int64) (bool, error) {
+	return true, nil
+}
+
 func createBlockTempMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (blockMetadata, error) {
 	if t, ok := mds.(*temp.Client); ok {
 		return &blockTempMetadata{
@@ -0,0 +1,93 @@
+package block
+
+import (
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+// DefaultTrashRetention is how long a deleted volume is kept in the trash,
+// unless told otherwise.
+const DefaultTrashRetention = 7 * 24 * time.Hour
+
+// TrashBlockVolume deletes the named volume, but keeps it and its blocks in
+// the trash for retention, so that it can be brought back with
+// UndeleteBlockVolume. If retention isn't positive, the volume is deleted for
+// good straight away. It returns torus.ErrLocked while the volume is
+// attached.
+func TrashBlockVolume(mds torus.MetadataService, volume string, retention time.Duration) error {
+	if retention <= 0 {
+		return DeleteBlockVolume(mds, volume)
+	}
+	vol, err := mds.GetVolume(volume)
+	if err != nil {
+		return err
+	}
+	if vol.Type != VolumeType {
+		return torus.ErrInvalid
+	}
+	bmds, err := createBlockMetadata(mds, vol.Name, torus.VolumeID(vol.Id))
+	if err != nil {
+		return err
+	}
+	return bmds.TrashVolume(time.Now().Add(retention))
+}
+
+// UndeleteBlockVolume brings the volume vid back from the trash as newName,
+// with its data, snapshots and settings as they were when it was deleted. It
+// returns torus.ErrNotExist if the volume isn't in the trash or has expired,
+// and torus.ErrExists if newName is taken.
+func UndeleteBlockVolume(mds torus.MetadataService, vid torus.VolumeID, newName string) error {
+	if newName == "" {
+		return torus.ErrInvalid
+	}
+	bmds, err := createBlockMetadata(mds, "", vid)
+	if err != nil {
+		return err
+	}
+	return bmds.RestoreVolume(newName)
+}
+
+// PurgeExpiredTrash deletes the volumes in the trash that have expired as of
+// now for good. Their blocks are then left to the garbage collector.
+func PurgeExpiredTrash(mds torus.MetadataService, now time.Time) error {
+	trash, err := mds.GetTrash()
+	if err != nil {
+		return err
+	}
+	for _, tv := range trash {
+		if !tv.Expired(now) {
+			continue
+		}
+		bmds, err := createBlockMetadata(mds, "", torus.VolumeID(tv.Volume.Id))
+		if err != nil {
+			return err
+		}
+		clog.Infof("purging deleted volume %s (%d) from the trash", tv.Volume.Name, tv.Volume.Id)
+		err = bmds.PurgeVolume()
+		// Someone else may have purged or restored it first.
+		if err != nil && err != torus.ErrNotExist {
+			return err
+		}
+	}
+	return nil
+}
+
+// TrashPurger purges expired volumes from the trash of the whole cluster.
+// Every torusd may run one; only the one holding the cluster-wide election
+// purges.
+type TrashPurger struct {
+	*leaderTask
+}
+
+// StartTrashPurger starts a TrashPurger that checks for expired volumes
+// every interval.
+func StartTrashPurger(srv *torus.Server, interval time.Duration) *TrashPurger {
+	return &TrashPurger{
+		startLeaderTask(srv, "trash-purger", "purging the trash", interval, func(now time.Time) {
+			if err := PurgeExpiredTrash(srv.MDS, now); err != nil {
+				clog.Errorf("trash-purger: couldn't purge trash: %v", err)
+			}
+		}),
+	}
+}
@@ -1,6 +1,8 @@
 package block
 
 import (
+	"errors"
+
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/blockset"
 	"github.com/coreos/torus/models"
@@ -9,27 +11,98 @@ import (
 
 const VolumeType = "block"
 
+// ErrBadSpec is returned when creating a volume with a block spec that
+// doesn't end in a base layer.
+var ErrBadSpec = errors.New("block: block spec must end with a base layer")
+
 type BlockVolume struct {
 	srv    *torus.Server
 	mds    blockMetadata
 	volume *models.Volume
 }
 
+// VolumeOptions are the settings a block volume is created with, in place of
+// the cluster's defaults.
+type VolumeOptions struct {
+	// Spec is how the volume's blocks are laid out, or nil for the
+	// cluster's default block spec.
+	Spec torus.BlockLayerSpec
+	// Replication is the number of peers that keep each block, or 0 for
+	// the ring's replication factor.
+	Replication int
+	// Encrypt encrypts the volume's blocks at rest; see
+	// CreateEncryptedBlockVolume.
+	Encrypt bool
+	// Meta is the volume's owner and labels, if any.
+	Meta *torus.VolumeMeta
+}
+
 func CreateBlockVolume(mds torus.MetadataService, volume string, size uint64) error {
+	_, err := createBlockVolume(mds, volume, size, VolumeOptions{})
+	return err
+}
+
+// CreateBlockVolumeWithSpec creates a block volume whose blocks are laid out
+// according to spec, rather than the cluster's default block spec.
+func CreateBlockVolumeWithSpec(mds torus.MetadataService, volume string, size uint64, spec torus.BlockLayerSpec) error {
+	_, err := createBlockVolume(mds, volume, size, VolumeOptions{Spec: spec})
+	return err
+}
+
+// CreateBlockVolumeWithOptions creates a block volume with the given
+// settings.
+func CreateBlockVolumeWithOptions(mds torus.MetadataService, volume string, size uint64, opts VolumeOptions) error {
+	_, err := createBlockVolume(mds, volume, size, opts)
+	return err
+}
+
+func createBlockVolume(mds torus.MetadataService, volume string, size uint64, opts VolumeOptions) (torus.VolumeID, error) {
+	if opts.Replication < 0 {
+		return 0, torus.ErrInvalid
+	}
+	if opts.Spec != nil {
+		// Catch unusable specs now, rather than when the volume's opened.
+		if len(opts.Spec) == 0 || opts.Spec[len(opts.Spec)-1].Kind != blockset.Base {
+			return 0, ErrBadSpec
+		}
+		if _, err := blockset.CreateBlocksetFromSpec(opts.Spec, nil); err != nil {
+			return 0, err
+		}
+	}
 	id, err := mds.NewVolumeID()
 	if err != nil {
-		return err
+		return 0, err
+	}
+	spec := opts.Spec
+	if opts.Encrypt {
+		kp := blockset.GetKeyProvider()
+		if kp == nil {
+			return 0, blockset.ErrNoKeyProvider
+		}
+		err = kp.CreateKey(id, 1)
+		if err != nil {
+			return 0, err
+		}
+		if spec == nil {
+			spec = mds.GlobalMetadata().DefaultBlockSpec
+		}
+		spec = blockset.EncryptedBlockSpec(spec)
+	}
+	lim, err := getProvisioning(mds)
+	if err != nil {
+		return 0, err
 	}
 	blkmd, err := createBlockMetadata(mds, volume, id)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return blkmd.CreateBlockVolume(&models.Volume{
+	err = blkmd.CreateBlockVolume(&models.Volume{
 		Name:     volume,
 		Id:       uint64(id),
 		Type:     VolumeType,
 		MaxBytes: size,
-	})
+	}, spec, opts.Replication, opts.Meta, lim)
+	return id, err
 }
 
 func OpenBlockVolume(s *torus.Server, volume string) (*BlockVolume, error) {
@@ -64,6 +137,33 @@ func (s *BlockVolume) SaveSnapshot(name string) error    { return s.mds.SaveSnap
 func (s *BlockVolume) GetSnapshots() ([]Snapshot, error) { return s.mds.GetSnapshots() }
 func (s *BlockVolume) DeleteSnapshot(name string) error  { return s.mds.DeleteSnapshot(name) }
 
+// Rename gives the volume a new name. It returns torus.ErrLocked while the
+// volume is attached for writing, and torus.ErrExists if the name is taken.
+func (s *BlockVolume) Rename(newName string) error {
+	if newName == "" {
+		return torus.ErrInvalid
+	}
+	err := s.mds.RenameVolume(newName)
+	if err != nil {
+		return err
+	}
+	v := *s.volume
+	v.Name = newName
+	s.volume = &v
+	return nil
+}
+
+// LockHolder returns the UUID of the client that has the volume open for
+// writing, or "" if none has.
+func (s *BlockVolume) LockHolder() (string, error) { return s.mds.GetLockHolder() }
+
+// BreakLock releases the volume's lock, for when its holder is stuck. The
+// holder can no longer sync the volume, and anything it hasn't synced is
+// lost. The lock is only broken if it's still held by holder, as returned by
+// LockHolder; otherwise BreakLock returns ErrLocked if the lock has changed
+// hands since, or ErrNotExist if it has been released.
+func (s *BlockVolume) BreakLock(holder string) error { return s.mds.BreakLock(holder) }
+
 func (s *BlockVolume) getContext() context.Context {
 	return context.TODO()
 }
@@ -76,7 +176,14 @@ func (s *BlockVolume) getOrCreateBlockINode(ref torus.INodeRef) (*models.INode,
 		return s.srv.INodes.GetINode(s.getContext(), ref)
 	}
 	globals := s.mds.GlobalMetadata()
-	bs, err := blockset.CreateBlocksetFromSpec(globals.DefaultBlockSpec, nil)
+	spec, err := s.mds.GetBlockSpec()
+	if err != nil {
+		return nil, err
+	}
+	if spec == nil {
+		spec = globals.DefaultBlockSpec
+	}
+	bs, err := blockset.CreateBlocksetFromSpec(spec, nil)
 	if err != nil {
 		return nil, err
 	}
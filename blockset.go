@@ -44,6 +44,19 @@ type Blockset interface {
 	String() string
 }
 
+// AllocatedBlocks returns the number of blocks of bs that have been
+// written, rather than left or trimmed to zero.
+func AllocatedBlocks(bs Blockset) int {
+	n := 0
+	// The data blocks come first, ahead of any that layers like rep add.
+	for _, ref := range bs.GetAllBlockRefs()[:bs.Length()] {
+		if !ref.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
 type BlockLayerKind int
 
 type BlockLayer struct {
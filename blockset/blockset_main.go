@@ -22,15 +22,56 @@ var (
 		Name: "torus_blockset_crc_failed_blocks",
 		Help: "Number of blocks that failed due to CRC mismatch",
 	})
+	promCRCAlgoFail = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_blockset_crc_failed_blocks_by_algorithm",
+		Help: "Number of blocks that failed due to CRC mismatch, by checksum algorithm",
+	}, []string{"algorithm"})
 	promBaseFail = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "torus_blockset_base_failed_blocks",
 		Help: "Number of blocks that failed",
 	})
+	promECReconstructed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_blockset_ec_reconstructed_blocks",
+		Help: "Number of blocks recovered from erasure coding parity",
+	})
+	promECFail = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_blockset_ec_failed_blocks",
+		Help: "Number of blocks that could not be recovered from erasure coding parity",
+	})
+	promCompressLogicalBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_blockset_compression_logical_bytes",
+		Help: "Number of bytes written to the compression layer before compression",
+	}, []string{"algorithm"})
+	promCompressStoredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_blockset_compression_stored_bytes",
+		Help: "Number of bytes written by the compression layer after compression",
+	}, []string{"algorithm"})
+	promCompressRatio = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "torus_blockset_compression_ratio",
+		Help:    "Histogram of per-block compression ratios (logical size / stored size)",
+		Buckets: []float64{1, 1.25, 1.5, 2, 3, 4, 8, 16, 64},
+	}, []string{"algorithm"})
+	promCompressFail = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_blockset_compression_failed_blocks",
+		Help: "Number of blocks that failed to decompress",
+	}, []string{"algorithm"})
+	promEncryptFail = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_blockset_encryption_failed_blocks",
+		Help: "Number of blocks that failed decryption or authentication",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(promCRCFail)
+	prometheus.MustRegister(promCRCAlgoFail)
 	prometheus.MustRegister(promBaseFail)
+	prometheus.MustRegister(promECReconstructed)
+	prometheus.MustRegister(promECFail)
+	prometheus.MustRegister(promCompressLogicalBytes)
+	prometheus.MustRegister(promCompressStoredBytes)
+	prometheus.MustRegister(promCompressRatio)
+	prometheus.MustRegister(promCompressFail)
+	prometheus.MustRegister(promEncryptFail)
 }
 
 type blockset interface {
@@ -45,6 +86,9 @@ const (
 	Base torus.BlockLayerKind = iota
 	CRC
 	Replication
+	ErasureCoding
+	Compression
+	Encryption
 )
 
 // CreateBlocksetFunc is the signature of a constructor used to create
@@ -125,6 +169,12 @@ func ParseBlockLayerKind(s string) (torus.BlockLayerKind, error) {
 		return CRC, nil
 	case "rep", "r":
 		return Replication, nil
+	case "ec", "erasure":
+		return ErasureCoding, nil
+	case "compress", "compression", "z":
+		return Compression, nil
+	case "encrypt", "encryption":
+		return Encryption, nil
 	default:
 		return torus.BlockLayerKind(-1), fmt.Errorf("no such block layer type: %s", s)
 	}
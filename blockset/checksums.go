@@ -0,0 +1,92 @@
+package blockset
+
+import (
+	"bytes"
+
+	"github.com/coreos/torus"
+)
+
+// Checksum is the expected checksum of a single stored block.
+type Checksum struct {
+	algo crcAlgo
+	sum  []byte
+}
+
+// Verify reports whether data matches the checksum.
+func (c Checksum) Verify(data []byte) bool {
+	sum := make([]byte, c.algo.size())
+	c.algo.sum(sum, data)
+	return bytes.Equal(sum, c.sum)
+}
+
+// Algorithm returns the name of the checksum algorithm.
+func (c Checksum) Algorithm() string {
+	return c.algo.String()
+}
+
+// BlockChecksums returns the expected checksum of every stored block in bs
+// that a CRC layer can vouch for on its own; that is, every block holding
+// exactly the bytes the CRC layer checksummed. Blocks beneath a layer that
+// transforms its data (such as compression or encryption) or holding derived
+// data (such as erasure coding parity) are not included.
+func BlockChecksums(bs torus.Blockset) map[torus.BlockRef]Checksum {
+	out := make(map[torus.BlockRef]Checksum)
+	var layer torus.Blockset
+	for layer = bs; layer != nil; layer = layer.GetSubBlockset() {
+		crc, ok := layer.(*crcBlockset)
+		if !ok {
+			continue
+		}
+		crc.mut.RLock()
+		refs, ok := storedRefs(crc.sub)
+		if ok {
+			for i, list := range refs {
+				if i >= crc.length() {
+					break
+				}
+				for _, ref := range list {
+					if ref.IsZero() {
+						continue
+					}
+					out[ref] = Checksum{
+						algo: crc.algo,
+						sum:  append([]byte(nil), crc.crcAt(i)...),
+					}
+				}
+			}
+		}
+		crc.mut.RUnlock()
+	}
+	return out
+}
+
+// storedRefs returns, for each block index of b, the BlockRefs that store
+// that block's data verbatim. It returns false if the data is transformed on
+// its way to storage.
+func storedRefs(b blockset) ([][]torus.BlockRef, bool) {
+	switch l := b.(type) {
+	case *baseBlockset:
+		out := make([][]torus.BlockRef, len(l.blocks))
+		for i, ref := range l.blocks {
+			out[i] = []torus.BlockRef{ref}
+		}
+		return out, true
+	case *replicationBlockset:
+		out, ok := storedRefs(l.sub)
+		if !ok {
+			return nil, false
+		}
+		for _, list := range l.repBlocks {
+			for i, ref := range list {
+				if i < len(out) {
+					out[i] = append(out[i], ref)
+				}
+			}
+		}
+		return out, true
+	case *erasureBlockset:
+		// Data blocks pass through untouched; parity can't be verified alone.
+		return storedRefs(l.sub)
+	}
+	return nil, false
+}
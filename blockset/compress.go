@@ -0,0 +1,319 @@
+package blockset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/coreos/torus"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// compressAlgo identifies a compression algorithm. These values are
+// serialized, so new algorithms must only ever be appended.
+type compressAlgo int32
+
+const (
+	compressSnappy compressAlgo = iota
+	compressLZ4
+	compressZstd
+)
+
+var compressAlgoNames = map[compressAlgo]string{
+	compressSnappy: "snappy",
+	compressLZ4:    "lz4",
+	compressZstd:   "zstd",
+}
+
+const defaultCompressAlgo = compressSnappy
+
+func parseCompressAlgo(s string) (compressAlgo, error) {
+	smalls := strings.ToLower(s)
+	for k, v := range compressAlgoNames {
+		if v == smalls {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression algorithm: %s", s)
+}
+
+func (c compressAlgo) String() string {
+	if s, ok := compressAlgoNames[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", int32(c))
+}
+
+var (
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdOnce    sync.Once
+)
+
+func initZstd() {
+	var err error
+	zstdEncoder, err = zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	zstdDecoder, err = zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (c compressAlgo) compress(data []byte) ([]byte, error) {
+	switch c {
+	case compressSnappy:
+		return snappy.Encode(nil, data), nil
+	case compressLZ4:
+		out := make([]byte, lz4.CompressBlockBound(len(data)))
+		n, err := lz4.CompressBlock(data, out, nil)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			// Incompressible.
+			return data, nil
+		}
+		return out[:n], nil
+	case compressZstd:
+		zstdOnce.Do(initZstd)
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %d", int32(c))
+}
+
+func (c compressAlgo) decompress(data []byte, blocksize uint64) ([]byte, error) {
+	switch c {
+	case compressSnappy:
+		return snappy.Decode(nil, data)
+	case compressLZ4:
+		out := make([]byte, blocksize)
+		n, err := lz4.UncompressBlock(data, out)
+		if err != nil {
+			return nil, err
+		}
+		return out[:n], nil
+	case compressZstd:
+		zstdOnce.Do(initZstd)
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %d", int32(c))
+}
+
+// compressBlockset compresses each block before handing it to the layer
+// below. Blocks that don't compress are stored as-is. The compressed length
+// of each block is kept in the layer, as stores may pad blocks on read.
+type compressBlockset struct {
+	sub   blockset
+	algo  compressAlgo
+	sizes []uint32
+	mut   sync.RWMutex
+}
+
+var _ blockset = &compressBlockset{}
+
+func init() {
+	RegisterBlockset(Compression, func(opt string, _ torus.BlockStore, sub blockset) (blockset, error) {
+		algo := defaultCompressAlgo
+		if opt != "" {
+			var err error
+			algo, err = parseCompressAlgo(opt)
+			if err != nil {
+				clog.Errorf("%v", err)
+				return nil, err
+			}
+		}
+		return newCompressBlockset(sub, algo), nil
+	})
+}
+
+func newCompressBlockset(sub blockset, algo compressAlgo) *compressBlockset {
+	return &compressBlockset{
+		sub:  sub,
+		algo: algo,
+	}
+}
+
+func (b *compressBlockset) Length() int {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if b.sub.Length() != len(b.sizes) {
+		panic("compressed sizes should always be as long as the sub blockset")
+	}
+	return len(b.sizes)
+}
+
+func (b *compressBlockset) Kind() uint32 {
+	return uint32(Compression)
+}
+
+func (b *compressBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if i >= len(b.sizes) {
+		clog.Trace("compress: requesting block off the edge of known blocks")
+		return nil, torus.ErrBlockNotExist
+	}
+	data, err := b.sub.GetBlock(ctx, i)
+	if err != nil {
+		clog.Trace("compress: error requesting subblock")
+		return nil, err
+	}
+	size := b.sizes[i]
+	if size == 0 {
+		return data, nil
+	}
+	if int(size) > len(data) {
+		clog.Warningf("compress: block %d is shorter than its compressed size", i)
+		promCompressFail.WithLabelValues(b.algo.String()).Inc()
+		return nil, torus.ErrBlockUnavailable
+	}
+	out, err := b.algo.decompress(data[:size], b.getStore().BlockSize())
+	if err != nil {
+		clog.Warningf("compress: block %d failed to decompress: %v", i, err)
+		promCompressFail.WithLabelValues(b.algo.String()).Inc()
+		return nil, torus.ErrBlockUnavailable
+	}
+	return out, nil
+}
+
+func (b *compressBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if i > len(b.sizes) {
+		return torus.ErrBlockNotExist
+	}
+	var size uint32
+	stored := data
+	c, err := b.algo.compress(data)
+	if err != nil {
+		return err
+	}
+	if len(c) < len(data) {
+		size = uint32(len(c))
+		stored = c
+	}
+	err = b.sub.PutBlock(ctx, inode, i, stored)
+	if err != nil {
+		return err
+	}
+	name := b.algo.String()
+	promCompressLogicalBytes.WithLabelValues(name).Add(float64(len(data)))
+	promCompressStoredBytes.WithLabelValues(name).Add(float64(len(stored)))
+	if len(data) != 0 {
+		promCompressRatio.WithLabelValues(name).Observe(float64(len(data)) / float64(len(stored)))
+	}
+	if i == len(b.sizes) {
+		b.sizes = append(b.sizes, size)
+	} else {
+		b.sizes[i] = size
+	}
+	return nil
+}
+
+func (b *compressBlockset) makeID(i torus.INodeRef) torus.BlockRef {
+	return b.sub.makeID(i)
+}
+
+func (b *compressBlockset) setStore(s torus.BlockStore) {
+	b.sub.setStore(s)
+}
+
+func (b *compressBlockset) getStore() torus.BlockStore {
+	return b.sub.getStore()
+}
+
+func (b *compressBlockset) Marshal() ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, int32(b.algo))
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(buf, binary.LittleEndian, b.sizes)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *compressBlockset) Unmarshal(data []byte) error {
+	if len(data) < 4 {
+		return torus.ErrInvalid
+	}
+	algo := compressAlgo(binary.LittleEndian.Uint32(data[:4]))
+	if _, ok := compressAlgoNames[algo]; !ok {
+		return fmt.Errorf("unknown compression algorithm %d", int32(algo))
+	}
+	data = data[4:]
+	l := len(data) / 4
+	out := make([]uint32, l)
+	for i := 0; i < l; i++ {
+		out[i] = binary.LittleEndian.Uint32(data[(i * 4) : (i+1)*4])
+	}
+	b.algo = algo
+	b.sizes = out
+	return nil
+}
+
+func (b *compressBlockset) GetSubBlockset() torus.Blockset { return b.sub }
+
+func (b *compressBlockset) GetLiveINodes() *roaring.Bitmap {
+	return b.sub.GetLiveINodes()
+}
+
+func (b *compressBlockset) Truncate(lastIndex int, blocksize uint64) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	err := b.sub.Truncate(lastIndex, blocksize)
+	if err != nil {
+		return err
+	}
+	if lastIndex <= len(b.sizes) {
+		b.sizes = b.sizes[:lastIndex]
+		return nil
+	}
+	toadd := lastIndex - len(b.sizes)
+	for toadd != 0 {
+		b.sizes = append(b.sizes, 0)
+		toadd--
+	}
+	return nil
+}
+
+func (b *compressBlockset) Trim(from, to int) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	err := b.sub.Trim(from, to)
+	if err != nil {
+		return err
+	}
+	if from >= len(b.sizes) {
+		return nil
+	}
+	if to > len(b.sizes) {
+		to = len(b.sizes)
+	}
+	for i := from; i < to; i++ {
+		b.sizes[i] = 0
+	}
+	return nil
+}
+
+func (b *compressBlockset) GetAllBlockRefs() []torus.BlockRef {
+	return b.sub.GetAllBlockRefs()
+}
+
+func (b *compressBlockset) String() string {
+	return "compress " + b.algo.String() + "\n" + b.sub.String()
+}
@@ -0,0 +1,66 @@
+package blockset
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+
+	// Register storage drivers.
+	_ "github.com/coreos/torus/storage"
+)
+
+var testCompressAlgos = []string{"snappy", "lz4", "zstd"}
+
+func TestCompressReadWrite(t *testing.T) {
+	for _, algo := range testCompressAlgos {
+		s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+		a, err := parseCompressAlgo(algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := newBaseBlockset(s)
+		readWriteTest(t, newCompressBlockset(b, a))
+	}
+}
+
+func TestCompressMarshal(t *testing.T) {
+	for _, algo := range testCompressAlgos {
+		s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+		marshalTest(t, s, MustParseBlockLayerSpec("crc,compress="+algo+",base"))
+	}
+}
+
+func TestCompressStoresLess(t *testing.T) {
+	for _, algo := range testCompressAlgos {
+		s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+		a, err := parseCompressAlgo(algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := newBaseBlockset(s)
+		crc := newCRCBlockset(newCompressBlockset(b, a))
+		inode := torus.NewINodeRef(1, 1)
+		data := bytes.Repeat([]byte("compressible "), 78)
+		err = crc.PutBlock(context.TODO(), inode, 0, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := s.GetBlock(context.TODO(), b.blocks[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) >= len(data) {
+			t.Errorf("%s: block was not compressed", algo)
+		}
+		out, err := crc.GetBlock(context.TODO(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s: data not retrieved", algo)
+		}
+	}
+}
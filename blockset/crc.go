@@ -1,36 +1,126 @@
 package blockset
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
+	"strings"
 	"sync"
 
 	"golang.org/x/net/context"
 
 	"github.com/RoaringBitmap/roaring"
+	"github.com/cespare/xxhash"
 	"github.com/coreos/pkg/capnslog"
 	"github.com/coreos/torus"
 )
 
+// crcAlgo identifies the checksum used by a crcBlockset. These values are
+// serialized, so new algorithms must only ever be appended.
+type crcAlgo byte
+
+const (
+	crcIEEE crcAlgo = iota
+	crcCastagnoli
+	crcXXHash64
+	crcSHA256
+)
+
+const defaultCRCAlgo = crcIEEE
+
+var crcAlgoNames = map[crcAlgo]string{
+	crcIEEE:       "crc32",
+	crcCastagnoli: "crc32c",
+	crcXXHash64:   "xxhash64",
+	crcSHA256:     "sha256",
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+func parseCRCAlgo(s string) (crcAlgo, error) {
+	smalls := strings.ToLower(s)
+	for k, v := range crcAlgoNames {
+		if v == smalls {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown checksum algorithm: %s", s)
+}
+
+func (c crcAlgo) String() string {
+	if s, ok := crcAlgoNames[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", byte(c))
+}
+
+// size is the number of bytes in a checksum.
+func (c crcAlgo) size() int {
+	switch c {
+	case crcIEEE, crcCastagnoli:
+		return 4
+	case crcXXHash64:
+		return 8
+	case crcSHA256:
+		return sha256.Size
+	}
+	panic("unknown checksum algorithm")
+}
+
+// sum writes the checksum of data into out, which must be c.size() long.
+func (c crcAlgo) sum(out, data []byte) {
+	switch c {
+	case crcIEEE:
+		binary.LittleEndian.PutUint32(out, crc32.ChecksumIEEE(data))
+	case crcCastagnoli:
+		binary.LittleEndian.PutUint32(out, crc32.Checksum(data, castagnoliTable))
+	case crcXXHash64:
+		binary.LittleEndian.PutUint64(out, xxhash.Sum64(data))
+	case crcSHA256:
+		s := sha256.Sum256(data)
+		copy(out, s[:])
+	default:
+		panic("unknown checksum algorithm")
+	}
+}
+
 type crcBlockset struct {
-	sub      blockset
-	crcs     []uint32
+	sub  blockset
+	algo crcAlgo
+	// crcs holds the checksum of each block, algo.size() bytes apiece.
+	crcs     []byte
 	mut      sync.RWMutex
-	emptyCrc uint32
+	emptyCrc []byte
 }
 
 var _ blockset = &crcBlockset{}
 
 func init() {
-	RegisterBlockset(CRC, func(_ string, _ torus.BlockStore, sub blockset) (blockset, error) {
-		return newCRCBlockset(sub), nil
+	RegisterBlockset(CRC, func(opt string, _ torus.BlockStore, sub blockset) (blockset, error) {
+		algo := defaultCRCAlgo
+		if opt != "" {
+			var err error
+			algo, err = parseCRCAlgo(opt)
+			if err != nil {
+				clog.Errorf("%v", err)
+				return nil, err
+			}
+		}
+		return newCRCBlocksetWithAlgo(sub, algo), nil
 	})
 }
 
 func newCRCBlockset(sub blockset) *crcBlockset {
+	return newCRCBlocksetWithAlgo(sub, defaultCRCAlgo)
+}
+
+func newCRCBlocksetWithAlgo(sub blockset, algo crcAlgo) *crcBlockset {
 	b := &crcBlockset{
 		crcs: nil,
 		sub:  sub,
+		algo: algo,
 	}
 	return b
 }
@@ -38,10 +128,19 @@ func newCRCBlockset(sub blockset) *crcBlockset {
 func (b *crcBlockset) Length() int {
 	b.mut.RLock()
 	defer b.mut.RUnlock()
-	if b.sub.Length() != len(b.crcs) {
+	if b.sub.Length() != b.length() {
 		panic("crcs should always be as long as the sub blockset")
 	}
-	return len(b.crcs)
+	return b.length()
+}
+
+func (b *crcBlockset) length() int {
+	return len(b.crcs) / b.algo.size()
+}
+
+func (b *crcBlockset) crcAt(i int) []byte {
+	size := b.algo.size()
+	return b.crcs[i*size : (i+1)*size]
 }
 
 func (b *crcBlockset) Kind() uint32 {
@@ -51,7 +150,7 @@ func (b *crcBlockset) Kind() uint32 {
 func (b *crcBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
 	b.mut.RLock()
 	defer b.mut.RUnlock()
-	if i >= len(b.crcs) {
+	if i >= b.length() {
 		clog.Trace("crc: requesting block off the edge of known blocks")
 		return nil, torus.ErrBlockNotExist
 	}
@@ -60,11 +159,15 @@ func (b *crcBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
 		clog.Trace("crc: error requesting subblock")
 		return nil, err
 	}
-	crc := crc32.ChecksumIEEE(data)
-	if crc != b.crcs[i] {
-		clog.Warningf("crc: block %d did not pass crc", i)
-		clog.Debugf("crc: %x should be %x\ndata : %v\n\n", crc, b.crcs[i], data[:10])
+	crc := make([]byte, b.algo.size())
+	b.algo.sum(crc, data)
+	if !bytes.Equal(crc, b.crcAt(i)) {
+		clog.Warningf("crc: block %d did not pass %s", i, b.algo)
+		if len(data) > 10 {
+			clog.Debugf("crc: %x should be %x\ndata : %v\n\n", crc, b.crcAt(i), data[:10])
+		}
 		promCRCFail.Inc()
+		promCRCAlgoFail.WithLabelValues(b.algo.String()).Inc()
 		return nil, torus.ErrBlockUnavailable
 	}
 	return data, nil
@@ -73,24 +176,25 @@ func (b *crcBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
 func (b *crcBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
 	b.mut.Lock()
 	defer b.mut.Unlock()
-	if i > len(b.crcs) {
+	if i > b.length() {
 		return torus.ErrBlockNotExist
 	}
-	crc := crc32.ChecksumIEEE(data)
-	if crc == b.emptyCrc {
+	crc := make([]byte, b.algo.size())
+	b.algo.sum(crc, data)
+	if b.emptyCrc != nil && bytes.Equal(crc, b.emptyCrc) {
 		ctx = context.WithValue(ctx, "isEmpty", true)
 	}
 	err := b.sub.PutBlock(ctx, inode, i, data)
 	if err != nil {
 		return err
 	}
-	if i == len(b.crcs) {
-		b.crcs = append(b.crcs, crc)
+	if i == b.length() {
+		b.crcs = append(b.crcs, crc...)
 	} else {
-		b.crcs[i] = crc
+		copy(b.crcAt(i), crc)
 	}
 	if clog.LevelAt(capnslog.TRACE) {
-		clog.Tracef("crc: setting crc %x at index %d", crc, i)
+		clog.Tracef("crc: setting %s %x at index %d", b.algo, crc, i)
 	}
 	return nil
 }
@@ -99,8 +203,14 @@ func (b *crcBlockset) makeID(i torus.INodeRef) torus.BlockRef {
 	return b.sub.makeID(i)
 }
 
+func (b *crcBlockset) emptySum(blocksize uint64) []byte {
+	crc := make([]byte, b.algo.size())
+	b.algo.sum(crc, make([]byte, blocksize))
+	return crc
+}
+
 func (b *crcBlockset) setStore(s torus.BlockStore) {
-	b.emptyCrc = crc32.ChecksumIEEE(make([]byte, s.BlockSize()))
+	b.emptyCrc = b.emptySum(s.BlockSize())
 	b.sub.setStore(s)
 }
 
@@ -108,27 +218,41 @@ func (b *crcBlockset) getStore() torus.BlockStore {
 	return b.sub.getStore()
 }
 
+// Marshal serializes the checksums. CRC32 (IEEE) checksums are written
+// as-is, as they always have been; other algorithms are preceded by a byte
+// identifying the algorithm, which keeps their length from being a multiple
+// of four.
 func (b *crcBlockset) Marshal() ([]byte, error) {
 	b.mut.RLock()
 	defer b.mut.RUnlock()
-	buf := make([]byte, (len(b.crcs))*4)
-	order := binary.LittleEndian
-	for i, x := range b.crcs {
-		order.PutUint32(buf[(i*4):((i+1)*4)], x)
+	if b.algo == crcIEEE {
+		buf := make([]byte, len(b.crcs))
+		copy(buf, b.crcs)
+		return buf, nil
 	}
+	buf := make([]byte, 1+len(b.crcs))
+	buf[0] = byte(b.algo)
+	copy(buf[1:], b.crcs)
 	return buf, nil
 }
 
 func (b *crcBlockset) Unmarshal(data []byte) error {
 	b.mut.Lock()
 	defer b.mut.Unlock()
-	l := len(data) / 4
-	out := make([]uint32, l)
-	order := binary.LittleEndian
-	for i := 0; i < l; i++ {
-		out[i] = order.Uint32(data[(i * 4) : (i+1)*4])
+	algo := crcIEEE
+	if len(data)%4 != 0 {
+		algo = crcAlgo(data[0])
+		if _, ok := crcAlgoNames[algo]; !ok {
+			return fmt.Errorf("unknown checksum algorithm %d", data[0])
+		}
+		data = data[1:]
+		if len(data)%algo.size() != 0 {
+			return torus.ErrInvalid
+		}
 	}
-	b.crcs = out
+	b.algo = algo
+	b.crcs = make([]byte, len(data))
+	copy(b.crcs, data)
 	return nil
 }
 
@@ -147,14 +271,14 @@ func (b *crcBlockset) Truncate(lastIndex int, blocksize uint64) error {
 	if err != nil {
 		return err
 	}
-	if lastIndex <= len(b.crcs) {
-		b.crcs = b.crcs[:lastIndex]
+	if lastIndex <= b.length() {
+		b.crcs = b.crcs[:lastIndex*b.algo.size()]
 		return nil
 	}
-	crc := crc32.ChecksumIEEE(make([]byte, blocksize))
-	toadd := lastIndex - len(b.crcs)
+	crc := b.emptySum(blocksize)
+	toadd := lastIndex - b.length()
 	for toadd != 0 {
-		b.crcs = append(b.crcs, crc)
+		b.crcs = append(b.crcs, crc...)
 		toadd--
 	}
 	return nil
@@ -167,15 +291,15 @@ func (b *crcBlockset) Trim(from, to int) error {
 	if err != nil {
 		return err
 	}
-	if from >= len(b.crcs) {
+	if from >= b.length() {
 		return nil
 	}
-	if to > len(b.crcs) {
-		to = len(b.crcs)
+	if to > b.length() {
+		to = b.length()
 	}
-	b.emptyCrc = crc32.ChecksumIEEE(make([]byte, b.getStore().BlockSize()))
+	b.emptyCrc = b.emptySum(b.getStore().BlockSize())
 	for i := from; i < to; i++ {
-		b.crcs[i] = b.emptyCrc
+		copy(b.crcAt(i), b.emptyCrc)
 	}
 	return nil
 }
@@ -187,5 +311,5 @@ func (b *crcBlockset) GetAllBlockRefs() []torus.BlockRef {
 }
 
 func (b *crcBlockset) String() string {
-	return "crc\n" + b.sub.String()
+	return "crc " + b.algo.String() + "\n" + b.sub.String()
 }
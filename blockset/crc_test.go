@@ -1,6 +1,8 @@
 package blockset
 
 import (
+	"encoding/binary"
+	"hash/crc32"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -35,3 +37,83 @@ func TestCRCCorruption(t *testing.T) {
 		t.Fatal("No corruption detection")
 	}
 }
+
+func TestCRCAlgorithms(t *testing.T) {
+	for _, algo := range []string{"crc32", "crc32c", "xxhash64", "sha256"} {
+		s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+		marshalTest(t, s, MustParseBlockLayerSpec("crc="+algo+",base"))
+
+		a, err := parseCRCAlgo(algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := newBaseBlockset(s)
+		crc := newCRCBlocksetWithAlgo(b, a)
+		readWriteTest(t, crc)
+		s.WriteBlock(context.TODO(), b.blocks[0], []byte("Evil Corruption!!"))
+		_, err = crc.GetBlock(context.TODO(), 0)
+		if err != torus.ErrBlockUnavailable {
+			t.Fatalf("%s: no corruption detection", algo)
+		}
+	}
+}
+
+func TestCRCUnmarshalLegacy(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b := newBaseBlockset(s)
+	crc := newCRCBlockset(b)
+	inode := torus.NewINodeRef(1, 1)
+	crc.PutBlock(context.TODO(), inode, 0, []byte("Some data"))
+	data, err := crc.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Volumes written before checksum algorithms were selectable hold
+	// nothing but the little-endian CRC32s.
+	if len(data) != 4 || binary.LittleEndian.Uint32(data) != crc32.ChecksumIEEE([]byte("Some data")) {
+		t.Fatalf("unexpected legacy marshal %x", data)
+	}
+	newcrc := newCRCBlocksetWithAlgo(b, crcSHA256)
+	err = newcrc.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newcrc.algo != crcIEEE {
+		t.Fatal("legacy checksums not read as crc32")
+	}
+	out, err := newcrc.GetBlock(context.TODO(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "Some data" {
+		t.Error("data not retrieved")
+	}
+}
+
+func TestBlockChecksums(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec("crc=xxhash64,rep=2,base"), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode := torus.NewINodeRef(1, 1)
+	b.PutBlock(context.TODO(), inode, 0, []byte("Some data"))
+	b.PutBlock(context.TODO(), inode, 1, []byte("More data"))
+	sums := BlockChecksums(b)
+	refs := b.GetAllBlockRefs()
+	if len(sums) != len(refs) || len(refs) != 4 {
+		t.Fatalf("expected checksums for all %d blocks, got %d", len(refs), len(sums))
+	}
+	for _, ref := range refs {
+		data, err := s.GetBlock(context.TODO(), ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sums[ref].Verify(data) {
+			t.Fatalf("block %s failed verification", ref)
+		}
+		if sums[ref].Verify([]byte("Evil Corruption!!")) {
+			t.Fatal("corruption passed verification")
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package blockset
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/coreos/torus"
+)
+
+const (
+	encryptNonceSize = 12
+	encryptTagSize   = 16
+	// encryptEntrySize is the marshaled size of an encryptEntry.
+	encryptEntrySize = 4 + 4 + encryptNonceSize + encryptTagSize
+)
+
+// ErrNoKeyProvider is returned if an encrypted block is accessed without a
+// KeyProvider having been configured.
+var ErrNoKeyProvider = errors.New("blockset: no encryption key provider configured")
+
+// encryptEntry holds what's needed to decrypt a single block. The ciphertext
+// stored in the layer below is exactly as long as the plaintext, so the nonce
+// and authentication tag live here instead of in the block itself.
+type encryptEntry struct {
+	// version is the key version the block was sealed with. Zero means the
+	// block was never written through this layer and holds zeroes.
+	version uint32
+	length  uint32
+	nonce   [encryptNonceSize]byte
+	tag     [encryptTagSize]byte
+}
+
+// encryptBlockset encrypts each block with AES-GCM using a key for its
+// volume obtained from the configured KeyProvider.
+type encryptBlockset struct {
+	sub     blockset
+	vol     torus.VolumeID
+	version uint32
+	entries []encryptEntry
+	mut     sync.RWMutex
+
+	keyMut sync.Mutex
+	aeads  map[uint32]cipher.AEAD
+}
+
+var _ blockset = &encryptBlockset{}
+
+func init() {
+	RegisterBlockset(Encryption, func(_ string, _ torus.BlockStore, sub blockset) (blockset, error) {
+		return newEncryptBlockset(sub), nil
+	})
+}
+
+func newEncryptBlockset(sub blockset) *encryptBlockset {
+	return &encryptBlockset{
+		sub:   sub,
+		aeads: make(map[uint32]cipher.AEAD),
+	}
+}
+
+// EncryptedBlockSpec returns a copy of spec with an encryption layer added.
+// The layer sits beneath any CRC or compression layers, so that those see the
+// plaintext, and above any redundancy layers, so that every copy of the data
+// is encrypted.
+func EncryptedBlockSpec(spec torus.BlockLayerSpec) torus.BlockLayerSpec {
+	out := make(torus.BlockLayerSpec, 0, len(spec)+1)
+	added := false
+	for _, l := range spec {
+		if l.Kind == Encryption {
+			return append(torus.BlockLayerSpec(nil), spec...)
+		}
+		if !added && l.Kind != CRC && l.Kind != Compression {
+			out = append(out, torus.BlockLayer{Kind: Encryption})
+			added = true
+		}
+		out = append(out, l)
+	}
+	if !added {
+		out = append(out, torus.BlockLayer{Kind: Encryption})
+	}
+	return out
+}
+
+func (b *encryptBlockset) Length() int {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if b.sub.Length() != len(b.entries) {
+		panic("encryption entries should always be as long as the sub blockset")
+	}
+	return len(b.entries)
+}
+
+func (b *encryptBlockset) Kind() uint32 {
+	return uint32(Encryption)
+}
+
+// getAEAD returns the cipher for a key version, loading the key if needed.
+func (b *encryptBlockset) getAEAD(version uint32) (cipher.AEAD, error) {
+	b.keyMut.Lock()
+	defer b.keyMut.Unlock()
+	if a, ok := b.aeads[version]; ok {
+		return a, nil
+	}
+	kp := GetKeyProvider()
+	if kp == nil {
+		return nil, ErrNoKeyProvider
+	}
+	key, err := kp.GetKey(b.vol, version)
+	if err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	a, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+	b.aeads[version] = a
+	return a, nil
+}
+
+// additionalData binds a ciphertext to its position, so that blocks can't be
+// swapped around undetected.
+func (b *encryptBlockset) additionalData(i int, version uint32) []byte {
+	ad := make([]byte, 20)
+	binary.LittleEndian.PutUint64(ad[0:8], uint64(b.vol))
+	binary.LittleEndian.PutUint64(ad[8:16], uint64(i))
+	binary.LittleEndian.PutUint32(ad[16:20], version)
+	return ad
+}
+
+func (b *encryptBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if i >= len(b.entries) {
+		clog.Trace("encrypt: requesting block off the edge of known blocks")
+		return nil, torus.ErrBlockNotExist
+	}
+	data, err := b.sub.GetBlock(ctx, i)
+	if err != nil {
+		clog.Trace("encrypt: error requesting subblock")
+		return nil, err
+	}
+	e := b.entries[i]
+	if e.version == 0 {
+		return data, nil
+	}
+	if int(e.length) > len(data) {
+		clog.Warningf("encrypt: block %d is shorter than expected", i)
+		promEncryptFail.Inc()
+		return nil, torus.ErrBlockUnavailable
+	}
+	aead, err := b.getAEAD(e.version)
+	if err != nil {
+		clog.Errorf("encrypt: couldn't get key version %d for volume %d: %v", e.version, b.vol, err)
+		return nil, err
+	}
+	sealed := make([]byte, 0, int(e.length)+encryptTagSize)
+	sealed = append(sealed, data[:e.length]...)
+	sealed = append(sealed, e.tag[:]...)
+	out, err := aead.Open(nil, e.nonce[:], sealed, b.additionalData(i, e.version))
+	if err != nil {
+		clog.Warningf("encrypt: block %d failed authentication", i)
+		promEncryptFail.Inc()
+		return nil, torus.ErrBlockUnavailable
+	}
+	return out, nil
+}
+
+func (b *encryptBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if i > len(b.entries) {
+		return torus.ErrBlockNotExist
+	}
+	if b.vol == 0 {
+		b.vol = inode.Volume()
+	}
+	if b.version == 0 {
+		b.version = 1
+	}
+	aead, err := b.getAEAD(b.version)
+	if err != nil {
+		clog.Errorf("encrypt: couldn't get key version %d for volume %d: %v", b.version, b.vol, err)
+		return err
+	}
+	e := encryptEntry{
+		version: b.version,
+		length:  uint32(len(data)),
+	}
+	_, err = io.ReadFull(rand.Reader, e.nonce[:])
+	if err != nil {
+		return err
+	}
+	sealed := aead.Seal(nil, e.nonce[:], data, b.additionalData(i, e.version))
+	copy(e.tag[:], sealed[len(data):])
+	err = b.sub.PutBlock(ctx, inode, i, sealed[:len(data)])
+	if err != nil {
+		return err
+	}
+	if i == len(b.entries) {
+		b.entries = append(b.entries, e)
+	} else {
+		b.entries[i] = e
+	}
+	return nil
+}
+
+// rotate switches new writes to the given key version and re-encrypts every
+// written block with it.
+func (b *encryptBlockset) rotate(ctx context.Context, inode torus.INodeRef, version uint32) error {
+	b.mut.Lock()
+	if b.vol == 0 {
+		b.vol = inode.Volume()
+	}
+	b.version = version
+	n := len(b.entries)
+	b.mut.Unlock()
+	for i := 0; i < n; i++ {
+		b.mut.RLock()
+		e := b.entries[i]
+		b.mut.RUnlock()
+		if e.version == 0 || e.version == version {
+			continue
+		}
+		data, err := b.GetBlock(ctx, i)
+		if err != nil {
+			return err
+		}
+		err = b.PutBlock(ctx, inode, i, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RotateKey moves the encryption layer of bs to a new key version, and
+// rewrites every block under that key as part of inode. It returns the new
+// key version. The caller is responsible for persisting the updated
+// blockset.
+func RotateKey(ctx context.Context, bs torus.Blockset, inode torus.INodeRef) (uint32, error) {
+	var layer torus.Blockset
+	for layer = bs; layer != nil; layer = layer.GetSubBlockset() {
+		if e, ok := layer.(*encryptBlockset); ok {
+			kp := GetKeyProvider()
+			if kp == nil {
+				return 0, ErrNoKeyProvider
+			}
+			e.mut.RLock()
+			vol, version := e.vol, e.version
+			e.mut.RUnlock()
+			if vol == 0 {
+				vol = inode.Volume()
+			}
+			if version == 0 {
+				// Key version 1 is created along with the volume.
+				version = 1
+			}
+			version++
+			// A clone goes on using its origin's keys, so the key is made
+			// under the volume the layer was first written for. The origin
+			// or another of its clones may have made this version already.
+			err := kp.CreateKey(vol, version)
+			if err != nil && err != torus.ErrExists {
+				return 0, err
+			}
+			return version, e.rotate(ctx, inode, version)
+		}
+	}
+	return 0, torus.ErrNotSupported
+}
+
+func (b *encryptBlockset) makeID(i torus.INodeRef) torus.BlockRef {
+	return b.sub.makeID(i)
+}
+
+func (b *encryptBlockset) setStore(s torus.BlockStore) {
+	b.sub.setStore(s)
+}
+
+func (b *encryptBlockset) getStore() torus.BlockStore {
+	return b.sub.getStore()
+}
+
+func (b *encryptBlockset) Marshal() ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	buf := new(bytes.Buffer)
+	header := []uint64{uint64(b.vol), uint64(b.version)}
+	err := binary.Write(buf, binary.LittleEndian, header)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, encryptEntrySize)
+	for _, e := range b.entries {
+		binary.LittleEndian.PutUint32(out[0:4], e.version)
+		binary.LittleEndian.PutUint32(out[4:8], e.length)
+		copy(out[8:8+encryptNonceSize], e.nonce[:])
+		copy(out[8+encryptNonceSize:], e.tag[:])
+		buf.Write(out)
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *encryptBlockset) Unmarshal(data []byte) error {
+	if len(data) < 16 || (len(data)-16)%encryptEntrySize != 0 {
+		return torus.ErrInvalid
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.vol = torus.VolumeID(binary.LittleEndian.Uint64(data[0:8]))
+	b.version = uint32(binary.LittleEndian.Uint64(data[8:16]))
+	data = data[16:]
+	l := len(data) / encryptEntrySize
+	b.entries = make([]encryptEntry, l)
+	for i := range b.entries {
+		d := data[i*encryptEntrySize : (i+1)*encryptEntrySize]
+		e := &b.entries[i]
+		e.version = binary.LittleEndian.Uint32(d[0:4])
+		e.length = binary.LittleEndian.Uint32(d[4:8])
+		copy(e.nonce[:], d[8:8+encryptNonceSize])
+		copy(e.tag[:], d[8+encryptNonceSize:])
+	}
+	b.keyMut.Lock()
+	b.aeads = make(map[uint32]cipher.AEAD)
+	b.keyMut.Unlock()
+	return nil
+}
+
+func (b *encryptBlockset) GetSubBlockset() torus.Blockset { return b.sub }
+
+func (b *encryptBlockset) GetLiveINodes() *roaring.Bitmap {
+	return b.sub.GetLiveINodes()
+}
+
+func (b *encryptBlockset) Truncate(lastIndex int, blocksize uint64) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	err := b.sub.Truncate(lastIndex, blocksize)
+	if err != nil {
+		return err
+	}
+	if lastIndex <= len(b.entries) {
+		b.entries = b.entries[:lastIndex]
+		return nil
+	}
+	toadd := lastIndex - len(b.entries)
+	for toadd != 0 {
+		b.entries = append(b.entries, encryptEntry{})
+		toadd--
+	}
+	return nil
+}
+
+func (b *encryptBlockset) Trim(from, to int) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	err := b.sub.Trim(from, to)
+	if err != nil {
+		return err
+	}
+	if from >= len(b.entries) {
+		return nil
+	}
+	if to > len(b.entries) {
+		to = len(b.entries)
+	}
+	for i := from; i < to; i++ {
+		b.entries[i] = encryptEntry{}
+	}
+	return nil
+}
+
+func (b *encryptBlockset) GetAllBlockRefs() []torus.BlockRef {
+	return b.sub.GetAllBlockRefs()
+}
+
+func (b *encryptBlockset) String() string {
+	return "encrypt\n" + b.sub.String()
+}
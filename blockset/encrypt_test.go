@@ -0,0 +1,183 @@
+package blockset
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+
+	// Register storage drivers.
+	_ "github.com/coreos/torus/storage"
+)
+
+func setTestKeyProvider() {
+	SetKeyProvider(&keyFileProvider{master: bytes.Repeat([]byte("secret"), 8)})
+}
+
+func TestEncryptReadWrite(t *testing.T) {
+	setTestKeyProvider()
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b := newBaseBlockset(s)
+	readWriteTest(t, newEncryptBlockset(b))
+}
+
+func TestEncryptMarshal(t *testing.T) {
+	setTestKeyProvider()
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	marshalTest(t, s, EncryptedBlockSpec(MustParseBlockLayerSpec("crc,rep=2,base")))
+}
+
+func TestEncryptedBlockSpec(t *testing.T) {
+	spec := EncryptedBlockSpec(MustParseBlockLayerSpec("crc,compress,rep=2,base"))
+	kinds := []torus.BlockLayerKind{CRC, Compression, Encryption, Replication, Base}
+	if len(spec) != len(kinds) {
+		t.Fatalf("unexpected spec %v", spec)
+	}
+	for i, k := range kinds {
+		if spec[i].Kind != k {
+			t.Fatalf("unexpected spec %v", spec)
+		}
+	}
+}
+
+func TestEncryptCiphertext(t *testing.T) {
+	setTestKeyProvider()
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b := newBaseBlockset(s)
+	enc := newEncryptBlockset(b)
+	inode := torus.NewINodeRef(1, 1)
+	data := []byte("Some secret data")
+	err := enc.PutBlock(context.TODO(), inode, 0, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.GetBlock(context.TODO(), b.blocks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(data) || bytes.Equal(stored, data) {
+		t.Fatal("block not encrypted in place")
+	}
+	stored[0] ^= 0xff
+	s.WriteBlock(context.TODO(), b.blocks[0], stored)
+	_, err = enc.GetBlock(context.TODO(), 0)
+	if err != torus.ErrBlockUnavailable {
+		t.Fatal("No tamper detection")
+	}
+}
+
+func TestEncryptRotateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp, err := NewKeystoreProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKeyProvider(kp)
+	err = kp.CreateKey(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b, err := CreateBlocksetFromSpec(EncryptedBlockSpec(MustParseBlockLayerSpec("crc,base")), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutBlock(context.TODO(), torus.NewINodeRef(1, 1), 0, []byte("Some data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := RotateKey(context.TODO(), b, torus.NewINodeRef(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("expected key version 2, got %d", version)
+	}
+	// Only the new key should now be needed.
+	err = os.Remove(kp.(*keystoreProvider).keyPath(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshal, err := torus.MarshalBlocksetToProto(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newb, err := UnmarshalFromProto(marshal, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := newb.GetBlock(context.TODO(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "Some data" {
+		t.Error("data not retrieved")
+	}
+}
+
+func TestEncryptRotateCloneKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp, err := NewKeystoreProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKeyProvider(kp)
+	err = kp.CreateKey(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	origin, err := CreateBlocksetFromSpec(EncryptedBlockSpec(MustParseBlockLayerSpec("crc,base")), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = origin.PutBlock(context.TODO(), torus.NewINodeRef(1, 1), 0, []byte("Some data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshal, err := torus.MarshalBlocksetToProto(origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone, err := UnmarshalFromProto(marshal, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The clone, volume 2, rotates to a new version of volume 1's key.
+	version, err := RotateKey(context.TODO(), clone, torus.NewINodeRef(2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("expected key version 2, got %d", version)
+	}
+	if _, err := kp.GetKey(1, 2); err != nil {
+		t.Fatalf("expected key version 2 of volume 1: %v", err)
+	}
+	// Then the origin rotates to the same version.
+	_, err = RotateKey(context.TODO(), origin, torus.NewINodeRef(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []torus.Blockset{origin, clone} {
+		data, err := b.GetBlock(context.TODO(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "Some data" {
+			t.Error("data not retrieved")
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package blockset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/coreos/pkg/capnslog"
+	"github.com/coreos/torus"
+)
+
+// erasureBlockset groups every k blocks of the sublayer into a stripe and
+// stores m Reed-Solomon parity blocks for each stripe. Any m blocks of a
+// stripe may be lost and the data is still recoverable.
+type erasureBlockset struct {
+	k, m   int
+	sub    blockset
+	bs     torus.BlockStore
+	rs     *reedSolomon
+	parity [][]torus.BlockRef
+	// stale holds the stripes whose parity no longer matches their data
+	// (after a partial Trim or Truncate) and cannot be used for recovery
+	// until the stripe is written again.
+	stale map[int]bool
+}
+
+var _ blockset = &erasureBlockset{}
+
+const (
+	defaultECData   = 4
+	defaultECParity = 2
+)
+
+var errCorruptErasure = errors.New("blockset: corrupt erasure coding metadata")
+
+func init() {
+	RegisterBlockset(ErasureCoding, func(opt string, bs torus.BlockStore, sub blockset) (blockset, error) {
+		k, m := defaultECData, defaultECParity
+		if opt != "" {
+			var err error
+			k, m, err = parseErasureOptions(opt)
+			if err != nil {
+				clog.Errorf("unknown erasure coding options %s: %v", opt, err)
+				return nil, err
+			}
+		}
+		return newErasureBlockset(sub, bs, k, m)
+	})
+}
+
+// parseErasureOptions parses erasure coding options of the form "K:M", where
+// K is the number of data blocks and M the number of parity blocks per stripe.
+func parseErasureOptions(opt string) (int, int, error) {
+	parts := strings.Split(opt, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("erasure coding options must be of the form data:parity, got %s", opt)
+	}
+	k, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, errors.New("unknown erasure coding data amount: " + parts[0])
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, errors.New("unknown erasure coding parity amount: " + parts[1])
+	}
+	return k, m, nil
+}
+
+func newErasureBlockset(sub blockset, bs torus.BlockStore, k, m int) (*erasureBlockset, error) {
+	rs, err := newReedSolomon(k, m)
+	if err != nil {
+		return nil, err
+	}
+	return &erasureBlockset{
+		k:     k,
+		m:     m,
+		sub:   sub,
+		bs:    bs,
+		rs:    rs,
+		stale: make(map[int]bool),
+	}, nil
+}
+
+func (b *erasureBlockset) Length() int {
+	return b.sub.Length()
+}
+
+func (b *erasureBlockset) Kind() uint32 {
+	return uint32(ErasureCoding)
+}
+
+func (b *erasureBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	data, err := b.sub.GetBlock(ctx, i)
+	if err == nil || i >= b.sub.Length() {
+		return data, err
+	}
+	clog.Debugf("ec: block %d unavailable, reconstructing from stripe", i)
+	data, err = b.reconstruct(ctx, i)
+	if err != nil {
+		clog.Warningf("ec: could not reconstruct block %d: %v", i, err)
+		promECFail.Inc()
+		return nil, torus.ErrBlockUnavailable
+	}
+	promECReconstructed.Inc()
+	return data, nil
+}
+
+func (b *erasureBlockset) reconstruct(ctx context.Context, i int) ([]byte, error) {
+	stripe := i / b.k
+	if stripe >= len(b.parity) || b.stale[stripe] {
+		return nil, errTooFewShards
+	}
+	shards := make([][]byte, b.k+b.m)
+	have := 0
+	for j := 0; j < b.k && have < b.k; j++ {
+		idx := stripe*b.k + j
+		if idx == i {
+			continue
+		}
+		if idx >= b.sub.Length() {
+			shards[j] = b.padShard(nil)
+			have++
+			continue
+		}
+		data, err := b.sub.GetBlock(ctx, idx)
+		if err != nil {
+			continue
+		}
+		shards[j] = b.padShard(data)
+		have++
+	}
+	for r := 0; r < b.m && have < b.k; r++ {
+		ref := b.parity[stripe][r]
+		if ref.IsZero() {
+			shards[b.k+r] = b.padShard(nil)
+			have++
+			continue
+		}
+		if torus.BlockLog.LevelAt(capnslog.TRACE) {
+			torus.BlockLog.Tracef("ec: getting parity %d of stripe %d at BlockID %s", r, stripe, ref)
+		}
+		data, err := b.bs.GetBlock(ctx, ref)
+		if err != nil {
+			continue
+		}
+		shards[b.k+r] = b.padShard(data)
+		have++
+	}
+	return b.rs.reconstruct(shards, i%b.k)
+}
+
+// padShard returns data sized to exactly one block, as every shard in a
+// stripe must be the same length.
+func (b *erasureBlockset) padShard(data []byte) []byte {
+	size := int(b.bs.BlockSize())
+	if len(data) == size {
+		return data
+	}
+	out := make([]byte, size)
+	copy(out, data)
+	return out
+}
+
+func (b *erasureBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	if i > b.sub.Length() {
+		return torus.ErrBlockNotExist
+	}
+	stripe := i / b.k
+	// Gather the rest of the stripe before the sublayer changes, so that any
+	// missing neighbours are reconstructed against the current parity.
+	shards := make([][]byte, b.k)
+	for j := range shards {
+		idx := stripe*b.k + j
+		switch {
+		case idx == i:
+			shards[j] = b.padShard(data)
+		case idx >= b.sub.Length():
+			shards[j] = b.padShard(nil)
+		default:
+			d, err := b.GetBlock(ctx, idx)
+			if err != nil {
+				return err
+			}
+			shards[j] = b.padShard(d)
+		}
+	}
+	err := b.sub.PutBlock(ctx, inode, i, data)
+	if err != nil {
+		return err
+	}
+	for len(b.parity) <= stripe {
+		b.parity = append(b.parity, make([]torus.BlockRef, b.m))
+	}
+	refs := make([]torus.BlockRef, b.m)
+	for r, p := range b.rs.encode(shards) {
+		newBlockID := b.makeID(inode)
+		if torus.BlockLog.LevelAt(capnslog.TRACE) {
+			torus.BlockLog.Tracef("ec: writing parity %d of stripe %d at BlockID %s", r, stripe, newBlockID)
+		}
+		err := b.bs.WriteBlock(ctx, newBlockID, p)
+		if err != nil {
+			return err
+		}
+		refs[r] = newBlockID
+	}
+	b.parity[stripe] = refs
+	delete(b.stale, stripe)
+	return nil
+}
+
+func (b *erasureBlockset) makeID(i torus.INodeRef) torus.BlockRef {
+	return b.sub.makeID(i)
+}
+
+func (b *erasureBlockset) setStore(s torus.BlockStore) {
+	b.bs = s
+	b.sub.setStore(s)
+}
+
+func (b *erasureBlockset) getStore() torus.BlockStore {
+	return b.bs
+}
+
+func (b *erasureBlockset) Marshal() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	header := []int32{int32(b.k), int32(b.m), int32(len(b.parity))}
+	err := binary.Write(buf, binary.LittleEndian, header)
+	if err != nil {
+		return nil, err
+	}
+	for _, refs := range b.parity {
+		for _, x := range refs {
+			_, err := buf.Write(x.ToBytes())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	stale := make([]int, 0, len(b.stale))
+	for s := range b.stale {
+		stale = append(stale, s)
+	}
+	sort.Ints(stale)
+	err = binary.Write(buf, binary.LittleEndian, int32(len(stale)))
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stale {
+		err := binary.Write(buf, binary.LittleEndian, int32(s))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *erasureBlockset) Unmarshal(data []byte) error {
+	r := bytes.NewReader(data)
+	header := make([]int32, 3)
+	err := binary.Read(r, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+	if header[0] < 1 || header[1] < 1 || header[2] < 0 {
+		return errCorruptErasure
+	}
+	// Don't trust the stripe count further than the data that's left.
+	if int64(header[2])*int64(header[1])*torus.BlockRefByteSize > int64(r.Len()) {
+		return errCorruptErasure
+	}
+	rs, err := newReedSolomon(int(header[0]), int(header[1]))
+	if err != nil {
+		return err
+	}
+	b.k, b.m, b.rs = int(header[0]), int(header[1]), rs
+	b.parity = make([][]torus.BlockRef, header[2])
+	buf := make([]byte, torus.BlockRefByteSize)
+	for s := range b.parity {
+		refs := make([]torus.BlockRef, b.m)
+		for j := range refs {
+			_, err := io.ReadFull(r, buf)
+			if err != nil {
+				return err
+			}
+			refs[j] = torus.BlockRefFromBytes(buf)
+		}
+		b.parity[s] = refs
+	}
+	var nstale int32
+	err = binary.Read(r, binary.LittleEndian, &nstale)
+	if err != nil {
+		return err
+	}
+	b.stale = make(map[int]bool)
+	for ; nstale > 0; nstale-- {
+		var s int32
+		err := binary.Read(r, binary.LittleEndian, &s)
+		if err != nil {
+			return err
+		}
+		b.stale[int(s)] = true
+	}
+	return nil
+}
+
+func (b *erasureBlockset) GetSubBlockset() torus.Blockset { return b.sub }
+
+func (b *erasureBlockset) GetLiveINodes() *roaring.Bitmap {
+	out := b.sub.GetLiveINodes()
+	for _, refs := range b.parity {
+		for _, ref := range refs {
+			if ref.IsZero() {
+				continue
+			}
+			out.Add(uint32(ref.INode))
+		}
+	}
+	return out
+}
+
+func (b *erasureBlockset) stripes(n int) int {
+	return (n + b.k - 1) / b.k
+}
+
+// markStale invalidates the parity of a stripe. The old parity blocks are
+// dropped so that they may be garbage collected.
+func (b *erasureBlockset) markStale(stripe int) {
+	if stripe >= len(b.parity) {
+		return
+	}
+	b.parity[stripe] = make([]torus.BlockRef, b.m)
+	b.stale[stripe] = true
+}
+
+func (b *erasureBlockset) Truncate(lastIndex int, blocksize uint64) error {
+	oldLen := b.sub.Length()
+	err := b.sub.Truncate(lastIndex, blocksize)
+	if err != nil {
+		return err
+	}
+	n := b.stripes(lastIndex)
+	if n <= len(b.parity) {
+		b.parity = b.parity[:n]
+		for s := range b.stale {
+			if s >= n {
+				delete(b.stale, s)
+			}
+		}
+		if lastIndex < oldLen && lastIndex%b.k != 0 {
+			// The last stripe still covers data that was cut off.
+			b.markStale(n - 1)
+		}
+		return nil
+	}
+	// New blocks are zero, and zero data has zero parity.
+	for len(b.parity) < n {
+		b.parity = append(b.parity, make([]torus.BlockRef, b.m))
+	}
+	return nil
+}
+
+func (b *erasureBlockset) Trim(from, to int) error {
+	err := b.sub.Trim(from, to)
+	if err != nil {
+		return err
+	}
+	length := b.sub.Length()
+	if to > length {
+		to = length
+	}
+	if from >= to {
+		return nil
+	}
+	for s := from / b.k; s < b.stripes(to) && s < len(b.parity); s++ {
+		end := (s + 1) * b.k
+		if end > length {
+			end = length
+		}
+		if s*b.k >= from && end <= to {
+			// The whole stripe is now zero.
+			b.parity[s] = make([]torus.BlockRef, b.m)
+			delete(b.stale, s)
+			continue
+		}
+		b.markStale(s)
+	}
+	return nil
+}
+
+func (b *erasureBlockset) GetAllBlockRefs() []torus.BlockRef {
+	out := b.sub.GetAllBlockRefs()
+	for _, refs := range b.parity {
+		out = append(out, refs...)
+	}
+	return out
+}
+
+func (b *erasureBlockset) String() string {
+	return fmt.Sprintf("ec %d:%d\n", b.k, b.m) + b.sub.String()
+}
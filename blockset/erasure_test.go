@@ -0,0 +1,156 @@
+package blockset
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+
+	// Register storage drivers.
+	_ "github.com/coreos/torus/storage"
+)
+
+func TestErasureReadWrite(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b := newBaseBlockset(s)
+	ec, err := newErasureBlockset(b, s, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readWriteTest(t, ec)
+}
+
+func TestErasureMarshal(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	marshalTest(t, s, MustParseBlockLayerSpec("crc,ec=3:2,base"))
+}
+
+func TestErasureReconstruct(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b := newBaseBlockset(s)
+	ec, err := newErasureBlockset(b, s, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode := torus.NewINodeRef(1, 1)
+	var blocks [][]byte
+	for i := 0; i < 7; i++ {
+		data := bytes.Repeat([]byte{byte(i + 1), byte(3 * i)}, 512)
+		blocks = append(blocks, data)
+		err := ec.PutBlock(context.TODO(), inode, i, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Lose two blocks from the first stripe and one from the second.
+	for _, i := range []int{1, 3, 5} {
+		err := s.DeleteBlock(context.TODO(), b.blocks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, expected := range blocks {
+		data, err := ec.GetBlock(context.TODO(), i)
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("block %d not reconstructed", i)
+		}
+	}
+	// A third loss in the first stripe is more than the parity can cover.
+	err = s.DeleteBlock(context.TODO(), b.blocks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ec.GetBlock(context.TODO(), 0)
+	if err != torus.ErrBlockUnavailable {
+		t.Fatal("expected block to be unavailable, got", err)
+	}
+}
+
+func TestErasureTrim(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b := newBaseBlockset(s)
+	ec, err := newErasureBlockset(b, s, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode := torus.NewINodeRef(1, 1)
+	for i := 0; i < 4; i++ {
+		err := ec.PutBlock(context.TODO(), inode, i, bytes.Repeat([]byte{byte(i + 1)}, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ec.Trim(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ec.parity[0][0].IsZero() || ec.stale[0] {
+		t.Error("fully trimmed stripe should have zero parity")
+	}
+	if !ec.stale[1] {
+		t.Error("partially trimmed stripe should be stale")
+	}
+	// Rewriting the stripe makes it recoverable again.
+	err = ec.PutBlock(context.TODO(), inode, 2, bytes.Repeat([]byte{9}, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ec.stale[1] {
+		t.Error("rewritten stripe should not be stale")
+	}
+	err = s.DeleteBlock(context.TODO(), b.blocks[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ec.GetBlock(context.TODO(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, bytes.Repeat([]byte{4}, 1024)) {
+		t.Error("block not reconstructed after trim")
+	}
+}
+
+func TestErasureUnmarshalCorrupt(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	ec, err := newErasureBlockset(newBaseBlockset(s), s, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode := torus.NewINodeRef(1, 1)
+	for i := 0; i < 4; i++ {
+		err := ec.PutBlock(context.TODO(), inode, i, bytes.Repeat([]byte{byte(i + 1)}, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ec.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := map[string][]byte{
+		"truncated":        data[:len(data)-torus.BlockRefByteSize],
+		"negative stripes": append([]byte{2, 0, 0, 0, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}, data[12:]...),
+		"huge stripes":     append([]byte{2, 0, 0, 0, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0x7f}, data[12:]...),
+		"zero data":        append([]byte{0, 0, 0, 0, 1, 0, 0, 0}, data[8:]...),
+		"negative parity":  append([]byte{2, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}, data[8:]...),
+	}
+	for name, d := range corrupt {
+		if err := (&erasureBlockset{}).Unmarshal(d); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	out := &erasureBlockset{}
+	err = out.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.k != 2 || out.m != 1 || len(out.parity) != 2 {
+		t.Errorf("got k=%d m=%d stripes=%d, expected 2, 1, 2", out.k, out.m, len(out.parity))
+	}
+}
@@ -0,0 +1,147 @@
+package blockset
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/coreos/torus"
+)
+
+// KeyProvider supplies the data encryption keys used by the encryption
+// layer. Keys are versioned per volume so they can be rotated; old versions
+// must remain available for as long as any INode (such as a snapshot) still
+// references blocks sealed with them.
+type KeyProvider interface {
+	// GetKey returns the 32-byte key for the given volume and key version.
+	GetKey(vol torus.VolumeID, version uint32) ([]byte, error)
+	// CreateKey makes a new key version available for the volume.
+	CreateKey(vol torus.VolumeID, version uint32) error
+}
+
+var (
+	keyProvider    KeyProvider
+	keyProviderMut sync.RWMutex
+)
+
+// SetKeyProvider sets the KeyProvider used by all encryption layers in this
+// process.
+func SetKeyProvider(kp KeyProvider) {
+	keyProviderMut.Lock()
+	defer keyProviderMut.Unlock()
+	keyProvider = kp
+}
+
+// GetKeyProvider returns the configured KeyProvider, or nil if there is none.
+func GetKeyProvider() KeyProvider {
+	keyProviderMut.RLock()
+	defer keyProviderMut.RUnlock()
+	return keyProvider
+}
+
+const encryptionKeySize = 32
+
+type keyFileProvider struct {
+	master []byte
+}
+
+// NewKeyFileProvider returns a KeyProvider which derives every volume key
+// from a single master key read from path. The file must contain at least 32
+// bytes of secret material. Creating new key versions is free, as every
+// version is derived on demand.
+func NewKeyFileProvider(path string) (KeyProvider, error) {
+	master, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(master) < encryptionKeySize {
+		return nil, fmt.Errorf("key file %s must contain at least %d bytes", path, encryptionKeySize)
+	}
+	return &keyFileProvider{master: master}, nil
+}
+
+func (k *keyFileProvider) GetKey(vol torus.VolumeID, version uint32) ([]byte, error) {
+	if version == 0 {
+		return nil, errors.New("blockset: invalid key version 0")
+	}
+	mac := hmac.New(sha256.New, k.master)
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(vol))
+	binary.BigEndian.PutUint32(buf[8:12], version)
+	mac.Write([]byte("torus volume key"))
+	mac.Write(buf)
+	return mac.Sum(nil), nil
+}
+
+func (k *keyFileProvider) CreateKey(vol torus.VolumeID, version uint32) error {
+	return nil
+}
+
+type keystoreProvider struct {
+	dir string
+}
+
+// NewKeystoreProvider returns a KeyProvider backed by a local keystore
+// directory, holding a randomly generated key per volume and version. The
+// keystore must be shared (or copied) to every machine that attaches the
+// volume.
+func NewKeystoreProvider(dir string) (KeyProvider, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &keystoreProvider{dir: dir}, nil
+}
+
+func (k *keystoreProvider) keyPath(vol torus.VolumeID, version uint32) string {
+	return filepath.Join(k.dir, fmt.Sprintf("%016x", uint64(vol)), fmt.Sprintf("%d.key", version))
+}
+
+func (k *keystoreProvider) GetKey(vol torus.VolumeID, version uint32) ([]byte, error) {
+	key, err := ioutil.ReadFile(k.keyPath(vol, version))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, torus.ErrNotExist
+		}
+		return nil, err
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("key for volume %d version %d is corrupt", vol, version)
+	}
+	return key, nil
+}
+
+func (k *keystoreProvider) CreateKey(vol torus.VolumeID, version uint32) error {
+	p := k.keyPath(vol, version)
+	err := os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, encryptionKeySize)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return torus.ErrExists
+		}
+		return err
+	}
+	_, err = f.Write(key)
+	if err != nil {
+		f.Close()
+		os.Remove(p)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,188 @@
+package blockset
+
+import "errors"
+
+// This file implements a small systematic Reed-Solomon codec over GF(2^8),
+// used by the erasure coding layer. The encoding matrix is the identity for
+// the k data shards stacked atop a Cauchy matrix for the m parity shards;
+// every k-row submatrix of such a matrix is invertible, so any k surviving
+// shards are sufficient to recover the stripe.
+
+var errTooFewShards = errors.New("blockset: too few shards to reconstruct stripe")
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	// Generator polynomial x^8 + x^4 + x^3 + x^2 + 1
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	if a == 0 {
+		panic("blockset: inverse of zero in GF(2^8)")
+	}
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd computes dst ^= c * src, elementwise.
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	if c == 1 {
+		for i, v := range src {
+			dst[i] ^= v
+		}
+		return
+	}
+	lc := int(gfLog[c])
+	for i, v := range src {
+		if v != 0 {
+			dst[i] ^= gfExp[lc+int(gfLog[v])]
+		}
+	}
+}
+
+type reedSolomon struct {
+	k, m int
+	// matrix has k+m rows of k columns.
+	matrix [][]byte
+}
+
+func newReedSolomon(k, m int) (*reedSolomon, error) {
+	if k <= 0 || m <= 0 {
+		return nil, errors.New("blockset: erasure coding requires positive data and parity counts")
+	}
+	if k+m > 256 {
+		return nil, errors.New("blockset: erasure coding supports at most 256 shards")
+	}
+	rs := &reedSolomon{
+		k:      k,
+		m:      m,
+		matrix: make([][]byte, k+m),
+	}
+	for r := 0; r < k; r++ {
+		rs.matrix[r] = make([]byte, k)
+		rs.matrix[r][r] = 1
+	}
+	for r := 0; r < m; r++ {
+		row := make([]byte, k)
+		for c := 0; c < k; c++ {
+			// x_r = k + r and y_c = c are all distinct, so x_r ^ y_c != 0.
+			row[c] = gfInv(byte(k+r) ^ byte(c))
+		}
+		rs.matrix[k+r] = row
+	}
+	return rs, nil
+}
+
+// encode computes the m parity shards for the k data shards given. All shards
+// must be the same length.
+func (rs *reedSolomon) encode(data [][]byte) [][]byte {
+	size := len(data[0])
+	parity := make([][]byte, rs.m)
+	for r := range parity {
+		parity[r] = make([]byte, size)
+		row := rs.matrix[rs.k+r]
+		for c, d := range data {
+			gfMulAdd(parity[r], d, row[c])
+		}
+	}
+	return parity
+}
+
+// reconstruct recovers data shard want from a set of shards, indexed as
+// data shards [0, k) followed by parity shards [k, k+m). Missing shards are nil.
+func (rs *reedSolomon) reconstruct(shards [][]byte, want int) ([]byte, error) {
+	if shards[want] != nil {
+		return shards[want], nil
+	}
+	rows := make([]int, 0, rs.k)
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+		rows = append(rows, i)
+		if len(rows) == rs.k {
+			break
+		}
+	}
+	if len(rows) < rs.k {
+		return nil, errTooFewShards
+	}
+	sub := make([][]byte, rs.k)
+	for i, r := range rows {
+		sub[i] = append([]byte(nil), rs.matrix[r]...)
+	}
+	inv, err := gfInvertMatrix(sub)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(shards[rows[0]]))
+	for i, r := range rows {
+		gfMulAdd(out, shards[r], inv[want][i])
+	}
+	return out, nil
+}
+
+// gfInvertMatrix inverts a square matrix over GF(2^8) by Gauss-Jordan
+// elimination. The input is modified.
+func gfInvertMatrix(a [][]byte) ([][]byte, error) {
+	n := len(a)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if a[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, errors.New("blockset: singular erasure coding matrix")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		if c := a[col][col]; c != 1 {
+			ic := gfInv(c)
+			for j := 0; j < n; j++ {
+				a[col][j] = gfMul(a[col][j], ic)
+				inv[col][j] = gfMul(inv[col][j], ic)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r == col || a[r][col] == 0 {
+				continue
+			}
+			f := a[r][col]
+			gfMulAdd(a[r], a[col], f)
+			gfMulAdd(inv[r], inv[col], f)
+		}
+	}
+	return inv, nil
+}
@@ -183,6 +183,9 @@ func attachAction(cmd *cobra.Command, args []string) {
 	if vol.WriteCacheSize != "" {
 		cmdList = append(cmdList, []string{"--write-cache-size", vol.WriteCacheSize}...)
 	}
+	if vol.ReadWrite == "ro" {
+		cmdList = append(cmdList, "--read-only")
+	}
 
 	ch := make(chan string)
 
@@ -226,7 +229,13 @@ func mountAction(cmd *cobra.Command, args []string) {
 	}
 
 	flags := "noatime"
-	if vol.Trim {
+	if vol.ReadWrite == "ro" {
+		flags = "ro,noatime"
+		if strings.HasPrefix(vol.FSType, "ext") {
+			// Someone else is writing, so don't try to replay the journal.
+			flags += ",noload"
+		}
+	} else if vol.Trim {
 		flags = "noatime,discard"
 	}
 
@@ -22,7 +22,8 @@ var (
 	httpAddr string
 	cfg      torus.Config
 
-	debug bool
+	debug     bool
+	readahead int
 )
 
 var rootCommand = &cobra.Command{
@@ -61,6 +62,7 @@ func init() {
 	rootCommand.PersistentFlags().StringVarP(&logpkg, "logpkg", "", "", "Specific package logging")
 	rootCommand.PersistentFlags().StringVarP(&httpAddr, "http", "", "", "HTTP endpoint for debug and stats")
 	rootCommand.PersistentFlags().BoolVarP(&debug, "debug", "", false, "Turn on debug output")
+	rootCommand.PersistentFlags().IntVarP(&readahead, "readahead", "", 8, "Number of blocks to fetch ahead of sequential reads (0 to turn off)")
 	flagconfig.AddConfigFlags(rootCommand.PersistentFlags())
 }
 
@@ -83,6 +85,11 @@ func configureServer(cmd *cobra.Command, args []string) {
 	}
 
 	cfg = flagconfig.BuildConfigFromFlags()
+	if readahead < 0 {
+		fmt.Fprintf(os.Stderr, "readahead must not be negative\n")
+		os.Exit(1)
+	}
+	cfg.Readahead = readahead
 }
 
 func createServer() *torus.Server {
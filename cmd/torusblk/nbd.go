@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/block"
@@ -45,6 +46,7 @@ var (
 var (
 	serveListenAddress string
 	detachDevice       string
+	nbdReadOnly        bool
 )
 
 func init() {
@@ -52,6 +54,7 @@ func init() {
 	rootCommand.AddCommand(nbdServeCommand)
 
 	nbdCommand.Flags().StringVarP(&detachDevice, "detach", "d", "", "detach an NBD device from a block volume. (e.g. torsublk nbd -d /dev/nbd0)")
+	nbdCommand.Flags().BoolVarP(&nbdReadOnly, "read-only", "r", false, "attach the volume read-only, alongside its writer and other readers; send SIGHUP to see its latest sync")
 	nbdServeCommand.Flags().StringVarP(&serveListenAddress, "listen", "l", "0.0.0.0:10809", "nbd server listen address")
 }
 
@@ -90,7 +93,12 @@ func nbdAction(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("server doesn't support block volumes: %s", err)
 	}
 
-	f, err := blockvol.OpenBlockFile()
+	var f *block.BlockFile
+	if nbdReadOnly {
+		f, err = blockvol.OpenBlockFileReadOnly()
+	} else {
+		f, err = blockvol.OpenBlockFile()
+	}
 	if err != nil {
 		if err == torus.ErrLocked {
 			return fmt.Errorf("volume %s is already mounted on another host", args[0])
@@ -131,6 +139,22 @@ func connectNBD(srv *torus.Server, f *block.BlockFile, target string, closer cha
 		n.Disconnect()
 	}(handle)
 
+	resized := func(size uint64) {
+		if err := handle.SetSize(int64(size)); err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't resize %s: %v\n", target, err)
+			return
+		}
+		fmt.Printf("Resized %s to %d bytes\n", target, size)
+	}
+	done := make(chan bool)
+	defer close(done)
+	if f.ReadOnly {
+		handle.ReadOnly = true
+		go refreshOnHangup(f, target, done, resized)
+	} else {
+		go f.WatchResize(done, resized)
+	}
+
 	err = handle.Serve()
 	if err != nil {
 		return fmt.Errorf("error from nbd server: %s", err)
@@ -138,6 +162,35 @@ func connectNBD(srv *torus.Server, f *block.BlockFile, target string, closer cha
 	return nil
 }
 
+// refreshOnHangup moves a read-only attach on to the volume's latest sync each
+// time torusblk gets a SIGHUP, until done is closed.
+func refreshOnHangup(f *block.BlockFile, target string, done chan bool, resized func(size uint64)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-done:
+			return
+		case <-hup:
+		}
+		size := f.Size()
+		changed, err := f.Refresh()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't refresh %s: %v\n", target, err)
+			continue
+		}
+		if !changed {
+			fmt.Printf("%s is up to date\n", target)
+			continue
+		}
+		fmt.Printf("Refreshed %s to the volume's latest sync\n", target)
+		if f.Size() != size {
+			resized(f.Size())
+		}
+	}
+}
+
 type finder struct {
 	srv *torus.Server
 }
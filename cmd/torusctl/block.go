@@ -20,7 +20,20 @@ var blockCreateCommand = &cobra.Command{
 	Run:   volumeCreateBlockAction,
 }
 
+var (
+	createEncrypted   bool
+	createSpec        string
+	createReplication int
+	createOwner       string
+	createLabels      []string
+)
+
 func init() {
+	blockCreateCommand.Flags().BoolVarP(&createEncrypted, "encrypt", "", false, "encrypt the volume's blocks at rest")
+	blockCreateCommand.Flags().StringVarP(&createSpec, "spec", "", "", "block layer spec for the volume, such as crc,rep=3,base (default the cluster's)")
+	blockCreateCommand.Flags().IntVarP(&createReplication, "replication", "", 0, "number of storage nodes to keep each of the volume's blocks on (default the ring's)")
+	blockCreateCommand.Flags().StringVarP(&createOwner, "owner", "", "", "user or tenant the volume belongs to")
+	blockCreateCommand.Flags().StringSliceVarP(&createLabels, "label", "l", nil, "label the volume with KEY=VALUE (may be repeated)")
 	blockCommand.AddCommand(blockCreateCommand)
 	flagconfig.AddConfigFlags(blockCommand.PersistentFlags())
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/spf13/cobra"
+)
+
+var blockRotateKeyCommand = &cobra.Command{
+	Use:   "rotate-key VOLUME",
+	Short: "re-encrypt an encrypted block volume with a new key",
+	Long: `creates a new key version for an encrypted block volume and re-encrypts
+the volume's current contents with it. Older keys are still needed to read
+existing snapshots, and must be kept until those snapshots are deleted.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := blockRotateKeyAction(cmd, args)
+		if err == torus.ErrUsage {
+			cmd.Usage()
+			os.Exit(1)
+		} else if err != nil {
+			die("%v", err)
+		}
+	},
+}
+
+func init() {
+	blockCommand.AddCommand(blockRotateKeyCommand)
+}
+
+func blockRotateKeyAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return torus.ErrUsage
+	}
+	srv := createServer()
+	defer srv.Close()
+	blockvol, err := block.OpenBlockVolume(srv, args[0])
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", args[0], err)
+	}
+	version, err := blockvol.RotateKey()
+	if err == torus.ErrNotSupported {
+		return fmt.Errorf("block volume %s is not encrypted", args[0])
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't rotate key for %s: %v", args[0], err)
+	}
+	fmt.Printf("volume %s now encrypted with key version %d\n", args[0], version)
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var (
+	blockLockCommand = &cobra.Command{
+		Use:   "lock",
+		Short: "inspect or break the write lock of a block volume",
+		Run:   blockAction,
+	}
+
+	blockLockStatusCommand = &cobra.Command{
+		Use:   "status VOLUME",
+		Short: "show who has a block volume open for writing",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := blockLockStatusAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+
+	blockLockBreakCommand = &cobra.Command{
+		Use:   "break VOLUME",
+		Short: "release the write lock of a block volume, whoever holds it",
+		Long: `releases the write lock of VOLUME, so that it can be attached elsewhere.
+Only use this when the holder is gone or stuck: it can no longer sync the volume, and
+anything it hasn't synced yet is lost. Read-only attaches are unaffected.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := blockLockBreakAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+)
+
+func init() {
+	blockLockCommand.AddCommand(blockLockStatusCommand)
+	blockLockCommand.AddCommand(blockLockBreakCommand)
+	blockCommand.AddCommand(blockLockCommand)
+}
+
+func blockLockStatusAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return torus.ErrUsage
+	}
+	srv := createServer()
+	defer srv.Close()
+	blockvol, err := block.OpenBlockVolume(srv, args[0])
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", args[0], err)
+	}
+	holder, err := blockvol.LockHolder()
+	if err != nil {
+		return fmt.Errorf("couldn't get lock of block volume %s: %v", args[0], err)
+	}
+	if holder == "" {
+		fmt.Printf("Volume %s is not locked\n", args[0])
+		return nil
+	}
+	fmt.Printf("Volume: %s\nHolder: %s\n", args[0], holder)
+	peers, err := srv.MDS.GetPeers()
+	if err != nil {
+		return fmt.Errorf("couldn't get peers: %v", err)
+	}
+	for _, p := range peers {
+		if p.UUID != holder {
+			continue
+		}
+		addr := p.Address
+		if addr == "" {
+			addr = "(client)"
+		}
+		fmt.Printf("Address: %s\nLast Seen: %s\n", addr, humanize.Time(time.Unix(0, p.LastSeen)))
+		return nil
+	}
+	fmt.Println("Last Seen: not heartbeating")
+	return nil
+}
+
+func blockLockBreakAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return torus.ErrUsage
+	}
+	srv := createServer()
+	defer srv.Close()
+	blockvol, err := block.OpenBlockVolume(srv, args[0])
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", args[0], err)
+	}
+	holder, err := blockvol.LockHolder()
+	if err != nil {
+		return fmt.Errorf("couldn't get lock of block volume %s: %v", args[0], err)
+	}
+	if holder == "" {
+		fmt.Printf("Volume %s is not locked\n", args[0])
+		return nil
+	}
+	err = blockvol.BreakLock(holder)
+	switch err {
+	case nil:
+	case torus.ErrNotExist:
+		fmt.Printf("Volume %s is not locked\n", args[0])
+		return nil
+	case torus.ErrLocked:
+		return fmt.Errorf("lock of block volume %s has changed hands since it was held by %s; not breaking it", args[0], holder)
+	default:
+		return fmt.Errorf("couldn't break lock of block volume %s: %v", args[0], err)
+	}
+	fmt.Printf("Broke the lock on %s held by %s\n", args[0], holder)
+	return nil
+}
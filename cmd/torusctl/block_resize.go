@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var blockResizeCommand = &cobra.Command{
+	Use:   "resize VOLUME SIZE",
+	Short: "grow or shrink a block volume",
+	Long: `resizes the block volume VOLUME to SIZE bytes (G,GiB,M,MiB,etc suffixes accepted).
+The volume may be attached; its attached device picks up the new size within a few seconds.
+Shrinking a volume drops the data past its new end, so shrink the filesystem on it first.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := blockResizeAction(cmd, args)
+		if err == torus.ErrUsage {
+			cmd.Usage()
+			os.Exit(1)
+		} else if err != nil {
+			die("%v", err)
+		}
+	},
+}
+
+func init() {
+	blockCommand.AddCommand(blockResizeCommand)
+}
+
+func blockResizeAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return torus.ErrUsage
+	}
+	size, err := humanize.ParseBytes(args[1])
+	if err != nil {
+		return fmt.Errorf("error parsing size %s: %v", args[1], err)
+	}
+	srv := createServer()
+	defer srv.Close()
+	blockvol, err := block.OpenBlockVolume(srv, args[0])
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", args[0], err)
+	}
+	err = blockvol.Resize(size)
+	if err == block.ErrResizePending {
+		return fmt.Errorf("volume %s is attached, and will be resized once its holder checks in", args[0])
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't resize block volume %s: %v", args[0], err)
+	}
+	return nil
+}
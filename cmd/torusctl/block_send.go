@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/spf13/cobra"
+)
+
+var (
+	blockSendCommand = &cobra.Command{
+		Use:   "send VOLUME@[FROM..VOLUME@]TO [OUTPUT_FILE]",
+		Short: "write a stream of a block volume's snapshot, or of the changes between two snapshots",
+		Long: `writes a stream of the contents of VOLUME as of snapshot TO to OUTPUT_FILE, or to stdout.
+If a FROM snapshot is given, as in VOLUME@FROM..VOLUME@TO, only the changes since FROM are included,
+and the stream can only be received into a copy of VOLUME as of FROM.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := blockSendAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+
+	blockReceiveCommand = &cobra.Command{
+		Use:   "receive VOLUME [INPUT_FILE]",
+		Short: "apply a stream written by block send to a block volume",
+		Long: `reads a stream written by block send from INPUT_FILE, or from stdin, and applies it to VOLUME.
+A full stream creates VOLUME; an incremental one needs VOLUME to have the stream's FROM snapshot.
+Either way, the stream's TO snapshot is then taken of VOLUME.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := blockReceiveAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+
+	receiveForce bool
+)
+
+func init() {
+	blockCommand.AddCommand(blockSendCommand)
+	blockReceiveCommand.Flags().BoolVarP(&receiveForce, "force", "f", false, "roll the volume back to the stream's FROM snapshot if it has changed since")
+	blockCommand.AddCommand(blockReceiveCommand)
+}
+
+func blockSendAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return torus.ErrUsage
+	}
+	var from, to SnapName
+	p := strings.SplitN(args[0], "..", 2)
+	to = ParseSnapName(p[0])
+	if len(p) == 2 {
+		from, to = to, ParseSnapName(p[1])
+		if from.Snapshot == "" || from.Volume != to.Volume {
+			return fmt.Errorf("please use the form VOLUME@FROM..VOLUME@TO, with the same VOLUME")
+		}
+	}
+	if to.Snapshot == "" {
+		return fmt.Errorf("can't send a volume without a snapshot, please use the form VOLUME@SNAPSHOT_NAME")
+	}
+	var output io.Writer = os.Stdout
+	if len(args) == 2 {
+		var err error
+		output, err = getWriterFromArg(args[1])
+		if err != nil {
+			return fmt.Errorf("couldn't open output: %v", err)
+		}
+	}
+	srv := createServer()
+	defer srv.Close()
+	blockvol, err := block.OpenBlockVolume(srv, to.Volume)
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", to.Volume, err)
+	}
+	err = blockvol.Send(output, from.Snapshot, to.Snapshot)
+	if err != nil {
+		return fmt.Errorf("couldn't send: %v", err)
+	}
+	if c, ok := output.(io.Closer); ok && output != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+func blockReceiveAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return torus.ErrUsage
+	}
+	var input io.Reader = os.Stdin
+	if len(args) == 2 && args[1] != "-" {
+		f, err := getReaderFromArg(args[1])
+		if err != nil {
+			return fmt.Errorf("couldn't open input: %v", err)
+		}
+		defer f.Close()
+		input = f
+	}
+	srv := createServer()
+	defer srv.Close()
+	h, err := block.ReceiveBlockVolume(srv, args[0], input, receiveForce)
+	if err != nil {
+		return fmt.Errorf("couldn't receive into %s: %v", args[0], err)
+	}
+	if h.From == "" {
+		fmt.Fprintf(os.Stderr, "received %s@%s\n", args[0], h.To)
+	} else {
+		fmt.Fprintf(os.Stderr, "received %s@%s..%s@%s\n", args[0], h.From, args[0], h.To)
+	}
+	return nil
+}
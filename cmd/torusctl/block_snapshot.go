@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -73,8 +74,40 @@ var (
 			}
 		},
 	}
+
+	bsnapScheduleCommand = &cobra.Command{
+		Use:   "schedule VOLUME",
+		Short: "set how many hourly, daily and weekly snapshots of a block volume to take and keep",
+		Long:  "sets the snapshot schedule of VOLUME. Snapshots are taken automatically, and the oldest of each period are deleted beyond the number to keep. Setting every count to zero clears the schedule; snapshots already taken are left in place.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := bsnapScheduleAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+
+	blockCloneCommand = &cobra.Command{
+		Use:   "clone VOLUME@SNAPSHOT_NAME NEW_VOLUME",
+		Short: "create a writable block volume from a snapshot",
+		Long:  "creates a block volume named NEW_VOLUME that starts out as a copy of SNAPSHOT_NAME of VOLUME, sharing its blocks until they're overwritten",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := blockCloneAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
 )
 
+var schedule block.SnapshotSchedule
+
 type SnapName struct {
 	Volume   string
 	Snapshot string
@@ -94,6 +127,11 @@ func init() {
 	blockSnapshotCommand.AddCommand(bsnapCreateCommand)
 	blockSnapshotCommand.AddCommand(bsnapDeleteCommand)
 	blockSnapshotCommand.AddCommand(bsnapRestoreCommand)
+	blockSnapshotCommand.AddCommand(bsnapScheduleCommand)
+	bsnapScheduleCommand.Flags().IntVarP(&schedule.Hourly, "hourly", "", 0, "number of hourly snapshots to keep")
+	bsnapScheduleCommand.Flags().IntVarP(&schedule.Daily, "daily", "", 0, "number of daily snapshots to keep")
+	bsnapScheduleCommand.Flags().IntVarP(&schedule.Weekly, "weekly", "", 0, "number of weekly snapshots to keep")
+	blockCommand.AddCommand(blockCloneCommand)
 	bsnapListCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
 }
 
@@ -120,12 +158,37 @@ func bsnapListAction(cmd *cobra.Command, args []string) error {
 			x.When.Format(time.RFC3339),
 		})
 	}
-	if !outputAsCSV {
-		fmt.Printf("Volume: %s\n", vol)
-		table.Render()
-	} else {
+	if outputAsCSV {
 		table.RenderCSV()
+		return nil
 	}
+	fmt.Printf("Volume: %s\n", vol)
+	table.Render()
+	sched, err := blockvol.SnapshotScheduleStatus()
+	if err != nil {
+		return fmt.Errorf("couldn't get snapshot schedule for block volume %s: %v", vol, err)
+	}
+	if len(sched) == 0 {
+		return nil
+	}
+	fmt.Println("Schedule:")
+	table = NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Period", "Keep", "Taken", "Last", "Next Due"})
+	for _, x := range sched {
+		last, next := "never", "now"
+		if !x.Last.IsZero() {
+			last = x.Last.Format(time.RFC3339)
+			next = x.Next.Format(time.RFC3339)
+		}
+		table.Append([]string{
+			x.Period,
+			strconv.Itoa(x.Keep),
+			strconv.Itoa(x.Count),
+			last,
+			next,
+		})
+	}
+	table.Render()
 	return nil
 }
 
@@ -191,3 +254,41 @@ func bsnapRestoreAction(cmd *cobra.Command, args []string) error {
 	}
 	return nil
 }
+
+func blockCloneAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return torus.ErrUsage
+	}
+	vol := ParseSnapName(args[0])
+	if vol.Snapshot == "" {
+		return fmt.Errorf("can't clone a volume without a snapshot, please use the form VOLUME@SNAPSHOT_NAME")
+	}
+	srv := createServer()
+	defer srv.Close()
+	blockvol, err := block.OpenBlockVolume(srv, vol.Volume)
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", vol.Volume, err)
+	}
+	err = blockvol.CloneSnapshot(vol.Snapshot, args[1])
+	if err != nil {
+		return fmt.Errorf("couldn't clone snapshot: %v", err)
+	}
+	return nil
+}
+
+func bsnapScheduleAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return torus.ErrUsage
+	}
+	srv := createServer()
+	defer srv.Close()
+	blockvol, err := block.OpenBlockVolume(srv, args[0])
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", args[0], err)
+	}
+	err = blockvol.SetSnapshotSchedule(&schedule)
+	if err != nil {
+		return fmt.Errorf("couldn't set snapshot schedule: %v", err)
+	}
+	return nil
+}
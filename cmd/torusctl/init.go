@@ -20,6 +20,7 @@ var (
 	blockSizeStr string
 	blockSpec    string
 	noMakeRing   bool
+	overcommit   float64
 	metaView     bool
 )
 
@@ -33,6 +34,7 @@ var initCommand = &cobra.Command{
 func init() {
 	initCommand.Flags().StringVarP(&blockSizeStr, "block-size", "", "512KiB", "size of all data blocks in this storage cluster")
 	initCommand.Flags().StringVarP(&blockSpec, "block-spec", "", "crc", "default replication/error correction applied to blocks in this storage cluster")
+	initCommand.Flags().Float64VarP(&overcommit, "overcommit-ratio", "", 0, "how far volume sizes, times their replication, may add up to beyond the cluster's storage, as a multiple of it (0 for no limit)")
 	initCommand.Flags().BoolVar(&noMakeRing, "no-ring", false, "do not create the default ring as part of init")
 	initCommand.Flags().BoolVar(&metaView, "view", false, "view metadata configured in this storage cluster")
 }
@@ -57,6 +59,7 @@ func initAction(cmd *cobra.Command, args []string) {
 	var err error
 	md := torus.GlobalMetadata{}
 	md.BlockSize = blockSize
+	md.OvercommitRatio = overcommit
 	md.DefaultBlockSpec, err = blockset.ParseBlockLayerSpec(blockSpec)
 	if err != nil {
 		die("error parsing block-spec: %v", err)
@@ -78,14 +81,26 @@ func viewMetadata() {
 	md := mds.GlobalMetadata()
 
 	var blockSpecToStrings = []string{
-		blockset.Base:        "base",
-		blockset.CRC:         "crc",
-		blockset.Replication: "rep",
+		blockset.Base:          "base",
+		blockset.CRC:           "crc",
+		blockset.Replication:   "rep",
+		blockset.ErasureCoding: "ec",
+		blockset.Compression:   "compress",
+		blockset.Encryption:    "encrypt",
 	}
 	blockSpec := ""
 	for _, x := range md.DefaultBlockSpec {
-		blockSpec += blockSpecToStrings[x.Kind] + " "
+		blockSpec += blockSpecToStrings[x.Kind]
+		if x.Options != "" {
+			blockSpec += "=" + x.Options
+		}
+		blockSpec += " "
 	}
 	fmt.Printf("Block size: %d byte\n", md.BlockSize)
 	fmt.Printf("Block spec: %s\n", blockSpec)
+	if md.OvercommitRatio > 0 {
+		fmt.Printf("Overcommit ratio: %g\n", md.OvercommitRatio)
+	} else {
+		fmt.Printf("Overcommit ratio: unlimited\n")
+	}
 }
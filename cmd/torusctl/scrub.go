@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus/distributor/scrub"
+)
+
+var scrubCommand = &cobra.Command{
+	Use:   "scrub",
+	Short: "inspect the background block scrubber",
+	Run:   scrubAction,
+}
+
+var scrubStatusCommand = &cobra.Command{
+	Use:   "status [HOST:PORT...]",
+	Short: "show scrub progress of torusd servers, by HTTP address",
+	Run:   scrubStatusAction,
+}
+
+func init() {
+	scrubCommand.AddCommand(scrubStatusCommand)
+	scrubStatusCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
+}
+
+func scrubAction(cmd *cobra.Command, args []string) {
+	cmd.Usage()
+	os.Exit(1)
+}
+
+func scrubStatusAction(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		args = []string{"localhost:4321"}
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Server", "Rate", "Passes", "Pass Started", "Scanned", "Verified", "Unverifiable", "Mismatched", "Repaired", "Unrepaired"})
+	for _, addr := range args {
+		st, err := getScrubStatus(client, addr)
+		if err != nil {
+			die("couldn't get scrub status from %s: %v", addr, err)
+		}
+		if !st.Enabled {
+			table.Append([]string{addr, "disabled", "", "", "", "", "", "", "", ""})
+			continue
+		}
+		started := "never"
+		if !st.PassStarted.IsZero() {
+			started = humanize.Time(st.PassStarted)
+		}
+		table.Append([]string{
+			addr,
+			strconv.Itoa(st.Rate) + "/sec",
+			strconv.FormatUint(st.Passes, 10),
+			started,
+			countPair(st.Pass.Scanned, st.Total.Scanned),
+			countPair(st.Pass.Verified, st.Total.Verified),
+			countPair(st.Pass.Unverifiable, st.Total.Unverifiable),
+			countPair(st.Pass.Mismatched, st.Total.Mismatched),
+			countPair(st.Pass.Repaired, st.Total.Repaired),
+			countPair(st.Pass.Unrepaired, st.Total.Unrepaired),
+		})
+	}
+	if outputAsCSV {
+		table.RenderCSV()
+		return
+	}
+	table.Render()
+	fmt.Println("Counts are given as this pass/all passes.")
+}
+
+func getScrubStatus(client *http.Client, addr string) (*scrub.Status, error) {
+	resp, err := client.Get("http://" + addr + "/scrub")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	var st scrub.Status
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func countPair(pass, total uint64) string {
+	return fmt.Sprintf("%d/%d", pass, total)
+}
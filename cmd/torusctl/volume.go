@@ -1,9 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"time"
 
+	"github.com/coreos/torus"
 	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/blockset"
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 )
@@ -17,7 +21,9 @@ var volumeCommand = &cobra.Command{
 var volumeDeleteCommand = &cobra.Command{
 	Use:   "delete NAME",
 	Short: "delete a volume in the cluster",
-	Run:   volumeDeleteAction,
+	Long: `deletes the volume NAME. It's kept in the trash for the retention period, during which
+it can be brought back with volume undelete; after that, it and its blocks are gone for good.`,
+	Run: volumeDeleteAction,
 }
 
 var volumeListCommand = &cobra.Command{
@@ -37,10 +43,27 @@ func init() {
 	volumeCommand.AddCommand(volumeDeleteCommand)
 	volumeCommand.AddCommand(volumeListCommand)
 	volumeCommand.AddCommand(volumeCreateBlockCommand)
+	volumeDeleteCommand.Flags().DurationVarP(&deleteRetention, "retention", "", block.DefaultTrashRetention, "how long to keep the volume in the trash; 0 deletes it for good straight away")
 	volumeListCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
 	volumeListCommand.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
+	volumeCreateBlockCommand.Flags().BoolVarP(&createEncrypted, "encrypt", "", false, "encrypt the volume's blocks at rest")
+	volumeCreateBlockCommand.Flags().StringVarP(&createSpec, "spec", "", "", "block layer spec for the volume, such as crc,rep=3,base (default the cluster's)")
+	volumeCreateBlockCommand.Flags().IntVarP(&createReplication, "replication", "", 0, "number of storage nodes to keep each of the volume's blocks on (default the ring's)")
+	volumeCreateBlockCommand.Flags().StringVarP(&createOwner, "owner", "", "", "user or tenant the volume belongs to")
+	volumeCreateBlockCommand.Flags().StringSliceVarP(&createLabels, "label", "l", nil, "label the volume with KEY=VALUE (may be repeated)")
+	volumeListCommand.Flags().StringVarP(&listSelector, "selector", "l", "", "only list volumes whose labels match, such as app=db,tier!=test")
+	volumeListCommand.Flags().StringVarP(&listOwner, "owner", "", "", "only list volumes belonging to this owner")
+	volumeListCommand.Flags().BoolVarP(&listShowLabels, "show-labels", "", false, "show the owner and labels of each volume")
 }
 
+var (
+	deleteRetention time.Duration
+
+	listSelector   string
+	listOwner      string
+	listShowLabels bool
+)
+
 func volumeAction(cmd *cobra.Command, args []string) {
 	cmd.Usage()
 	os.Exit(1)
@@ -52,25 +75,64 @@ func volumeListAction(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 	mds := mustConnectToMDS()
+	sel, err := torus.ParseSelector(listSelector)
+	if err != nil {
+		die("%v\n", err)
+	}
 	vols, _, err := mds.GetVolumes()
 	if err != nil {
 		die("error listing volumes: %v\n", err)
 	}
 	table := NewTableWriter(os.Stdout)
-	table.SetHeader([]string{"Volume Name", "Size", "Type", "Status"})
+	header := []string{"Volume Name", "Used", "Provisioned", "Used %", "Type", "Status"}
+	if listShowLabels {
+		header = append(header, "Owner", "Labels")
+	}
+	table.SetHeader(header)
 	for _, x := range vols {
-		table.Append([]string{
+		meta, err := mds.GetVolumeMeta(torus.VolumeID(x.Id))
+		if err != nil {
+			die("error getting labels of volume %s: %v\n", x.Name, err)
+		}
+		if !sel.Matches(meta.Labels) || (listOwner != "" && meta.Owner != listOwner) {
+			continue
+		}
+		used, err := mds.GetVolumeAllocated(torus.VolumeID(x.Id))
+		if err != nil {
+			die("error getting usage of volume %s: %v\n", x.Name, err)
+		}
+		percent := 0.0
+		if x.MaxBytes != 0 {
+			percent = 100 * float64(used) / float64(x.MaxBytes)
+		}
+		row := []string{
 			x.Name,
+			bytesOrIbytes(used, outputAsSI),
 			bytesOrIbytes(x.MaxBytes, outputAsSI),
+			fmt.Sprintf("%.1f%%", percent),
 			x.Type,
 			mds.GetLockStatus(x.Id),
-		})
+		}
+		if listShowLabels {
+			row = append(row, meta.Owner, meta.LabelString())
+		}
+		table.Append(row)
 	}
 	if outputAsCSV {
 		table.RenderCSV()
 		return
 	}
 	table.Render()
+	c, err := block.GetCapacity(mds)
+	if err != nil {
+		die("error getting cluster capacity: %v\n", err)
+	}
+	limit := "no limit"
+	if c.Limit != 0 {
+		limit = "limit " + bytesOrIbytes(c.Limit, outputAsSI)
+	}
+	fmt.Printf("\nProvisioned %s of %s storage (%s), counting replicas and the trash\n",
+		bytesOrIbytes(c.Provisioned, outputAsSI), bytesOrIbytes(c.Storage, outputAsSI), limit)
 }
 
 func volumeDeleteAction(cmd *cobra.Command, args []string) {
@@ -86,13 +148,19 @@ func volumeDeleteAction(cmd *cobra.Command, args []string) {
 	}
 	switch vol.Type {
 	case "block":
-		err = block.DeleteBlockVolume(mds, name)
+		err = block.TrashBlockVolume(mds, name, deleteRetention)
 	default:
 		die("unknown volume type %s", vol.Type)
 	}
+	if err == torus.ErrLocked {
+		die("cannot delete volume %s: it's attached; detach it first", name)
+	}
 	if err != nil {
 		die("cannot delete volume: %v", err)
 	}
+	if deleteRetention > 0 {
+		fmt.Printf("moved %s to the trash until %s\n", name, time.Now().Add(deleteRetention).Format(time.RFC3339))
+	}
 }
 
 func volumeCreateBlockAction(cmd *cobra.Command, args []string) {
@@ -105,7 +173,33 @@ func volumeCreateBlockAction(cmd *cobra.Command, args []string) {
 	if err != nil {
 		die("error parsing size %s: %v", args[1], err)
 	}
-	err = block.CreateBlockVolume(mds, args[0], size)
+	opts := block.VolumeOptions{
+		Replication: createReplication,
+		Encrypt:     createEncrypted,
+	}
+	if createSpec != "" {
+		opts.Spec, err = blockset.ParseBlockLayerSpec(createSpec)
+		if err != nil {
+			die("error parsing block spec %s: %v", createSpec, err)
+		}
+	}
+	if createReplication < 0 {
+		die("replication must be at least 1")
+	}
+	if createOwner != "" || len(createLabels) != 0 {
+		opts.Meta = &torus.VolumeMeta{Owner: createOwner}
+		for _, l := range createLabels {
+			k, v, err := parseLabel(l)
+			if err != nil {
+				die("%v", err)
+			}
+			if opts.Meta.Labels == nil {
+				opts.Meta.Labels = make(map[string]string)
+			}
+			opts.Meta.Labels[k] = v
+		}
+	}
+	err = block.CreateBlockVolumeWithOptions(mds, args[0], size, opts)
 	if err != nil {
 		die("error creating volume %s: %v", args[0], err)
 	}
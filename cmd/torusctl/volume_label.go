@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/spf13/cobra"
+)
+
+var volumeRenameCommand = &cobra.Command{
+	Use:   "rename NAME NEW_NAME",
+	Short: "rename a volume",
+	Long:  "renames the volume NAME to NEW_NAME. The volume can't be attached for writing meanwhile.",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := volumeRenameAction(cmd, args)
+		if err == torus.ErrUsage {
+			cmd.Usage()
+			os.Exit(1)
+		} else if err != nil {
+			die("%v", err)
+		}
+	},
+}
+
+var volumeLabelCommand = &cobra.Command{
+	Use:   "label NAME [KEY=VALUE ...] [KEY- ...]",
+	Short: "show or change the owner and labels of a volume",
+	Long: `sets the label KEY to VALUE on the volume NAME for each KEY=VALUE, and removes the label KEY for each KEY-.
+With neither, nor --owner, shows the volume's owner and labels.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := volumeLabelAction(cmd, args)
+		if err == torus.ErrUsage {
+			cmd.Usage()
+			os.Exit(1)
+		} else if err != nil {
+			die("%v", err)
+		}
+	},
+}
+
+var labelOwner string
+
+func init() {
+	volumeCommand.AddCommand(volumeRenameCommand)
+	volumeCommand.AddCommand(volumeLabelCommand)
+	volumeLabelCommand.Flags().StringVarP(&labelOwner, "owner", "", "", "set the user or tenant the volume belongs to")
+}
+
+func volumeRenameAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return torus.ErrUsage
+	}
+	srv := createServer()
+	defer srv.Close()
+	vol, err := srv.MDS.GetVolume(args[0])
+	if err != nil {
+		return fmt.Errorf("cannot get volume %s (perhaps it doesn't exist): %v", args[0], err)
+	}
+	switch vol.Type {
+	case block.VolumeType:
+		var blockvol *block.BlockVolume
+		blockvol, err = block.OpenBlockVolume(srv, args[0])
+		if err == nil {
+			err = blockvol.Rename(args[1])
+		}
+	default:
+		return fmt.Errorf("unknown volume type %s", vol.Type)
+	}
+	switch err {
+	case nil:
+		return nil
+	case torus.ErrLocked:
+		return fmt.Errorf("volume %s is attached; detach it first", args[0])
+	case torus.ErrExists:
+		return fmt.Errorf("there's already a volume named %s", args[1])
+	default:
+		return fmt.Errorf("couldn't rename volume %s: %v", args[0], err)
+	}
+}
+
+func volumeLabelAction(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return torus.ErrUsage
+	}
+	mds := mustConnectToMDS()
+	vol, err := mds.GetVolume(args[0])
+	if err != nil {
+		return fmt.Errorf("cannot get volume %s (perhaps it doesn't exist): %v", args[0], err)
+	}
+	vid := torus.VolumeID(vol.Id)
+	meta, err := mds.GetVolumeMeta(vid)
+	if err != nil {
+		return fmt.Errorf("couldn't get labels of volume %s: %v", args[0], err)
+	}
+	if len(args) == 1 && !cmd.Flags().Changed("owner") {
+		fmt.Printf("Owner: %s\n", meta.Owner)
+		fmt.Printf("Labels: %s\n", meta.LabelString())
+		return nil
+	}
+	if cmd.Flags().Changed("owner") {
+		meta.Owner = labelOwner
+	}
+	for _, arg := range args[1:] {
+		if strings.HasSuffix(arg, "-") && !strings.Contains(arg, "=") {
+			delete(meta.Labels, strings.TrimSuffix(arg, "-"))
+			continue
+		}
+		k, v, err := parseLabel(arg)
+		if err != nil {
+			return err
+		}
+		if meta.Labels == nil {
+			meta.Labels = make(map[string]string)
+		}
+		meta.Labels[k] = v
+	}
+	err = mds.SetVolumeMeta(vid, meta)
+	if err != nil {
+		return fmt.Errorf("couldn't set labels of volume %s: %v", args[0], err)
+	}
+	return nil
+}
+
+func parseLabel(s string) (string, string, error) {
+	p := strings.SplitN(s, "=", 2)
+	if len(p) != 2 {
+		return "", "", fmt.Errorf("bad label %q, please use the form KEY=VALUE", s)
+	}
+	if err := torus.ValidateLabel(p[0], p[1]); err != nil {
+		return "", "", err
+	}
+	return p[0], p[1], nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/torus"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var volumeQoSCommand = &cobra.Command{
+	Use:   "qos NAME",
+	Short: "show or set the I/O limits of a volume",
+	Long: `shows the I/O limits of the volume NAME, or sets them if any flags are given.
+A limit of 0 lifts it. Attached volumes pick up new limits when they are next attached;
+storage nodes pick them up within a minute.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := volumeQoSAction(cmd, args)
+		if err == torus.ErrUsage {
+			cmd.Usage()
+			os.Exit(1)
+		} else if err != nil {
+			die("%v", err)
+		}
+	},
+}
+
+var (
+	qosIOPS      uint64
+	qosBurstIOPS uint64
+	qosBandwidth string
+	qosBurst     string
+)
+
+func init() {
+	volumeCommand.AddCommand(volumeQoSCommand)
+	volumeQoSCommand.Flags().Uint64VarP(&qosIOPS, "iops", "", 0, "most reads and writes per second")
+	volumeQoSCommand.Flags().StringVarP(&qosBandwidth, "bandwidth", "", "0", "most bytes read and written per second (G,GiB,M,MiB,etc suffixes accepted)")
+	volumeQoSCommand.Flags().Uint64VarP(&qosBurstIOPS, "burst-iops", "", 0, "reads and writes that may run ahead of --iops after a quiet spell (default one second's worth)")
+	volumeQoSCommand.Flags().StringVarP(&qosBurst, "burst", "", "0", "bytes that may run ahead of --bandwidth after a quiet spell (default one second's worth)")
+}
+
+func volumeQoSAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return torus.ErrUsage
+	}
+	mds := mustConnectToMDS()
+	vol, err := mds.GetVolume(args[0])
+	if err != nil {
+		return fmt.Errorf("cannot get volume %s (perhaps it doesn't exist): %v", args[0], err)
+	}
+	vid := torus.VolumeID(vol.Id)
+	q, err := mds.GetVolumeQoS(vid)
+	if err != nil {
+		return fmt.Errorf("couldn't get QoS limits of volume %s: %v", args[0], err)
+	}
+	if q == nil {
+		q = &torus.VolumeQoS{}
+	}
+	flags := cmd.Flags()
+	if !flags.Changed("iops") && !flags.Changed("bandwidth") && !flags.Changed("burst-iops") && !flags.Changed("burst") {
+		printQoS(q)
+		return nil
+	}
+	if flags.Changed("iops") {
+		q.IOPS = qosIOPS
+	}
+	if flags.Changed("burst-iops") {
+		q.BurstIOPS = qosBurstIOPS
+	}
+	if flags.Changed("bandwidth") {
+		q.BytesPerSec, err = humanize.ParseBytes(qosBandwidth)
+		if err != nil {
+			return fmt.Errorf("error parsing bandwidth %s: %v", qosBandwidth, err)
+		}
+	}
+	if flags.Changed("burst") {
+		q.BurstBytes, err = humanize.ParseBytes(qosBurst)
+		if err != nil {
+			return fmt.Errorf("error parsing burst %s: %v", qosBurst, err)
+		}
+	}
+	if q.Unlimited() {
+		q = nil
+	}
+	err = mds.SetVolumeQoS(vid, q)
+	if err != nil {
+		return fmt.Errorf("couldn't set QoS limits of volume %s: %v", args[0], err)
+	}
+	return nil
+}
+
+func printQoS(q *torus.VolumeQoS) {
+	if q.Unlimited() {
+		fmt.Println("no limits")
+		return
+	}
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Limit", "Rate", "Burst"})
+	if q.IOPS != 0 {
+		burst := q.BurstIOPS
+		if burst == 0 {
+			burst = q.IOPS
+		}
+		table.Append([]string{"IOPS", fmt.Sprint(q.IOPS), fmt.Sprint(burst)})
+	}
+	if q.BytesPerSec != 0 {
+		burst := q.BurstBytes
+		if burst == 0 {
+			burst = q.BytesPerSec
+		}
+		table.Append([]string{"Bandwidth", humanize.IBytes(q.BytesPerSec) + "/s", humanize.IBytes(burst)})
+	}
+	table.Render()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/spf13/cobra"
+)
+
+var volumeTrashCommand = &cobra.Command{
+	Use:   "trash",
+	Short: "list deleted volumes that can still be brought back",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := volumeTrashAction(cmd, args)
+		if err == torus.ErrUsage {
+			cmd.Usage()
+			os.Exit(1)
+		} else if err != nil {
+			die("%v", err)
+		}
+	},
+}
+
+var volumeUndeleteCommand = &cobra.Command{
+	Use:   "undelete NAME",
+	Short: "bring a deleted volume back from the trash",
+	Long: `brings the volume NAME back from the trash, with its data, snapshots and settings as they were
+when it was deleted. If several volumes named NAME have been deleted, the latest is brought back,
+unless --id picks another.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := volumeUndeleteAction(cmd, args)
+		if err == torus.ErrUsage {
+			cmd.Usage()
+			os.Exit(1)
+		} else if err != nil {
+			die("%v", err)
+		}
+	},
+}
+
+var (
+	undeleteAs string
+	undeleteID uint64
+)
+
+func init() {
+	volumeCommand.AddCommand(volumeTrashCommand)
+	volumeCommand.AddCommand(volumeUndeleteCommand)
+	volumeTrashCommand.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
+	volumeUndeleteCommand.Flags().StringVarP(&undeleteAs, "as", "", "", "name to bring the volume back as (default NAME)")
+	volumeUndeleteCommand.Flags().Uint64VarP(&undeleteID, "id", "", 0, "ID of the deleted volume to bring back, as shown by volume trash")
+}
+
+type trashByDeleted []torus.TrashedVolume
+
+func (t trashByDeleted) Len() int           { return len(t) }
+func (t trashByDeleted) Less(i, j int) bool { return t[i].DeletedAt.Before(t[j].DeletedAt) }
+func (t trashByDeleted) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// getTrash returns the volumes in the trash that haven't expired, oldest
+// deletion first.
+func getTrash(mds torus.MetadataService) ([]torus.TrashedVolume, error) {
+	trash, err := mds.GetTrash()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get trash: %v", err)
+	}
+	now := time.Now()
+	var out []torus.TrashedVolume
+	for _, x := range trash {
+		if !x.Expired(now) {
+			out = append(out, x)
+		}
+	}
+	sort.Sort(trashByDeleted(out))
+	return out, nil
+}
+
+func volumeTrashAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return torus.ErrUsage
+	}
+	mds := mustConnectToMDS()
+	trash, err := getTrash(mds)
+	if err != nil {
+		return err
+	}
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Volume Name", "ID", "Size", "Type", "Deleted", "Expires"})
+	for _, x := range trash {
+		table.Append([]string{
+			x.Volume.Name,
+			fmt.Sprint(x.Volume.Id),
+			bytesOrIbytes(x.Volume.MaxBytes, outputAsSI),
+			x.Volume.Type,
+			x.DeletedAt.Format(time.RFC3339),
+			x.ExpiresAt.Format(time.RFC3339),
+		})
+	}
+	table.Render()
+	return nil
+}
+
+func volumeUndeleteAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return torus.ErrUsage
+	}
+	name := args[0]
+	newName := undeleteAs
+	if newName == "" {
+		newName = name
+	}
+	mds := mustConnectToMDS()
+	trash, err := getTrash(mds)
+	if err != nil {
+		return err
+	}
+	var found *torus.TrashedVolume
+	for i, x := range trash {
+		if x.Volume.Name != name || (undeleteID != 0 && x.Volume.Id != undeleteID) {
+			continue
+		}
+		// The trash is in order of deletion, so the last match is the
+		// latest.
+		found = &trash[i]
+	}
+	if found == nil {
+		return fmt.Errorf("no volume named %s in the trash", name)
+	}
+	switch found.Volume.Type {
+	case "block":
+		err = block.UndeleteBlockVolume(mds, torus.VolumeID(found.Volume.Id), newName)
+	default:
+		return fmt.Errorf("unknown volume type %s", found.Volume.Type)
+	}
+	if err == torus.ErrExists {
+		return fmt.Errorf("volume %s already exists; use --as to bring it back under another name", newName)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't undelete volume %s: %v", name, err)
+	}
+	fmt.Printf("brought back %s as %s\n", name, newName)
+	return nil
+}
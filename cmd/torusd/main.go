@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coreos/pkg/capnslog"
 	"github.com/dustin/go-humanize"
@@ -16,6 +17,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
 	"github.com/coreos/torus/blockset"
 	"github.com/coreos/torus/distributor"
 	"github.com/coreos/torus/internal/flagconfig"
@@ -24,7 +26,6 @@ import (
 	"github.com/coreos/torus/ring"
 
 	// Register all the possible drivers.
-	_ "github.com/coreos/torus/block"
 	_ "github.com/coreos/torus/metadata/etcd"
 	_ "github.com/coreos/torus/metadata/temp"
 	_ "github.com/coreos/torus/storage"
@@ -40,6 +41,13 @@ var (
 	debugInit   bool
 	autojoin    bool
 	logpkg      string
+	storageKind string
+	devicePath  string
+	disks       []string
+	scrubRate   int
+	scrubIntvl  time.Duration
+	snapSched   bool
+	trashPurge  bool
 	cfg         torus.Config
 
 	debug      bool
@@ -63,8 +71,15 @@ func init() {
 	rootCommand.PersistentFlags().IntVarP(&port, "port", "", 4321, "Port to listen on for HTTP")
 	rootCommand.PersistentFlags().StringVarP(&peerAddress, "peer-address", "", "", "Address to listen on for intra-cluster data")
 	rootCommand.PersistentFlags().StringVarP(&sizeStr, "size", "", "1GiB", "How much disk space to use for this storage node")
+	rootCommand.PersistentFlags().StringVarP(&storageKind, "storage", "", "mfile", "Kind of local block storage to use (mfile, dedup, raw or multi)")
+	rootCommand.PersistentFlags().StringVarP(&devicePath, "device", "", "", "Block device (or image file) to use for raw storage")
+	rootCommand.PersistentFlags().StringSliceVarP(&disks, "disk", "", nil, "Directory of a disk to use for multi-disk storage, as PATH[:SIZE]; may be repeated")
 	rootCommand.PersistentFlags().StringVarP(&logpkg, "logpkg", "", "", "Specific package logging")
 	rootCommand.PersistentFlags().BoolVarP(&autojoin, "auto-join", "", false, "Automatically join the storage pool")
+	rootCommand.PersistentFlags().IntVarP(&scrubRate, "scrub-rate", "", 0, "Blocks per second to verify in the background scrubber (0 disables scrubbing)")
+	rootCommand.PersistentFlags().DurationVarP(&scrubIntvl, "scrub-interval", "", 24*time.Hour, "Time to wait between scrub passes")
+	rootCommand.PersistentFlags().BoolVarP(&snapSched, "snapshot-scheduler", "", true, "Take part in running the block volumes' snapshot schedules")
+	rootCommand.PersistentFlags().BoolVarP(&trashPurge, "trash-purger", "", true, "Take part in purging expired volumes from the trash")
 	rootCommand.PersistentFlags().BoolVarP(&version, "version", "", false, "Print version info and exit")
 	rootCommand.PersistentFlags().BoolVarP(&completion, "completion", "", false, "Output bash completion code")
 	flagconfig.AddConfigFlags(rootCommand.PersistentFlags())
@@ -103,29 +118,70 @@ func configureServer(cmd *cobra.Command, args []string) {
 		httpAddress = fmt.Sprintf("%s:%d", host, port)
 	}
 
-	var (
-		err  error
-		size uint64
-	)
-	if strings.Contains(sizeStr, "%") {
-		percent, err := parsePercentage(sizeStr)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error parsing size %s: %s\n", sizeStr, err)
+	size, err := parseSize(sizeStr, dataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error parsing size %s: %s\n", sizeStr, err)
+		os.Exit(1)
+	}
+
+	if devicePath != "" && !cmd.Flags().Changed("storage") {
+		storageKind = "raw"
+	}
+	if storageKind == "raw" {
+		if devicePath == "" {
+			fmt.Fprintf(os.Stderr, "raw storage needs a --device\n")
 			os.Exit(1)
 		}
-		directory, _ := filepath.Abs(dataDir)
-		size = du.NewDiskUsage(directory).Size() * percent / 100
-	} else {
-		size, err = humanize.ParseBytes(sizeStr)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error parsing size %s: %s\n", sizeStr, err)
+		if !cmd.Flags().Changed("size") {
+			// Use the whole device.
+			size = 0
+		}
+	}
+
+	if len(disks) != 0 && !cmd.Flags().Changed("storage") {
+		storageKind = "multi"
+	}
+	var diskCfgs []torus.DiskConfig
+	if storageKind == "multi" {
+		if len(disks) == 0 {
+			fmt.Fprintf(os.Stderr, "multi storage needs at least one --disk\n")
 			os.Exit(1)
 		}
+		for _, disk := range disks {
+			// Each disk gets --size of space, unless it says otherwise.
+			path, diskSize := disk, sizeStr
+			if i := strings.LastIndex(disk, ":"); i != -1 {
+				path, diskSize = disk[:i], disk[i+1:]
+			}
+			size, err := parseSize(diskSize, path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error parsing size %s of disk %s: %s\n", diskSize, path, err)
+				os.Exit(1)
+			}
+			diskCfgs = append(diskCfgs, torus.DiskConfig{Path: path, Size: size})
+		}
 	}
 
 	cfg = flagconfig.BuildConfigFromFlags()
 	cfg.DataDir = dataDir
+	cfg.DevicePath = devicePath
+	cfg.Disks = diskCfgs
 	cfg.StorageSize = size
+	cfg.ScrubRate = scrubRate
+	cfg.ScrubInterval = scrubIntvl
+}
+
+// parseSize parses a size, which may be a percentage of the disk holding dir.
+func parseSize(sizeStr string, dir string) (uint64, error) {
+	if !strings.Contains(sizeStr, "%") {
+		return humanize.ParseBytes(sizeStr)
+	}
+	percent, err := parsePercentage(sizeStr)
+	if err != nil {
+		return 0, err
+	}
+	directory, _ := filepath.Abs(dir)
+	return du.NewDiskUsage(directory).Size() * percent / 100, nil
 }
 
 func parsePercentage(percentString string) (uint64, error) {
@@ -152,7 +208,7 @@ func runServer(cmd *cobra.Command, args []string) {
 	)
 	switch {
 	case cfg.MetadataAddress == "":
-		srv, err = torus.NewServer(cfg, "temp", "mfile")
+		srv, err = torus.NewServer(cfg, "temp", storageKind)
 	case debugInit:
 		err = torus.InitMDS("etcd", cfg, torus.GlobalMetadata{
 			BlockSize:        512 * 1024,
@@ -168,7 +224,7 @@ func runServer(cmd *cobra.Command, args []string) {
 		}
 		fallthrough
 	default:
-		srv, err = torus.NewServer(cfg, "etcd", "mfile")
+		srv, err = torus.NewServer(cfg, "etcd", storageKind)
 	}
 	if err != nil {
 		fmt.Printf("Couldn't start: %s\n", err)
@@ -219,6 +275,14 @@ func runServer(cmd *cobra.Command, args []string) {
 		fmt.Println("couldn't use server:", err)
 		os.Exit(1)
 	}
+	if snapSched {
+		sched := block.StartSnapshotScheduler(srv, time.Minute)
+		defer sched.Close()
+	}
+	if trashPurge {
+		purger := block.StartTrashPurger(srv, time.Minute)
+		defer purger.Close()
+	}
 	if httpAddress != "" {
 		http.ServeHTTP(httpAddress, srv)
 	}
@@ -1,14 +1,51 @@
 package torus
 
-import "crypto/tls"
+import (
+	"crypto/tls"
+	"time"
+)
 
 type Config struct {
-	DataDir         string
+	DataDir string
+	// DevicePath is the block device (or image file) used by the raw
+	// block store.
+	DevicePath string
+	// Disks are the disks used by the multi-disk block store.
+	Disks           []DiskConfig
 	StorageSize     uint64
 	MetadataAddress string
 	ReadCacheSize   uint64
 	ReadLevel       ReadLevel
 	WriteLevel      WriteLevel
+	// WriteQuorum and ReadQuorum are how many replicas of a block must
+	// take a write, or agree on a read, at the quorum levels. Zero means a
+	// majority, and more than a block has means all of them.
+	WriteQuorum int
+	ReadQuorum  int
+	// WriteBatch is the most blocks sent to a peer in one RPC at WriteAll.
+	// If it's set, writes to peers are queued and sent in batches, and
+	// Flush waits for them; if it's zero, each block is written before
+	// WriteBlock returns.
+	WriteBatch int
+	// WriteWindow is how many batches may be in flight to each peer at
+	// once, each on its own connection. Zero means 4.
+	WriteWindow int
+	// Readahead is how many blocks a File fetches ahead of reads once it
+	// sees them going through it in order. Zero turns readahead off.
+	Readahead int
+	// ScrubRate is the number of blocks per second the scrubber verifies.
+	// Zero disables scrubbing.
+	ScrubRate int
+	// ScrubInterval is how long the scrubber rests between passes.
+	ScrubInterval time.Duration
 
 	TLS *tls.Config
 }
+
+// DiskConfig is one disk of the multi-disk block store.
+type DiskConfig struct {
+	// Path is the directory the disk is mounted at.
+	Path string
+	// Size is how much of the disk to use, in bytes.
+	Size uint64
+}
@@ -0,0 +1,263 @@
+package distributor
+
+import (
+	"github.com/coreos/torus"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultWriteWindow is how many batches may be in flight to each
+	// peer at once, unless Config.WriteWindow says otherwise.
+	defaultWriteWindow = 4
+	// maxWriteBatch is the most blocks any protocol carries in one
+	// request.
+	maxWriteBatch = 255
+)
+
+// A pendingBlock is a block written in batches, which is in flight until
+// each of its peers has answered. Its fields are guarded by d.batchMut.
+type pendingBlock struct {
+	data []byte
+	left int
+	acks int
+	// spares are the peers after its replicas, which take the block in
+	// turn when writing it to a replica fails.
+	spares []string
+}
+
+type batchedWrite struct {
+	ref torus.BlockRef
+	blk *pendingBlock
+}
+
+// A peerWriter sends the blocks queued for one peer in batches, with a
+// bounded number of batches in flight. window holds the free slots, each of
+// which sends on its own connection to the peer.
+type peerWriter struct {
+	d      *Distributor
+	peer   string
+	queue  chan batchedWrite
+	window chan int
+}
+
+// writeBatched writes a block to its replicas without waiting for the remote
+// ones, which are queued to be sent in batches. Flush waits for them, and
+// returns an error if any block couldn't be written to any replica.
+func (d *Distributor) writeBatched(ctx context.Context, i torus.BlockRef, data []byte, peers torus.PeerPermutation) error {
+	// The caller may reuse data as soon as we return.
+	blk := &pendingBlock{
+		data:   append([]byte(nil), data...),
+		spares: peers.Peers[peers.Replication:],
+	}
+	var remote []string
+	for _, p := range peers.Peers[:peers.Replication] {
+		if p != d.UUID() {
+			remote = append(remote, p)
+			continue
+		}
+		err := d.blocks.WriteBlock(ctx, i, blk.data)
+		if err != nil {
+			clog.Noticef("error WriteAll to local peer: %s", err)
+			if !d.writeSpare(ctx, i, blk) {
+				continue
+			}
+		}
+		blk.acks++
+	}
+	if len(remote) == 0 {
+		if blk.acks == 0 {
+			return torus.ErrNoPeer
+		}
+		return nil
+	}
+	blk.left = len(remote)
+	d.batchMut.Lock()
+	d.inflight[i] = blk
+	d.batchPending++
+	var writers []*peerWriter
+	for _, p := range remote {
+		writers = append(writers, d.peerWriter(p))
+	}
+	d.batchMut.Unlock()
+	promDistBatchInflight.Inc()
+	for _, w := range writers {
+		// The batches are sent without ctx, so the block is held to its
+		// volume's QoS limits here instead. It's written anyway if ctx is
+		// done meanwhile, having been written locally already.
+		if err := d.throttle(ctx, i.Volume(), len(blk.data)); err != nil {
+			clog.Debugf("gave up throttling block %s to peer %s: %s", i, w.peer, err)
+		}
+		// This blocks while the peer's queue is full.
+		w.queue <- batchedWrite{ref: i, blk: blk}
+	}
+	return nil
+}
+
+// peerWriter returns the writer for peer, starting it if need be. The caller
+// must hold d.batchMut.
+func (d *Distributor) peerWriter(peer string) *peerWriter {
+	w, ok := d.writers[peer]
+	if ok {
+		return w
+	}
+	window := d.srv.Cfg.WriteWindow
+	if window <= 0 {
+		window = defaultWriteWindow
+	}
+	w = &peerWriter{
+		d:      d,
+		peer:   peer,
+		queue:  make(chan batchedWrite, window*d.srv.Cfg.WriteBatch),
+		window: make(chan int, window),
+	}
+	for slot := 1; slot <= window; slot++ {
+		w.window <- slot
+	}
+	d.writers[peer] = w
+	go w.run(d.batchChan)
+	return w
+}
+
+// inflightBlock returns the data of a block that's still being written in
+// batches, or nil.
+func (d *Distributor) inflightBlock(i torus.BlockRef) []byte {
+	d.batchMut.Lock()
+	defer d.batchMut.Unlock()
+	if blk, ok := d.inflight[i]; ok {
+		return blk.data
+	}
+	return nil
+}
+
+// waitBatches waits until no blocks are being written in batches, and returns
+// an error if any written since it was last called couldn't be written to
+// any replica.
+func (d *Distributor) waitBatches() error {
+	d.batchMut.Lock()
+	defer d.batchMut.Unlock()
+	for d.batchPending != 0 {
+		d.batchCond.Wait()
+	}
+	err := d.batchErr
+	d.batchErr = nil
+	return err
+}
+
+func (w *peerWriter) run(closer chan struct{}) {
+	max := w.d.srv.Cfg.WriteBatch
+	if max > maxWriteBatch {
+		max = maxWriteBatch
+	}
+	for {
+		// Take a slot first, so that writes queued while the window is
+		// full are coalesced into the next batch.
+		var slot int
+		select {
+		case <-closer:
+			return
+		case slot = <-w.window:
+		}
+		var first batchedWrite
+		select {
+		case <-closer:
+			return
+		case first = <-w.queue:
+		}
+		batch := []batchedWrite{first}
+	drain:
+		for len(batch) < max {
+			select {
+			case x := <-w.queue:
+				batch = append(batch, x)
+			default:
+				break drain
+			}
+		}
+		go w.send(slot, batch)
+	}
+}
+
+func (w *peerWriter) send(slot int, batch []batchedWrite) {
+	defer func() { w.window <- slot }()
+	refs := make([]torus.BlockRef, len(batch))
+	data := make([][]byte, len(batch))
+	for i, x := range batch {
+		refs[i] = x.ref
+		data[i] = x.blk.data
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), writeClientTimeout)
+	err := w.d.client.PutBlocks(ctx, w.peer, slot, refs, data)
+	cancel()
+	promDistWriteBatches.Inc()
+	promDistBatchedBlocks.Add(float64(len(batch)))
+	acked := make([]bool, len(batch))
+	for i, x := range batch {
+		if err == nil {
+			acked[i] = true
+			continue
+		}
+		w.d.hintFailedWrite(w.peer, x.ref, data[i], err)
+		ctx, cancel := context.WithTimeout(context.TODO(), writeClientTimeout)
+		acked[i] = w.d.writeSpare(ctx, x.ref, x.blk)
+		cancel()
+	}
+	if err != nil {
+		clog.Noticef("error writing batch of %d blocks to peer %s: %s", len(batch), w.peer, err)
+	}
+	w.d.finishBatch(batch, acked)
+}
+
+// writeSpare writes a block that couldn't be written to one of its replicas
+// to the next of its spare peers that takes it, as WriteAll does when it
+// isn't batching. It returns whether one did.
+func (d *Distributor) writeSpare(ctx context.Context, i torus.BlockRef, blk *pendingBlock) bool {
+	for {
+		d.batchMut.Lock()
+		if len(blk.spares) == 0 {
+			d.batchMut.Unlock()
+			return false
+		}
+		p := blk.spares[0]
+		blk.spares = blk.spares[1:]
+		d.batchMut.Unlock()
+		var err error
+		if p == d.UUID() {
+			err = d.blocks.WriteBlock(ctx, i, blk.data)
+		} else {
+			err = d.client.PutBlock(ctx, p, i, blk.data)
+		}
+		if err == nil {
+			return true
+		}
+		clog.Noticef("error WriteAll to spare peer %s: %s", p, err)
+	}
+}
+
+// finishBatch counts the blocks of a batch as written to the peer it was
+// sent to, or to a spare in its stead, where acked says so.
+func (d *Distributor) finishBatch(batch []batchedWrite, acked []bool) {
+	d.batchMut.Lock()
+	defer d.batchMut.Unlock()
+	for i, x := range batch {
+		blk := x.blk
+		blk.left--
+		if acked[i] {
+			blk.acks++
+		}
+		if blk.left != 0 {
+			continue
+		}
+		if d.inflight[x.ref] == blk {
+			delete(d.inflight, x.ref)
+		}
+		if blk.acks == 0 {
+			clog.Errorf("couldn't write block %s to any of its peers", x.ref)
+			d.batchErr = torus.ErrNoPeer
+		}
+		d.batchPending--
+		promDistBatchInflight.Dec()
+	}
+	if d.batchPending == 0 {
+		d.batchCond.Broadcast()
+	}
+}
@@ -22,15 +22,23 @@ const (
 type distClient struct {
 	dist *Distributor
 	//TODO(barakmich): Better connection pooling
-	openConns map[string]protocols.RPC
+	openConns map[connKey]protocols.RPC
 	mut       sync.Mutex
 }
 
+// connKey picks one of the connections to a peer. Slot 0 is the one shared by
+// everything but batched writes, which each window slot sends on its own so
+// that they're in flight at once.
+type connKey struct {
+	peer string
+	slot int
+}
+
 func newDistClient(d *Distributor) *distClient {
 
 	client := &distClient{
 		dist:      d,
-		openConns: make(map[string]protocols.RPC),
+		openConns: make(map[connKey]protocols.RPC),
 	}
 	d.srv.AddTimeoutCallback(client.onPeerTimeout)
 	return client
@@ -39,30 +47,35 @@ func newDistClient(d *Distributor) *distClient {
 func (d *distClient) onPeerTimeout(uuid string) {
 	d.mut.Lock()
 	defer d.mut.Unlock()
-	conn, ok := d.openConns[uuid]
-	if !ok {
-		return
-	}
-	err := conn.Close()
-	if err != nil {
-		clog.Errorf("peer timeout err on close: %s", err)
+	for k, conn := range d.openConns {
+		if k.peer != uuid {
+			continue
+		}
+		err := conn.Close()
+		if err != nil {
+			clog.Errorf("peer timeout err on close: %s", err)
+		}
+		delete(d.openConns, k)
 	}
-	delete(d.openConns, uuid)
-
 }
+
 func (d *distClient) getConn(uuid string) protocols.RPC {
+	return d.getSlotConn(connKey{uuid, 0})
+}
+
+func (d *distClient) getSlotConn(k connKey) protocols.RPC {
 	d.mut.Lock()
-	if conn, ok := d.openConns[uuid]; ok {
+	if conn, ok := d.openConns[k]; ok {
 		d.mut.Unlock()
 		return conn
 	}
 	d.mut.Unlock()
 	pm := d.dist.srv.GetPeerMap()
-	pi := pm[uuid]
+	pi := pm[k.peer]
 	if pi == nil {
 		// We know this UUID exists, we don't have an address for it, let's refresh now.
 		pm := d.dist.srv.UpdatePeerMap()
-		pi = pm[uuid]
+		pi = pm[k.peer]
 		if pi == nil {
 			// Not much more we can try
 			return nil
@@ -84,18 +97,22 @@ func (d *distClient) getConn(uuid string) protocols.RPC {
 		clog.Errorf("couldn't dial: %v", err)
 		return nil
 	}
-	d.openConns[uuid] = conn
+	d.openConns[k] = conn
 	return conn
 }
 
 func (d *distClient) resetConn(uuid string) {
+	d.resetSlotConn(connKey{uuid, 0})
+}
+
+func (d *distClient) resetSlotConn(k connKey) {
 	d.mut.Lock()
 	defer d.mut.Unlock()
-	conn, ok := d.openConns[uuid]
+	conn, ok := d.openConns[k]
 	if !ok {
 		return
 	}
-	delete(d.openConns, uuid)
+	delete(d.openConns, k)
 	err := conn.Close()
 	if err != nil {
 		clog.Errorf("error resetConn: %s", err)
@@ -115,6 +132,10 @@ func (d *distClient) Close() error {
 }
 
 func (d *distClient) GetBlock(ctx context.Context, uuid string, b torus.BlockRef) ([]byte, error) {
+	gmd := d.dist.srv.MDS.GlobalMetadata()
+	if err := d.dist.throttle(ctx, b.Volume(), int(gmd.BlockSize)); err != nil {
+		return nil, err
+	}
 	conn := d.getConn(uuid)
 	if conn == nil {
 		return nil, torus.ErrNoPeer
@@ -129,6 +150,9 @@ func (d *distClient) GetBlock(ctx context.Context, uuid string, b torus.BlockRef
 }
 
 func (d *distClient) PutBlock(ctx context.Context, uuid string, b torus.BlockRef, data []byte) error {
+	if err := d.dist.throttle(ctx, b.Volume(), len(data)); err != nil {
+		return err
+	}
 	conn := d.getConn(uuid)
 	if conn == nil {
 		return torus.ErrNoPeer
@@ -136,11 +160,36 @@ func (d *distClient) PutBlock(ctx context.Context, uuid string, b torus.BlockRef
 	err := conn.PutBlock(ctx, b, data)
 	if err != nil {
 		d.resetConn(uuid)
-		if err == context.DeadlineExceeded {
-			return torus.ErrBlockUnavailable
-		}
+		return putError(err)
+	}
+	return nil
+}
+
+// PutBlocks writes several blocks to a peer in one RPC, on the connection
+// for slot, which is only used by one batch at a time.
+func (d *distClient) PutBlocks(ctx context.Context, uuid string, slot int, refs []torus.BlockRef, data [][]byte) error {
+	k := connKey{uuid, slot}
+	conn := d.getSlotConn(k)
+	if conn == nil {
+		return torus.ErrNoPeer
+	}
+	err := conn.PutBlocks(ctx, refs, data)
+	if err != nil {
+		d.resetSlotConn(k)
+		return putError(err)
 	}
-	return err
+	return nil
+}
+
+// putError returns ErrBlockUnavailable for a write that failed on the way to
+// or from the peer, such as by timing out or losing the connection, as
+// opposed to one the peer itself refused, so that it's hinted.
+func putError(err error) error {
+	if err == protocols.ErrServer || err == torus.ErrInvalid {
+		return err
+	}
+	clog.Debug(err)
+	return torus.ErrBlockUnavailable
 }
 
 func (d *distClient) Check(ctx context.Context, uuid string, blks []torus.BlockRef) ([]bool, error) {
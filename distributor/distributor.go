@@ -5,12 +5,14 @@ package distributor
 
 import (
 	"net/url"
+	"path/filepath"
 	"sync"
 
 	"github.com/coreos/pkg/capnslog"
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/distributor/protocols"
 	"github.com/coreos/torus/distributor/rebalance"
+	"github.com/coreos/torus/distributor/scrub"
 	"github.com/coreos/torus/gc"
 )
 
@@ -32,13 +34,48 @@ type Distributor struct {
 	ringWatcherChan chan struct{}
 	rebalancer      rebalance.Rebalancer
 	rebalancing     bool
+	scrubberChan    chan struct{}
+	scrubber        scrub.Scrubber
+	qosChan         chan struct{}
+	repairChan      chan struct{}
+	repairQueue     chan readRepair
+	hintChan        chan struct{}
+	hints           *hintStore
+	batchChan       chan struct{}
+
+	// batchMut guards the writes in flight in batches.
+	batchMut     sync.Mutex
+	batchCond    *sync.Cond
+	batchPending int
+	batchErr     error
+	writers      map[string]*peerWriter
+	inflight     map[torus.BlockRef]*pendingBlock
+
+	throttleMut sync.RWMutex
+	throttles   map[torus.VolumeID]*volumeThrottle
+
+	repMut      sync.RWMutex
+	replication map[torus.VolumeID]int
 }
 
 func newDistributor(srv *torus.Server, addr *url.URL) (*Distributor, error) {
 	var err error
 	d := &Distributor{
-		blocks: srv.Blocks,
-		srv:    srv,
+		blocks:      srv.Blocks,
+		srv:         srv,
+		replication: make(map[torus.VolumeID]int),
+		batchChan:   make(chan struct{}),
+		writers:     make(map[string]*peerWriter),
+		inflight:    make(map[torus.BlockRef]*pendingBlock),
+	}
+	d.batchCond = sync.NewCond(&d.batchMut)
+	hintDir := ""
+	if srv.Cfg.DataDir != "" {
+		hintDir = filepath.Join(srv.Cfg.DataDir, "hints")
+	}
+	d.hints, err = newHintStore(hintDir)
+	if err != nil {
+		return nil, err
 	}
 	gmd := d.srv.MDS.GlobalMetadata()
 	if addr != nil {
@@ -63,10 +100,23 @@ func newDistributor(srv *torus.Server, addr *url.URL) (*Distributor, error) {
 	d.ringWatcherChan = make(chan struct{})
 	go d.ringWatcher(d.rebalancerChan)
 	d.client = newDistClient(d)
-	g := gc.NewGCController(d.srv, torus.NewINodeStore(d))
+	inodes := torus.NewINodeStore(d)
+	g := gc.NewGCController(d.srv, inodes)
 	d.rebalancer = rebalance.NewRebalancer(d, d.blocks, d.client, g)
 	d.rebalancerChan = make(chan struct{})
 	go d.rebalanceTicker(d.rebalancerChan)
+	if srv.Cfg.ScrubRate > 0 {
+		d.scrubber = scrub.NewScrubber(d, d.blocks, inodes, scrubVolumes{d.srv, g.(gc.INodeLister)}, d.client)
+		d.scrubberChan = make(chan struct{})
+		go d.scrubTicker(d.scrubberChan)
+	}
+	d.hintChan = make(chan struct{})
+	go d.hintTicker(d.hintChan)
+	d.repairQueue = make(chan readRepair, readRepairQueueSize)
+	d.repairChan = make(chan struct{})
+	go d.readRepairer(d.repairChan)
+	d.qosChan = make(chan struct{})
+	go d.qosTicker(d.qosChan)
 	return d, nil
 }
 
@@ -80,14 +130,55 @@ func (d *Distributor) Ring() torus.Ring {
 	return d.ring
 }
 
+// VolumeReplication returns the replication factor of a volume, or 0 if it
+// follows the ring's. A volume's replication factor is fixed when it's
+// created, so it's only looked up once.
+func (d *Distributor) VolumeReplication(vid torus.VolumeID) int {
+	d.repMut.RLock()
+	rep, ok := d.replication[vid]
+	d.repMut.RUnlock()
+	if ok {
+		return rep
+	}
+	rep, err := d.srv.MDS.GetVolumeReplication(vid)
+	if err != nil {
+		clog.Errorf("couldn't get replication factor of volume %d, using the ring's: %v", vid, err)
+		return 0
+	}
+	d.repMut.Lock()
+	d.replication[vid] = rep
+	d.repMut.Unlock()
+	return rep
+}
+
+// getPeers returns where a block belongs, on the current ring and at its
+// volume's replication factor. The caller must hold d.mut.
+func (d *Distributor) getPeers(ref torus.BlockRef) (torus.PeerPermutation, error) {
+	perm, err := d.ring.GetPeers(ref)
+	if err != nil {
+		return perm, err
+	}
+	return perm.WithReplication(d.VolumeReplication(ref.Volume())), nil
+}
+
 func (d *Distributor) Close() error {
 	d.mut.Lock()
 	defer d.mut.Unlock()
 	if d.closed {
 		return nil
 	}
+	if err := d.waitBatches(); err != nil {
+		clog.Errorf("couldn't finish writing blocks on close: %v", err)
+	}
+	close(d.batchChan)
 	close(d.rebalancerChan)
+	if d.scrubberChan != nil {
+		close(d.scrubberChan)
+	}
 	close(d.ringWatcherChan)
+	close(d.qosChan)
+	close(d.repairChan)
+	close(d.hintChan)
 	if d.rpcSrv != nil {
 		d.rpcSrv.Close()
 	}
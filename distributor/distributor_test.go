@@ -1,12 +1,21 @@
 package distributor
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/coreos/torus"
+	"github.com/coreos/torus/distributor/protocols"
 	"github.com/coreos/torus/metadata/temp"
 
 	_ "github.com/coreos/torus/storage"
@@ -70,3 +79,100 @@ func testOpenClose(t *testing.T) {
 	closeAll(t, srvs...)
 	md.Close()
 }
+
+func TestPutError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{protocols.ErrServer, protocols.ErrServer},
+		{torus.ErrInvalid, torus.ErrInvalid},
+		{context.DeadlineExceeded, torus.ErrBlockUnavailable},
+		{io.EOF, torus.ErrBlockUnavailable},
+		{errors.New("connection reset by peer"), torus.ErrBlockUnavailable},
+	}
+	for i, tt := range tests {
+		if got := putError(tt.err); got != tt.want {
+			t.Errorf("%d: putError(%v) = %v, want %v", i, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestHintStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, err := newHintStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := torus.BlockRef{INodeRef: torus.NewINodeRef(1, 2), Index: 3}
+	data := []byte("some block data")
+	ok, err := h.add("peer", ref, data)
+	if !ok || err != nil {
+		t.Fatalf("couldn't add hint: %v, %v", ok, err)
+	}
+	// A hint that was being written when the server went down.
+	tmp := filepath.Join(dir, "peer", hintTempPrefix+"123")
+	err = ioutil.WriteFile(tmp, data[:4], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = newHintStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := h.count(); n != 1 || h.bytes != uint64(len(data)) {
+		t.Fatalf("expected 1 hint of %d bytes, got %d of %d", len(data), n, h.bytes)
+	}
+	got, err := h.get("peer", ref)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("hint read back differs: %q, %v", got, err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("expected the partial hint to be removed, got %v", err)
+	}
+}
+
+func TestThrottleFileIO(t *testing.T) {
+	d := &Distributor{
+		throttles: map[torus.VolumeID]*volumeThrottle{
+			1: {throttle: torus.NewThrottle(&torus.VolumeQoS{IOPS: 20, BurstIOPS: 1}, nil)},
+		},
+	}
+	// Other traffic for the volume isn't held back.
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		err := d.throttle(context.TODO(), 1, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if el := time.Since(start); el > 40*time.Millisecond {
+		t.Fatalf("5 RPCs that aren't for file I/O took %v", el)
+	}
+	ctx := context.WithValue(context.TODO(), torus.CtxFileIO, true)
+	start = time.Now()
+	for i := 0; i < 5; i++ {
+		err := d.throttle(ctx, 1, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first takes the burst; the other four wait 50ms each.
+	if el := time.Since(start); el < 150*time.Millisecond {
+		t.Fatalf("5 RPCs for file I/O at 20 IOPS took only %v", el)
+	}
+	// Other volumes aren't limited.
+	start = time.Now()
+	err := d.throttle(ctx, 2, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if el := time.Since(start); el > 40*time.Millisecond {
+		t.Fatalf("an RPC to an unlimited volume took %v", el)
+	}
+}
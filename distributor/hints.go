@@ -0,0 +1,284 @@
+package distributor
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/torus"
+	"golang.org/x/net/context"
+)
+
+var (
+	// hintInterval is how often hints are replayed to peers that are back.
+	hintInterval = 5 * time.Second
+	// maxHintBytes is the most block data kept in hints. Beyond it, new
+	// hints are dropped, and left to the rebalancer.
+	maxHintBytes uint64 = 256 * 1024 * 1024
+)
+
+// hintTempPrefix starts the names of hint files still being written.
+const hintTempPrefix = ".tmp-"
+
+// A hint is a block that couldn't be written to one of its replicas because
+// the peer was unreachable, kept to be handed off to it once it's back.
+type hint struct {
+	size uint64
+	// data is nil if the hint is kept on disk.
+	data []byte
+}
+
+// hintStore keeps hints by peer, in files under dir, or in memory if dir is
+// empty. Hints kept on disk outlive restarts.
+type hintStore struct {
+	mut   sync.Mutex
+	dir   string
+	hints map[string]map[torus.BlockRef]hint
+	bytes uint64
+}
+
+func newHintStore(dir string) (*hintStore, error) {
+	h := &hintStore{
+		dir:   dir,
+		hints: make(map[string]map[torus.BlockRef]hint),
+	}
+	if dir == "" {
+		return h, nil
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range peers {
+		if !p.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, p.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), hintTempPrefix) {
+				// Left by a crash while writing a hint, which was never
+				// recorded.
+				os.Remove(filepath.Join(dir, p.Name(), f.Name()))
+				continue
+			}
+			b, err := hex.DecodeString(f.Name())
+			if err != nil || len(b) != torus.BlockRefByteSize {
+				clog.Warningf("ignoring stray hint file %s", filepath.Join(dir, p.Name(), f.Name()))
+				continue
+			}
+			h.put(p.Name(), torus.BlockRefFromBytes(b), hint{size: uint64(f.Size())})
+		}
+	}
+	promDistHintsPending.Add(float64(h.count()))
+	return h, nil
+}
+
+func (h *hintStore) path(peer string, ref torus.BlockRef) string {
+	return filepath.Join(h.dir, peer, hex.EncodeToString(ref.ToBytes()))
+}
+
+// put records a hint. The caller must hold h.mut, or own h.
+func (h *hintStore) put(peer string, ref torus.BlockRef, x hint) {
+	if h.hints[peer] == nil {
+		h.hints[peer] = make(map[torus.BlockRef]hint)
+	}
+	h.hints[peer][ref] = x
+	h.bytes += x.size
+}
+
+func (h *hintStore) count() int {
+	n := 0
+	for _, m := range h.hints {
+		n += len(m)
+	}
+	return n
+}
+
+// add keeps data as a hint of block ref for peer. It returns false if there's
+// no room for it.
+func (h *hintStore) add(peer string, ref torus.BlockRef, data []byte) (bool, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if _, ok := h.hints[peer][ref]; ok {
+		return true, nil
+	}
+	size := uint64(len(data))
+	if h.bytes+size > maxHintBytes {
+		return false, nil
+	}
+	x := hint{size: size}
+	if h.dir == "" {
+		x.data = append([]byte(nil), data...)
+	} else {
+		err := h.write(peer, ref, data)
+		if err != nil {
+			return false, err
+		}
+	}
+	h.put(peer, ref, x)
+	promDistHintsPending.Inc()
+	return true, nil
+}
+
+// write puts data in the file for the hint of ref for peer, all at once, so
+// that a crash can't leave a partial hint behind to be handed off.
+func (h *hintStore) write(peer string, ref torus.BlockRef, data []byte) error {
+	dir := filepath.Join(h.dir, peer)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, hintTempPrefix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, h.path(peer, ref))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// peers returns the peers that have hints waiting, and their blocks.
+func (h *hintStore) peers() map[string][]torus.BlockRef {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	out := make(map[string][]torus.BlockRef)
+	for p, m := range h.hints {
+		for ref := range m {
+			out[p] = append(out[p], ref)
+		}
+	}
+	return out
+}
+
+func (h *hintStore) get(peer string, ref torus.BlockRef) ([]byte, error) {
+	h.mut.Lock()
+	x, ok := h.hints[peer][ref]
+	h.mut.Unlock()
+	if !ok {
+		return nil, torus.ErrBlockNotExist
+	}
+	if x.data != nil {
+		return x.data, nil
+	}
+	return ioutil.ReadFile(h.path(peer, ref))
+}
+
+func (h *hintStore) remove(peer string, ref torus.BlockRef) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	x, ok := h.hints[peer][ref]
+	if !ok {
+		return
+	}
+	delete(h.hints[peer], ref)
+	if len(h.hints[peer]) == 0 {
+		delete(h.hints, peer)
+	}
+	h.bytes -= x.size
+	promDistHintsPending.Dec()
+	if h.dir != "" {
+		err := os.Remove(h.path(peer, ref))
+		if err != nil && !os.IsNotExist(err) {
+			clog.Warningf("couldn't remove hint for %s on %s: %v", ref, peer, err)
+		}
+	}
+}
+
+// hintFailedWrite keeps a hint for peer if writing block ref to it failed
+// because it couldn't be reached.
+func (d *Distributor) hintFailedWrite(peer string, ref torus.BlockRef, data []byte, err error) {
+	if err != torus.ErrNoPeer && err != torus.ErrBlockUnavailable {
+		return
+	}
+	ok, err := d.hints.add(peer, ref, data)
+	if err != nil {
+		clog.Errorf("couldn't keep hint for %s on %s: %v", ref, peer, err)
+	}
+	if !ok {
+		promDistHintsDropped.Inc()
+		return
+	}
+	promDistHintsStored.Inc()
+}
+
+// hintTicker hands hinted blocks off to their peers until closer is closed.
+func (d *Distributor) hintTicker(closer chan struct{}) {
+	for {
+		select {
+		case <-closer:
+			return
+		case <-time.After(hintInterval):
+		}
+		d.replayHints()
+	}
+}
+
+// replayHints hands hinted blocks off to each of their peers that's
+// heartbeating again. It gives up on a peer until next time at its first
+// failure.
+func (d *Distributor) replayHints() {
+	hinted := d.hints.peers()
+	if len(hinted) == 0 {
+		return
+	}
+	// Don't wait for our own next heartbeat to notice peers are back.
+	pm := d.srv.UpdatePeerMap()
+	for peer, refs := range hinted {
+		if pi := pm[peer]; pi == nil || pi.TimedOut {
+			continue
+		}
+		for _, ref := range refs {
+			d.mut.RLock()
+			perm, err := d.getPeers(ref)
+			d.mut.RUnlock()
+			if err != nil {
+				clog.Errorf("couldn't get peers for hinted block %s: %v", ref, err)
+				break
+			}
+			if torus.PeerList(perm.Peers[:perm.Replication]).IndexAt(peer) == -1 {
+				// The ring has changed since, and the rebalancer
+				// will put the block where it now belongs.
+				d.hints.remove(peer, ref)
+				continue
+			}
+			data, err := d.hints.get(peer, ref)
+			if err != nil {
+				clog.Errorf("couldn't read hint for %s on %s: %v", ref, peer, err)
+				d.hints.remove(peer, ref)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.TODO(), writeClientTimeout)
+			err = d.client.PutBlock(ctx, peer, ref, data)
+			cancel()
+			if err != nil {
+				clog.Debugf("couldn't hand off hinted block %s to %s: %v", ref, peer, err)
+				break
+			}
+			d.hints.remove(peer, ref)
+			promDistHintsReplayed.Inc()
+		}
+	}
+}
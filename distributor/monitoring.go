@@ -32,6 +32,57 @@ var (
 		Name: "torus_distributor_block_request_failures",
 		Help: "Number of failed block requests",
 	})
+	promDistQuorumFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_distributor_quorum_failures",
+		Help: "Number of block reads and writes that couldn't reach a quorum of replicas",
+	}, []string{"op"})
+	// Read repair
+	promDistReadRepairs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_read_repairs_total",
+		Help: "Number of blocks put back on replicas found to be missing them when read",
+	})
+	promDistReadRepairFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_read_repair_failures",
+		Help: "Number of blocks that couldn't be put back on replicas missing them",
+	})
+	promDistReadRepairsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_read_repairs_dropped",
+		Help: "Number of read repairs dropped because the queue was full",
+	})
+	promDistReadRepairQueue = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_read_repair_queue_length",
+		Help: "Number of read repairs waiting to be carried out",
+	})
+	// Hinted handoff
+	promDistHintsStored = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_hints_stored_total",
+		Help: "Number of blocks kept as hints for peers that couldn't be reached when written",
+	})
+	promDistHintsReplayed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_hints_replayed_total",
+		Help: "Number of hinted blocks handed off to their peers once back",
+	})
+	promDistHintsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_hints_dropped",
+		Help: "Number of hints dropped because the hint store was full",
+	})
+	promDistHintsPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_hints_pending",
+		Help: "Number of hinted blocks waiting to be handed off",
+	})
+	// Batched writes
+	promDistWriteBatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_write_batches_total",
+		Help: "Number of batches of blocks sent to peers in one PutBlock RPC",
+	})
+	promDistBatchedBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_batched_blocks_total",
+		Help: "Number of blocks sent to peers in batches",
+	})
+	promDistBatchInflight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_batched_blocks_inflight",
+		Help: "Number of blocks written in batches that some peer has yet to answer for",
+	})
 	// RPCs
 	promDistPutBlockRPCs = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "torus_distributor_put_block_rpcs_total",
@@ -57,6 +108,10 @@ var (
 		Name: "torus_distributor_rebalance_rpc_failures",
 		Help: "Number of Rebalance RPCs with errors",
 	})
+	promDistRPCThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_distributor_rpc_throttled_seconds",
+		Help: "Seconds block RPCs to other nodes for file I/O have been held back by the volume's QoS limits",
+	}, []string{"volume"})
 )
 
 func init() {
@@ -68,6 +123,21 @@ func init() {
 	prometheus.MustRegister(promDistBlockPeerHits)
 	prometheus.MustRegister(promDistBlockPeerFailures)
 	prometheus.MustRegister(promDistBlockFailures)
+	prometheus.MustRegister(promDistQuorumFailures)
+	// Read repair
+	prometheus.MustRegister(promDistReadRepairs)
+	prometheus.MustRegister(promDistReadRepairFailures)
+	prometheus.MustRegister(promDistReadRepairsDropped)
+	prometheus.MustRegister(promDistReadRepairQueue)
+	// Hinted handoff
+	prometheus.MustRegister(promDistHintsStored)
+	prometheus.MustRegister(promDistHintsReplayed)
+	prometheus.MustRegister(promDistHintsDropped)
+	prometheus.MustRegister(promDistHintsPending)
+	// Batched writes
+	prometheus.MustRegister(promDistWriteBatches)
+	prometheus.MustRegister(promDistBatchedBlocks)
+	prometheus.MustRegister(promDistBatchInflight)
 	// RPC
 	prometheus.MustRegister(promDistPutBlockRPCs)
 	prometheus.MustRegister(promDistPutBlockRPCFailures)
@@ -75,4 +145,5 @@ func init() {
 	prometheus.MustRegister(promDistBlockRPCFailures)
 	prometheus.MustRegister(promDistRebalanceRPCs)
 	prometheus.MustRegister(promDistRebalanceRPCFailures)
+	prometheus.MustRegister(promDistRPCThrottled)
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 
 	"golang.org/x/net/context"
 
@@ -73,6 +74,26 @@ func (c *client) PutBlock(ctx context.Context, ref torus.BlockRef, data []byte)
 			data,
 		},
 	})
+	return serverError(err)
+}
+
+func (c *client) PutBlocks(ctx context.Context, refs []torus.BlockRef, data [][]byte) error {
+	req := &models.PutBlockRequest{
+		Blocks: data,
+	}
+	for _, x := range refs {
+		req.Refs = append(req.Refs, x.ToProto())
+	}
+	_, err := c.handler.PutBlock(ctx, req)
+	return serverError(err)
+}
+
+// serverError returns protocols.ErrServer for an error returned by the
+// peer's handler, rather than by the transport.
+func serverError(err error) error {
+	if err != nil && grpc.Code(err) == codes.Unknown {
+		return protocols.ErrServer
+	}
 	return err
 }
 
@@ -119,11 +140,21 @@ func (h *handler) Block(ctx context.Context, req *models.BlockRequest) (*models.
 }
 
 func (h *handler) PutBlock(ctx context.Context, req *models.PutBlockRequest) (*models.PutResponse, error) {
-	for i, ref := range req.Refs {
-		err := h.handle.PutBlock(ctx, torus.BlockFromProto(ref), req.Blocks[i])
-		if err != nil {
-			return nil, err
+	if len(req.Refs) != len(req.Blocks) {
+		return nil, torus.ErrInvalid
+	}
+	var err error
+	if len(req.Refs) == 1 {
+		err = h.handle.PutBlock(ctx, torus.BlockFromProto(req.Refs[0]), req.Blocks[0])
+	} else {
+		refs := make([]torus.BlockRef, len(req.Refs))
+		for i, x := range req.Refs {
+			refs[i] = torus.BlockFromProto(x)
 		}
+		err = h.handle.PutBlocks(ctx, refs, req.Blocks)
+	}
+	if err != nil {
+		return nil, err
 	}
 	return &models.PutResponse{Ok: true}, nil
 }
@@ -3,6 +3,7 @@
 package protocols
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
 	"time"
@@ -12,8 +13,14 @@ import (
 	"github.com/coreos/torus"
 )
 
+// ErrServer is returned by an RPC that reached the peer, but that the peer
+// couldn't carry out.
+var ErrServer = errors.New("protocols: peer couldn't carry out the request")
+
 type RPC interface {
 	PutBlock(ctx context.Context, ref torus.BlockRef, data []byte) error
+	// PutBlocks writes several blocks in one round trip.
+	PutBlocks(ctx context.Context, refs []torus.BlockRef, data [][]byte) error
 	Block(ctx context.Context, ref torus.BlockRef) ([]byte, error)
 	RebalanceCheck(ctx context.Context, refs []torus.BlockRef) ([]bool, error)
 	Close() error
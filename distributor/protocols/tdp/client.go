@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/coreos/torus"
+	"github.com/coreos/torus/distributor/protocols"
 	"golang.org/x/net/context"
 )
 
@@ -96,7 +97,7 @@ func (c *Conn) Block(_ context.Context, ref torus.BlockRef) ([]byte, error) {
 		return nil, err
 	}
 	if c.buf[0] == respErr {
-		return nil, errors.New("server error")
+		return nil, protocols.ErrServer
 	}
 	data := make([]byte, c.blockSize)
 	err = readConnIntoBuffer(c.conn, data)
@@ -128,7 +129,47 @@ func (c *Conn) PutBlock(ctx context.Context, ref torus.BlockRef, data []byte) er
 		return err
 	}
 	if c.buf[0] == respErr {
-		return errors.New("server error")
+		return protocols.ErrServer
+	}
+	return nil
+}
+
+func (c *Conn) PutBlocks(ctx context.Context, refs []torus.BlockRef, data [][]byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	if len(refs) != len(data) {
+		return torus.ErrInvalid
+	}
+	if len(refs) > maxPutBlocks {
+		return errors.New("too many blocks for one request")
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.conn.SetDeadline(time.Now().Add(writeClientTimeout))
+	c.buf[0] = cmdPutBlocks
+	c.buf[1] = byte(len(refs))
+	_, err := c.conn.Write(c.buf[:2])
+	if err != nil {
+		return fmt.Errorf("couldn't write: %v", err)
+	}
+	for i, ref := range refs {
+		ref.ToBytesBuf(c.buf)
+		_, err = c.conn.Write(c.buf[:torus.BlockRefByteSize])
+		if err != nil {
+			return fmt.Errorf("couldn't write ref: %v", err)
+		}
+		_, err = c.conn.Write(data[i])
+		if err != nil {
+			return fmt.Errorf("couldn't write data: %v", err)
+		}
+	}
+	err = readConnIntoBuffer(c.conn, c.buf[:1])
+	if err != nil {
+		return err
+	}
+	if c.buf[0] == respErr {
+		return protocols.ErrServer
 	}
 	return nil
 }
@@ -162,7 +203,7 @@ func (c *Conn) RebalanceCheck(_ context.Context, refs []torus.BlockRef) ([]bool,
 		return nil, err
 	}
 	if c.buf[0] == respErr {
-		return nil, errors.New("server error")
+		return nil, protocols.ErrServer
 	}
 	data := make([]byte, size)
 	err = readConnIntoBuffer(c.conn, data)
@@ -21,8 +21,12 @@ const (
 	cmdPutBlock
 	cmdBlock
 	cmdRebalanceCheck
+	cmdPutBlocks
 )
 
+// maxPutBlocks is the most blocks one PutBlocks request may carry.
+const maxPutBlocks = 255
+
 const (
 	respOk byte = iota + 1
 	respErr
@@ -118,6 +122,11 @@ func (s *Server) handle(conn net.Conn) {
 			if err == nil {
 				err = s.handleRebalanceCheck(conn, int(header[0]), refbuf)
 			}
+		case cmdPutBlocks:
+			err = readConnIntoBuffer(conn, header)
+			if err == nil {
+				err = s.handlePutBlocks(conn, int(header[0]), refbuf, null)
+			}
 		default:
 			err = errors.New("unknown message on the data port")
 		}
@@ -192,6 +201,31 @@ func (s *Server) handlePutBlock(conn net.Conn, refbuf []byte, null []byte) error
 	return err
 }
 
+// handlePutBlocks reads n blocks, each a ref followed by its data, straight
+// into the handler's buffers, and answers once for all of them.
+func (s *Server) handlePutBlocks(conn net.Conn, n int, refbuf []byte, null []byte) error {
+	for i := 0; i < n; i++ {
+		err := readConnIntoBuffer(conn, refbuf)
+		if err != nil {
+			return err
+		}
+		ref := torus.BlockRefFromBytes(refbuf)
+		data, err := s.handler.WriteBuf(context.TODO(), ref)
+		if err != nil {
+			if err != torus.ErrExists {
+				return err
+			}
+			data = null
+		}
+		err = readConnIntoBuffer(conn, data)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write(headerOk)
+	return err
+}
+
 func (s *Server) handleRebalanceCheck(conn net.Conn, len int, refbuf []byte) error {
 	refs := make([]torus.BlockRef, len)
 	for i := 0; i < len; i++ {
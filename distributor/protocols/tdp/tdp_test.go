@@ -190,6 +190,44 @@ func TestPutBlock(t *testing.T) {
 	}
 }
 
+func TestPutBlocks(t *testing.T) {
+	stest := makeTestData(512 * 1024)
+	m := &mockBlockRPC{
+		data: stest,
+	}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var refs []torus.BlockRef
+	var data [][]byte
+	for i := 0; i < 3; i++ {
+		refs = append(refs, torus.BlockRef{
+			INodeRef: torus.NewINodeRef(1, 2),
+			Index:    3,
+		})
+		data = append(data, append([]byte(nil), stest...))
+	}
+	err = c.PutBlocks(context.TODO(), refs, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The connection is still in step afterwards.
+	resp, err := c.Block(context.TODO(), refs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, stest) {
+		t.Fatal("unequal response")
+	}
+}
+
 func TestPutBlockGRPC(t *testing.T) {
 	test := makeTestData(512 * 1024)
 	m := &mockBlockGRPC{
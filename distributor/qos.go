@@ -0,0 +1,81 @@
+package distributor
+
+import (
+	"time"
+
+	"github.com/coreos/torus"
+	"golang.org/x/net/context"
+)
+
+// qosInterval is how often the distributor picks up changes to the volumes'
+// QoS limits.
+var qosInterval = 30 * time.Second
+
+type volumeThrottle struct {
+	qos      torus.VolumeQoS
+	throttle *torus.Throttle
+}
+
+// qosTicker keeps the throttles for block RPCs made for file I/O in step with
+// the volumes' QoS limits.
+func (d *Distributor) qosTicker(closer chan struct{}) {
+	for {
+		d.updateThrottles()
+		select {
+		case <-closer:
+			return
+		case <-time.After(qosInterval):
+		}
+	}
+}
+
+func (d *Distributor) updateThrottles() {
+	vols, _, err := d.srv.MDS.GetVolumes()
+	if err != nil {
+		clog.Errorf("couldn't get volumes for QoS: %v", err)
+		return
+	}
+	d.throttleMut.Lock()
+	defer d.throttleMut.Unlock()
+	next := make(map[torus.VolumeID]*volumeThrottle)
+	for _, vol := range vols {
+		vid := torus.VolumeID(vol.Id)
+		q, err := d.srv.MDS.GetVolumeQoS(vid)
+		if err != nil {
+			clog.Errorf("couldn't get QoS limits of volume %s: %v", vol.Name, err)
+			if old, ok := d.throttles[vid]; ok {
+				next[vid] = old
+			}
+			continue
+		}
+		if q.Unlimited() {
+			continue
+		}
+		if old, ok := d.throttles[vid]; ok && old.qos == *q {
+			// Keep the state of the buckets.
+			next[vid] = old
+			continue
+		}
+		next[vid] = &volumeThrottle{
+			qos:      *q,
+			throttle: torus.NewThrottle(q, promDistRPCThrottled.WithLabelValues(vol.Name)),
+		}
+	}
+	d.throttles = next
+}
+
+// throttle waits until the volume's QoS limits allow a block RPC of n bytes
+// to it, if it's made for file I/O. Other traffic, such as rebalancing,
+// repairs and hints, isn't held to them.
+func (d *Distributor) throttle(ctx context.Context, vid torus.VolumeID, n int) error {
+	if v, ok := ctx.Value(torus.CtxFileIO).(bool); !ok || !v {
+		return nil
+	}
+	d.throttleMut.RLock()
+	t, ok := d.throttles[vid]
+	d.throttleMut.RUnlock()
+	if !ok {
+		return nil
+	}
+	return t.throttle.Wait(ctx, n)
+}
@@ -0,0 +1,142 @@
+package distributor
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/coreos/torus"
+	"golang.org/x/net/context"
+)
+
+// ErrNoQuorum is returned when too few of a block's replicas take a write,
+// or agree on a read, at the quorum levels.
+var ErrNoQuorum = errors.New("distributor: couldn't reach a quorum of replicas")
+
+// writeQuorum writes a block to all of its replicas at once, and returns as
+// soon as a quorum of them have it. The rest of the writes carry on in the
+// background. A replica that fails is hinted if it couldn't be reached, and
+// the block is also written to the next peer in the permutation, if there is
+// one, so that it's kept as many times over. As quorum reads only ask the
+// replicas, only they count towards the quorum.
+func (d *Distributor) writeQuorum(ctx context.Context, i torus.BlockRef, data []byte, peers torus.PeerPermutation) error {
+	need := torus.QuorumSize(d.srv.Cfg.WriteQuorum, peers.Replication)
+	// The caller may reuse data as soon as we return, while the writes to
+	// the other replicas carry on.
+	data = append([]byte(nil), data...)
+	type result struct {
+		replica bool
+		err     error
+	}
+	// Each peer is written to at most once, so this never blocks.
+	errch := make(chan result, len(peers.Peers))
+	write := func(p string, replica bool) {
+		go func() {
+			var err error
+			if p == d.UUID() {
+				err = d.blocks.WriteBlock(ctx, i, data)
+			} else {
+				err = d.client.PutBlock(ctx, p, i, data)
+				if err != nil && replica {
+					d.hintFailedWrite(p, i, data, err)
+				}
+			}
+			if err != nil {
+				clog.Noticef("error WriteQuorum to peer %s: %s", p, err)
+			}
+			errch <- result{replica, err}
+		}()
+	}
+	for _, p := range peers.Peers[:peers.Replication] {
+		write(p, true)
+	}
+	spare := peers.Peers[peers.Replication:]
+	acks := 0
+	for left := peers.Replication; left > 0; {
+		r := <-errch
+		if r.replica {
+			left--
+		}
+		if r.err == nil {
+			if r.replica {
+				acks++
+				if acks == need {
+					return nil
+				}
+			}
+			continue
+		}
+		if len(spare) != 0 {
+			write(spare[0], false)
+			spare = spare[1:]
+		}
+	}
+	promDistQuorumFailures.WithLabelValues("write").Inc()
+	clog.Warningf("only wrote block %s to %d replicas, short of a quorum of %d", i, acks, need)
+	return ErrNoQuorum
+}
+
+type replicaRead struct {
+	peer string
+	data []byte
+	err  error
+}
+
+// readQuorum reads a block from all of its replicas at once, and returns it
+// as soon as a quorum of them agree on its contents. Replicas that are missing
+// the block, or hold different contents, count against the quorum; those
+// found missing it by then are repaired.
+func (d *Distributor) readQuorum(ctx context.Context, i torus.BlockRef, peers torus.PeerPermutation) ([]byte, error) {
+	need := torus.QuorumSize(d.srv.Cfg.ReadQuorum, peers.Replication)
+	resch := make(chan replicaRead, peers.Replication)
+	for _, p := range peers.Peers[:peers.Replication] {
+		go func(peer string) {
+			r := replicaRead{peer: peer}
+			if peer == d.UUID() {
+				r.data, r.err = d.blocks.GetBlock(ctx, i)
+			} else {
+				getctx, cancel := context.WithTimeout(ctx, clientTimeout)
+				r.data, r.err = d.client.GetBlock(getctx, peer, i)
+				cancel()
+			}
+			resch <- r
+		}(p)
+	}
+	var got []replicaRead
+	var stale []string
+	for n := 0; n < peers.Replication; n++ {
+		r := <-resch
+		if r.err != nil {
+			clog.Debugf("failed quorum read of %s from %s: %s", i, r.peer, r.err)
+			promDistBlockPeerFailures.WithLabelValues(r.peer).Inc()
+			if r.err == torus.ErrBlockUnavailable || r.err == torus.ErrBlockNotExist {
+				stale = append(stale, r.peer)
+			}
+			continue
+		}
+		got = append(got, r)
+		agree := 0
+		for _, x := range got {
+			if bytes.Equal(x.data, r.data) {
+				agree++
+			}
+		}
+		if agree < need {
+			continue
+		}
+		for _, x := range got {
+			if !bytes.Equal(x.data, r.data) {
+				clog.Warningf("peer %s holds different contents for block %s than a quorum of its replicas", x.peer, i)
+			}
+		}
+		d.queueReadRepair(i, r.data, stale)
+		if r.peer != d.UUID() {
+			// Local blocks may be backed by the store's own memory,
+			// so only cache copies from the network.
+			d.readCache.Put(string(i.ToBytes()), r.data)
+		}
+		return r.data, nil
+	}
+	promDistQuorumFailures.WithLabelValues("read").Inc()
+	clog.Warningf("only %d replicas of block %s answered, short of a quorum of %d that agree", len(got), i, need)
+	return nil, ErrNoQuorum
+}
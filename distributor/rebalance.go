@@ -40,6 +40,38 @@ exit:
 	}
 }
 
+// prepGC prepares the GC with the volumes, and those in the trash that
+// haven't expired, which keep their blocks until they do. It returns whether
+// all of them were.
+func (d *Distributor) prepGC() bool {
+	// A volume being restored or deleted meanwhile must be in one list or
+	// the other, or its blocks would be taken for garbage.
+	volset, trash, err := d.srv.MDS.GetVolumesAndTrash()
+	if err != nil {
+		clog.Errorf("couldn't get volumes for gc: %v", err)
+		return false
+	}
+	ok := true
+	for _, x := range volset {
+		err := d.rebalancer.PrepVolume(x)
+		if err != nil {
+			clog.Errorf("gc prep for %s failed: %s", x.Name, err)
+			ok = false
+		}
+	}
+	for _, x := range trash {
+		if x.Expired(time.Now()) {
+			continue
+		}
+		err := d.rebalancer.PrepVolume(x.Volume)
+		if err != nil {
+			clog.Errorf("gc prep for deleted volume %s failed: %s", x.Volume.Name, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
 func (d *Distributor) rebalanceTicker(closer chan struct{}) {
 	n := 0
 	total := 0
@@ -47,15 +79,12 @@ func (d *Distributor) rebalanceTicker(closer chan struct{}) {
 exit:
 	for {
 		clog.Tracef("starting rebalance/gc cycle")
-		volset, _, err := d.srv.MDS.GetVolumes()
-		if err != nil {
-			clog.Error(err)
-		}
-		for _, x := range volset {
-			err := d.rebalancer.PrepVolume(x)
-			if err != nil {
-				clog.Errorf("gc prep for %s failed: %s", x.Name, err)
-			}
+		if !d.prepGC() {
+			// Without every volume, blocks that are still in use
+			// would look dead; rebalance, but collect nothing this
+			// time around.
+			clog.Warningf("skipping gc this cycle")
+			d.rebalancer.SkipGC()
 		}
 	ratelimit:
 		for {
@@ -16,12 +16,18 @@ var clog = capnslog.NewPackageLogger("github.com/coreos/torus", "rebalance")
 type Ringer interface {
 	Ring() torus.Ring
 	UUID() string
+	// VolumeReplication returns the replication factor of a volume, or 0
+	// if it follows the ring's.
+	VolumeReplication(torus.VolumeID) int
 }
 
 type Rebalancer interface {
 	Tick() (int, error)
 	VersionStart() int
 	PrepVolume(*models.Volume) error
+	// SkipGC keeps the pass from collecting any blocks, for when the GC
+	// couldn't be prepared with every volume, until the next Reset.
+	SkipGC()
 	Reset() error
 }
 
@@ -46,6 +52,8 @@ type rebalancer struct {
 	it   torus.BlockIterator
 	gc   gc.GC
 	ring torus.Ring
+	// skipGC is set by SkipGC.
+	skipGC bool
 }
 
 func (r *rebalancer) VersionStart() int {
@@ -59,11 +67,16 @@ func (r *rebalancer) PrepVolume(vol *models.Volume) error {
 	return r.gc.PrepVolume(vol)
 }
 
+func (r *rebalancer) SkipGC() {
+	r.skipGC = true
+}
+
 func (r *rebalancer) Reset() error {
 	if r.it != nil {
 		r.it.Close()
 		r.it = nil
 	}
 	r.gc.Clear()
+	r.skipGC = false
 	return nil
 }
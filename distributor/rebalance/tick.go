@@ -36,7 +36,7 @@ func (r *rebalancer) Tick() (int, error) {
 			break
 		}
 		ref = r.it.BlockRef()
-		if r.gc.IsDead(ref) {
+		if !r.skipGC && r.gc.IsDead(ref) {
 			dead[ref] = true
 			continue
 		}
@@ -44,6 +44,7 @@ func (r *rebalancer) Tick() (int, error) {
 		if err != nil {
 			return 0, err
 		}
+		perm = perm.WithReplication(r.r.VolumeReplication(ref.Volume()))
 		desired := torus.PeerList(perm.Peers[:perm.Replication])
 		myIndex := desired.IndexAt(r.r.UUID())
 		for j, p := range desired {
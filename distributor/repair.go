@@ -0,0 +1,74 @@
+package distributor
+
+import (
+	"github.com/coreos/torus"
+	"golang.org/x/net/context"
+)
+
+// readRepairQueueSize is the most read repairs that may wait to be carried
+// out. Beyond it, new ones are dropped, and left to the rebalancer.
+var readRepairQueueSize = 256
+
+// A readRepair puts a block back on replicas found to be missing it while
+// reading it from another.
+type readRepair struct {
+	ref   torus.BlockRef
+	data  []byte
+	peers []string
+}
+
+// queueReadRepair queues putting data back as block ref on peers, without
+// waiting for it.
+func (d *Distributor) queueReadRepair(ref torus.BlockRef, data []byte, peers []string) {
+	if len(peers) == 0 {
+		return
+	}
+	// Local blocks may be backed by the store's own memory.
+	r := readRepair{
+		ref:   ref,
+		data:  append([]byte(nil), data...),
+		peers: peers,
+	}
+	promDistReadRepairQueue.Inc()
+	select {
+	case d.repairQueue <- r:
+	default:
+		promDistReadRepairQueue.Dec()
+		promDistReadRepairsDropped.Inc()
+		clog.Debugf("read repair queue full, dropping repair of %s", ref)
+	}
+}
+
+// readRepairer carries out queued read repairs one at a time until closer is
+// closed.
+func (d *Distributor) readRepairer(closer chan struct{}) {
+	for {
+		select {
+		case <-closer:
+			return
+		case r := <-d.repairQueue:
+			promDistReadRepairQueue.Dec()
+			d.readRepair(r)
+		}
+	}
+}
+
+func (d *Distributor) readRepair(r readRepair) {
+	for _, p := range r.peers {
+		ctx, cancel := context.WithTimeout(context.TODO(), clientTimeout)
+		var err error
+		if p == d.UUID() {
+			err = d.blocks.WriteBlock(ctx, r.ref, r.data)
+		} else {
+			err = d.client.PutBlock(ctx, p, r.ref, r.data)
+		}
+		cancel()
+		if err != nil {
+			promDistReadRepairFailures.Inc()
+			clog.Debugf("couldn't repair block %s on peer %s: %s", r.ref, p, err)
+			continue
+		}
+		promDistReadRepairs.Inc()
+		clog.Tracef("repaired block %s on peer %s", r.ref, p)
+	}
+}
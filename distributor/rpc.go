@@ -21,10 +21,34 @@ func (d *Distributor) Block(ctx context.Context, ref torus.BlockRef) ([]byte, er
 }
 
 func (d *Distributor) PutBlock(ctx context.Context, ref torus.BlockRef, data []byte) error {
+	promDistPutBlockRPCs.Inc()
+	err := d.putBlock(ctx, ref, data)
+	if err != nil {
+		return err
+	}
+	return d.blocks.Flush()
+}
+
+// PutBlocks handles a batch of blocks written by a peer in one RPC.
+func (d *Distributor) PutBlocks(ctx context.Context, refs []torus.BlockRef, data [][]byte) error {
+	promDistPutBlockRPCs.Inc()
+	if len(refs) != len(data) {
+		promDistPutBlockRPCFailures.Inc()
+		return torus.ErrInvalid
+	}
+	for i, ref := range refs {
+		err := d.putBlock(ctx, ref, data[i])
+		if err != nil {
+			return err
+		}
+	}
+	return d.blocks.Flush()
+}
+
+func (d *Distributor) putBlock(ctx context.Context, ref torus.BlockRef, data []byte) error {
 	d.mut.RLock()
 	defer d.mut.RUnlock()
-	promDistPutBlockRPCs.Inc()
-	peers, err := d.ring.GetPeers(ref)
+	peers, err := d.getPeers(ref)
 	if err != nil {
 		promDistPutBlockRPCFailures.Inc()
 		return err
@@ -41,12 +65,13 @@ func (d *Distributor) PutBlock(ctx context.Context, ref torus.BlockRef, data []b
 	}
 	err = d.blocks.WriteBlock(ctx, ref, data)
 	if err != nil {
+		promDistPutBlockRPCFailures.Inc()
 		return err
 	}
 	if torus.BlockLog.LevelAt(capnslog.TRACE) {
 		torus.BlockLog.Tracef("rpc: saving block %s", ref)
 	}
-	return d.Flush()
+	return nil
 }
 
 func (d *Distributor) RebalanceCheck(ctx context.Context, refs []torus.BlockRef) ([]bool, error) {
@@ -0,0 +1,90 @@
+package distributor
+
+import (
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/distributor/scrub"
+	"github.com/coreos/torus/gc"
+)
+
+// scrubVolumes finds the INodes that keep a volume's blocks alive for the
+// scrubber, by asking the garbage collector about the volume, whether it's
+// live or in the trash.
+type scrubVolumes struct {
+	srv *torus.Server
+	gc  gc.INodeLister
+}
+
+func (s scrubVolumes) LiveINodes(vid torus.VolumeID) ([]torus.INodeRef, error) {
+	vols, _, err := s.srv.MDS.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vols {
+		if torus.VolumeID(v.Id) == vid {
+			return s.gc.LiveINodes(v)
+		}
+	}
+	trash, err := s.srv.MDS.GetTrash()
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range trash {
+		if torus.VolumeID(x.Volume.Id) == vid {
+			return s.gc.LiveINodes(x.Volume)
+		}
+	}
+	return nil, torus.ErrNotExist
+}
+
+// scrubTicker runs the scrubber at the configured rate, resting for the
+// configured interval between passes.
+func (d *Distributor) scrubTicker(closer chan struct{}) {
+	rate := d.srv.Cfg.ScrubRate
+	batch := rate / 10
+	if batch < 1 {
+		batch = 1
+	}
+	interval := time.Duration(batch) * time.Second / time.Duration(rate)
+	time.Sleep(time.Duration(250+rand.Intn(250)) * time.Millisecond)
+	for {
+		clog.Debugf("starting scrub pass")
+	pass:
+		for {
+			select {
+			case <-closer:
+				return
+			case <-time.After(interval):
+				_, err := d.scrubber.Tick(batch)
+				if err == io.EOF {
+					break pass
+				} else if err != nil {
+					clog.Errorf("scrub: %v", err)
+					d.scrubber.Reset()
+					break pass
+				}
+			}
+		}
+		st := d.scrubber.Status()
+		clog.Infof("scrub pass finished: %d blocks scanned, %d mismatched, %d repaired", st.Pass.Scanned, st.Pass.Mismatched, st.Pass.Repaired)
+		select {
+		case <-closer:
+			return
+		case <-time.After(d.srv.Cfg.ScrubInterval):
+		}
+	}
+}
+
+// ScrubStatus reports the progress of the background scrubber.
+func (d *Distributor) ScrubStatus() scrub.Status {
+	if d.scrubber == nil {
+		return scrub.Status{}
+	}
+	st := d.scrubber.Status()
+	st.Enabled = true
+	st.Rate = d.srv.Cfg.ScrubRate
+	return st
+}
@@ -0,0 +1,296 @@
+// scrub provides the implementation of the scrubber, which walks the blocks
+// stored on a host, verifies them against the checksums recorded in their
+// INodes, and replaces any corrupt blocks with good copies from other peers.
+package scrub
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+	"github.com/coreos/torus/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var clog = capnslog.NewPackageLogger("github.com/coreos/torus", "scrub")
+
+var (
+	promScrubBlocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_scrub_blocks_total",
+		Help: "Number of blocks examined by the scrubber, by outcome",
+	}, []string{"result"})
+	promScrubPasses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_scrub_passes_total",
+		Help: "Number of complete passes the scrubber has made over local storage",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(promScrubBlocks)
+	prometheus.MustRegister(promScrubPasses)
+}
+
+// maxCachedVolumes bounds the number of volumes whose checksums are kept in
+// memory during a pass.
+const maxCachedVolumes = 8
+
+var scrubTimeout = 5 * time.Second
+
+type Ringer interface {
+	Ring() torus.Ring
+	UUID() string
+}
+
+type INodeFetcher interface {
+	GetINode(context.Context, torus.INodeRef) (*models.INode, error)
+}
+
+// INodeLister returns the INodes that keep a volume's blocks alive, which
+// are those the garbage collector keeps.
+type INodeLister interface {
+	LiveINodes(torus.VolumeID) ([]torus.INodeRef, error)
+}
+
+type BlockFetcher interface {
+	GetBlock(ctx context.Context, peer string, ref torus.BlockRef) ([]byte, error)
+}
+
+type Scrubber interface {
+	// Tick examines up to n blocks, and returns the number examined. It
+	// returns io.EOF when it has reached the end of a pass.
+	Tick(n int) (int, error)
+	Status() Status
+	Reset() error
+}
+
+// Counts tallies the outcome of scrubbing blocks.
+type Counts struct {
+	Scanned      uint64 `json:"scanned"`
+	Verified     uint64 `json:"verified"`
+	Unverifiable uint64 `json:"unverifiable"`
+	Mismatched   uint64 `json:"mismatched"`
+	Repaired     uint64 `json:"repaired"`
+	Unrepaired   uint64 `json:"unrepaired"`
+}
+
+func (c *Counts) add(o Counts) {
+	c.Scanned += o.Scanned
+	c.Verified += o.Verified
+	c.Unverifiable += o.Unverifiable
+	c.Mismatched += o.Mismatched
+	c.Repaired += o.Repaired
+	c.Unrepaired += o.Unrepaired
+}
+
+// Status reports the progress of the scrubber.
+type Status struct {
+	Enabled          bool      `json:"enabled"`
+	Rate             int       `json:"rate"`
+	Passes           uint64    `json:"passes"`
+	PassStarted      time.Time `json:"pass_started"`
+	LastPassFinished time.Time `json:"last_pass_finished"`
+	// Pass holds the counts for the pass in progress.
+	Pass Counts `json:"pass"`
+	// Total holds the counts since the scrubber started.
+	Total Counts `json:"total"`
+}
+
+func NewScrubber(r Ringer, bs torus.BlockStore, inodes INodeFetcher, live INodeLister, bf BlockFetcher) Scrubber {
+	return &scrubber{
+		r:      r,
+		bs:     bs,
+		inodes: inodes,
+		live:   live,
+		bf:     bf,
+		sums:   make(map[torus.VolumeID]map[torus.BlockRef]blockset.Checksum),
+	}
+}
+
+type scrubber struct {
+	r      Ringer
+	bs     torus.BlockStore
+	inodes INodeFetcher
+	live   INodeLister
+	bf     BlockFetcher
+	it     torus.BlockIterator
+	sums   map[torus.VolumeID]map[torus.BlockRef]blockset.Checksum
+
+	mut    sync.Mutex
+	status Status
+}
+
+func (s *scrubber) Status() Status {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.status
+}
+
+func (s *scrubber) Reset() error {
+	if s.it != nil {
+		s.it.Close()
+		s.it = nil
+	}
+	s.sums = make(map[torus.VolumeID]map[torus.BlockRef]blockset.Checksum)
+	return nil
+}
+
+func (s *scrubber) Tick(n int) (int, error) {
+	if s.it == nil {
+		s.it = s.bs.BlockIterator()
+		s.mut.Lock()
+		s.status.PassStarted = time.Now()
+		s.status.Pass = Counts{}
+		s.mut.Unlock()
+	}
+	var c Counts
+	done := false
+	for i := 0; i < n; i++ {
+		if !s.it.Next() {
+			err := s.it.Err()
+			if err != nil {
+				return i, err
+			}
+			done = true
+			break
+		}
+		s.scrubBlock(s.it.BlockRef(), &c)
+	}
+	s.mut.Lock()
+	s.status.Pass.add(c)
+	s.status.Total.add(c)
+	if done {
+		s.status.Passes++
+		s.status.LastPassFinished = time.Now()
+	}
+	s.mut.Unlock()
+	if done {
+		promScrubPasses.Inc()
+		s.Reset()
+		return int(c.Scanned), io.EOF
+	}
+	return int(c.Scanned), nil
+}
+
+func (s *scrubber) scrubBlock(ref torus.BlockRef, c *Counts) {
+	c.Scanned++
+	sum, ok := s.checksumFor(ref)
+	if !ok {
+		c.Unverifiable++
+		promScrubBlocks.WithLabelValues("unverifiable").Inc()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), scrubTimeout)
+	defer cancel()
+	data, err := s.bs.GetBlock(ctx, ref)
+	if err == nil && sum.Verify(data) {
+		c.Verified++
+		promScrubBlocks.WithLabelValues("verified").Inc()
+		return
+	}
+	c.Mismatched++
+	promScrubBlocks.WithLabelValues("mismatched").Inc()
+	if err != nil {
+		clog.Warningf("scrub: couldn't read local block %s: %v", ref, err)
+	} else {
+		clog.Warningf("scrub: block %s failed %s verification", ref, sum.Algorithm())
+	}
+	if s.repair(ctx, ref, sum) {
+		c.Repaired++
+		promScrubBlocks.WithLabelValues("repaired").Inc()
+		return
+	}
+	c.Unrepaired++
+	promScrubBlocks.WithLabelValues("unrepaired").Inc()
+	clog.Errorf("scrub: no good copy of block %s available", ref)
+}
+
+// repair replaces a bad local block with a good copy from another peer.
+func (s *scrubber) repair(ctx context.Context, ref torus.BlockRef, sum blockset.Checksum) bool {
+	perm, err := s.r.Ring().GetPeers(ref)
+	if err != nil {
+		clog.Errorf("scrub: couldn't get peers for %s: %v", ref, err)
+		return false
+	}
+	for _, p := range perm.Peers {
+		if p == s.r.UUID() {
+			continue
+		}
+		data, err := s.bf.GetBlock(ctx, p, ref)
+		if err != nil || !sum.Verify(data) {
+			continue
+		}
+		if torus.BlockLog.LevelAt(capnslog.TRACE) {
+			torus.BlockLog.Tracef("scrub: replacing block %s with copy from %s", ref, p)
+		}
+		// Stores keep the first copy of a block they're given, so remove
+		// the bad one first.
+		err = s.bs.DeleteBlock(ctx, ref)
+		if err != nil && err != torus.ErrBlockNotExist {
+			clog.Errorf("scrub: couldn't delete bad block %s: %v", ref, err)
+			return false
+		}
+		err = s.bs.WriteBlock(ctx, ref, data)
+		if err != nil {
+			clog.Errorf("scrub: couldn't write repaired block %s: %v", ref, err)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// checksumFor finds the checksum of a block by way of the INodes that keep
+// its volume's blocks alive.
+func (s *scrubber) checksumFor(ref torus.BlockRef) (blockset.Checksum, bool) {
+	if ref.BlockType() != torus.TypeBlock {
+		return blockset.Checksum{}, false
+	}
+	vid := ref.Volume()
+	sums, ok := s.sums[vid]
+	if !ok {
+		sums = s.loadChecksums(vid)
+		if len(s.sums) >= maxCachedVolumes {
+			s.sums = make(map[torus.VolumeID]map[torus.BlockRef]blockset.Checksum)
+		}
+		s.sums[vid] = sums
+	}
+	sum, ok := sums[ref]
+	return sum, ok
+}
+
+func (s *scrubber) loadChecksums(vid torus.VolumeID) map[torus.BlockRef]blockset.Checksum {
+	irefs, err := s.live.LiveINodes(vid)
+	if err != nil {
+		// Most likely a volume that has been deleted; its blocks are
+		// garbage collected rather than checked.
+		clog.Debugf("scrub: couldn't get inodes of volume %d: %v", vid, err)
+		return nil
+	}
+	out := make(map[torus.BlockRef]blockset.Checksum)
+	for _, iref := range irefs {
+		ctx, cancel := context.WithTimeout(context.TODO(), scrubTimeout)
+		inode, err := s.inodes.GetINode(ctx, iref)
+		cancel()
+		if err != nil {
+			clog.Debugf("scrub: couldn't get inode %s: %v", iref, err)
+			continue
+		}
+		bs, err := blockset.UnmarshalFromProto(inode.Blocks, nil)
+		if err != nil {
+			clog.Errorf("scrub: couldn't unmarshal blockset of inode %s: %v", iref, err)
+			continue
+		}
+		for ref, sum := range blockset.BlockChecksums(bs) {
+			// Blocks a clone shares with its origin are checked against
+			// the origin's INodes.
+			if ref.Volume() == vid {
+				out[ref] = sum
+			}
+		}
+	}
+	return out
+}
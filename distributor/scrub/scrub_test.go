@@ -0,0 +1,73 @@
+package scrub
+
+import (
+	"io"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+	"github.com/coreos/torus/models"
+
+	// Register storage drivers.
+	_ "github.com/coreos/torus/storage"
+)
+
+type testRinger struct{}
+
+func (testRinger) Ring() torus.Ring { return nil }
+func (testRinger) UUID() string     { return "" }
+
+type testINodes map[torus.INodeRef]*models.INode
+
+func (m testINodes) GetINode(_ context.Context, ref torus.INodeRef) (*models.INode, error) {
+	inode, ok := m[ref]
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	return inode, nil
+}
+
+type testLister map[torus.VolumeID][]torus.INodeRef
+
+func (m testLister) LiveINodes(vid torus.VolumeID) ([]torus.INodeRef, error) {
+	refs, ok := m[vid]
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	return refs, nil
+}
+
+func TestScrubBlocksOfOlderINodes(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	bs, err := blockset.CreateBlocksetFromSpec(blockset.MustParseBlockLayerSpec("crc,base"), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each block is written by a different sync of the volume; only the
+	// last INode is still around.
+	for i := 0; i < 3; i++ {
+		err = bs.PutBlock(context.TODO(), torus.NewINodeRef(1, torus.INodeID(i+2)), i, make([]byte, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	blocks, err := torus.MarshalBlocksetToProto(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := torus.NewINodeRef(1, 4)
+	inodes := testINodes{cur: &models.INode{Volume: 1, INode: 4, Blocks: blocks}}
+	live := testLister{1: {cur}}
+
+	sc := NewScrubber(testRinger{}, s, inodes, live, nil)
+	_, err = sc.Tick(100)
+	if err != io.EOF {
+		t.Fatalf("expected the pass to finish, got %v", err)
+	}
+	st := sc.Status()
+	if st.Total.Scanned != 3 || st.Total.Verified != 3 {
+		t.Fatalf("expected 3 blocks verified, got %+v", st.Total)
+	}
+}
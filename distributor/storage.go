@@ -22,7 +22,12 @@ func (d *Distributor) GetBlock(ctx context.Context, i torus.BlockRef) ([]byte, e
 		promDistBlockCacheHits.Inc()
 		return bcache.([]byte), nil
 	}
-	peers, err := d.ring.GetPeers(i)
+	if blk := d.inflightBlock(i); blk != nil {
+		// Still on its way to its peers.
+		promDistBlockCacheHits.Inc()
+		return blk, nil
+	}
+	peers, err := d.getPeers(i)
 	if err != nil {
 		promDistBlockFailures.Inc()
 		return nil, err
@@ -31,6 +36,15 @@ func (d *Distributor) GetBlock(ctx context.Context, i torus.BlockRef) ([]byte, e
 		promDistBlockFailures.Inc()
 		return nil, ErrNoPeersBlock
 	}
+	readLevel := d.getReadFromServer()
+	if readLevel == torus.ReadQuorum {
+		// The local replica is just one vote.
+		blk, err := d.readQuorum(ctx, i, peers)
+		if err != nil {
+			promDistBlockFailures.Inc()
+		}
+		return blk, err
+	}
 	writeLevel := d.getWriteFromServer()
 	for _, p := range peers.Peers[:peers.Replication] {
 		if p == d.UUID() || writeLevel == torus.WriteLocal {
@@ -44,7 +58,6 @@ func (d *Distributor) GetBlock(ctx context.Context, i torus.BlockRef) ([]byte, e
 		}
 	}
 	var blk []byte
-	readLevel := d.getReadFromServer()
 	switch readLevel {
 	case torus.ReadBlock:
 		blk, err = d.readWithBackoff(ctx, i, peers)
@@ -76,16 +89,24 @@ func (d *Distributor) readWithBackoff(ctx context.Context, ref torus.BlockRef, p
 }
 
 func (d *Distributor) readSequential(ctx context.Context, i torus.BlockRef, peers torus.PeerPermutation, timeout time.Duration) ([]byte, error) {
-	for _, p := range peers.Peers {
+	// Replicas found to be missing the block, to be repaired once it's
+	// been read from another.
+	var stale []string
+	for n, p := range peers.Peers {
+		replica := n < peers.Replication
 		// If it's local, just try to get it.
 		if p == d.UUID() {
 			b, err := d.blocks.GetBlock(ctx, i)
 			if err == nil {
 				promDistBlockLocalHits.Inc()
+				d.queueReadRepair(i, b, stale)
 				return b, nil
 			}
 			promDistBlockLocalFailures.Inc()
 			clog.Debugf("failed local peer (again): %s", err)
+			if replica && err == torus.ErrBlockNotExist {
+				stale = append(stale, p)
+			}
 			continue
 		}
 		// Fetch block from remote. First pass through peers
@@ -95,6 +116,7 @@ func (d *Distributor) readSequential(ctx context.Context, i torus.BlockRef, peer
 		cancel()
 
 		if err == nil {
+			d.queueReadRepair(i, blk, stale)
 			return blk, nil
 		}
 
@@ -102,6 +124,9 @@ func (d *Distributor) readSequential(ctx context.Context, i torus.BlockRef, peer
 		if err == torus.ErrBlockUnavailable || err == torus.ErrNoPeer {
 			clog.Warningf("block %s from %s failed, trying next peer", i, p)
 			promDistBlockPeerFailures.WithLabelValues(p).Inc()
+			if replica && err == torus.ErrBlockUnavailable {
+				stale = append(stale, p)
+			}
 			continue
 		}
 
@@ -174,7 +199,7 @@ func (d *Distributor) getReadFromServer() torus.ReadLevel {
 func (d *Distributor) WriteBlock(ctx context.Context, i torus.BlockRef, data []byte) error {
 	d.mut.RLock()
 	defer d.mut.RUnlock()
-	peers, err := d.ring.GetPeers(i)
+	peers, err := d.getPeers(i)
 	if err != nil {
 		return err
 	}
@@ -183,6 +208,8 @@ func (d *Distributor) WriteBlock(ctx context.Context, i torus.BlockRef, data []b
 	}
 	d.readCache.Put(string(i.ToBytes()), data)
 	switch d.getWriteFromServer() {
+	case torus.WriteQuorum:
+		return d.writeQuorum(ctx, i, data, peers)
 	case torus.WriteLocal:
 		err = d.blocks.WriteBlock(ctx, i, data)
 		if err == nil {
@@ -202,22 +229,33 @@ func (d *Distributor) WriteBlock(ctx context.Context, i torus.BlockRef, data []b
 				}
 			}
 		}
-		for _, p := range peers.Peers {
+		for n, p := range peers.Peers {
 			err = d.client.PutBlock(ctx, p, i, data)
 			if err == nil {
 				return nil
 			}
 			clog.Noticef("WriteOne error, remote: %s", err)
+			if n < peers.Replication {
+				d.hintFailedWrite(p, i, data, err)
+			}
 		}
 		return torus.ErrNoPeer
 	case torus.WriteAll:
+		// INode blocks are pointed at by the metadata service as soon as
+		// they're written, so they aren't left in flight.
+		if d.srv.Cfg.WriteBatch > 0 && i.BlockType() != torus.TypeINode {
+			return d.writeBatched(ctx, i, data, peers)
+		}
 		toWrite := peers.Replication
-		for _, p := range peers.Peers {
+		for n, p := range peers.Peers {
 			var err error
 			if p == d.UUID() {
 				err = d.blocks.WriteBlock(ctx, i, data)
 			} else {
 				err = d.client.PutBlock(ctx, p, i, data)
+				if err != nil && n < peers.Replication {
+					d.hintFailedWrite(p, i, data, err)
+				}
 			}
 			if err != nil {
 				clog.Noticef("error WriteAll to peer %s: %s", p, err)
@@ -265,8 +303,15 @@ func (d *Distributor) BlockIterator() torus.BlockIterator {
 	return d.blocks.BlockIterator()
 }
 
+// Flush waits for any blocks being written in batches, and flushes the local
+// store.
 func (d *Distributor) Flush() error {
-	return d.blocks.Flush()
+	err := d.waitBatches()
+	ferr := d.blocks.Flush()
+	if err != nil {
+		return err
+	}
+	return ferr
 }
 
 func (d *Distributor) Kind() string { return "distributor" }
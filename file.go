@@ -46,6 +46,18 @@ var (
 		Help:    "Histogram of ms taken to write a block through the layers and into the file abstraction",
 		Buckets: prometheus.ExponentialBuckets(50.0, 2, 20),
 	})
+	promFileReadaheadHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_server_file_readahead_hits",
+		Help: "Number of blocks read from a file that had been read ahead",
+	})
+	promFileReadaheadMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_server_file_readahead_misses",
+		Help: "Number of blocks read from a file with readahead that had to be fetched when asked for",
+	})
+	promFileThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_server_file_throttled_seconds",
+		Help: "Seconds reads and writes to a file on this server have been held back by the volume's QoS limits",
+	}, []string{"volume"})
 )
 
 func init() {
@@ -56,6 +68,9 @@ func init() {
 	prometheus.MustRegister(promFileWrittenBytes)
 	prometheus.MustRegister(promFileBlockRead)
 	prometheus.MustRegister(promFileBlockWrite)
+	prometheus.MustRegister(promFileReadaheadHits)
+	prometheus.MustRegister(promFileReadaheadMisses)
+	prometheus.MustRegister(promFileThrottled)
 }
 
 type File struct {
@@ -73,6 +88,7 @@ type File struct {
 	replaces uint64
 	changed  map[string]bool
 	cache    fileCache
+	throttle *Throttle
 
 	writeINodeRef INodeRef
 	writeOpen     bool
@@ -95,7 +111,7 @@ func (s *Server) CreateFile(volume *models.Volume, inode *models.INode, blocks B
 		srv:     s,
 		blocks:  blocks,
 		blkSize: int64(md.BlockSize),
-		cache:   newSingleBlockCache(blocks, md.BlockSize),
+		cache:   newSingleBlockCache(blocks, md.BlockSize, s.Cfg.Readahead),
 	}, nil
 }
 
@@ -125,8 +141,23 @@ func (f *File) writeToBlock(i, from, to int, data []byte) (int, error) {
 	return f.cache.writeToBlock(f.getContext(), i, from, to, data)
 }
 
+// SetQoS limits the reads and writes done through the file to q; nil lifts
+// the limits.
+func (f *File) SetQoS(q *VolumeQoS) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.throttle = NewThrottle(q, promFileThrottled.WithLabelValues(f.volume.Name))
+}
+
+func (f *File) wait(n int) error {
+	f.mut.RLock()
+	t := f.throttle
+	f.mut.RUnlock()
+	return t.Wait(f.getContext(), n)
+}
+
 func (f *File) getContext() context.Context {
-	return f.srv.getContext()
+	return context.WithValue(f.srv.getContext(), CtxFileIO, true)
 }
 
 func (f *File) Write(b []byte) (n int, err error) {
@@ -136,6 +167,9 @@ func (f *File) Write(b []byte) (n int, err error) {
 }
 
 func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
+	if err = f.wait(len(b)); err != nil {
+		return 0, err
+	}
 	f.mut.Lock()
 	defer f.mut.Unlock()
 	err = f.openWrite()
@@ -158,7 +192,7 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 	// Write the front matter, which may dangle from a byte offset
 	blkIndex := int(off / f.blkSize)
 
-	if f.blocks.Length()+1 < blkIndex {
+	if f.blocks.Length() < blkIndex {
 		if clog.LevelAt(capnslog.DEBUG) {
 			clog.Debug("begin write: offset ", off, " size ", len(b))
 			clog.Debug("end of file ", f.blocks.Length(), " blkIndex ", blkIndex)
@@ -202,6 +236,9 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 		panic("Offset not equal to a block boundary")
 	}
 
+	if toWrite >= int(f.blkSize) {
+		f.cache.dropReadahead()
+	}
 	for toWrite >= int(f.blkSize) {
 		blkIndex := int(off / f.blkSize)
 		if clog.LevelAt(capnslog.TRACE) {
@@ -256,6 +293,9 @@ func (f *File) Read(b []byte) (n int, err error) {
 }
 
 func (f *File) ReadAt(b []byte, off int64) (n int, ferr error) {
+	if ferr = f.wait(len(b)); ferr != nil {
+		return 0, ferr
+	}
 	f.mut.RLock()
 	defer f.mut.RUnlock()
 	toRead := len(b)
@@ -327,11 +367,67 @@ func (f *File) Truncate(size int64) error {
 		nBlocks++
 	}
 	clog.Tracef("truncate to %d %d", size, nBlocks)
+	f.cache.dropReadahead()
 	f.blocks.Truncate(int(nBlocks), uint64(f.blkSize))
 	f.inode.Filesize = uint64(size)
 	return nil
 }
 
+// Resize grows or shrinks the file to size, like Truncate, but may be called
+// while the file is being read and written. When shrinking, the data past the
+// new end is zeroed first, so that growing the file again later doesn't bring
+// it back.
+func (f *File) Resize(size int64) error {
+	if size < 0 {
+		return ErrInvalid
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	err := f.openWrite()
+	if err != nil {
+		return err
+	}
+	old := int64(f.inode.Filesize)
+	if size < old {
+		if tail := size % f.blkSize; tail != 0 {
+			zero := make([]byte, f.blkSize-tail)
+			_, err = f.writeToBlock(int(size/f.blkSize), int(tail), int(f.blkSize), zero)
+			if err != nil {
+				return err
+			}
+		}
+		err = f.cache.sync(f.getContext())
+		if err != nil {
+			return err
+		}
+		err = f.Trim(size, old-size)
+		if err != nil {
+			return err
+		}
+	}
+	// The cache may be holding blocks past the new end.
+	f.cache.dropReadahead()
+	f.cache = newSingleBlockCache(f.blocks, uint64(f.blkSize), f.srv.Cfg.Readahead)
+	f.cache.newINode(f.writeINodeRef)
+	return f.Truncate(size)
+}
+
+// Reopen points a read-only file at another version of its contents, such as
+// a newer INode of the same volume. It may be called while the file is being
+// read.
+func (f *File) Reopen(inode *models.INode, blocks Blockset) error {
+	if !f.ReadOnly {
+		return ErrInvalid
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.cache.dropReadahead()
+	f.inode = inode
+	f.blocks = blocks
+	f.cache = newSingleBlockCache(blocks, uint64(f.blkSize), f.srv.Cfg.Readahead)
+	return nil
+}
+
 // Trim zeroes data in the middle of a file.
 func (f *File) Trim(offset, length int64) error {
 	clog.Debugf("trimming %d %d", offset, length)
@@ -345,6 +441,7 @@ func (f *File) Trim(offset, length int64) error {
 		blkFrom += 1
 	}
 	blkTo := (offset + length) / f.blkSize
+	f.cache.dropReadahead()
 	return f.blocks.Trim(int(blkFrom), int(blkTo))
 }
 
@@ -384,6 +481,16 @@ func (f *File) SyncBlocks() error {
 	return f.srv.Blocks.Flush()
 }
 
+// Allocated returns the number of bytes of the file that are backed by
+// written blocks.
+func (f *File) Allocated() uint64 {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	return uint64(AllocatedBlocks(f.blocks)) * uint64(f.blkSize)
+}
+
 func (f *File) Size() uint64 {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
 	return f.inode.Filesize
 }
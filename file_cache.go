@@ -11,6 +11,9 @@ type fileCache interface {
 	writeToBlock(ctx context.Context, i, from, to int, data []byte) (int, error)
 	getBlock(ctx context.Context, i int) ([]byte, error)
 	sync(context.Context) error
+	// dropReadahead forgets any blocks read ahead. It must be called before
+	// changing the Blockset.
+	dropReadahead()
 }
 
 type singleBlockCache struct {
@@ -25,16 +28,20 @@ type singleBlockCache struct {
 
 	readIdx  int
 	readData []byte
+	ra       *readahead
 
 	blkSize uint64
 }
 
-func newSingleBlockCache(bs Blockset, blkSize uint64) *singleBlockCache {
+// newSingleBlockCache creates a singleBlockCache, which reads up to
+// readahead blocks ahead of sequential reads.
+func newSingleBlockCache(bs Blockset, blkSize uint64, readahead int) *singleBlockCache {
 	return &singleBlockCache{
 		readIdx: -1,
 		openIdx: -1,
 		blocks:  bs,
 		blkSize: blkSize,
+		ra:      newReadahead(bs, readahead),
 	}
 }
 
@@ -98,6 +105,7 @@ func (sb *singleBlockCache) sync(ctx context.Context) error {
 	if !sb.openWrote {
 		return nil
 	}
+	sb.dropReadahead()
 	start := time.Now()
 	err := sb.blocks.PutBlock(ctx, sb.ref, sb.openIdx, sb.openData)
 	delta := time.Since(start)
@@ -107,6 +115,15 @@ func (sb *singleBlockCache) sync(ctx context.Context) error {
 }
 
 func (sb *singleBlockCache) openRead(ctx context.Context, i int) error {
+	if sb.ra != nil {
+		d, err := sb.ra.getBlock(ctx, i)
+		if err != nil {
+			return err
+		}
+		sb.readData = d
+		sb.readIdx = i
+		return nil
+	}
 	start := time.Now()
 	d, err := sb.blocks.GetBlock(ctx, i)
 	if err != nil {
@@ -131,3 +148,9 @@ func (sb *singleBlockCache) getBlock(ctx context.Context, i int) ([]byte, error)
 	}
 	return sb.readData, nil
 }
+
+func (sb *singleBlockCache) dropReadahead() {
+	if sb.ra != nil {
+		sb.ra.drop()
+	}
+}
@@ -0,0 +1,155 @@
+package torus
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// readahead fetches the blocks after the one being read, once a file is
+// being read a block after another, so that they're at hand by the time
+// they're asked for. At most window blocks are held or being fetched at
+// once.
+type readahead struct {
+	mut    sync.Mutex
+	blocks Blockset
+	window int
+	// last is the block most recently asked for, and ahead the furthest one
+	// fetched after it. Nothing is fetched ahead until a block is asked for
+	// right after the one before it.
+	last    int
+	ahead   int
+	pending map[int]*prefetch
+	// cancel stops the fetches in pending, once they won't be asked for.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// slots holds a token for every fetch running, including those that
+	// were given up on but haven't returned yet, so that no more than
+	// window run at once.
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+type prefetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newReadahead(bs Blockset, window int) *readahead {
+	if window <= 0 {
+		return nil
+	}
+	return &readahead{
+		blocks:  bs,
+		window:  window,
+		last:    -2,
+		ahead:   -1,
+		pending: make(map[int]*prefetch),
+		slots:   make(chan struct{}, window),
+	}
+}
+
+// getBlock returns the ith block, from those fetched ahead if it's one of
+// them, and starts fetching the blocks after it if reads are sequential.
+func (ra *readahead) getBlock(ctx context.Context, i int) ([]byte, error) {
+	ra.mut.Lock()
+	p := ra.pending[i]
+	if i == ra.last+1 {
+		delete(ra.pending, i)
+		ra.start(ctx, i)
+	} else {
+		// Not sequential; what was fetched won't be asked for.
+		ra.reset()
+		ra.ahead = i
+		p = nil
+	}
+	ra.last = i
+	ra.mut.Unlock()
+
+	if p == nil {
+		promFileReadaheadMisses.Inc()
+		return ra.fetch(ctx, i)
+	}
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if p.err != nil {
+		// Try again, in case it was a passing failure, or the fetch was
+		// cancelled.
+		promFileReadaheadMisses.Inc()
+		return ra.fetch(ctx, i)
+	}
+	promFileReadaheadHits.Inc()
+	return p.data, nil
+}
+
+// start fetches the blocks up to window past i that aren't being fetched
+// already, as long as fewer than window fetches are running. ra.mut must be
+// held.
+func (ra *readahead) start(ctx context.Context, i int) {
+	if ra.ahead < i {
+		ra.ahead = i
+	}
+	if ra.ctx == nil {
+		ra.ctx, ra.cancel = context.WithCancel(ctx)
+	}
+	n := ra.blocks.Length()
+	for ra.ahead < i+ra.window && ra.ahead+1 < n {
+		select {
+		case ra.slots <- struct{}{}:
+		default:
+			// The rest are fetched as the blocks before them are asked for.
+			return
+		}
+		ra.ahead++
+		p := &prefetch{done: make(chan struct{})}
+		ra.pending[ra.ahead] = p
+		ra.wg.Add(1)
+		go func(ctx context.Context, j int) {
+			defer ra.wg.Done()
+			p.data, p.err = ra.fetch(ctx, j)
+			<-ra.slots
+			close(p.done)
+		}(ra.ctx, ra.ahead)
+	}
+}
+
+// reset cancels the fetches in pending and forgets them. ra.mut must be
+// held.
+func (ra *readahead) reset() {
+	if ra.cancel != nil {
+		ra.cancel()
+		ra.ctx, ra.cancel = nil, nil
+	}
+	ra.pending = make(map[int]*prefetch)
+}
+
+func (ra *readahead) fetch(ctx context.Context, i int) ([]byte, error) {
+	start := time.Now()
+	d, err := ra.blocks.GetBlock(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	delta := time.Since(start)
+	promFileBlockRead.Observe(float64(delta.Nanoseconds()) / 1000)
+	return d, nil
+}
+
+// drop cancels the fetches ahead and forgets what they fetched. It's called
+// before the Blockset is changed, which mustn't happen under a fetch, so it
+// returns once the cancelled fetches have. Sequential reads carry on
+// fetching ahead from where they are.
+func (ra *readahead) drop() {
+	if ra == nil {
+		return
+	}
+	ra.mut.Lock()
+	ra.reset()
+	ra.ahead = ra.last
+	ra.mut.Unlock()
+	ra.wg.Wait()
+}
@@ -22,6 +22,12 @@ type GC interface {
 	Clear()
 }
 
+// INodeLister is implemented by GCs that can tell which INodes keep a
+// volume's blocks alive.
+type INodeLister interface {
+	LiveINodes(*models.Volume) ([]torus.INodeRef, error)
+}
+
 type INodeFetcher interface {
 	GetINode(context.Context, torus.INodeRef) (*models.INode, error)
 }
@@ -63,6 +69,24 @@ func (c *controller) IsDead(ref torus.BlockRef) bool {
 	return false
 }
 
+// LiveINodes returns the INodes that keep vol's blocks alive, according to
+// every GC that can tell.
+func (c *controller) LiveINodes(vol *models.Volume) ([]torus.INodeRef, error) {
+	var out []torus.INodeRef
+	for _, x := range c.gcs {
+		l, ok := x.(INodeLister)
+		if !ok {
+			continue
+		}
+		refs, err := l.LiveINodes(vol)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, refs...)
+	}
+	return out, nil
+}
+
 func (c *controller) Clear() {
 	for _, x := range c.gcs {
 		x.Clear()
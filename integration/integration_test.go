@@ -7,13 +7,22 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/blockset"
 	"github.com/coreos/torus/distributor"
 	"github.com/coreos/torus/metadata/temp"
 	"github.com/coreos/torus/models"
@@ -223,6 +232,1388 @@ func TestRewrite(t *testing.T) {
 	closeAll(t, servers...)
 }
 
+func readVol(t *testing.T, server *torus.Server, volname string) []byte {
+	f := openVol(t, server, volname)
+	defer f.Close()
+	output := &bytes.Buffer{}
+	_, err := io.Copy(output, f)
+	if err != nil {
+		t.Fatalf("couldn't copy: %v", err)
+	}
+	return output.Bytes()
+}
+
+func TestClone(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 100
+	data := makeTestData(size)
+	f := createVol(t, client, "testvol", uint64(size))
+	_, err = io.Copy(f, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("couldn't copy: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("couldn't close: %v", err)
+	}
+	blockvol, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blockvol.SaveSnapshot("golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blockvol.CloneSnapshot("golden", "clonevol")
+	if err != nil {
+		t.Fatalf("couldn't clone: %v", err)
+	}
+	err = blockvol.CloneSnapshot("golden", "clonevol")
+	if err != torus.ErrExists {
+		t.Fatalf("expected cloning onto an existing volume to fail, got %v", err)
+	}
+
+	// Writes to the clone don't show through to the original.
+	f = openVol(t, client, "clonevol")
+	patch := makeTestData(BlockSize * 3)
+	_, err = f.WriteAt(patch, BlockSize*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("couldn't close: %v", err)
+	}
+	cloned := make([]byte, size)
+	copy(cloned, data)
+	copy(cloned[BlockSize*10:], patch)
+	if !bytes.Equal(readVol(t, client, "clonevol"), cloned) {
+		t.Error("clone has the wrong contents")
+	}
+	if !bytes.Equal(readVol(t, client, "testvol"), data) {
+		t.Error("original changed along with the clone")
+	}
+	closeAll(t, servers...)
+}
+
+func writeVol(t *testing.T, server *torus.Server, volname string, data []byte, off int64) {
+	f := openVol(t, server, volname)
+	_, err := f.WriteAt(data, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("couldn't close: %v", err)
+	}
+}
+
+func TestSendReceive(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 100
+	data := makeTestData(size)
+	createVol(t, client, "testvol", uint64(size)).Close()
+	writeVol(t, client, "testvol", data, 0)
+	blockvol, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blockvol.SaveSnapshot("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := makeTestData(BlockSize * 2)
+	writeVol(t, client, "testvol", patch, BlockSize*40)
+	copy(data[BlockSize*40:], patch)
+	writeVol(t, client, "testvol", patch[:10], BlockSize*90)
+	copy(data[BlockSize*90:], patch[:10])
+	err = blockvol.SaveSnapshot("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extents, err := blockvol.DiffSnapshots("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []block.Extent{
+		{Offset: BlockSize * 40, Length: BlockSize * 2},
+		{Offset: BlockSize * 90, Length: BlockSize},
+	}
+	if fmt.Sprint(extents) != fmt.Sprint(want) {
+		t.Fatalf("expected extents %v, got %v", want, extents)
+	}
+
+	full := &bytes.Buffer{}
+	err = blockvol.Send(full, "", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	incr := &bytes.Buffer{}
+	err = blockvol.Send(incr, "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = block.ReceiveBlockVolume(client, "copyvol", full, false)
+	if err != nil {
+		t.Fatalf("couldn't receive: %v", err)
+	}
+	before := readVol(t, client, "copyvol")
+
+	// A corrupt stream changes nothing.
+	bad := append([]byte(nil), incr.Bytes()...)
+	bad[len(bad)/2] ^= 0xff
+	_, err = block.ReceiveBlockVolume(client, "copyvol", bytes.NewReader(bad), false)
+	if err != block.ErrBadStream {
+		t.Fatalf("expected a bad stream, got %v", err)
+	}
+	if !bytes.Equal(readVol(t, client, "copyvol"), before) {
+		t.Fatal("corrupt stream changed the volume")
+	}
+
+	h, err := block.ReceiveBlockVolume(client, "copyvol", bytes.NewReader(incr.Bytes()), false)
+	if err != nil {
+		t.Fatalf("couldn't receive: %v", err)
+	}
+	if h.From != "a" || h.To != "b" {
+		t.Fatalf("unexpected stream header %+v", h)
+	}
+	if !bytes.Equal(readVol(t, client, "copyvol"), data) {
+		t.Error("received volume has the wrong contents")
+	}
+
+	// The copy follows the volume's size.
+	err = blockvol.Resize(uint64(size + BlockSize*10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeVol(t, client, "testvol", patch, int64(size))
+	// Leave a hole of a block, so the copy is written a block past its end.
+	writeVol(t, client, "testvol", patch[:10], int64(size+BlockSize*3))
+	data = append(data, patch...)
+	data = append(data, make([]byte, BlockSize*8)...)
+	copy(data[size+BlockSize*3:], patch[:10])
+	err = blockvol.SaveSnapshot("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	incr.Reset()
+	err = blockvol.Send(incr, "b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A corrupt stream doesn't resize the copy either.
+	before = readVol(t, client, "copyvol")
+	bad = append(bad[:0], incr.Bytes()...)
+	bad[len(bad)-2] ^= 0xff
+	_, err = block.ReceiveBlockVolume(client, "copyvol", bytes.NewReader(bad), false)
+	if err != block.ErrBadStream {
+		t.Fatalf("expected a bad stream, got %v", err)
+	}
+	if !bytes.Equal(readVol(t, client, "copyvol"), before) {
+		t.Fatal("corrupt stream changed the volume")
+	}
+	_, err = block.ReceiveBlockVolume(client, "copyvol", incr, false)
+	if err != nil {
+		t.Fatalf("couldn't receive: %v", err)
+	}
+	if !bytes.Equal(readVol(t, client, "copyvol"), data) {
+		t.Error("resized volume was received wrongly")
+	}
+	closeAll(t, servers...)
+}
+
+func TestResize(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 10
+	data := makeTestData(size)
+	createVol(t, client, "testvol", uint64(size)).Close()
+	writeVol(t, client, "testvol", data, 0)
+	blockvol, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSize := func(want int) []byte {
+		out := readVol(t, client, "testvol")
+		if len(out) != want {
+			t.Fatalf("expected %d bytes, read %d", want, len(out))
+		}
+		vol, err := client.MDS.GetVolume("testvol")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vol.MaxBytes != uint64(want) {
+			t.Fatalf("expected volume size %d, got %d", want, vol.MaxBytes)
+		}
+		return out
+	}
+
+	err = blockvol.Resize(uint64(size * 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := checkSize(size * 2)
+	if !bytes.Equal(out[:size], data) || !bytes.Equal(out[size:], make([]byte, size)) {
+		t.Fatal("data changed growing the volume")
+	}
+
+	// Shrinking zeroes what's cut off, even within a block.
+	small := BlockSize*5 + 100
+	err = blockvol.Resize(uint64(small))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSize(small)
+	err = blockvol.Resize(uint64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = checkSize(size)
+	if !bytes.Equal(out[:small], data[:small]) || !bytes.Equal(out[small:], make([]byte, size-small)) {
+		t.Fatal("data past the end came back after shrinking the volume")
+	}
+
+	// An attached volume is resized by its holder.
+	f := openVol(t, client, "testvol")
+	done := make(chan error)
+	go func() {
+		done <- blockvol.Resize(uint64(size * 3))
+	}()
+	for {
+		resized, err := f.CheckResize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resized {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f.Size() != uint64(size*3) {
+		t.Fatalf("expected attached volume to grow to %d bytes, got %d", size*3, f.Size())
+	}
+	_, err = f.WriteAt(data, int64(size*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = checkSize(size * 3)
+	if !bytes.Equal(out[size*2:], data) {
+		t.Fatal("couldn't write past the old end of the attached volume")
+	}
+	closeAll(t, servers...)
+}
+
+func TestReadOnlyAttach(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 10
+	data := makeTestData(size)
+	createVol(t, client, "testvol", uint64(size)).Close()
+	writeVol(t, client, "testvol", data, 0)
+	blockvol, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := openVol(t, client, "testvol")
+	var readers []*block.BlockFile
+	for i := 0; i < 2; i++ {
+		r, err := blockvol.OpenBlockFileReadOnly()
+		if err != nil {
+			t.Fatalf("couldn't attach read-only alongside a writer: %v", err)
+		}
+		readers = append(readers, r)
+	}
+	r := readers[0]
+	read := func() []byte {
+		out := make([]byte, size)
+		_, err := r.ReadAt(out, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	if _, err := r.WriteAt(data[:10], 0); err != torus.ErrLocked {
+		t.Fatalf("expected a read-only attach to refuse writes, got %v", err)
+	}
+
+	vol, err := client.MDS.GetVolume("testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := make(map[torus.BlockRef]bool)
+	for _, srv := range servers {
+		for ref := range volumeBlocks(t, srv, torus.VolumeID(vol.Id)) {
+			old[ref] = true
+		}
+	}
+
+	patch := makeTestData(BlockSize)
+	_, err = w.WriteAt(patch, BlockSize*3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read(), data) {
+		t.Fatal("read-only attach changed before being refreshed")
+	}
+	changed, err := r.Refresh()
+	if err != nil || !changed {
+		t.Fatalf("expected a refresh, got %v, %v", changed, err)
+	}
+	copy(data[BlockSize*3:], patch)
+	if !bytes.Equal(read(), data) {
+		t.Fatal("read-only attach didn't see the writer's sync")
+	}
+	changed, err = r.Refresh()
+	if err != nil || changed {
+		t.Fatalf("expected nothing to refresh, got %v, %v", changed, err)
+	}
+
+	// The second reader still shows the volume from before the sync, so the
+	// blocks only it uses mustn't be collected until it's gone.
+	g, err := block.NewBlockVolGC(client, torus.NewINodeStore(client.Blocks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := func() int {
+		g.Clear()
+		if err := g.PrepVolume(vol); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for ref := range old {
+			if g.IsDead(ref) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := dead(); n != 0 {
+		t.Fatalf("%d blocks of a read-only attach would be collected", n)
+	}
+	err = readers[1].Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readers = readers[:1]
+	if dead() == 0 {
+		t.Fatal("expected the blocks replaced by the sync to be collectable once no reader uses them")
+	}
+
+	holder, err := blockvol.LockHolder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder != client.MDS.UUID() {
+		t.Fatalf("expected the lock to be held by %s, got %q", client.MDS.UUID(), holder)
+	}
+	if err := blockvol.BreakLock("someone-else"); err != torus.ErrLocked {
+		t.Fatalf("expected breaking another holder's lock to fail, got %v", err)
+	}
+	err = blockvol.BreakLock(holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blockvol.BreakLock(holder); err != torus.ErrNotExist {
+		t.Fatalf("expected breaking a released lock to fail, got %v", err)
+	}
+	_, err = w.WriteAt(patch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Sync(); err != torus.ErrLocked {
+		t.Fatalf("expected the old holder's sync to fail, got %v", err)
+	}
+	w.Close()
+	if !bytes.Equal(readVol(t, client, "testvol"), data) {
+		t.Fatal("old holder changed the volume after its lock was broken")
+	}
+	for _, r := range readers {
+		err = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeAll(t, servers...)
+}
+
+func TestSnapshotSchedule(t *testing.T) {
+	servers, mds := ringN(t, 1)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	createVol(t, client, "testvol", BlockSize*10).Close()
+	blockvol, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blockvol.SaveSnapshot("manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blockvol.SetSnapshotSchedule(&block.SnapshotSchedule{Hourly: 2, Weekly: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	counts := []int{1, 1, 2, 2}
+	for i, d := range []time.Duration{0, 30 * time.Minute, 61 * time.Minute, 122 * time.Minute} {
+		err = blockvol.RunSnapshotSchedule(now.Add(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := blockvol.SnapshotScheduleStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(status) != 2 || status[0].Period != "hourly" || status[1].Period != "weekly" {
+			t.Fatalf("unexpected schedule status %+v", status)
+		}
+		if status[0].Count != counts[i] || status[1].Count != 1 {
+			t.Fatalf("after %v: expected %d hourly and 1 weekly snapshots, got %+v", d, counts[i], status)
+		}
+	}
+	snaps, err := blockvol.GetSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pruning leaves snapshots taken by hand alone.
+	if len(snaps) != 4 || snaps[0].Name != "manual" {
+		t.Fatalf("unexpected snapshots %+v", snaps)
+	}
+	closeAll(t, servers...)
+}
+
+// volumeBlocks returns the blocks of a volume that a server stores.
+func volumeBlocks(t *testing.T, srv *torus.Server, vid torus.VolumeID) map[torus.BlockRef]bool {
+	out := make(map[torus.BlockRef]bool)
+	it := srv.Blocks.BlockIterator()
+	defer it.Close()
+	for it.Next() {
+		if ref := it.BlockRef(); ref.Volume() == vid {
+			out[ref] = true
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestVolumeReplication(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = block.CreateBlockVolumeWithOptions(client.MDS, "bad", BlockSize*10, block.VolumeOptions{
+		Spec: blockset.MustParseBlockLayerSpec("crc"),
+	})
+	if err != block.ErrBadSpec {
+		t.Fatalf("expected ErrBadSpec for a spec without a base layer, got %v", err)
+	}
+	for _, rep := range []int{0, 3} {
+		name := fmt.Sprintf("rep%d", rep)
+		err = block.CreateBlockVolumeWithOptions(client.MDS, name, BlockSize*10, block.VolumeOptions{
+			Spec:        blockset.MustParseBlockLayerSpec("crc,base"),
+			Replication: rep,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := openVol(t, client, name)
+		_, err = f.WriteAt(makeTestData(BlockSize*10), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, rep := range []int{0, 3} {
+		vol, err := client.MDS.GetVolume(fmt.Sprintf("rep%d", rep))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vid := torus.VolumeID(vol.Id)
+		got, err := client.MDS.GetVolumeReplication(vid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != rep {
+			t.Fatalf("expected replication %d, got %d", rep, got)
+		}
+		all := make(map[torus.BlockRef]bool)
+		copies := 0
+		for _, srv := range servers {
+			blks := volumeBlocks(t, srv, vid)
+			for ref := range blks {
+				all[ref] = true
+			}
+			copies += len(blks)
+		}
+		want := rep
+		if want == 0 {
+			// The ring's.
+			want = 2
+		}
+		if len(all) == 0 || copies != want*len(all) {
+			t.Fatalf("volume with replication %d: expected %d copies of %d blocks, got %d", rep, want*len(all), len(all), copies)
+		}
+	}
+	closeAll(t, servers...)
+}
+
+func TestThinProvisioning(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	gmd := client.MDS.GlobalMetadata()
+	gmd.OvercommitRatio = 1
+	mds.SetGlobalMetadata(gmd)
+
+	f := createVol(t, client, "testvol", BlockSize*10)
+	_, err = f.WriteAt(makeTestData(BlockSize*3), BlockSize*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := client.MDS.GetVolume("testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := client.MDS.GetVolumeAllocated(torus.VolumeID(vol.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != BlockSize*3 {
+		t.Fatalf("expected %d bytes allocated, got %d", BlockSize*3, used)
+	}
+
+	c, err := block.GetCapacity(client.MDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The ring keeps two copies of each block.
+	if c.Storage != 3*StorageSize || c.Provisioned != 2*BlockSize*10 || c.Limit != c.Storage {
+		t.Fatalf("unexpected capacity %+v", c)
+	}
+	free := (c.Limit - c.Provisioned) / 2
+	err = block.CreateBlockVolume(client.MDS, "toobig", free+1)
+	if err != block.ErrOvercommitted {
+		t.Fatalf("expected ErrOvercommitted, got %v", err)
+	}
+	err = block.CreateBlockVolume(client.MDS, "justright", free)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockvol, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blockvol.Resize(BlockSize * 11)
+	if err != block.ErrOvercommitted {
+		t.Fatalf("expected ErrOvercommitted growing a volume, got %v", err)
+	}
+
+	// Growing through a handle opened before the volume was shrunk is
+	// charged from the volume's current size.
+	stale, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blockvol.Resize(BlockSize * 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stale.Resize(BlockSize * 11)
+	if err != block.ErrOvercommitted {
+		t.Fatalf("expected ErrOvercommitted growing through a stale handle, got %v", err)
+	}
+	err = stale.Resize(BlockSize * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A volume in the trash keeps its blocks, so it's still counted until
+	// it's purged.
+	err = block.TrashBlockVolume(client.MDS, "justright", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := block.GetCapacity(client.MDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Provisioned != c.Provisioned+2*free {
+		t.Fatalf("expected the trash to count towards %d bytes provisioned, got %d", c.Provisioned+2*free, after.Provisioned)
+	}
+	err = block.CreateBlockVolume(client.MDS, "instead", free)
+	if err != block.ErrOvercommitted {
+		t.Fatalf("expected ErrOvercommitted with the space in the trash, got %v", err)
+	}
+	err = block.PurgeExpiredTrash(client.MDS, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// However many are created at once, only as many fit as the ratio
+	// allows.
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			errs <- block.CreateBlockVolume(client.MDS, fmt.Sprintf("racer%d", i), free)
+		}(i)
+	}
+	created := 0
+	for i := 0; i < 4; i++ {
+		switch err := <-errs; err {
+		case nil:
+			created++
+		case block.ErrOvercommitted:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("expected one of the volumes to fit, created %d", created)
+	}
+	closeAll(t, servers...)
+}
+
+func TestRenameAndLabels(t *testing.T) {
+	servers, mds := ringN(t, 1)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = block.CreateBlockVolumeWithOptions(client.MDS, "old", BlockSize*10, block.VolumeOptions{
+		Meta: &torus.VolumeMeta{Owner: "team1", Labels: map[string]string{"app": "db"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeTestData(BlockSize * 10)
+	writeVol(t, client, "old", data, 0)
+	createVol(t, client, "taken", BlockSize).Close()
+
+	blockvol, err := block.OpenBlockVolume(client, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := openVol(t, client, "old")
+	if err = blockvol.Rename("new"); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked renaming an attached volume, got %v", err)
+	}
+	f.Close()
+	if err = blockvol.Rename("taken"); err != torus.ErrExists {
+		t.Fatalf("expected ErrExists renaming onto another volume, got %v", err)
+	}
+	if err = blockvol.Rename("new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.MDS.GetVolume("old"); err == nil {
+		t.Fatal("volume still found under its old name")
+	}
+	if !bytes.Equal(readVol(t, client, "new"), data) {
+		t.Fatal("renamed volume's data differs")
+	}
+
+	vol, err := client.MDS.GetVolume("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := client.MDS.GetVolumeMeta(torus.VolumeID(vol.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Owner != "team1" || meta.LabelString() != "app=db" {
+		t.Fatalf("unexpected volume metadata %+v", meta)
+	}
+	for sel, want := range map[string]bool{
+		"":              true,
+		"app=db":        true,
+		"app==db,!tier": true,
+		"app":           true,
+		"app!=db":       false,
+		"tier":          false,
+		"app=db,tier=x": false,
+	} {
+		s, err := torus.ParseSelector(sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Matches(meta.Labels) != want {
+			t.Errorf("selector %q: expected match %v", sel, want)
+		}
+	}
+	if _, err = torus.ParseSelector("app=a b"); err == nil {
+		t.Error("expected an error for a selector with a space in a value")
+	}
+	closeAll(t, servers...)
+}
+
+func TestQoS(t *testing.T) {
+	servers, mds := ringN(t, 1)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	createVol(t, client, "testvol", BlockSize*10).Close()
+	vol, err := client.MDS.GetVolume("testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vid := torus.VolumeID(vol.Id)
+	q := &torus.VolumeQoS{IOPS: 20, BurstIOPS: 1}
+	err = client.MDS.SetVolumeQoS(vid, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.MDS.GetVolumeQoS(vid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || *got != *q {
+		t.Fatalf("expected QoS %+v, got %+v", q, got)
+	}
+
+	f := openVol(t, client, "testvol")
+	data := makeTestData(BlockSize)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		_, err = f.WriteAt(data, int64(i*BlockSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first write takes the burst; the other nine wait 50ms each.
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("10 writes at 20 IOPS took only %v", d)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.MDS.SetVolumeQoS(vid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = client.MDS.GetVolumeQoS(vid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Fatalf("expected no QoS after clearing it, got %+v", got)
+	}
+	closeAll(t, servers...)
+}
+
+func TestTrash(t *testing.T) {
+	servers, mds := ringN(t, 1)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	f := createVol(t, client, "testvol", BlockSize*10)
+	data := makeTestData(BlockSize * 10)
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = block.TrashBlockVolume(client.MDS, "testvol", time.Hour); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked deleting an attached volume, got %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := client.MDS.GetVolume("testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vid := torus.VolumeID(vol.Id)
+	err = block.TrashBlockVolume(client.MDS, "testvol", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.MDS.GetVolume("testvol"); err == nil {
+		t.Fatal("deleted volume still found")
+	}
+	trash, err := client.MDS.GetTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Volume.Id != uint64(vid) || trash[0].Expired(time.Now()) {
+		t.Fatalf("unexpected trash %+v", trash)
+	}
+
+	// Not yet expired, so nothing is purged.
+	err = block.PurgeExpiredTrash(client.MDS, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	createVol(t, client, "testvol", BlockSize).Close()
+	if err = block.UndeleteBlockVolume(client.MDS, vid, "testvol"); err != torus.ErrExists {
+		t.Fatalf("expected ErrExists undeleting onto another volume, got %v", err)
+	}
+	err = block.UndeleteBlockVolume(client.MDS, vid, "restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readVol(t, client, "restored"), data) {
+		t.Fatal("undeleted volume's data differs")
+	}
+	if trash, err = client.MDS.GetTrash(); err != nil || len(trash) != 0 {
+		t.Fatalf("expected an empty trash, got %+v, %v", trash, err)
+	}
+
+	err = block.TrashBlockVolume(client.MDS, "restored", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = block.PurgeExpiredTrash(client.MDS, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trash, err = client.MDS.GetTrash(); err != nil || len(trash) != 0 {
+		t.Fatalf("expected expired volume to be purged, got %+v, %v", trash, err)
+	}
+	if err = block.UndeleteBlockVolume(client.MDS, vid, "restored"); err != torus.ErrNotExist {
+		t.Fatalf("expected ErrNotExist undeleting a purged volume, got %v", err)
+	}
+	closeAll(t, servers...)
+}
+
+func TestQuorum(t *testing.T) {
+	servers, mds := ringN(t, 4)
+	quorumClient := func() *torus.Server {
+		client := newServer(t, mds)
+		client.Cfg.WriteLevel = torus.WriteQuorum
+		client.Cfg.ReadLevel = torus.ReadQuorum
+		err := distributor.OpenReplication(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	client := quorumClient()
+	defer client.Close()
+	err := block.CreateBlockVolumeWithOptions(client.MDS, "testvol", BlockSize*10, block.VolumeOptions{
+		Replication: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeTestData(BlockSize * 10)
+	writeVol(t, client, "testvol", data, 0)
+
+	// A fresh client has nothing cached, so every block is read from a
+	// quorum of replicas.
+	reader := quorumClient()
+	defer reader.Close()
+	if !bytes.Equal(readVol(t, reader, "testvol"), data) {
+		t.Fatal("data read at quorum differs from data written")
+	}
+
+	// With a replica down, the rest still make a majority of them, for
+	// writes and reads alike.
+	closeAll(t, servers[3])
+	servers = servers[:3]
+	data = makeTestData(BlockSize * 10)
+	writeVol(t, client, "testvol", data, 0)
+	reader = quorumClient()
+	defer reader.Close()
+	if !bytes.Equal(readVol(t, reader, "testvol"), data) {
+		t.Fatal("data read at quorum with a replica down differs from data written")
+	}
+
+	// The block is also written to the peer after the replicas in its
+	// place, but as reads don't ask it, it doesn't count towards the
+	// quorum.
+	strict := quorumClient()
+	defer strict.Close()
+	strict.Cfg.WriteQuorum = 3
+	f := openVol(t, strict, "testvol")
+	_, err = f.WriteAt(makeTestData(BlockSize*10), 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		t.Fatal("expected writing to every replica with one down to fail")
+	}
+	closeAll(t, servers...)
+}
+
+func TestReadRepair(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	data := makeTestData(BlockSize * 10)
+	createVol(t, client, "testvol", BlockSize*10).Close()
+	writeVol(t, client, "testvol", data, 0)
+	vol, err := client.MDS.GetVolume("testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vid := torus.VolumeID(vol.Id)
+
+	// Lose each block from the replica that's read first.
+	r, err := client.MDS.GetRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := make(map[torus.BlockRef]*torus.Server)
+	for _, srv := range servers {
+		for ref := range volumeBlocks(t, srv, vid) {
+			perm, err := r.GetPeers(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm.Peers[0] != srv.MDS.UUID() {
+				continue
+			}
+			err = srv.Blocks.DeleteBlock(context.TODO(), ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lost[ref] = srv
+		}
+	}
+	if len(lost) == 0 {
+		t.Fatal("no blocks to lose")
+	}
+
+	// A fresh client has nothing cached, so reads fall through to the
+	// second replica, and repair the first.
+	reader := newServer(t, mds)
+	err = distributor.OpenReplication(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if !bytes.Equal(readVol(t, reader, "testvol"), data) {
+		t.Fatal("data read past lost replicas differs")
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(lost) != 0; {
+		for ref, srv := range lost {
+			if volumeBlocks(t, srv, vid)[ref] {
+				delete(lost, ref)
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d lost blocks weren't repaired", len(lost))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	closeAll(t, servers...)
+}
+
+func TestHintedHandoff(t *testing.T) {
+	servers, mds := createN(t, 2)
+	// The third peer is in the ring, but down for now.
+	late := newServer(t, mds)
+	var peers torus.PeerInfoList
+	for _, s := range append(servers, late) {
+		peers = append(peers, &models.PeerInfo{
+			UUID:        s.MDS.UUID(),
+			TotalBlocks: StorageSize / BlockSize,
+		})
+	}
+	r, err := ring.CreateRing(&models.Ring{
+		Type:              uint32(ring.Ketama),
+		Peers:             peers,
+		ReplicationFactor: 2,
+		Version:           2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mds.SetRing(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newServer(t, mds)
+	err = distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = block.CreateBlockVolumeWithOptions(client.MDS, "testvol", BlockSize*10, block.VolumeOptions{
+		Replication: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeTestData(BlockSize * 10)
+	writeVol(t, client, "testvol", data, 0)
+
+	hintDir := filepath.Join(client.Cfg.DataDir, "hints", late.MDS.UUID())
+	hints, err := ioutil.ReadDir(hintDir)
+	if err != nil || len(hints) == 0 {
+		t.Fatalf("expected hints for the down peer, got %d, %v", len(hints), err)
+	}
+
+	uri, err := url.Parse("http://127.0.0.1:40002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = distributor.ListenReplication(late, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers = append(servers, late)
+	for deadline := time.Now().Add(15 * time.Second); ; {
+		hints, err = ioutil.ReadDir(hintDir)
+		if (err == nil && len(hints) == 0) || os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d hints weren't handed off, %v", len(hints), err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	vol, err := client.MDS.GetVolume("testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vid := torus.VolumeID(vol.Id)
+	want := volumeBlocks(t, servers[0], vid)
+	got := volumeBlocks(t, late, vid)
+	for ref := range want {
+		if !got[ref] {
+			t.Fatalf("block %s missing from the peer that was down", ref)
+		}
+	}
+	closeAll(t, servers...)
+}
+
+func TestBatchedWrites(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	client := newServer(t, mds)
+	client.Cfg.WriteBatch = 4
+	client.Cfg.WriteWindow = 2
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	data := makeTestData(BlockSize * 100)
+	createVol(t, client, "testvol", uint64(len(data))).Close()
+	f := openVol(t, client, "testvol")
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks still in flight are read back from the distributor.
+	buf := make([]byte, len(data))
+	_, err = f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("data read back while being written differs")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol, err := client.MDS.GetVolume("testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vid := torus.VolumeID(vol.Id)
+	all := make(map[torus.BlockRef]bool)
+	copies := 0
+	for _, srv := range servers {
+		blks := volumeBlocks(t, srv, vid)
+		for ref := range blks {
+			all[ref] = true
+		}
+		copies += len(blks)
+	}
+	if len(all) < 100 || copies != 2*len(all) {
+		t.Fatalf("expected 2 copies of at least 100 blocks, got %d of %d", copies, len(all))
+	}
+
+	reader := newServer(t, mds)
+	err = distributor.OpenReplication(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if !bytes.Equal(readVol(t, reader, "testvol"), data) {
+		t.Fatal("data written in batches differs")
+	}
+	closeAll(t, servers...)
+}
+
+func TestBatchedWritesToSpares(t *testing.T) {
+	servers, mds := createN(t, 3)
+	// The fourth peer is in the ring, but down, so its blocks go to the
+	// peers after it instead.
+	down := newServer(t, mds)
+	var peers torus.PeerInfoList
+	for _, s := range append(servers, down) {
+		peers = append(peers, &models.PeerInfo{
+			UUID:        s.MDS.UUID(),
+			TotalBlocks: StorageSize / BlockSize,
+		})
+	}
+	r, err := ring.CreateRing(&models.Ring{
+		Type:              uint32(ring.Ketama),
+		Peers:             peers,
+		ReplicationFactor: 2,
+		Version:           2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mds.SetRing(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newServer(t, mds)
+	client.Cfg.WriteBatch = 4
+	err = distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	data := makeTestData(BlockSize * 100)
+	createVol(t, client, "testvol", uint64(len(data))).Close()
+	writeVol(t, client, "testvol", data, 0)
+
+	vol, err := client.MDS.GetVolume("testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vid := torus.VolumeID(vol.Id)
+	copies := make(map[torus.BlockRef]int)
+	for _, srv := range servers {
+		for ref := range volumeBlocks(t, srv, vid) {
+			copies[ref]++
+		}
+	}
+	if len(copies) < 100 {
+		t.Fatalf("expected at least 100 blocks, got %d", len(copies))
+	}
+	for ref, n := range copies {
+		if n != 2 {
+			t.Fatalf("expected 2 copies of block %s, got %d", ref, n)
+		}
+	}
+	closeAll(t, servers...)
+}
+
+func TestReadahead(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	client := newServer(t, mds)
+	client.Cfg.Readahead = 4
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	data := makeTestData(BlockSize * 50)
+	// Without a CRC layer, nothing but readahead keeps fetches from running
+	// under changes to the Blockset.
+	err = block.CreateBlockVolumeWithSpec(client.MDS, "testvol", uint64(len(data)), blockset.MustParseBlockLayerSpec("base"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := openVol(t, client, "testvol")
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read in order, a piece of a block at a time, as over NBD.
+	hits, misses := readaheadCounts()
+	buf := make([]byte, len(data))
+	for off := 0; off < len(buf); off += BlockSize / 4 {
+		_, err = f.ReadAt(buf[off:off+BlockSize/4], int64(off))
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("data read in order differs")
+	}
+	// Only the first two blocks aren't read ahead: the second is what shows
+	// the reads are in order.
+	hits, misses = expectReadahead(t, hits, misses, 48, 2)
+
+	// Overwrite blocks that were read ahead, and read on through them.
+	for off := 0; off < 10*BlockSize; off += BlockSize {
+		_, err = f.ReadAt(buf[off:off+BlockSize], int64(off))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	hits, misses = expectReadahead(t, hits, misses, 8, 2)
+	copy(data[11*BlockSize:13*BlockSize], makeTestData(2*BlockSize))
+	_, err = f.WriteAt(data[11*BlockSize:13*BlockSize], 11*BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off := 10 * BlockSize; off < 20*BlockSize; off += BlockSize {
+		_, err = f.ReadAt(buf[off:off+BlockSize], int64(off))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf[:20*BlockSize], data[:20*BlockSize]) {
+		t.Fatal("data read after overwriting blocks read ahead differs")
+	}
+	// The write drops what was read ahead, but the reads are still known
+	// to be in order, so only the block after it has to be fetched.
+	expectReadahead(t, hits, misses, 9, 1)
+
+	// Grow the file while it's being read in order, with blocks being
+	// fetched ahead.
+	reading, done := make(chan struct{}), make(chan error)
+	go func() {
+		rbuf := make([]byte, BlockSize)
+		for off := 0; off < len(data); off += BlockSize {
+			if off == 4*BlockSize {
+				close(reading)
+			}
+			_, err := f.ReadAt(rbuf, int64(off))
+			if err != nil {
+				done <- err
+				return
+			}
+			if !bytes.Equal(rbuf, data[off:off+BlockSize]) {
+				done <- fmt.Errorf("block %d read while growing differs", off/BlockSize)
+				return
+			}
+		}
+		done <- nil
+	}()
+	<-reading
+	err = f.Resize(uint64(len(data) + 10*BlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, make([]byte, 10*BlockSize)...)
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readVol(t, client, "testvol"), data) {
+		t.Fatal("data differs after sync")
+	}
+	closeAll(t, servers...)
+}
+
+// readaheadCounts returns the torus_server_file_readahead_hits and _misses
+// metrics.
+func readaheadCounts() (hits, misses int) {
+	w := httptest.NewRecorder()
+	prometheus.UninstrumentedHandler().ServeHTTP(w, &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/metrics"},
+		Header: http.Header{},
+	})
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		n, err := strconv.ParseFloat(f[1], 64)
+		if err != nil {
+			continue
+		}
+		switch f[0] {
+		case "torus_server_file_readahead_hits":
+			hits = int(n)
+		case "torus_server_file_readahead_misses":
+			misses = int(n)
+		}
+	}
+	return hits, misses
+}
+
+// expectReadahead checks that the readahead metrics went up by hits and
+// misses since they were last read, and returns them as they are now.
+func expectReadahead(t *testing.T, lastHits, lastMisses, hits, misses int) (int, int) {
+	h, m := readaheadCounts()
+	if h-lastHits != hits || m-lastMisses != misses {
+		t.Fatalf("expected %d blocks read ahead and %d not, got %d and %d", hits, misses, h-lastHits, m-lastMisses)
+	}
+	return h, m
+}
+
 func BenchmarkLoadOne(b *testing.B) {
 	b.StopTimer()
 
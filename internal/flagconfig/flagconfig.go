@@ -14,6 +14,7 @@ import (
 	"strings"
 
 	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
 	cli "github.com/coreos/torus/cliconfig"
 	"github.com/dustin/go-humanize"
 	flag "github.com/spf13/pflag"
@@ -31,25 +32,37 @@ var (
 	readCacheSize     uint64
 	readLevel         string
 	writeLevel        string
+	readQuorum        int
+	writeQuorum       int
+	writeBatch        int
+	writeWindow       int
 	etcdAddress       string
 	etcdCertFile      string
 	etcdKeyFile       string
 	etcdCAFile        string
 	config            string
 	profile           string
+	keyFile           string
+	keystoreDir       string
 )
 
 func AddConfigFlags(set *flag.FlagSet) {
 	set.StringVarP(&localBlockSizeStr, "write-cache-size", "", "128MiB", "Maximum amount of memory to use for the local write cache")
 	set.StringVarP(&readCacheSizeStr, "read-cache-size", "", "50MiB", "Amount of memory to use for read cache")
-	set.StringVarP(&readLevel, "read-level", "", "block", "Read replication level (spread, seq or block)")
-	set.StringVarP(&writeLevel, "write-level", "", "all", "Write replication level (all, one or local)")
+	set.StringVarP(&readLevel, "read-level", "", "block", "Read replication level (spread, seq, block or quorum)")
+	set.StringVarP(&writeLevel, "write-level", "", "all", "Write replication level (all, one, local or quorum)")
+	set.IntVarP(&readQuorum, "read-quorum", "", 0, "Number of replicas that must agree on a block at read-level quorum (default a majority)")
+	set.IntVarP(&writeBatch, "write-batch", "", 0, "Most blocks to send to a peer at once at write-level all, writing in the background until the next sync; 0 writes each block before going on")
+	set.IntVarP(&writeWindow, "write-window", "", 4, "Number of batches of blocks that may be in flight to each peer with write-batch")
+	set.IntVarP(&writeQuorum, "write-quorum", "", 0, "Number of replicas that must take a block at write-level quorum (default a majority)")
 	set.StringVarP(&etcdAddress, "etcd", "C", "", "Address for talking to etcd (default \"127.0.0.1:2379\")")
 	set.StringVarP(&etcdCertFile, "etcd-cert-file", "", "", "Certificate to use to authenticate against etcd")
 	set.StringVarP(&etcdKeyFile, "etcd-key-file", "", "", "Key for Certificate")
 	set.StringVarP(&etcdCAFile, "etcd-ca-file", "", "", "CA to authenticate etcd against")
 	set.StringVarP(&config, "config", "", "", "path to torus config file")
 	set.StringVarP(&profile, "profile", "", "default", "profile to use in torus config file")
+	set.StringVarP(&keyFile, "encryption-key-file", "", "", "Master key file from which encrypted volume keys are derived")
+	set.StringVarP(&keystoreDir, "encryption-keystore", "", "", "Local keystore directory holding encrypted volume keys")
 }
 
 func defaultConfigPath() string {
@@ -127,15 +140,49 @@ func BuildConfigFromFlags() torus.Config {
 		os.Exit(1)
 	}
 
+	if readQuorum < 0 || writeQuorum < 0 {
+		fmt.Fprintf(os.Stderr, "read-quorum and write-quorum can't be negative\n")
+		os.Exit(1)
+	}
+	if writeBatch < 0 || writeBatch > 255 || writeWindow < 1 {
+		fmt.Fprintf(os.Stderr, "write-batch must be between 0 and 255, and write-window at least 1\n")
+		os.Exit(1)
+	}
+
 	if etcdAddress == "" {
 		etcdAddress = defaultEtcdAddress
 	}
 
+	if keyFile != "" && keystoreDir != "" {
+		fmt.Fprintf(os.Stderr, "only one of encryption-key-file and encryption-keystore may be given\n")
+		os.Exit(1)
+	}
+	if keyFile != "" {
+		kp, err := blockset.NewKeyFileProvider(keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading encryption-key-file: %s\n", err)
+			os.Exit(1)
+		}
+		blockset.SetKeyProvider(kp)
+	}
+	if keystoreDir != "" {
+		kp, err := blockset.NewKeystoreProvider(keystoreDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error opening encryption-keystore: %s\n", err)
+			os.Exit(1)
+		}
+		blockset.SetKeyProvider(kp)
+	}
+
 	cfg := torus.Config{
 		StorageSize:     localBlockSize,
 		ReadCacheSize:   readCacheSize,
 		WriteLevel:      wl,
 		ReadLevel:       rl,
+		WriteQuorum:     writeQuorum,
+		ReadQuorum:      readQuorum,
+		WriteBatch:      writeBatch,
+		WriteWindow:     writeWindow,
 		MetadataAddress: etcdAddress,
 	}
 	etcdURL, err := url.Parse(etcdAddress)
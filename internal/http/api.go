@@ -5,6 +5,7 @@ import (
 
 	"github.com/DeanThompson/ginpprof"
 	"github.com/coreos/torus"
+	"github.com/coreos/torus/distributor/scrub"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -29,6 +30,7 @@ func NewServer(dfs *torus.Server) *Server {
 
 func (s *Server) setupRoutes() {
 	s.router.GET("/metrics", s.prometheus)
+	s.router.GET("/scrub", s.scrubStatus)
 	ginpprof.Wrapper(s.router)
 }
 
@@ -36,6 +38,19 @@ func (s *Server) prometheus(c *gin.Context) {
 	s.promHandler.ServeHTTP(c.Writer, c.Request)
 }
 
+type scrubStatuser interface {
+	ScrubStatus() scrub.Status
+}
+
+func (s *Server) scrubStatus(c *gin.Context) {
+	ss, ok := s.dfs.Blocks.(scrubStatuser)
+	if !ok {
+		c.JSON(http.StatusOK, scrub.Status{})
+		return
+	}
+	c.JSON(http.StatusOK, ss.ScrubStatus())
+}
+
 func ServeHTTP(addr string, srv *torus.Server) error {
 	return NewServer(srv).router.Run(addr)
 }
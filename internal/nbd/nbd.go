@@ -43,9 +43,9 @@ const (
 
 const (
 	flagHasFlags  = (1 << 0) // nbd-server supports flags
+	flagReadOnly  = (1 << 1) // device is read-only
 	flagSendFlush = (1 << 2) // can flush writeback cache
 	flagSendTrim  = (1 << 5) // Send TRIM (discard)
-	// flagReadOnly   = (1 << 1) // device is read-only
 	// flagSendFUA    = (1 << 3) // Send FUA (Force Unit Access)
 	// flagRotational = (1 << 4) // Use elevator algorithm - rotational media
 )
@@ -80,6 +80,10 @@ type Device interface {
 }
 
 type NBD struct {
+	// ReadOnly makes the kernel refuse writes to the device. It must be
+	// set before calling Serve.
+	ReadOnly bool
+
 	device    Device
 	size      int64
 	blocksize int64
@@ -185,7 +189,11 @@ func (nbd *NBD) Serve() error {
 		// even when disconnected. Changing it only when connected is fine -- but keep my intent.
 		blksized = false
 	}
-	if err := ioctl(nbd.nbd.Fd(), ioctlSetFlags, uintptr(flagSendFlush|flagSendTrim)); err != nil {
+	flags := uintptr(flagSendFlush | flagSendTrim)
+	if nbd.ReadOnly {
+		flags = flagReadOnly
+	}
+	if err := ioctl(nbd.nbd.Fd(), ioctlSetFlags, flags); err != nil {
 		switch err {
 		case syscall.ENOTTY:
 			clog.Error(fmt.Sprintf("ioctl returned: %v. kernel version may be old. flush thread will run every 30sec", err))
@@ -1,6 +1,8 @@
 package torustcmu
 
 import (
+	"encoding/binary"
+
 	"github.com/coreos/go-tcmu"
 	"github.com/coreos/go-tcmu/scsi"
 )
@@ -15,6 +17,29 @@ func (h *torusHandler) handleSyncCommand(cmd *tcmu.SCSICmd) (tcmu.SCSIResponse,
 	return cmd.Ok(), nil
 }
 
+const serviceActionReadCapacity16 = 0x10
+
+// handleReadCapacity16 reports the volume's current size, rather than the
+// size it had when the device was set up, so that a resize shows up on a
+// rescan.
+func (h *torusHandler) handleReadCapacity16(cmd *tcmu.SCSICmd) (tcmu.SCSIResponse, error) {
+	blockSize := uint64(cmd.Device().Sizes().BlockSize)
+	data := make([]byte, 32)
+	// The address of the last block, not the number of them.
+	binary.BigEndian.PutUint64(data[0:8], h.file.Size()/blockSize-1)
+	binary.BigEndian.PutUint32(data[8:12], uint32(blockSize))
+	n, err := cmd.Write(data)
+	if err != nil {
+		clog.Errorf("readCapacity16 failed: %v", err)
+		return cmd.MediumError(), nil
+	}
+	if n < len(data) {
+		clog.Error("readCapacity16 failed: unable to copy enough data")
+		return cmd.MediumError(), nil
+	}
+	return cmd.Ok(), nil
+}
+
 func (h *torusHandler) handleReportDeviceID(cmd *tcmu.SCSICmd) (tcmu.SCSIResponse, error) {
 	v := h.name
 	// The SCSI spec only allows lengths representable in one byte (byte 3). We
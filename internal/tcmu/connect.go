@@ -2,6 +2,8 @@ package torustcmu
 
 import (
 	"fmt"
+	"io/ioutil"
+	"strconv"
 
 	"github.com/coreos/go-tcmu"
 	"github.com/coreos/go-tcmu/scsi"
@@ -12,6 +14,7 @@ import (
 const (
 	defaultBlockSize = 4 * 1024
 	devPath          = "/dev/torus"
+	hbaNumber        = 30
 )
 
 var clog = capnslog.NewPackageLogger("github.com/coreos/torus", "tcmu")
@@ -23,7 +26,7 @@ func ConnectAndServe(f *block.BlockFile, name string, closer chan bool) error {
 		VendorID: tcmu.GenerateSerial(name),
 	}
 	h := &tcmu.SCSIHandler{
-		HBA:        30,
+		HBA:        hbaNumber,
 		LUN:        0,
 		WWN:        wwn,
 		VolumeName: name,
@@ -49,10 +52,24 @@ func ConnectAndServe(f *block.BlockFile, name string, closer chan bool) error {
 	}
 	defer d.Close()
 	fmt.Printf("Attached to %s/%s. Server loop begins ... \n", devPath, name)
+	go f.WatchResize(closer, func(size uint64) {
+		if err := setDevSize(name, size); err != nil {
+			clog.Errorf("couldn't tell the kernel about the new size: %v", err)
+			return
+		}
+		fmt.Printf("Volume resized to %d bytes; rescan the SCSI device to see it.\n", size)
+	})
 	<-closer
 	return nil
 }
 
+// setDevSize changes the size of the device as the kernel sees it, so that it
+// lets I/O through up to the new end.
+func setDevSize(name string, size uint64) error {
+	path := fmt.Sprintf("/sys/kernel/config/target/core/user_%d/%s/attrib/dev_size", hbaNumber, name)
+	return ioutil.WriteFile(path, []byte(strconv.FormatUint(size, 10)), 0644)
+}
+
 type torusHandler struct {
 	file *block.BlockFile
 	name string
@@ -66,6 +83,9 @@ func (h *torusHandler) HandleCommand(cmd *tcmu.SCSICmd) (tcmu.SCSIResponse, erro
 	case scsi.TestUnitReady:
 		return tcmu.EmulateTestUnitReady(cmd)
 	case scsi.ServiceActionIn16:
+		if cmd.GetCDB(1)&0x1f == serviceActionReadCapacity16 {
+			return h.handleReadCapacity16(cmd)
+		}
 		return tcmu.EmulateServiceActionIn(cmd)
 	case scsi.ModeSense, scsi.ModeSense10:
 		return tcmu.EmulateModeSense(cmd, true)
@@ -0,0 +1,120 @@
+package torus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// VolumeMeta is descriptive metadata kept with a volume, for the tools that
+// manage it. Torus itself doesn't act on it.
+type VolumeMeta struct {
+	// Owner is the user or tenant the volume belongs to.
+	Owner  string            `json:"owner,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Selector picks out volumes by their labels. It's a list of requirements,
+// all of which must hold, in the form used by Kubernetes: "key=value" or
+// "key==value", "key!=value", "key" for a key that's set, and "!key" for one
+// that isn't.
+type Selector []Requirement
+
+// Requirement is one term of a Selector.
+type Requirement struct {
+	Key   string
+	Value string
+	// Op is one of "=", "!=", "exists" and "!".
+	Op string
+}
+
+// ParseSelector parses a comma-separated Selector. The empty string selects
+// everything.
+func ParseSelector(s string) (Selector, error) {
+	var out Selector
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return out, nil
+	}
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		var r Requirement
+		switch {
+		case strings.Contains(term, "!="):
+			p := strings.SplitN(term, "!=", 2)
+			r = Requirement{Key: p[0], Value: p[1], Op: "!="}
+		case strings.Contains(term, "=="):
+			p := strings.SplitN(term, "==", 2)
+			r = Requirement{Key: p[0], Value: p[1], Op: "="}
+		case strings.Contains(term, "="):
+			p := strings.SplitN(term, "=", 2)
+			r = Requirement{Key: p[0], Value: p[1], Op: "="}
+		case strings.HasPrefix(term, "!"):
+			r = Requirement{Key: term[1:], Op: "!"}
+		default:
+			r = Requirement{Key: term, Op: "exists"}
+		}
+		r.Key = strings.TrimSpace(r.Key)
+		r.Value = strings.TrimSpace(r.Value)
+		if err := ValidateLabel(r.Key, r.Value); err != nil {
+			return nil, fmt.Errorf("bad selector %q: %v", term, err)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// Matches returns whether a volume with the given labels is selected.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		v, ok := labels[r.Key]
+		switch r.Op {
+		case "=":
+			if !ok || v != r.Value {
+				return false
+			}
+		case "!=":
+			if ok && v == r.Value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ValidateLabel checks that a label's key is non-empty, and that neither the
+// key nor the value holds characters used to write selectors.
+func ValidateLabel(key, value string) error {
+	if key == "" {
+		return fmt.Errorf("empty label key")
+	}
+	if strings.ContainsAny(key, "=!, ") {
+		return fmt.Errorf("label key %q may not contain '=', '!', ',' or spaces", key)
+	}
+	if strings.ContainsAny(value, "=!, ") {
+		return fmt.Errorf("label value %q may not contain '=', '!', ',' or spaces", value)
+	}
+	return nil
+}
+
+// LabelString returns the labels as comma-separated "key=value" pairs,
+// sorted by key.
+func (m *VolumeMeta) LabelString() string {
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + m.Labels[k]
+	}
+	return strings.Join(keys, ",")
+}
@@ -3,6 +3,7 @@ package torus
 import (
 	"fmt"
 	"io"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -53,6 +54,45 @@ type MetadataService interface {
 	CommitINodeIndex(VolumeID) (INodeID, error)
 	GetINodeIndex(VolumeID) (INodeID, error)
 	GetLockStatus(vid uint64) string
+
+	// GetVolumeAllocated returns the number of bytes of a volume that are
+	// backed by written blocks, as of its last sync.
+	GetVolumeAllocated(VolumeID) (uint64, error)
+
+	// GetVolumeReplication returns the number of peers that keep each of a
+	// volume's blocks, or 0 if it follows the ring's replication factor.
+	GetVolumeReplication(VolumeID) (int, error)
+
+	// GetVolumeMeta returns the owner and labels of a volume.
+	GetVolumeMeta(VolumeID) (*VolumeMeta, error)
+	// SetVolumeMeta replaces the owner and labels of a volume.
+	SetVolumeMeta(VolumeID, *VolumeMeta) error
+
+	// GetVolumeQoS returns the I/O limits of a volume, or nil if it has
+	// none.
+	GetVolumeQoS(VolumeID) (*VolumeQoS, error)
+	// SetVolumeQoS sets the I/O limits of a volume; nil clears them.
+	SetVolumeQoS(VolumeID, *VolumeQoS) error
+
+	// GetTrash returns the deleted volumes that haven't been purged yet,
+	// including any that have expired.
+	GetTrash() ([]TrashedVolume, error)
+	// GetVolumesAndTrash returns the volumes and the trash as of the same
+	// moment, so that a volume moving between them is in one or the other.
+	GetVolumesAndTrash() ([]*models.Volume, []TrashedVolume, error)
+}
+
+// TrashedVolume is a deleted volume, which can be restored until it expires.
+// Its blocks are kept until then.
+type TrashedVolume struct {
+	Volume    *models.Volume
+	DeletedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Expired returns whether the volume's retention is over as of now.
+func (t TrashedVolume) Expired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
 }
 
 type DebugMetadataService interface {
@@ -62,6 +102,10 @@ type DebugMetadataService interface {
 type GlobalMetadata struct {
 	BlockSize        uint64
 	DefaultBlockSpec BlockLayerSpec
+	// OvercommitRatio is how far the volumes' provisioned sizes, times their
+	// replication, may add up to beyond the storage in the ring, as a
+	// multiple of it. 0 doesn't limit them.
+	OvercommitRatio float64 `json:",omitempty"`
 }
 
 // CreateMetadataServiceFunc is the signature of a constructor used to create
@@ -14,6 +14,7 @@ import (
 
 	etcdv3 "github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/coreos/pkg/capnslog"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
@@ -311,6 +312,14 @@ func (c *etcdCtx) GetVolumes() ([]*models.Volume, torus.VolumeID, error) {
 	return out, torus.VolumeID(highwater), nil
 }
 
+// ForgetVolume drops this client's cached copy of the named volume, after it
+// has been changed.
+func (e *Etcd) ForgetVolume(volume string) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	delete(e.volumesCache, volume)
+}
+
 func (c *etcdCtx) GetVolume(volume string) (*models.Volume, error) {
 	if v, ok := c.etcd.volumesCache[volume]; ok {
 		return v, nil
@@ -355,6 +364,150 @@ func (c *etcdCtx) GetLockStatus(vid uint64) string {
 	return "in-use"
 }
 
+func (c *etcdCtx) GetTrash() ([]torus.TrashedVolume, error) {
+	resp, err := c.etcd.Client.Get(c.getContext(), MkKey("trash"), etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalTrash(resp.Kvs)
+}
+
+func (c *etcdCtx) GetVolumesAndTrash() ([]*models.Volume, []torus.TrashedVolume, error) {
+	promOps.WithLabelValues("get-volumes").Inc()
+	resp, err := c.etcd.Client.Txn(c.getContext()).Then(
+		etcdv3.OpGet(MkKey("volumeid"), etcdv3.WithPrefix()),
+		etcdv3.OpGet(MkKey("trash"), etcdv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	var vols []*models.Volume
+	for _, x := range resp.Responses[0].GetResponseRange().Kvs {
+		v := &models.Volume{}
+		err := v.Unmarshal(x.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		vols = append(vols, v)
+	}
+	trash, err := unmarshalTrash(resp.Responses[1].GetResponseRange().Kvs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vols, trash, nil
+}
+
+func unmarshalTrash(kvs []*mvccpb.KeyValue) ([]torus.TrashedVolume, error) {
+	var out []torus.TrashedVolume
+	for _, kv := range kvs {
+		var t torus.TrashedVolume
+		err := json.Unmarshal(kv.Value, &t)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func (c *etcdCtx) GetVolumeAllocated(vid torus.VolumeID) (uint64, error) {
+	resp, err := c.etcd.Client.Get(c.getContext(), MkKey("volumemeta", Uint64ToHex(uint64(vid)), "allocated"))
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return BytesToUint64(resp.Kvs[0].Value), nil
+}
+
+func (c *etcdCtx) GetVolumeReplication(vid torus.VolumeID) (int, error) {
+	resp, err := c.etcd.Client.Get(c.getContext(), MkKey("volumemeta", Uint64ToHex(uint64(vid)), "replication"))
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return int(BytesToUint64(resp.Kvs[0].Value)), nil
+}
+
+func (c *etcdCtx) GetVolumeMeta(vid torus.VolumeID) (*torus.VolumeMeta, error) {
+	resp, err := c.etcd.Client.Get(c.getContext(), MkKey("volumemeta", Uint64ToHex(uint64(vid)), "labels"))
+	if err != nil {
+		return nil, err
+	}
+	m := &torus.VolumeMeta{}
+	if len(resp.Kvs) == 0 {
+		return m, nil
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *etcdCtx) SetVolumeMeta(vid torus.VolumeID, m *torus.VolumeMeta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	resp, err := c.etcd.Client.Txn(c.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(MkKey("volumeid", Uint64ToHex(uint64(vid)))), ">", 0),
+	).Then(
+		etcdv3.OpPut(MkKey("volumemeta", Uint64ToHex(uint64(vid)), "labels"), string(b)),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrNotExist
+	}
+	return nil
+}
+
+func (c *etcdCtx) GetVolumeQoS(vid torus.VolumeID) (*torus.VolumeQoS, error) {
+	resp, err := c.etcd.Client.Get(c.getContext(), MkKey("volumemeta", Uint64ToHex(uint64(vid)), "qos"))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	var q torus.VolumeQoS
+	err = json.Unmarshal(resp.Kvs[0].Value, &q)
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (c *etcdCtx) SetVolumeQoS(vid torus.VolumeID, q *torus.VolumeQoS) error {
+	k := MkKey("volumemeta", Uint64ToHex(uint64(vid)), "qos")
+	if q == nil {
+		_, err := c.etcd.Client.Delete(c.getContext(), k)
+		return err
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	// Don't resurrect the limits of a volume deleted in the meantime.
+	resp, err := c.etcd.Client.Txn(c.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(MkKey("volumeid", Uint64ToHex(uint64(vid)))), ">", 0),
+	).Then(
+		etcdv3.OpPut(k, string(b)),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrNotExist
+	}
+	return nil
+}
+
 func (c *etcdCtx) GetLease() (int64, error) {
 	resp, err := c.etcd.Client.Grant(c.getContext(), leaseTTL)
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -31,6 +32,12 @@ type Server struct {
 	newRing  torus.Ring
 
 	keys map[string]interface{}
+	qos  map[torus.VolumeID]torus.VolumeQoS
+	rep  map[torus.VolumeID]int
+	used map[torus.VolumeID]uint64
+	meta map[torus.VolumeID]torus.VolumeMeta
+
+	trash map[torus.VolumeID]torus.TrashedVolume
 
 	ringListeners []chan torus.Ring
 }
@@ -59,9 +66,22 @@ func NewServer() *Server {
 		ring:  r,
 		keys:  make(map[string]interface{}),
 		inode: make(map[torus.VolumeID]torus.INodeID),
+		qos:   make(map[torus.VolumeID]torus.VolumeQoS),
+		rep:   make(map[torus.VolumeID]int),
+		used:  make(map[torus.VolumeID]uint64),
+		meta:  make(map[torus.VolumeID]torus.VolumeMeta),
+		trash: make(map[torus.VolumeID]torus.TrashedVolume),
 	}
 }
 
+// SetGlobalMetadata replaces the cluster's global metadata, as if it had
+// been initialized with gmd.
+func (s *Server) SetGlobalMetadata(gmd torus.GlobalMetadata) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.global = gmd
+}
+
 func NewClient(cfg torus.Config, srv *Server) *Client {
 	return &Client{
 		cfg:  cfg,
@@ -140,11 +160,46 @@ func (t *Client) GetVolumes() ([]*models.Volume, torus.VolumeID, error) {
 }
 
 func (t *Client) CreateVolume(volume *models.Volume) error {
+	if _, ok := t.srv.volIndex[volume.Name]; ok {
+		return torus.ErrExists
+	}
 	t.srv.volIndex[volume.Name] = volume
 	t.srv.inode[torus.VolumeID(volume.Id)] = 1
 	return nil
 }
 
+// RenameVolume renames a volume. Like CreateVolume, it must be called with
+// the data lock held.
+func (t *Client) RenameVolume(volume, newName string) error {
+	vol, ok := t.srv.volIndex[volume]
+	if !ok {
+		return torus.ErrNotExist
+	}
+	if _, ok := t.srv.volIndex[newName]; ok {
+		return torus.ErrExists
+	}
+	// Volumes already handed out are left as they were.
+	v := *vol
+	v.Name = newName
+	delete(t.srv.volIndex, volume)
+	t.srv.volIndex[newName] = &v
+	return nil
+}
+
+// SetVolumeSize changes the size of the named volume. Like CreateVolume, it
+// must be called with the data lock held.
+func (t *Client) SetVolumeSize(volume string, size uint64) error {
+	vol, ok := t.srv.volIndex[volume]
+	if !ok {
+		return torus.ErrNotExist
+	}
+	// Volumes already handed out are left as they were.
+	v := *vol
+	v.MaxBytes = size
+	t.srv.volIndex[volume] = &v
+	return nil
+}
+
 func (t *Client) GetVolume(volume string) (*models.Volume, error) {
 	t.srv.mut.RLock()
 	defer t.srv.mut.RUnlock()
@@ -210,6 +265,89 @@ func (s *Server) SetRing(ring torus.Ring) error {
 	return nil
 }
 
+func (t *Client) GetVolumeAllocated(vid torus.VolumeID) (uint64, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	return t.srv.used[vid], nil
+}
+
+// SetVolumeAllocated records the number of bytes of the volume backed by
+// written blocks. Like CreateVolume, it must be called with the data lock
+// held.
+func (t *Client) SetVolumeAllocated(vid torus.VolumeID, allocated uint64) {
+	t.srv.used[vid] = allocated
+}
+
+func (t *Client) GetVolumeReplication(vid torus.VolumeID) (int, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	return t.srv.rep[vid], nil
+}
+
+// SetVolumeReplication sets the volume's replication factor, which is
+// otherwise fixed when it's created. Like CreateVolume, it must be called
+// with the data lock held.
+func (t *Client) SetVolumeReplication(vid torus.VolumeID, rep int) {
+	if rep == 0 {
+		delete(t.srv.rep, vid)
+		return
+	}
+	t.srv.rep[vid] = rep
+}
+
+func (t *Client) GetVolumeMeta(vid torus.VolumeID) (*torus.VolumeMeta, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	m := copyMeta(t.srv.meta[vid])
+	return &m, nil
+}
+
+func (t *Client) SetVolumeMeta(vid torus.VolumeID, m *torus.VolumeMeta) error {
+	t.srv.mut.Lock()
+	defer t.srv.mut.Unlock()
+	t.CreateVolumeMeta(vid, m)
+	return nil
+}
+
+// CreateVolumeMeta sets the owner and labels of a volume being created. Like
+// CreateVolume, it must be called with the data lock held.
+func (t *Client) CreateVolumeMeta(vid torus.VolumeID, m *torus.VolumeMeta) {
+	t.srv.meta[vid] = copyMeta(*m)
+}
+
+// copyMeta keeps callers from sharing the stored labels.
+func copyMeta(m torus.VolumeMeta) torus.VolumeMeta {
+	out := torus.VolumeMeta{Owner: m.Owner}
+	if len(m.Labels) != 0 {
+		out.Labels = make(map[string]string)
+		for k, v := range m.Labels {
+			out.Labels[k] = v
+		}
+	}
+	return out
+}
+
+func (t *Client) GetVolumeQoS(vid torus.VolumeID) (*torus.VolumeQoS, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	q, ok := t.srv.qos[vid]
+	if !ok {
+		return nil, nil
+	}
+	return &q, nil
+}
+
+func (t *Client) SetVolumeQoS(vid torus.VolumeID, q *torus.VolumeQoS) error {
+	t.srv.mut.Lock()
+	defer t.srv.mut.Unlock()
+	if q == nil {
+		delete(t.srv.qos, vid)
+		return nil
+	}
+	t.srv.qos[vid] = *q
+	return nil
+}
+
 func (t *Client) GetINodeIndex(volume torus.VolumeID) (torus.INodeID, error) {
 	t.srv.mut.RLock()
 	defer t.srv.mut.RUnlock()
@@ -251,10 +389,93 @@ func (t *Client) SetData(x string, v interface{}) {
 	t.srv.keys[x] = v
 }
 
+func (t *Client) DeleteData(x string) {
+	delete(t.srv.keys, x)
+}
+
+// DeleteVolume deletes the named volume for good. Like CreateVolume, it must
+// be called with the data lock held.
 func (t *Client) DeleteVolume(name string) error {
-	t.srv.mut.Lock()
-	defer t.srv.mut.Unlock()
-	delete(t.srv.keys, name)
+	vol, ok := t.srv.volIndex[name]
+	if !ok {
+		return torus.ErrNotExist
+	}
+	t.purge(torus.VolumeID(vol.Id))
+	delete(t.srv.volIndex, name)
+	return nil
+}
+
+func (t *Client) purge(vid torus.VolumeID) {
+	delete(t.srv.qos, vid)
+	delete(t.srv.rep, vid)
+	delete(t.srv.used, vid)
+	delete(t.srv.meta, vid)
+	delete(t.srv.trash, vid)
+}
+
+// TrashVolume moves the named volume to the trash, until expires. Like
+// CreateVolume, it must be called with the data lock held.
+func (t *Client) TrashVolume(name string, expires time.Time) error {
+	vol, ok := t.srv.volIndex[name]
+	if !ok {
+		return torus.ErrNotExist
+	}
+	t.srv.trash[torus.VolumeID(vol.Id)] = torus.TrashedVolume{
+		Volume:    vol,
+		DeletedAt: time.Now(),
+		ExpiresAt: expires,
+	}
 	delete(t.srv.volIndex, name)
 	return nil
 }
+
+// RestoreVolume brings a volume back from the trash under newName. Like
+// CreateVolume, it must be called with the data lock held.
+func (t *Client) RestoreVolume(vid torus.VolumeID, newName string) error {
+	tv, ok := t.srv.trash[vid]
+	if !ok || tv.Expired(time.Now()) {
+		return torus.ErrNotExist
+	}
+	if _, ok := t.srv.volIndex[newName]; ok {
+		return torus.ErrExists
+	}
+	v := *tv.Volume
+	v.Name = newName
+	t.srv.volIndex[newName] = &v
+	delete(t.srv.trash, vid)
+	return nil
+}
+
+// PurgeVolume deletes a volume in the trash for good. Like CreateVolume, it
+// must be called with the data lock held.
+func (t *Client) PurgeVolume(vid torus.VolumeID) error {
+	if _, ok := t.srv.trash[vid]; !ok {
+		return torus.ErrNotExist
+	}
+	t.purge(vid)
+	return nil
+}
+
+func (t *Client) GetTrash() ([]torus.TrashedVolume, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	var out []torus.TrashedVolume
+	for _, tv := range t.srv.trash {
+		out = append(out, tv)
+	}
+	return out, nil
+}
+
+func (t *Client) GetVolumesAndTrash() ([]*models.Volume, []torus.TrashedVolume, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	var vols []*models.Volume
+	for _, v := range t.srv.volIndex {
+		vols = append(vols, v)
+	}
+	var trash []torus.TrashedVolume
+	for _, tv := range t.srv.trash {
+		trash = append(trash, tv)
+	}
+	return vols, trash, nil
+}
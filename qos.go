@@ -0,0 +1,89 @@
+package torus
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+// VolumeQoS limits the I/O done to a volume. A zero limit means no limit.
+type VolumeQoS struct {
+	IOPS        uint64 `json:"iops,omitempty"`
+	BytesPerSec uint64 `json:"bytes_per_sec,omitempty"`
+	// BurstIOPS and BurstBytes are how far I/O may run ahead of the limits
+	// after a quiet spell. They default to one second's worth.
+	BurstIOPS  uint64 `json:"burst_iops,omitempty"`
+	BurstBytes uint64 `json:"burst_bytes,omitempty"`
+}
+
+// Unlimited returns whether q doesn't limit anything.
+func (q *VolumeQoS) Unlimited() bool {
+	return q == nil || (q.IOPS == 0 && q.BytesPerSec == 0)
+}
+
+// Throttle holds I/O to a volume to its VolumeQoS, using a token bucket for
+// each limit. A nil Throttle doesn't limit anything.
+type Throttle struct {
+	ops       *rate.Limiter
+	bytes     *rate.Limiter
+	throttled prometheus.Counter
+}
+
+// NewThrottle creates a Throttle enforcing q, which counts the seconds it
+// holds I/O back in throttled. It returns nil if q is unlimited.
+func NewThrottle(q *VolumeQoS, throttled prometheus.Counter) *Throttle {
+	if q.Unlimited() {
+		return nil
+	}
+	return &Throttle{
+		ops:       newLimiter(q.IOPS, q.BurstIOPS),
+		bytes:     newLimiter(q.BytesPerSec, q.BurstBytes),
+		throttled: throttled,
+	}
+}
+
+func newLimiter(limit, burst uint64) *rate.Limiter {
+	if limit == 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = limit
+	}
+	return rate.NewLimiter(rate.Limit(limit), int(burst))
+}
+
+// Wait blocks until one operation of n bytes is allowed, or ctx is done.
+func (t *Throttle) Wait(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	start := time.Now()
+	defer func() {
+		if t.throttled != nil {
+			t.throttled.Add(time.Since(start).Seconds())
+		}
+	}()
+	if t.ops != nil {
+		if err := t.ops.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if t.bytes == nil {
+		return nil
+	}
+	// A limiter refuses to wait for more than its burst at once.
+	burst := t.bytes.Burst()
+	for n > 0 {
+		chunk := n
+		if chunk > burst {
+			chunk = burst
+		}
+		if err := t.bytes.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
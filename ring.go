@@ -38,6 +38,20 @@ type PeerPermutation struct {
 	Peers       PeerList
 }
 
+// WithReplication returns the permutation with its replication factor
+// changed to rep, as far as there are peers for. A rep of 0 leaves it as it
+// is.
+func (p PeerPermutation) WithReplication(rep int) PeerPermutation {
+	if rep <= 0 {
+		return p
+	}
+	if rep > len(p.Peers) {
+		rep = len(p.Peers)
+	}
+	p.Replication = rep
+	return p
+}
+
 type PeerList []string
 
 func (pl PeerList) IndexAt(uuid string) int {
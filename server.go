@@ -24,6 +24,9 @@ func init() {
 const (
 	CtxWriteLevel int = iota
 	CtxReadLevel
+	// CtxFileIO is set on the context of block reads and writes made for a
+	// File's reads and writes, which are held to the volume's QoS limits.
+	CtxFileIO
 )
 
 // Server is the type representing the generic distributed block store.
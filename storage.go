@@ -197,6 +197,9 @@ const (
 	WriteAll WriteLevel = iota
 	WriteOne
 	WriteLocal
+	// WriteQuorum writes to all of a block's replicas at once, and returns
+	// as soon as Config.WriteQuorum of them have it.
+	WriteQuorum
 )
 
 func ParseWriteLevel(s string) (wl WriteLevel, err error) {
@@ -207,8 +210,10 @@ func ParseWriteLevel(s string) (wl WriteLevel, err error) {
 		wl = WriteOne
 	case "local":
 		wl = WriteLocal
+	case "quorum":
+		wl = WriteQuorum
 	default:
-		err = errors.New("invalid writelevel; use one of 'one', 'all', or 'local'")
+		err = errors.New("invalid writelevel; use one of 'one', 'all', 'local', or 'quorum'")
 	}
 	return
 }
@@ -217,6 +222,9 @@ const (
 	ReadBlock ReadLevel = iota
 	ReadSequential
 	ReadSpread
+	// ReadQuorum reads a block from all of its replicas at once, and
+	// returns it as soon as Config.ReadQuorum of them agree on it.
+	ReadQuorum
 )
 
 func ParseReadLevel(s string) (rl ReadLevel, err error) {
@@ -227,12 +235,27 @@ func ParseReadLevel(s string) (rl ReadLevel, err error) {
 		rl = ReadSequential
 	case "block":
 		rl = ReadBlock
+	case "quorum":
+		rl = ReadQuorum
 	default:
-		err = errors.New("invalid readlevel; use one of 'spread', 'seq', or 'block'")
+		err = errors.New("invalid readlevel; use one of 'spread', 'seq', 'block', or 'quorum'")
 	}
 	return
 }
 
+// QuorumSize returns how many of a block's replication replicas make a
+// quorum: n, but no more than replication, or a majority of them if n is
+// less than 1.
+func QuorumSize(n, replication int) int {
+	if n < 1 {
+		return replication/2 + 1
+	}
+	if n > replication {
+		return replication
+	}
+	return n
+}
+
 // BlockStore is the interface representing the standardized methods to
 // interact with something storing blocks.
 type BlockStore interface {
@@ -274,5 +297,8 @@ func RegisterBlockStore(name string, newFunc NewBlockStoreFunc) {
 
 func CreateBlockStore(kind string, name string, cfg Config, gmd GlobalMetadata) (BlockStore, error) {
 	clog.Infof("creating blockstore: %s", kind)
-	return blockStores[kind](name, cfg, gmd)
+	if bsf, ok := blockStores[kind]; ok {
+		return bsf(name, cfg, gmd)
+	}
+	return nil, fmt.Errorf("torus: the block store %q doesn't exist", kind)
 }
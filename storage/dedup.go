@@ -0,0 +1,545 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/coreos/torus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ torus.BlockStore = &dedupBlock{}
+
+var (
+	promDedupLogicalBlocks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_storage_dedup_logical_blocks",
+		Help: "Gauge of number of blocks stored, before deduplication",
+	}, []string{"storage"})
+	promDedupPhysicalBlocks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_storage_dedup_physical_blocks",
+		Help: "Gauge of number of distinct blocks stored, after deduplication",
+	}, []string{"storage"})
+	promDedupHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_storage_dedup_hits",
+		Help: "Number of written blocks that were already stored",
+	}, []string{"storage"})
+)
+
+func init() {
+	prometheus.MustRegister(promDedupLogicalBlocks)
+	prometheus.MustRegister(promDedupPhysicalBlocks)
+	prometheus.MustRegister(promDedupHits)
+	torus.RegisterBlockStore("dedup", newDedupBlockStore)
+}
+
+// dedupRefsPerSlot is how many BlockRefs the store can hold per block of
+// storage; that is, the best deduplication ratio it can reach.
+const dedupRefsPerSlot = 4
+
+const dedupRefEntrySize = torus.BlockRefByteSize + 8
+
+var (
+	// A slot with a zero hash is free.
+	blankHash [sha256.Size]byte
+	// A slot with a pending hash was filled by WriteBuf, and will be hashed
+	// on the next flush.
+	pendingHash = [sha256.Size]byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	}
+	blankRefEntry = make([]byte, dedupRefEntrySize)
+)
+
+// dedupBlock is a content-addressed BlockStore. Block data is kept once per
+// distinct content in a slot of the data file; the hash file holds the
+// SHA-256 of each slot, and the map file holds (BlockRef, slot) entries
+// pointing at them. Slots are refcounted by the entries that use them.
+type dedupBlock struct {
+	mut       sync.RWMutex
+	dataFile  *MFile
+	hashFile  *MFile
+	refFile   *MFile
+	refIndex  map[torus.BlockRef]dedupRef
+	hashIndex map[[sha256.Size]byte]int
+	refcount  []uint32
+	// pending holds slots handed out by WriteBuf before the last flush,
+	// which are ready to be hashed; filling holds those handed out since,
+	// which may still be being written to.
+	pending   map[int]torus.BlockRef
+	filling   map[int]torus.BlockRef
+	used      int
+	closed    bool
+	lastFree  int
+	lastEntry int
+	name      string
+	blocksize uint64
+}
+
+type dedupRef struct {
+	entry int
+	slot  int
+}
+
+func newDedupBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata) (torus.BlockStore, error) {
+	storageSize := cfg.StorageSize
+	offset := cfg.StorageSize % meta.BlockSize
+	if offset != 0 {
+		storageSize = cfg.StorageSize - offset
+		clog.Infof("resizing to %v bytes to make an even multiple of blocksize: %v\n", storageSize, meta.BlockSize)
+	}
+
+	nBlocks := storageSize / meta.BlockSize
+	promBytesPerBlock.Set(float64(meta.BlockSize))
+	promBlocksAvail.WithLabelValues(name).Set(float64(nBlocks))
+	dpath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("dedup-data-%s.blk", name))
+	hpath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("dedup-hash-%s.blk", name))
+	mpath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("dedup-map-%s.blk", name))
+	d, err := CreateOrOpenMFile(dpath, storageSize, meta.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	h, err := CreateOrOpenMFile(hpath, nBlocks*sha256.Size, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	m, err := CreateOrOpenMFile(mpath, nBlocks*dedupRefsPerSlot*dedupRefEntrySize, dedupRefEntrySize)
+	if err != nil {
+		return nil, err
+	}
+	if h.NumBlocks() != d.NumBlocks() || m.NumBlocks() != d.NumBlocks()*dedupRefsPerSlot {
+		panic("non-equal number of blocks between data and metadata")
+	}
+	b := &dedupBlock{
+		dataFile:  d,
+		hashFile:  h,
+		refFile:   m,
+		refIndex:  make(map[torus.BlockRef]dedupRef),
+		hashIndex: make(map[[sha256.Size]byte]int),
+		refcount:  make([]uint32, d.NumBlocks()),
+		pending:   make(map[int]torus.BlockRef),
+		filling:   make(map[int]torus.BlockRef),
+		name:      name,
+		blocksize: meta.BlockSize,
+	}
+	err = b.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (m *dedupBlock) loadIndex() error {
+	clog.Infof("loading dedup block index...")
+	pending := make(map[int]bool)
+	for i := uint64(0); i < m.refFile.NumBlocks(); i++ {
+		e := m.refFile.GetBlock(i)
+		if bytes.Equal(blankRefEntry, e) {
+			continue
+		}
+		ref := torus.BlockRefFromBytes(e[:torus.BlockRefByteSize])
+		slot := int(binary.LittleEndian.Uint64(e[torus.BlockRefByteSize:]))
+		if slot >= len(m.refcount) {
+			return fmt.Errorf("dedup: block %s points past the end of storage", ref)
+		}
+		m.refIndex[ref] = dedupRef{entry: int(i), slot: slot}
+		m.refcount[slot]++
+	}
+	for i := 0; i < len(m.refcount); i++ {
+		var h [sha256.Size]byte
+		copy(h[:], m.hashFile.GetBlock(uint64(i)))
+		if h == blankHash {
+			continue
+		}
+		if m.refcount[i] == 0 {
+			// Left behind by a crash between writing the slot and its entry.
+			m.hashFile.WriteBlock(uint64(i), blankHash[:])
+			continue
+		}
+		m.used++
+		if h == pendingHash {
+			pending[i] = true
+			continue
+		}
+		m.hashIndex[h] = i
+	}
+	for ref, r := range m.refIndex {
+		if pending[r.slot] {
+			m.pending[r.slot] = ref
+		}
+	}
+	m.settle()
+	m.updateGauges()
+	clog.Infof("done loading dedup block index")
+	return nil
+}
+
+func (m *dedupBlock) updateGauges() {
+	promBlocks.WithLabelValues(m.name).Set(float64(m.used))
+	promDedupPhysicalBlocks.WithLabelValues(m.name).Set(float64(m.used))
+	promDedupLogicalBlocks.WithLabelValues(m.name).Set(float64(len(m.refIndex)))
+}
+
+func (m *dedupBlock) Kind() string { return "dedup" }
+
+func (m *dedupBlock) NumBlocks() uint64 {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return m.dataFile.NumBlocks()
+}
+
+func (m *dedupBlock) BlockSize() uint64 {
+	return m.blocksize
+}
+
+// UsedBlocks returns the number of blocks of storage in use, after
+// deduplication.
+func (m *dedupBlock) UsedBlocks() uint64 {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return uint64(m.used)
+}
+
+// LogicalBlocks returns the number of blocks stored, before deduplication.
+func (m *dedupBlock) LogicalBlocks() uint64 {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return uint64(len(m.refIndex))
+}
+
+func (m *dedupBlock) Flush() error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.flush()
+}
+
+func (m *dedupBlock) flush() error {
+	m.settle()
+	m.pending, m.filling = m.filling, m.pending
+	for _, f := range []*MFile{m.dataFile, m.hashFile, m.refFile} {
+		err := f.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	promStorageFlushes.WithLabelValues(m.name).Inc()
+	return nil
+}
+
+func (m *dedupBlock) Close() error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.flush()
+	for _, f := range []*MFile{m.dataFile, m.hashFile, m.refFile} {
+		err := f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	m.closed = true
+	return nil
+}
+
+// hashBlock returns the hash of data as stored; that is, padded with zeros
+// to the block size.
+func (m *dedupBlock) hashBlock(data []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(data)
+	if pad := int(m.blocksize) - len(data); pad > 0 {
+		h.Write(make([]byte, pad))
+	}
+	var out [sha256.Size]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// findSlot returns the slot already holding data, or -1.
+func (m *dedupBlock) findSlot(h [sha256.Size]byte, data []byte) int {
+	slot, ok := m.hashIndex[h]
+	if !ok {
+		return -1
+	}
+	stored := m.dataFile.GetBlock(uint64(slot))
+	if !bytes.Equal(stored[:len(data)], data) || !isZero(stored[len(data):]) {
+		clog.Errorf("dedup: hash collision on slot %d", slot)
+		return -1
+	}
+	return slot
+}
+
+func (m *dedupBlock) findEmptySlot() int {
+	n := len(m.refcount)
+	for i := 0; i < n; i++ {
+		slot := (i + m.lastFree + 1) % n
+		if m.refcount[slot] == 0 {
+			m.lastFree = slot
+			return slot
+		}
+	}
+	return -1
+}
+
+func (m *dedupBlock) findEmptyEntry() int {
+	n := int(m.refFile.NumBlocks())
+	for i := 0; i < n; i++ {
+		e := (i + m.lastEntry + 1) % n
+		if bytes.Equal(m.refFile.GetBlock(uint64(e)), blankRefEntry) {
+			m.lastEntry = e
+			return e
+		}
+	}
+	return -1
+}
+
+func (m *dedupBlock) writeEntry(entry int, s torus.BlockRef, slot int) error {
+	buf := make([]byte, dedupRefEntrySize)
+	s.ToBytesBuf(buf)
+	binary.LittleEndian.PutUint64(buf[torus.BlockRefByteSize:], uint64(slot))
+	return m.refFile.WriteBlock(uint64(entry), buf)
+}
+
+// addRef points s at slot, taking a reference to it.
+func (m *dedupBlock) addRef(s torus.BlockRef, slot int) error {
+	entry := m.findEmptyEntry()
+	if entry == -1 {
+		clog.Error("dedup: out of block entries")
+		return torus.ErrOutOfSpace
+	}
+	err := m.writeEntry(entry, s, slot)
+	if err != nil {
+		return err
+	}
+	m.refIndex[s] = dedupRef{entry: entry, slot: slot}
+	m.refcount[slot]++
+	return nil
+}
+
+// release drops a reference to slot, freeing it if it was the last.
+func (m *dedupBlock) release(slot int) error {
+	m.refcount[slot]--
+	if m.refcount[slot] != 0 {
+		return nil
+	}
+	var h [sha256.Size]byte
+	copy(h[:], m.hashFile.GetBlock(uint64(slot)))
+	if s, ok := m.hashIndex[h]; ok && s == slot {
+		delete(m.hashIndex, h)
+	}
+	delete(m.pending, slot)
+	delete(m.filling, slot)
+	m.used--
+	return m.hashFile.WriteBlock(uint64(slot), blankHash[:])
+}
+
+// settle hashes the pending slots filled by WriteBuf, merging any that
+// duplicate an existing slot.
+func (m *dedupBlock) settle() {
+	for slot, ref := range m.pending {
+		delete(m.pending, slot)
+		data := m.dataFile.GetBlock(uint64(slot))
+		h := m.hashBlock(data)
+		existing := m.findSlot(h, data)
+		if existing == -1 {
+			m.hashFile.WriteBlock(uint64(slot), h[:])
+			m.hashIndex[h] = slot
+			continue
+		}
+		// Repoint the ref at the existing copy, freeing this one.
+		r := m.refIndex[ref]
+		err := m.writeEntry(r.entry, ref, existing)
+		if err != nil {
+			clog.Errorf("dedup: couldn't repoint block %s: %v", ref, err)
+			m.hashFile.WriteBlock(uint64(slot), h[:])
+			m.hashIndex[h] = slot
+			continue
+		}
+		m.refIndex[ref] = dedupRef{entry: r.entry, slot: existing}
+		m.refcount[existing]++
+		m.release(slot)
+		promDedupHits.WithLabelValues(m.name).Inc()
+	}
+	m.updateGauges()
+}
+
+func (m *dedupBlock) HasBlock(_ context.Context, s torus.BlockRef) (bool, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	_, ok := m.refIndex[s]
+	return ok, nil
+}
+
+func (m *dedupBlock) GetBlock(_ context.Context, s torus.BlockRef) ([]byte, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	if m.closed {
+		promBlocksFailed.WithLabelValues(m.name).Inc()
+		return nil, torus.ErrClosed
+	}
+	r, ok := m.refIndex[s]
+	if !ok {
+		promBlocksFailed.WithLabelValues(m.name).Inc()
+		return nil, torus.ErrBlockNotExist
+	}
+	if clog.LevelAt(capnslog.TRACE) {
+		clog.Tracef("dedup: getting block %s at slot %d", s, r.slot)
+	}
+	promBlocksRetrieved.WithLabelValues(m.name).Inc()
+	return m.dataFile.GetBlock(uint64(r.slot)), nil
+}
+
+func (m *dedupBlock) WriteBlock(_ context.Context, s torus.BlockRef, data []byte) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return torus.ErrClosed
+	}
+	if uint64(len(data)) > m.blocksize {
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return torus.ErrInvalid
+	}
+	h := m.hashBlock(data)
+	if r, ok := m.refIndex[s]; ok {
+		// We already have it.
+		stored := m.dataFile.GetBlock(uint64(r.slot))
+		if !bytes.Equal(stored[:len(data)], data) || !isZero(stored[len(data):]) {
+			clog.Error("getting wrong data for block: ", s)
+			return torus.ErrExists
+		}
+		return nil
+	}
+	slot := m.findSlot(h, data)
+	if slot != -1 {
+		err := m.addRef(s, slot)
+		if err != nil {
+			promBlockWritesFailed.WithLabelValues(m.name).Inc()
+			return err
+		}
+		promDedupHits.WithLabelValues(m.name).Inc()
+		promBlocksWritten.WithLabelValues(m.name).Inc()
+		m.updateGauges()
+		return nil
+	}
+	slot = m.findEmptySlot()
+	if slot == -1 {
+		clog.Error("dedup: out of space")
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return torus.ErrOutOfSpace
+	}
+	clog.Tracef("dedup: writing block at slot %d", slot)
+	err := m.dataFile.WriteBlock(uint64(slot), data)
+	if err == nil {
+		err = m.hashFile.WriteBlock(uint64(slot), h[:])
+	}
+	if err == nil {
+		err = m.addRef(s, slot)
+	}
+	if err != nil {
+		m.hashFile.WriteBlock(uint64(slot), blankHash[:])
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return err
+	}
+	m.hashIndex[h] = slot
+	m.used++
+	promBlocksWritten.WithLabelValues(m.name).Inc()
+	m.updateGauges()
+	return nil
+}
+
+// WriteBuf hands out a fresh slot to be filled in by the caller. As its
+// contents aren't known yet, it's deduplicated a flush later, once the
+// caller is sure to be done with it.
+func (m *dedupBlock) WriteBuf(_ context.Context, s torus.BlockRef) ([]byte, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return nil, torus.ErrClosed
+	}
+	if _, ok := m.refIndex[s]; ok {
+		clog.Debug("dedup: block already exists: ", s)
+		return nil, torus.ErrExists
+	}
+	slot := m.findEmptySlot()
+	if slot == -1 {
+		clog.Error("dedup: out of space")
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return nil, torus.ErrOutOfSpace
+	}
+	err := m.hashFile.WriteBlock(uint64(slot), pendingHash[:])
+	if err == nil {
+		err = m.addRef(s, slot)
+	}
+	if err != nil {
+		m.hashFile.WriteBlock(uint64(slot), blankHash[:])
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return nil, err
+	}
+	m.filling[slot] = s
+	m.used++
+	promBlocksWritten.WithLabelValues(m.name).Inc()
+	m.updateGauges()
+	return m.dataFile.GetBlock(uint64(slot)), nil
+}
+
+func (m *dedupBlock) DeleteBlock(_ context.Context, s torus.BlockRef) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
+		return torus.ErrClosed
+	}
+	r, ok := m.refIndex[s]
+	if !ok {
+		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
+		clog.Errorf("dedup: deleting non-existent thing? %s", s)
+		return torus.ErrBlockNotExist
+	}
+	err := m.refFile.WriteBlock(uint64(r.entry), blankRefEntry)
+	if err != nil {
+		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
+		return err
+	}
+	delete(m.refIndex, s)
+	err = m.release(r.slot)
+	if err != nil {
+		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
+		return err
+	}
+	promBlocksDeleted.WithLabelValues(m.name).Inc()
+	m.updateGauges()
+	return nil
+}
+
+func (m *dedupBlock) BlockIterator() torus.BlockIterator {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	l := make([]torus.BlockRef, 0, len(m.refIndex))
+	for k := range m.refIndex {
+		l = append(l, k)
+	}
+	return &mfileIterator{
+		set: l,
+		i:   -1,
+	}
+}
+
+func isZero(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+func openTestDedup(t *testing.T, dir string) *dedupBlock {
+	s, err := newDedupBlockStore("test", torus.Config{DataDir: dir, StorageSize: 16 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*dedupBlock)
+}
+
+func TestDedupWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/block", 0700)
+	s := openTestDedup(t, dir)
+	ctx := context.TODO()
+	same := []byte("the same data")
+	for i := 1; i <= 4; i++ {
+		err := s.WriteBlock(ctx, torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: torus.IndexID(i)}, same)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: 5}
+	err = s.WriteBlock(ctx, other, []byte("other data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.UsedBlocks() != 2 || s.LogicalBlocks() != 5 {
+		t.Fatalf("expected 2 physical, 5 logical blocks; got %d, %d", s.UsedBlocks(), s.LogicalBlocks())
+	}
+
+	// A block handed out by WriteBuf is merged a flush after it's filled.
+	buf, err := s.WriteBuf(ctx, torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(buf, same)
+	s.Flush()
+	s.Flush()
+	if s.UsedBlocks() != 2 || s.LogicalBlocks() != 6 {
+		t.Fatalf("expected 2 physical, 6 logical blocks; got %d, %d", s.UsedBlocks(), s.LogicalBlocks())
+	}
+
+	err = s.DeleteBlock(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		err = s.DeleteBlock(ctx, torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: torus.IndexID(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.UsedBlocks() != 1 {
+		t.Fatalf("expected 1 physical block, got %d", s.UsedBlocks())
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestDedup(t, dir)
+	defer s.Close()
+	if s.UsedBlocks() != 1 || s.LogicalBlocks() != 2 {
+		t.Fatalf("after reopening, expected 1 physical, 2 logical blocks; got %d, %d", s.UsedBlocks(), s.LogicalBlocks())
+	}
+	for _, i := range []torus.IndexID{4, 6} {
+		data, err := s.GetBlock(ctx, torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, same) {
+			t.Fatalf("wrong data for block %d", i)
+		}
+	}
+}
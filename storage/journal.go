@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/coreos/torus"
+)
+
+// The mfile journal makes changes to an mfile block store atomic across its
+// data and map files.
+//
+// Between checkpoints, the map file is left untouched. A write fills a slot
+// that is free in the map file, then appends a record naming the slot, the
+// BlockRef, and a checksum of the slot's contents to the journal. A delete
+// appends a record, and holds its slot back from reuse until the next
+// checkpoint. A checkpoint syncs the data file and the journal, applies the
+// journaled changes to the map file, syncs that, and empties the journal.
+//
+// On open, the journal is replayed in order until the first record that is
+// torn, or whose data did not make it to disk, and then checkpointed. So
+// after a crash, the store reflects some prefix of the operations made
+// since the last checkpoint, and every BlockRef points at the data that
+// was written for it.
+
+type journalOp byte
+
+const (
+	journalWrite journalOp = iota + 1
+	journalDelete
+)
+
+// seq, op, padding, data checksum, slot, BlockRef, record checksum.
+const journalRecordSize = 8 + 1 + 3 + 4 + 8 + torus.BlockRefByteSize + 4
+
+var journalTable = crc32.MakeTable(crc32.Castagnoli)
+
+type journalRecord struct {
+	seq  uint64
+	op   journalOp
+	sum  uint32
+	slot uint64
+	ref  torus.BlockRef
+}
+
+func (r journalRecord) marshal(buf []byte) {
+	binary.LittleEndian.PutUint64(buf[0:8], r.seq)
+	buf[8] = byte(r.op)
+	buf[9], buf[10], buf[11] = 0, 0, 0
+	binary.LittleEndian.PutUint32(buf[12:16], r.sum)
+	binary.LittleEndian.PutUint64(buf[16:24], r.slot)
+	r.ref.ToBytesBuf(buf[24 : 24+torus.BlockRefByteSize])
+	end := journalRecordSize - 4
+	binary.LittleEndian.PutUint32(buf[end:], crc32.Checksum(buf[:end], journalTable))
+}
+
+func unmarshalJournalRecord(buf []byte) (journalRecord, bool) {
+	end := journalRecordSize - 4
+	if crc32.Checksum(buf[:end], journalTable) != binary.LittleEndian.Uint32(buf[end:]) {
+		return journalRecord{}, false
+	}
+	r := journalRecord{
+		seq:  binary.LittleEndian.Uint64(buf[0:8]),
+		op:   journalOp(buf[8]),
+		sum:  binary.LittleEndian.Uint32(buf[12:16]),
+		slot: binary.LittleEndian.Uint64(buf[16:24]),
+		ref:  torus.BlockRefFromBytes(buf[24 : 24+torus.BlockRefByteSize]),
+	}
+	if r.op != journalWrite && r.op != journalDelete {
+		return journalRecord{}, false
+	}
+	return r, true
+}
+
+// slotSum is the checksum recorded for the contents of a slot.
+func slotSum(data []byte) uint32 {
+	return crc32.Checksum(data, journalTable)
+}
+
+type mfileJournal struct {
+	f   *os.File
+	seq uint64
+	buf []byte
+}
+
+// openJournal opens the journal at path, creating it if need be, and returns
+// the intact records in it.
+func openJournal(path string) (*mfileJournal, []journalRecord, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	j := &mfileJournal{
+		f:   f,
+		buf: make([]byte, journalRecordSize),
+	}
+	var out []journalRecord
+	for {
+		_, err := io.ReadFull(f, j.buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		r, ok := unmarshalJournalRecord(j.buf)
+		if !ok || (len(out) != 0 && r.seq != j.seq+1) {
+			clog.Warningf("mfile: journal %s torn after %d records", path, len(out))
+			break
+		}
+		j.seq = r.seq
+		out = append(out, r)
+	}
+	return j, out, nil
+}
+
+func (j *mfileJournal) append(r journalRecord) error {
+	j.seq++
+	r.seq = j.seq
+	r.marshal(j.buf)
+	_, err := j.f.Write(j.buf)
+	return err
+}
+
+func (j *mfileJournal) sync() error {
+	return j.f.Sync()
+}
+
+// reset empties the journal once its records have been checkpointed.
+func (j *mfileJournal) reset() error {
+	err := j.f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = j.f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *mfileJournal) close() error {
+	return j.f.Close()
+}
+
+// journalCrashHook, if set, is called at each step of a checkpoint, so that
+// tests can simulate a crash there.
+var journalCrashHook func(point string)
+
+func journalCrashPoint(point string) {
+	if journalCrashHook != nil {
+		journalCrashHook(point)
+	}
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+const testBlockSize = 1024
+
+type crash string
+
+func makeTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "torus-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(dir, "block"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// openTestMFile opens the mfile store in dir. Opening it again without
+// closing it first is how these tests simulate a crash.
+func openTestMFile(t *testing.T, dir string) *mfileBlock {
+	s, err := newMFileBlockStore("test", torus.Config{DataDir: dir, StorageSize: 64 * testBlockSize}, torus.GlobalMetadata{BlockSize: testBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*mfileBlock)
+}
+
+func testRef(i int) torus.BlockRef {
+	return torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: torus.IndexID(i)}
+}
+
+func testData(i int) []byte {
+	return []byte(fmt.Sprintf("data for block %d", i))
+}
+
+func writeTestBlocks(t *testing.T, m *mfileBlock, from, to int) {
+	for i := from; i < to; i++ {
+		err := m.WriteBlock(context.TODO(), testRef(i), testData(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkTestBlocks(t *testing.T, m *mfileBlock, from, to int, present bool) {
+	for i := from; i < to; i++ {
+		data, err := m.GetBlock(context.TODO(), testRef(i))
+		if !present {
+			if err != torus.ErrBlockNotExist {
+				t.Fatalf("block %d should not exist", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if !bytes.HasPrefix(data, testData(i)) {
+			t.Fatalf("block %d has the wrong data", i)
+		}
+	}
+}
+
+func journalPath(dir string) string {
+	return filepath.Join(dir, "block", "journal-test.blk")
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+	m := openTestMFile(t, dir)
+	writeTestBlocks(t, m, 0, 4)
+	err := m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestBlocks(t, m, 4, 8)
+	for _, i := range []int{1, 5} {
+		err = m.DeleteBlock(context.TODO(), testRef(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m = openTestMFile(t, dir)
+	defer m.Close()
+	checkTestBlocks(t, m, 0, 1, true)
+	checkTestBlocks(t, m, 1, 2, false)
+	checkTestBlocks(t, m, 2, 5, true)
+	checkTestBlocks(t, m, 5, 6, false)
+	checkTestBlocks(t, m, 6, 8, true)
+	if m.UsedBlocks() != 6 {
+		t.Fatalf("expected 6 blocks, got %d", m.UsedBlocks())
+	}
+}
+
+func TestJournalLostData(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+	m := openTestMFile(t, dir)
+	writeTestBlocks(t, m, 0, 4)
+	// Pretend the data for block 2 never made it to disk.
+	f, err := os.OpenFile(filepath.Join(dir, "block", "data-test.blk"), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(make([]byte, testBlockSize), int64(m.findIndex(testRef(2)))*testBlockSize)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = openTestMFile(t, dir)
+	defer m.Close()
+	checkTestBlocks(t, m, 0, 2, true)
+	checkTestBlocks(t, m, 2, 4, false)
+}
+
+func TestJournalTornRecord(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+	m := openTestMFile(t, dir)
+	writeTestBlocks(t, m, 0, 3)
+	err := os.Truncate(journalPath(dir), journalRecordSize*5/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = openTestMFile(t, dir)
+	defer m.Close()
+	checkTestBlocks(t, m, 0, 2, true)
+	checkTestBlocks(t, m, 2, 3, false)
+}
+
+func TestJournalCheckpointCrash(t *testing.T) {
+	for _, point := range []string{"data-synced", "journal-synced", "map-applying", "map-synced", "index-synced"} {
+		dir := makeTestDir(t)
+		m := openTestMFile(t, dir)
+		writeTestBlocks(t, m, 0, 8)
+		m.Flush()
+		writeTestBlocks(t, m, 8, 16)
+		err := m.DeleteBlock(context.TODO(), testRef(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		func() {
+			journalCrashHook = func(p string) {
+				if p == point {
+					panic(crash(p))
+				}
+			}
+			defer func() {
+				journalCrashHook = nil
+				if r := recover(); r != crash(point) {
+					t.Fatalf("%s: expected crash, got %v", point, r)
+				}
+			}()
+			m.Flush()
+		}()
+
+		m = openTestMFile(t, dir)
+		checkTestBlocks(t, m, 0, 3, true)
+		checkTestBlocks(t, m, 3, 4, false)
+		checkTestBlocks(t, m, 4, 16, true)
+		if fi, err := os.Stat(journalPath(dir)); err != nil || fi.Size() != 0 {
+			t.Fatalf("%s: journal not checkpointed on open", point)
+		}
+		m.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestJournalSlotReuse(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+	m := openTestMFile(t, dir)
+	writeTestBlocks(t, m, 0, 64)
+	err := m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.DeleteBlock(context.TODO(), testRef(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The deleted block's slot can't be reused before a checkpoint.
+	err = m.WriteBlock(context.TODO(), testRef(100), testData(100))
+	if err != torus.ErrOutOfSpace {
+		t.Fatalf("expected out of space, got %v", err)
+	}
+	// Lose the whole journal; the delete never happened.
+	err = os.Truncate(journalPath(dir), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = openTestMFile(t, dir)
+	defer m.Close()
+	checkTestBlocks(t, m, 0, 64, true)
+	err = m.DeleteBlock(context.TODO(), testRef(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.WriteBlock(context.TODO(), testRef(100), testData(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestBlocks(t, m, 100, 101, true)
+}
@@ -4,8 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"path/filepath"
-
-	"runtime"
 	"sync"
 
 	"golang.org/x/net/context"
@@ -24,43 +22,33 @@ type mfileBlock struct {
 	mut       sync.RWMutex
 	dataFile  *MFile
 	refFile   *MFile
-	refIndex  map[torus.BlockRef]int
+	index     *mfileIndex
+	indexPath string
+	free      *freeList
+	journal   *mfileJournal
 	closed    bool
-	lastFree  int
+	used      int
 	name      string
 	blocksize uint64
 
+	// delta holds the changes to the index since the last checkpoint; the
+	// slot holding each BlockRef, or -1 if it's been deleted.
+	delta map[torus.BlockRef]int
+	// unapplied holds the journal records not yet applied to refFile and
+	// the index, and freed the slots to release at the next checkpoint.
+	unapplied []journalRecord
+	freed     []int
+	// pending holds slots handed out by WriteBuf before the last flush,
+	// which are ready to be journaled; filling holds those handed out
+	// since, which may still be being written to.
+	pending map[int]torus.BlockRef
+	filling map[int]torus.BlockRef
+
 	itPool sync.Pool
-	// NB: Still room for improvement. Free lists, smart allocation, etc.
 }
 
 var blankRefBytes = make([]byte, torus.BlockRefByteSize)
 
-func loadIndex(m *MFile) (map[torus.BlockRef]int, error) {
-	clog.Infof("loading block index...")
-	var membefore uint64
-	if clog.LevelAt(capnslog.DEBUG) {
-		var mem runtime.MemStats
-		runtime.ReadMemStats(&mem)
-		membefore = mem.Alloc
-	}
-	out := make(map[torus.BlockRef]int)
-	for i := uint64(0); i < m.NumBlocks(); i++ {
-		b := m.GetBlock(i)
-		if bytes.Equal(blankRefBytes, b) {
-			continue
-		}
-		out[torus.BlockRefFromBytes(b)] = int(i)
-	}
-	if clog.LevelAt(capnslog.DEBUG) {
-		var mem runtime.MemStats
-		runtime.ReadMemStats(&mem)
-		clog.Debugf("index memory usage: %dK", ((mem.Alloc - membefore) / 1024))
-	}
-	clog.Infof("done loading block index")
-	return out, nil
-}
-
 func newMFileBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata) (torus.BlockStore, error) {
 
 	storageSize := cfg.StorageSize
@@ -75,6 +63,9 @@ func newMFileBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata
 	promBlocksAvail.WithLabelValues(name).Set(float64(nBlocks))
 	dpath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("data-%s.blk", name))
 	mpath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("map-%s.blk", name))
+	ipath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("index-%s.blk", name))
+	fpath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("free-%s.blk", name))
+	jpath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("journal-%s.blk", name))
 	d, err := CreateOrOpenMFile(dpath, storageSize, meta.BlockSize)
 	if err != nil {
 		return nil, err
@@ -83,21 +74,83 @@ func newMFileBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata
 	if err != nil {
 		return nil, err
 	}
-	refIndex, err := loadIndex(m)
+	if m.NumBlocks() != d.NumBlocks() {
+		panic("non-equal number of blocks between data and metadata")
+	}
+	idx, ok, err := openIndex(ipath, nBlocks)
 	if err != nil {
 		return nil, err
 	}
-	if m.NumBlocks() != d.NumBlocks() {
-		panic("non-equal number of blocks between data and metadata")
+	if !ok {
+		clog.Infof("building block index...")
+		idx, err = buildIndex(ipath, nBlocks, m)
+		if err != nil {
+			return nil, err
+		}
+		clog.Infof("done building block index")
 	}
-	promBlocks.WithLabelValues(name).Set(float64(len(refIndex)))
-	return &mfileBlock{
+	fl, clean, err := openFreeList(fpath, nBlocks)
+	if err != nil {
+		return nil, err
+	}
+	j, records, err := openJournal(jpath)
+	if err != nil {
+		return nil, err
+	}
+	b := &mfileBlock{
 		dataFile:  d,
 		refFile:   m,
-		refIndex:  refIndex,
+		index:     idx,
+		indexPath: ipath,
+		free:      fl,
+		journal:   j,
 		name:      name,
 		blocksize: meta.BlockSize,
-	}, nil
+		delta:     make(map[torus.BlockRef]int),
+		pending:   make(map[int]torus.BlockRef),
+		filling:   make(map[int]torus.BlockRef),
+	}
+	b.replay(records)
+	err = b.checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	if !clean || len(records) != 0 {
+		clog.Infof("mfile: not cleanly closed; rebuilding free list")
+		fl.rebuild(m)
+	}
+	b.used = int(nBlocks - fl.count)
+	promBlocks.WithLabelValues(name).Set(float64(b.used))
+	return b, nil
+}
+
+// replay applies the journal records left from before the store was last
+// closed, stopping at the first whose data never made it to disk.
+func (m *mfileBlock) replay(records []journalRecord) {
+	for i, r := range records {
+		if r.slot >= m.numBlocks() {
+			clog.Errorf("mfile: journal record for %s is past the end of storage", r.ref)
+			return
+		}
+		slot := int(r.slot)
+		switch r.op {
+		case journalWrite:
+			if slotSum(m.dataFile.GetBlock(r.slot)) != r.sum {
+				clog.Warningf("mfile: data for %s never reached disk; dropping the last %d journal records", r.ref, len(records)-i)
+				return
+			}
+			m.delta[r.ref] = slot
+		case journalDelete:
+			if m.findIndex(r.ref) == slot {
+				m.delta[r.ref] = -1
+				m.freed = append(m.freed, slot)
+			}
+		}
+		m.unapplied = append(m.unapplied, r)
+	}
+	if len(records) != 0 {
+		clog.Infof("mfile: replayed %d journal records", len(records))
+	}
 }
 
 func (m *mfileBlock) Kind() string { return "mfile" }
@@ -118,7 +171,7 @@ func (m *mfileBlock) numBlocks() uint64 {
 func (m *mfileBlock) UsedBlocks() uint64 {
 	m.mut.RLock()
 	defer m.mut.RUnlock()
-	return uint64(len(m.refIndex))
+	return uint64(m.used)
 }
 
 func (m *mfileBlock) Flush() error {
@@ -128,16 +181,104 @@ func (m *mfileBlock) Flush() error {
 }
 
 func (m *mfileBlock) flush() error {
-	err := m.dataFile.Flush()
+	err := m.checkpoint()
+	if err != nil {
+		return err
+	}
+	promStorageFlushes.WithLabelValues(m.name).Inc()
+	return nil
+}
 
+// checkpoint makes everything written so far durable, and applies the
+// journal to the map file and the index.
+func (m *mfileBlock) checkpoint() error {
+	for slot, ref := range m.pending {
+		err := m.logWrite(slot, ref)
+		if err != nil {
+			return err
+		}
+	}
+	m.pending, m.filling = m.filling, make(map[int]torus.BlockRef)
+	if len(m.unapplied) == 0 {
+		return m.dataFile.Flush()
+	}
+	err := m.dataFile.Sync()
 	if err != nil {
 		return err
 	}
-	err = m.refFile.Flush()
+	journalCrashPoint("data-synced")
+	err = m.journal.sync()
 	if err != nil {
 		return err
 	}
-	promStorageFlushes.WithLabelValues(m.name).Inc()
+	journalCrashPoint("journal-synced")
+	for i, r := range m.unapplied {
+		refBytes := blankRefBytes
+		if r.op == journalWrite {
+			refBytes = r.ref.ToBytes()
+		}
+		err = m.refFile.WriteBlock(r.slot, refBytes)
+		if err != nil {
+			return err
+		}
+		if i == len(m.unapplied)/2 {
+			journalCrashPoint("map-applying")
+		}
+	}
+	err = m.refFile.Sync()
+	if err != nil {
+		return err
+	}
+	journalCrashPoint("map-synced")
+	for _, r := range m.unapplied {
+		if r.op == journalWrite {
+			m.index.insert(r.ref, r.slot)
+		} else {
+			m.index.remove(r.ref, r.slot)
+		}
+	}
+	err = m.index.sync()
+	if err != nil {
+		return err
+	}
+	journalCrashPoint("index-synced")
+	err = m.journal.reset()
+	if err != nil {
+		return err
+	}
+	m.unapplied = nil
+	for _, slot := range m.freed {
+		m.free.push(uint64(slot))
+	}
+	m.freed = nil
+	m.delta = make(map[torus.BlockRef]int)
+	for slot, ref := range m.pending {
+		m.delta[ref] = slot
+	}
+	if m.index.needsRebuild() {
+		clog.Debugf("mfile: rebuilding block index")
+		idx, err := buildIndex(m.indexPath, m.numBlocks(), m.refFile)
+		if err != nil {
+			return err
+		}
+		m.index.close()
+		m.index = idx
+	}
+	return nil
+}
+
+func (m *mfileBlock) logWrite(slot int, s torus.BlockRef) error {
+	r := journalRecord{
+		op:   journalWrite,
+		sum:  slotSum(m.dataFile.GetBlock(uint64(slot))),
+		slot: uint64(slot),
+		ref:  s,
+	}
+	err := m.journal.append(r)
+	if err != nil {
+		return err
+	}
+	m.unapplied = append(m.unapplied, r)
 	return nil
 }
 
@@ -148,15 +289,33 @@ func (m *mfileBlock) Close() error {
 }
 
 func (m *mfileBlock) close() error {
-	m.flush()
 	if m.closed {
 		return nil
 	}
-	err := m.dataFile.Close()
+	// Nothing more will be written to the slots handed out by WriteBuf.
+	for slot, ref := range m.filling {
+		m.pending[slot] = ref
+	}
+	m.filling = make(map[int]torus.BlockRef)
+	err := m.flush()
+	if err != nil {
+		return err
+	}
+	for _, f := range []*MFile{m.dataFile, m.refFile} {
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	err = m.index.close()
+	if err != nil {
+		return err
+	}
+	err = m.journal.close()
 	if err != nil {
 		return err
 	}
-	err = m.refFile.Close()
+	err = m.free.close()
 	if err != nil {
 		return err
 	}
@@ -168,22 +327,10 @@ func (m *mfileBlock) findIndex(s torus.BlockRef) int {
 	if clog.LevelAt(capnslog.TRACE) {
 		clog.Tracef("finding blockid %s", s)
 	}
-	if v, ok := m.refIndex[s]; ok {
+	if v, ok := m.delta[s]; ok {
 		return v
 	}
-	return -1
-}
-
-func (m *mfileBlock) findEmpty() int {
-	emptyBlock := make([]byte, torus.BlockRefByteSize)
-	for i := uint64(0); i < m.numBlocks(); i++ {
-		b := m.refFile.GetBlock((i + uint64(m.lastFree) + 1) % m.numBlocks())
-		if bytes.Equal(b, emptyBlock) {
-			m.lastFree = int((i + uint64(m.lastFree) + 1) % m.numBlocks())
-			return m.lastFree
-		}
-	}
-	return -1
+	return m.index.lookup(s)
 }
 
 func (m *mfileBlock) HasBlock(_ context.Context, s torus.BlockRef) (bool, error) {
@@ -220,23 +367,6 @@ func (m *mfileBlock) WriteBlock(_ context.Context, s torus.BlockRef, data []byte
 		promBlockWritesFailed.WithLabelValues(m.name).Inc()
 		return torus.ErrClosed
 	}
-	index := m.findEmpty()
-	if index == -1 {
-		clog.Error("mfile: out of space")
-		promBlockWritesFailed.WithLabelValues(m.name).Inc()
-		return torus.ErrOutOfSpace
-	}
-	clog.Tracef("mfile: writing block at index %d", index)
-	err := m.dataFile.WriteBlock(uint64(index), data)
-	if err != nil {
-		promBlockWritesFailed.WithLabelValues(m.name).Inc()
-		return err
-	}
-	err = m.refFile.WriteBlock(uint64(index), s.ToBytes())
-	if err != nil {
-		promBlockWritesFailed.WithLabelValues(m.name).Inc()
-		return err
-	}
 	if v := m.findIndex(s); v != -1 {
 		// we already have it
 		clog.Debug("mfile: block already exists: ", s)
@@ -249,12 +379,31 @@ func (m *mfileBlock) WriteBlock(_ context.Context, s torus.BlockRef, data []byte
 		// Not an error, if we already have it
 		return nil
 	}
+	index := m.free.pop()
+	if index == -1 {
+		clog.Error("mfile: out of space")
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return torus.ErrOutOfSpace
+	}
+	clog.Tracef("mfile: writing block at index %d", index)
+	err := m.dataFile.WriteBlock(uint64(index), data)
+	if err == nil {
+		err = m.logWrite(index, s)
+	}
+	if err != nil {
+		m.free.push(uint64(index))
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return err
+	}
 	promBlocks.WithLabelValues(m.name).Inc()
-	m.refIndex[s] = index
+	m.delta[s] = index
+	m.used++
 	promBlocksWritten.WithLabelValues(m.name).Inc()
 	return nil
 }
 
+// WriteBuf hands out a slot to be filled in by the caller. It's journaled a
+// flush later, once the caller is sure to be done with it.
 func (m *mfileBlock) WriteBuf(_ context.Context, s torus.BlockRef) ([]byte, error) {
 	m.mut.Lock()
 	defer m.mut.Unlock()
@@ -262,7 +411,13 @@ func (m *mfileBlock) WriteBuf(_ context.Context, s torus.BlockRef) ([]byte, erro
 		promBlockWritesFailed.WithLabelValues(m.name).Inc()
 		return nil, torus.ErrClosed
 	}
-	index := m.findEmpty()
+	if v := m.findIndex(s); v != -1 {
+		// we already have it
+		clog.Debug("mfile: block already exists: ", s)
+		// Not an error, if we already have it
+		return nil, torus.ErrExists
+	}
+	index := m.free.pop()
 	if index == -1 {
 		clog.Error("mfile: out of space")
 		promBlockWritesFailed.WithLabelValues(m.name).Inc()
@@ -270,19 +425,10 @@ func (m *mfileBlock) WriteBuf(_ context.Context, s torus.BlockRef) ([]byte, erro
 	}
 	clog.Tracef("mfile: writing block at index %d", index)
 	buf := m.dataFile.GetBlock(uint64(index))
-	err := m.refFile.WriteBlock(uint64(index), s.ToBytes())
-	if err != nil {
-		promBlockWritesFailed.WithLabelValues(m.name).Inc()
-		return nil, err
-	}
-	if v := m.findIndex(s); v != -1 {
-		// we already have it
-		clog.Debug("mfile: block already exists: ", s)
-		// Not an error, if we already have it
-		return nil, torus.ErrExists
-	}
 	promBlocks.WithLabelValues(m.name).Inc()
-	m.refIndex[s] = index
+	m.delta[s] = index
+	m.used++
+	m.filling[index] = s
 	promBlocksWritten.WithLabelValues(m.name).Inc()
 	return buf, nil
 }
@@ -300,13 +446,32 @@ func (m *mfileBlock) DeleteBlock(_ context.Context, s torus.BlockRef) error {
 		clog.Errorf("mfile: deleting non-existent thing? %s", s)
 		return torus.ErrBlockNotExist
 	}
-	err := m.refFile.WriteBlock(uint64(index), blankRefBytes)
-	if err != nil {
-		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
-		return err
+	_, isPending := m.pending[index]
+	_, isFilling := m.filling[index]
+	if isPending || isFilling {
+		// Never journaled, so the slot can be reused right away.
+		delete(m.pending, index)
+		delete(m.filling, index)
+		m.free.push(uint64(index))
+	} else {
+		r := journalRecord{
+			op:   journalDelete,
+			slot: uint64(index),
+			ref:  s,
+		}
+		err := m.journal.append(r)
+		if err != nil {
+			promBlockDeletesFailed.WithLabelValues(m.name).Inc()
+			return err
+		}
+		m.unapplied = append(m.unapplied, r)
+		// The map file still points at this slot until the next
+		// checkpoint, so it can't be reused until then.
+		m.freed = append(m.freed, index)
 	}
 	promBlocks.WithLabelValues(m.name).Dec()
-	delete(m.refIndex, s)
+	m.delta[s] = -1
+	m.used--
 	promBlocksDeleted.WithLabelValues(m.name).Inc()
 	return nil
 }
@@ -315,11 +480,16 @@ func (m *mfileBlock) BlockIterator() torus.BlockIterator {
 	m.mut.RLock()
 	defer m.mut.RUnlock()
 	// TODO(barakmich): Amortize this alloc, eg, with Close() and a sync.Pool
-	l := make([]torus.BlockRef, len(m.refIndex))
-	i := 0
-	for k := range m.refIndex {
-		l[i] = k
-		i++
+	l := make([]torus.BlockRef, 0, m.used)
+	m.index.each(func(ref torus.BlockRef, _ int) {
+		if _, ok := m.delta[ref]; !ok {
+			l = append(l, ref)
+		}
+	})
+	for ref, v := range m.delta {
+		if v != -1 {
+			l = append(l, ref)
+		}
 	}
 	return &mfileIterator{
 		set: l,
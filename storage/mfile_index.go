@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+
+	"github.com/coreos/torus"
+)
+
+// mfileIndex is an on-disk, open-addressed hash table from BlockRef to the
+// slot holding it, so that opening an mfile store doesn't require reading
+// the whole map file into memory.
+//
+// The first entry of the file is a header; the rest are entries of a
+// BlockRef and its slot plus one. A zero slot is an empty entry, and
+// indexTombstone marks a deleted one.
+type mfileIndex struct {
+	file *MFile
+	// mask is the number of entries minus one; a power of two minus one.
+	mask uint64
+}
+
+const (
+	indexEntrySize = torus.BlockRefByteSize + 8
+	indexMagic     = 0x544f525553494458 // "TORUSIDX"
+	indexVersion   = 1
+	indexTombstone = math.MaxUint64
+)
+
+// header fields, as offsets into the first entry.
+const (
+	indexHeaderMagic   = 0
+	indexHeaderVersion = 8
+	indexHeaderBlocks  = 16
+	indexHeaderDeleted = 24
+)
+
+func indexCapacity(nBlocks uint64) uint64 {
+	// Keep the table no more than half full.
+	c := uint64(1)
+	for c < nBlocks*2 {
+		c <<= 1
+	}
+	return c
+}
+
+// openIndex opens the index at path, returning false if there isn't a
+// usable one for a store of nBlocks.
+func openIndex(path string, nBlocks uint64) (*mfileIndex, bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	f, err := OpenMFile(path, indexEntrySize)
+	if err != nil {
+		return nil, false, err
+	}
+	h := f.GetBlock(0)
+	if h == nil ||
+		binary.LittleEndian.Uint64(h[indexHeaderMagic:]) != indexMagic ||
+		binary.LittleEndian.Uint64(h[indexHeaderVersion:]) != indexVersion ||
+		binary.LittleEndian.Uint64(h[indexHeaderBlocks:]) != nBlocks ||
+		f.NumBlocks() != indexCapacity(nBlocks)+1 {
+		f.Close()
+		return nil, false, nil
+	}
+	return &mfileIndex{
+		file: f,
+		mask: f.NumBlocks() - 2,
+	}, true, nil
+}
+
+// buildIndex writes a new index for a store of nBlocks at path, from the map
+// file of the store.
+func buildIndex(path string, nBlocks uint64, refFile *MFile) (*mfileIndex, error) {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	capacity := indexCapacity(nBlocks)
+	err := CreateMFile(tmp, (capacity+1)*indexEntrySize)
+	if err != nil {
+		return nil, err
+	}
+	f, err := OpenMFile(tmp, indexEntrySize)
+	if err != nil {
+		return nil, err
+	}
+	idx := &mfileIndex{
+		file: f,
+		mask: capacity - 1,
+	}
+	h := make([]byte, indexEntrySize)
+	binary.LittleEndian.PutUint64(h[indexHeaderMagic:], indexMagic)
+	binary.LittleEndian.PutUint64(h[indexHeaderVersion:], indexVersion)
+	binary.LittleEndian.PutUint64(h[indexHeaderBlocks:], nBlocks)
+	err = f.WriteBlock(0, h)
+	if err == nil {
+		for i := uint64(0); i < refFile.NumBlocks(); i++ {
+			b := refFile.GetBlock(i)
+			if bytes.Equal(blankRefBytes, b) {
+				continue
+			}
+			idx.insert(torus.BlockRefFromBytes(b), i)
+		}
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return idx, nil
+}
+
+func hashRef(ref torus.BlockRef) uint64 {
+	var buf [torus.BlockRefByteSize]byte
+	ref.ToBytesBuf(buf[:])
+	h := binary.LittleEndian.Uint64(buf[0:8])*0x9e3779b97f4a7c15 ^
+		binary.LittleEndian.Uint64(buf[8:16])*0xc2b2ae3d27d4eb4f ^
+		binary.LittleEndian.Uint64(buf[16:24])*0x165667b19e3779f9
+	// Finish as in MurmurHash3.
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// entry returns the n-th entry of the table.
+func (x *mfileIndex) entry(n uint64) []byte {
+	return x.file.GetBlock(n + 1)
+}
+
+func entrySlot(e []byte) uint64 {
+	return binary.LittleEndian.Uint64(e[torus.BlockRefByteSize:])
+}
+
+func setEntry(e []byte, ref []byte, slot uint64) {
+	copy(e, ref)
+	binary.LittleEndian.PutUint64(e[torus.BlockRefByteSize:], slot)
+}
+
+// find returns the position of ref in the table, or the position to insert
+// it at, and whether it was found.
+func (x *mfileIndex) find(ref []byte, h uint64) (uint64, bool) {
+	insertAt := uint64(math.MaxUint64)
+	for i := uint64(0); i <= x.mask; i++ {
+		n := (h + i) & x.mask
+		e := x.entry(n)
+		switch entrySlot(e) {
+		case 0:
+			if insertAt == math.MaxUint64 {
+				insertAt = n
+			}
+			return insertAt, false
+		case indexTombstone:
+			if insertAt == math.MaxUint64 {
+				insertAt = n
+			}
+		default:
+			if bytes.Equal(e[:torus.BlockRefByteSize], ref) {
+				return n, true
+			}
+		}
+	}
+	return insertAt, false
+}
+
+// lookup returns the slot holding ref, or -1.
+func (x *mfileIndex) lookup(ref torus.BlockRef) int {
+	var buf [torus.BlockRefByteSize]byte
+	ref.ToBytesBuf(buf[:])
+	n, ok := x.find(buf[:], hashRef(ref))
+	if !ok {
+		return -1
+	}
+	return int(entrySlot(x.entry(n)) - 1)
+}
+
+// insert records ref as being held in slot. Inserting an existing ref
+// updates it, so replaying inserts is harmless.
+func (x *mfileIndex) insert(ref torus.BlockRef, slot uint64) {
+	var buf [torus.BlockRefByteSize]byte
+	ref.ToBytesBuf(buf[:])
+	n, ok := x.find(buf[:], hashRef(ref))
+	if n == math.MaxUint64 {
+		panic("mfile: block index is full")
+	}
+	if !ok && entrySlot(x.entry(n)) == indexTombstone {
+		x.addDeleted(-1)
+	}
+	setEntry(x.entry(n), buf[:], slot+1)
+}
+
+// remove forgets ref, if it is held in slot.
+func (x *mfileIndex) remove(ref torus.BlockRef, slot uint64) {
+	var buf [torus.BlockRefByteSize]byte
+	ref.ToBytesBuf(buf[:])
+	n, ok := x.find(buf[:], hashRef(ref))
+	if !ok {
+		return
+	}
+	e := x.entry(n)
+	if entrySlot(e)-1 != slot {
+		return
+	}
+	setEntry(e, blankRefBytes, indexTombstone)
+	x.addDeleted(1)
+}
+
+func (x *mfileIndex) deleted() uint64 {
+	return binary.LittleEndian.Uint64(x.file.GetBlock(0)[indexHeaderDeleted:])
+}
+
+func (x *mfileIndex) addDeleted(n int) {
+	h := x.file.GetBlock(0)
+	d := int64(binary.LittleEndian.Uint64(h[indexHeaderDeleted:])) + int64(n)
+	if d < 0 {
+		d = 0
+	}
+	binary.LittleEndian.PutUint64(h[indexHeaderDeleted:], uint64(d))
+}
+
+// needsRebuild reports whether enough of the table is tombstones to slow
+// down lookups.
+func (x *mfileIndex) needsRebuild() bool {
+	return x.deleted() > (x.mask+1)/4
+}
+
+// each calls f with every BlockRef in the table.
+func (x *mfileIndex) each(f func(torus.BlockRef, int)) {
+	for n := uint64(0); n <= x.mask; n++ {
+		e := x.entry(n)
+		s := entrySlot(e)
+		if s == 0 || s == indexTombstone {
+			continue
+		}
+		f(torus.BlockRefFromBytes(e[:torus.BlockRefByteSize]), int(s-1))
+	}
+}
+
+func (x *mfileIndex) sync() error  { return x.file.Sync() }
+func (x *mfileIndex) close() error { return x.file.Close() }
+
+// freeList is an on-disk stack of the free slots of an mfile store. It's
+// changed in place as slots are allocated and freed, so it's only trusted on
+// open if the store was cleanly closed.
+//
+// The first three entries are a header: a magic number marking a clean
+// close, the number of slots in the store, and the number of free slots.
+// The rest are the stack.
+type freeList struct {
+	file  *MFile
+	count uint64
+}
+
+const (
+	freeListClean   = 0x544f525553464c43 // "TORUSFLC"
+	freeListHeaders = 3
+)
+
+// openFreeList opens the free list for a store of nBlocks, returning whether
+// it can be trusted.
+func openFreeList(path string, nBlocks uint64) (*freeList, bool, error) {
+	f, err := CreateOrOpenMFile(path, (nBlocks+freeListHeaders)*8, 8)
+	if err != nil {
+		return nil, false, err
+	}
+	fl := &freeList{file: f}
+	clean := binary.LittleEndian.Uint64(f.GetBlock(0)) == freeListClean &&
+		binary.LittleEndian.Uint64(f.GetBlock(1)) == nBlocks
+	if clean {
+		fl.count = binary.LittleEndian.Uint64(f.GetBlock(2))
+		if fl.count > nBlocks {
+			clean = false
+		}
+	}
+	// Until it's closed again, the free list on disk can't be trusted.
+	binary.LittleEndian.PutUint64(f.GetBlock(0), 0)
+	binary.LittleEndian.PutUint64(f.GetBlock(1), nBlocks)
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	return fl, clean, nil
+}
+
+// rebuild refills the free list from the map file of the store.
+func (fl *freeList) rebuild(refFile *MFile) {
+	fl.count = 0
+	for i := refFile.NumBlocks(); i > 0; i-- {
+		if bytes.Equal(blankRefBytes, refFile.GetBlock(i-1)) {
+			fl.push(i - 1)
+		}
+	}
+}
+
+func (fl *freeList) push(slot uint64) {
+	binary.LittleEndian.PutUint64(fl.file.GetBlock(fl.count+freeListHeaders), slot)
+	fl.count++
+}
+
+// pop returns a free slot, or -1 if there are none.
+func (fl *freeList) pop() int {
+	if fl.count == 0 {
+		return -1
+	}
+	fl.count--
+	return int(binary.LittleEndian.Uint64(fl.file.GetBlock(fl.count + freeListHeaders)))
+}
+
+// close marks the free list as trustworthy, and closes it.
+func (fl *freeList) close() error {
+	binary.LittleEndian.PutUint64(fl.file.GetBlock(2), fl.count)
+	err := fl.file.Sync()
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(fl.file.GetBlock(0), freeListClean)
+	err = fl.file.Sync()
+	if err != nil {
+		return err
+	}
+	return fl.file.Close()
+}
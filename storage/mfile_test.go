@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMFileReopen(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+	m := openTestMFile(t, dir)
+	writeTestBlocks(t, m, 0, 48)
+	for i := 0; i < 48; i += 2 {
+		err := m.DeleteBlock(context.TODO(), testRef(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = openTestMFile(t, dir)
+	if m.UsedBlocks() != 24 || m.free.count != 40 {
+		t.Fatalf("expected 24 used and 40 free blocks, got %d and %d", m.UsedBlocks(), m.free.count)
+	}
+	for i := 0; i < 48; i++ {
+		checkTestBlocks(t, m, i, i+1, i%2 == 1)
+	}
+	writeTestBlocks(t, m, 100, 140)
+	err = m.WriteBlock(context.TODO(), testRef(200), testData(200))
+	if err == nil {
+		t.Fatal("expected the store to be full")
+	}
+	m.Close()
+
+	// Losing the index and free list only costs a rebuild.
+	os.Remove(filepath.Join(dir, "block", "index-test.blk"))
+	os.Remove(filepath.Join(dir, "block", "free-test.blk"))
+	m = openTestMFile(t, dir)
+	defer m.Close()
+	if m.UsedBlocks() != 64 {
+		t.Fatalf("expected 64 used blocks, got %d", m.UsedBlocks())
+	}
+	checkTestBlocks(t, m, 100, 140, true)
+	n := 0
+	it := m.BlockIterator()
+	for it.Next() {
+		n++
+	}
+	if n != 64 {
+		t.Fatalf("expected to iterate over 64 blocks, got %d", n)
+	}
+}
+
+func TestMFileIndexRebuild(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+	m := openTestMFile(t, dir)
+	defer m.Close()
+	// Churn through enough blocks to fill the index with tombstones.
+	for round := 0; round < 8; round++ {
+		writeTestBlocks(t, m, round*32, round*32+32)
+		err := m.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := round * 32; i < round*32+32; i++ {
+			err = m.DeleteBlock(context.TODO(), testRef(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = m.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.index.deleted() > (m.index.mask+1)/4 {
+			t.Fatal("index not rebuilt")
+		}
+	}
+	writeTestBlocks(t, m, 1000, 1064)
+	checkTestBlocks(t, m, 1000, 1064, true)
+	checkTestBlocks(t, m, 0, 256, false)
+}
@@ -109,6 +109,11 @@ func (m *MFile) Flush() error {
 	return m.mmap.FlushAsync()
 }
 
+// Sync writes any changes to the file to disk, and waits for them to be written.
+func (m *MFile) Sync() error {
+	return m.mmap.Flush()
+}
+
 func (m *MFile) Close() error {
 	if err := m.mmap.Flush(); err != nil {
 		return err
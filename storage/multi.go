@@ -0,0 +1,389 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ torus.BlockStore = &multiBlock{}
+
+var promFailedDisks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "torus_storage_failed_disks",
+	Help: "Gauge of number of failed disks in multi-disk local storage",
+}, []string{"storage"})
+
+var (
+	errNoDisks        = errors.New("multi: no disks configured")
+	errNoWorkingDisks = errors.New("multi: none of the disks could be opened")
+)
+
+func init() {
+	prometheus.MustRegister(promFailedDisks)
+	torus.RegisterBlockStore("multi", newMultiBlockStore)
+}
+
+// multiBlock is a BlockStore spread across several disks, each with an mfile
+// store of its own. A block lives on exactly one disk; new blocks go to the
+// disk with the most room.
+//
+// When a disk fails, it's dropped from the store rather than failing the
+// whole node. Its blocks read as missing, so the rebalancers of the other
+// replicas send them back to the disks that remain, and its space no longer
+// counts towards NumBlocks.
+type multiBlock struct {
+	mut       sync.RWMutex
+	disks     []*multiDisk
+	closed    bool
+	name      string
+	blocksize uint64
+}
+
+type multiDisk struct {
+	path   string
+	store  torus.BlockStore
+	failed bool
+}
+
+func newMultiBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata) (torus.BlockStore, error) {
+	if len(cfg.Disks) == 0 {
+		return nil, errNoDisks
+	}
+	m := &multiBlock{
+		name:      name,
+		blocksize: meta.BlockSize,
+	}
+	for _, disk := range cfg.Disks {
+		d := &multiDisk{path: disk.Path}
+		err := os.MkdirAll(filepath.Join(disk.Path, "block"), 0700)
+		if err == nil {
+			d.store, err = newMFileBlockStore(name, torus.Config{
+				DataDir:     disk.Path,
+				StorageSize: disk.Size,
+			}, meta)
+		}
+		if err != nil {
+			clog.Errorf("multi: couldn't open disk %s: %v", disk.Path, err)
+			d.failed = true
+		}
+		m.disks = append(m.disks, d)
+	}
+	if len(m.healthy()) == 0 {
+		return nil, errNoWorkingDisks
+	}
+	m.updateMetrics()
+	return m, nil
+}
+
+func (m *multiBlock) Kind() string      { return "multi" }
+func (m *multiBlock) BlockSize() uint64 { return m.blocksize }
+
+// healthy returns the disks that haven't failed.
+func (m *multiBlock) healthy() []*multiDisk {
+	var out []*multiDisk
+	for _, d := range m.disks {
+		if !d.failed {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// isDiskError reports whether err from a disk's store means the disk itself
+// is in trouble, rather than something about the request.
+func isDiskError(err error) bool {
+	switch err {
+	case nil, torus.ErrBlockNotExist, torus.ErrExists, torus.ErrOutOfSpace:
+		return false
+	}
+	return true
+}
+
+// fail drops d from the store. Its store is left open, as data already read
+// from it may still be in use; it's closed along with the rest.
+func (m *multiBlock) fail(d *multiDisk, err error) {
+	if d.failed {
+		return
+	}
+	clog.Errorf("multi: disk %s failed, dropping its blocks: %v", d.path, err)
+	d.failed = true
+	m.updateMetrics()
+}
+
+func (m *multiBlock) updateMetrics() {
+	failed := len(m.disks) - len(m.healthy())
+	promFailedDisks.WithLabelValues(m.name).Set(float64(failed))
+	// The disks' stores share our name, so set the gauges for all of them.
+	promBlocksAvail.WithLabelValues(m.name).Set(float64(m.numBlocks()))
+	promBlocks.WithLabelValues(m.name).Set(float64(m.usedBlocks()))
+}
+
+// locate returns the disk holding s, or nil.
+func (m *multiBlock) locate(ctx context.Context, s torus.BlockRef) *multiDisk {
+	for _, d := range m.healthy() {
+		if ok, _ := d.store.HasBlock(ctx, s); ok {
+			return d
+		}
+	}
+	return nil
+}
+
+// byRoom returns the healthy disks, the emptiest (as a fraction of its size)
+// first.
+func (m *multiBlock) byRoom() []*multiDisk {
+	r := disksByRoom{disks: m.healthy()}
+	for _, d := range r.disks {
+		var room float64
+		if n := d.store.NumBlocks(); n != 0 {
+			room = float64(n-d.store.UsedBlocks()) / float64(n)
+		}
+		r.room = append(r.room, room)
+	}
+	sort.Stable(r)
+	return r.disks
+}
+
+type disksByRoom struct {
+	disks []*multiDisk
+	room  []float64
+}
+
+func (r disksByRoom) Len() int           { return len(r.disks) }
+func (r disksByRoom) Less(i, j int) bool { return r.room[i] > r.room[j] }
+func (r disksByRoom) Swap(i, j int) {
+	r.disks[i], r.disks[j] = r.disks[j], r.disks[i]
+	r.room[i], r.room[j] = r.room[j], r.room[i]
+}
+
+func (m *multiBlock) NumBlocks() uint64 {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return m.numBlocks()
+}
+
+func (m *multiBlock) numBlocks() uint64 {
+	var n uint64
+	for _, d := range m.healthy() {
+		n += d.store.NumBlocks()
+	}
+	return n
+}
+
+func (m *multiBlock) UsedBlocks() uint64 {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return m.usedBlocks()
+}
+
+func (m *multiBlock) usedBlocks() uint64 {
+	var n uint64
+	for _, d := range m.healthy() {
+		n += d.store.UsedBlocks()
+	}
+	return n
+}
+
+func (m *multiBlock) HasBlock(ctx context.Context, s torus.BlockRef) (bool, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return m.locate(ctx, s) != nil, nil
+}
+
+func (m *multiBlock) GetBlock(ctx context.Context, s torus.BlockRef) ([]byte, error) {
+	m.mut.RLock()
+	if m.closed {
+		m.mut.RUnlock()
+		promBlocksFailed.WithLabelValues(m.name).Inc()
+		return nil, torus.ErrClosed
+	}
+	d := m.locate(ctx, s)
+	if d == nil {
+		m.mut.RUnlock()
+		promBlocksFailed.WithLabelValues(m.name).Inc()
+		return nil, torus.ErrBlockNotExist
+	}
+	data, err := d.store.GetBlock(ctx, s)
+	m.mut.RUnlock()
+	if isDiskError(err) {
+		m.mut.Lock()
+		m.fail(d, err)
+		m.mut.Unlock()
+		return nil, torus.ErrBlockNotExist
+	}
+	return data, err
+}
+
+func (m *multiBlock) WriteBlock(ctx context.Context, s torus.BlockRef, data []byte) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return torus.ErrClosed
+	}
+	if d := m.locate(ctx, s); d != nil {
+		err := d.store.WriteBlock(ctx, s, data)
+		if !isDiskError(err) {
+			return err
+		}
+		// Write it anew to one of the other disks.
+		m.fail(d, err)
+	}
+	for _, d := range m.byRoom() {
+		err := d.store.WriteBlock(ctx, s, data)
+		if err == torus.ErrOutOfSpace {
+			continue
+		}
+		if isDiskError(err) {
+			m.fail(d, err)
+			continue
+		}
+		return err
+	}
+	return torus.ErrOutOfSpace
+}
+
+func (m *multiBlock) WriteBuf(ctx context.Context, s torus.BlockRef) ([]byte, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return nil, torus.ErrClosed
+	}
+	if d := m.locate(ctx, s); d != nil {
+		return nil, torus.ErrExists
+	}
+	for _, d := range m.byRoom() {
+		buf, err := d.store.WriteBuf(ctx, s)
+		if err == torus.ErrOutOfSpace {
+			continue
+		}
+		if isDiskError(err) {
+			m.fail(d, err)
+			continue
+		}
+		return buf, err
+	}
+	return nil, torus.ErrOutOfSpace
+}
+
+func (m *multiBlock) DeleteBlock(ctx context.Context, s torus.BlockRef) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
+		return torus.ErrClosed
+	}
+	// A disk that failed and came back may hold a stale copy of a block
+	// that has since been written to another, so delete it everywhere.
+	found := false
+	for _, d := range m.healthy() {
+		if ok, _ := d.store.HasBlock(ctx, s); !ok {
+			continue
+		}
+		found = true
+		err := d.store.DeleteBlock(ctx, s)
+		if isDiskError(err) {
+			// Failing the disk deletes the block as far as anyone can tell.
+			m.fail(d, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !found {
+		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
+		return torus.ErrBlockNotExist
+	}
+	return nil
+}
+
+func (m *multiBlock) BlockIterator() torus.BlockIterator {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	it := &multiIterator{}
+	for _, d := range m.healthy() {
+		it.its = append(it.its, d.store.BlockIterator())
+	}
+	return it
+}
+
+func (m *multiBlock) Flush() error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		return torus.ErrClosed
+	}
+	for _, d := range m.healthy() {
+		err := d.store.Flush()
+		if err != nil {
+			m.fail(d, err)
+		}
+	}
+	return nil
+}
+
+func (m *multiBlock) Close() error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		return nil
+	}
+	var out error
+	for _, d := range m.disks {
+		if d.store == nil {
+			continue
+		}
+		err := d.store.Close()
+		if err != nil && !d.failed {
+			clog.Errorf("multi: couldn't close disk %s: %v", d.path, err)
+			out = err
+		}
+	}
+	m.closed = true
+	return out
+}
+
+// multiIterator iterates over each disk's blocks in turn.
+type multiIterator struct {
+	its []torus.BlockIterator
+	i   int
+}
+
+func (i *multiIterator) Err() error {
+	if i.i < len(i.its) {
+		return i.its[i.i].Err()
+	}
+	return nil
+}
+
+func (i *multiIterator) Next() bool {
+	for i.i < len(i.its) {
+		if i.its[i.i].Next() {
+			return true
+		}
+		if i.its[i.i].Err() != nil {
+			return false
+		}
+		i.i++
+	}
+	return false
+}
+
+func (i *multiIterator) BlockRef() torus.BlockRef {
+	return i.its[i.i].BlockRef()
+}
+
+func (i *multiIterator) Close() error {
+	for _, it := range i.its {
+		it.Close()
+	}
+	return nil
+}
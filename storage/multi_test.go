@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+func openTestMulti(t *testing.T, dirs ...string) *multiBlock {
+	var disks []torus.DiskConfig
+	for _, dir := range dirs {
+		disks = append(disks, torus.DiskConfig{Path: dir, Size: 64 * testBlockSize})
+	}
+	s, err := newMultiBlockStore("test", torus.Config{Disks: disks}, torus.GlobalMetadata{BlockSize: testBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*multiBlock)
+}
+
+func makeTestDisks(t *testing.T, n int) (string, []string) {
+	dir, err := ioutil.TempDir("", "torus-multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for i := 0; i < n; i++ {
+		dirs = append(dirs, filepath.Join(dir, fmt.Sprintf("disk%d", i)))
+	}
+	return dir, dirs
+}
+
+func checkMultiBlocks(t *testing.T, m *multiBlock, from, to int, present bool) {
+	for i := from; i < to; i++ {
+		data, err := m.GetBlock(context.TODO(), testRef(i))
+		if !present {
+			if err != torus.ErrBlockNotExist {
+				t.Fatalf("block %d should not exist", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if string(data[:len(testData(i))]) != string(testData(i)) {
+			t.Fatalf("block %d has the wrong data", i)
+		}
+	}
+}
+
+func TestMultiSpread(t *testing.T) {
+	dir, dirs := makeTestDisks(t, 2)
+	defer os.RemoveAll(dir)
+	m := openTestMulti(t, dirs...)
+	if m.NumBlocks() != 128 {
+		t.Fatalf("expected 128 blocks, got %d", m.NumBlocks())
+	}
+	for i := 0; i < 100; i++ {
+		err := m.WriteBlock(context.TODO(), testRef(i), testData(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range m.disks {
+		if d.store.UsedBlocks() != 50 {
+			t.Fatalf("expected blocks spread evenly, disk %s has %d", d.path, d.store.UsedBlocks())
+		}
+	}
+	err := m.DeleteBlock(context.TODO(), testRef(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = openTestMulti(t, dirs...)
+	defer m.Close()
+	if m.UsedBlocks() != 99 {
+		t.Fatalf("expected 99 blocks, got %d", m.UsedBlocks())
+	}
+	checkMultiBlocks(t, m, 0, 7, true)
+	checkMultiBlocks(t, m, 7, 8, false)
+	checkMultiBlocks(t, m, 8, 100, true)
+	n := 0
+	it := m.BlockIterator()
+	for it.Next() {
+		n++
+	}
+	it.Close()
+	if n != 99 {
+		t.Fatalf("expected to iterate 99 blocks, got %d", n)
+	}
+	for i := 100; i < 129; i++ {
+		err := m.WriteBlock(context.TODO(), testRef(i), testData(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = m.WriteBlock(context.TODO(), testRef(129), testData(129))
+	if err != torus.ErrOutOfSpace {
+		t.Fatalf("expected out of space, got %v", err)
+	}
+}
+
+func TestMultiDiskFailure(t *testing.T) {
+	dir, dirs := makeTestDisks(t, 2)
+	defer os.RemoveAll(dir)
+	m := openTestMulti(t, dirs...)
+	for i := 0; i < 32; i++ {
+		err := m.WriteBlock(context.TODO(), testRef(i), testData(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bad := m.disks[0]
+	var lost []int
+	for i := 0; i < 32; i++ {
+		if ok, _ := bad.store.HasBlock(context.TODO(), testRef(i)); ok {
+			lost = append(lost, i)
+		}
+	}
+	m.fail(bad, errors.New("test failure"))
+	if m.NumBlocks() != 64 || m.UsedBlocks() != uint64(32-len(lost)) {
+		t.Fatalf("failed disk still counted: %d of %d blocks", m.UsedBlocks(), m.NumBlocks())
+	}
+	for _, i := range lost {
+		checkMultiBlocks(t, m, i, i+1, false)
+		// The rest of the cluster sends it back.
+		err := m.WriteBlock(context.TODO(), testRef(i), testData(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkMultiBlocks(t, m, 0, 32, true)
+	m.Close()
+
+	// A disk that can't be opened is left out.
+	os.RemoveAll(dirs[1])
+	err := ioutil.WriteFile(dirs[1], nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = openTestMulti(t, dirs...)
+	defer m.Close()
+	if m.NumBlocks() != 64 {
+		t.Fatalf("expected 64 blocks, got %d", m.NumBlocks())
+	}
+}
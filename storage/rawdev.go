@@ -0,0 +1,497 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/coreos/torus"
+)
+
+var _ torus.BlockStore = &rawDevice{}
+
+func init() {
+	torus.RegisterBlockStore("raw", newRawDeviceBlockStore)
+}
+
+// rawDevice is a BlockStore written directly to a block device (or an image
+// file), bypassing any filesystem. The device is laid out as:
+//
+//   - a superblock, in the first rawSectorSize bytes;
+//   - the slot map, of a rawMapEntrySize entry per slot, padded to a sector;
+//   - the slots, each holding a block.
+//
+// All I/O is done in whole, aligned sectors, so the device can be opened
+// with O_DIRECT.
+type rawDevice struct {
+	mut       sync.RWMutex
+	f         *os.File
+	path      string
+	name      string
+	blocksize uint64
+	closed    bool
+
+	nSlots     uint64
+	mapOffset  int64
+	dataOffset int64
+	// slotMap is the in-memory copy of the slot map on disk.
+	slotMap  []byte
+	refIndex map[torus.BlockRef]int
+	free     []int
+
+	// bufs holds blocks handed out by WriteBuf, which are written to the
+	// device a flush later, once the caller is sure to be done with them;
+	// filling holds those handed out since the last flush.
+	bufs    map[torus.BlockRef]*rawBuf
+	filling map[torus.BlockRef]bool
+}
+
+type rawBuf struct {
+	slot int
+	data []byte
+}
+
+const (
+	rawSectorSize   = 4096
+	rawMagic        = 0x544f52555352574b // "TORUSRWK"
+	rawVersion      = 1
+	rawMapEntrySize = torus.BlockRefByteSize + 8
+)
+
+var rawCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// superblock fields, as offsets.
+const (
+	rawSuperMagic     = 0
+	rawSuperVersion   = 8
+	rawSuperBlockSize = 16
+	rawSuperSlots     = 24
+	rawSuperMap       = 32
+	rawSuperData      = 40
+	rawSuperChecksum  = 48
+)
+
+var (
+	errRawNotFormatted = errors.New("raw: device has data on it that isn't a torus store; wipe it first")
+	errRawBlockSize    = errors.New("raw: block size must be a multiple of 4096")
+)
+
+func alignUp(n, to int64) int64 {
+	return (n + to - 1) / to * to
+}
+
+// alignedBuf returns a buffer of size bytes, aligned for O_DIRECT I/O.
+func alignedBuf(size int) []byte {
+	buf := make([]byte, size+rawSectorSize)
+	off := 0
+	if rem := int(uintptrOf(buf) % rawSectorSize); rem != 0 {
+		off = rawSectorSize - rem
+	}
+	return buf[off : off+size]
+}
+
+func uintptrOf(b []byte) uintptr {
+	return uintptr(unsafe.Pointer(&b[0]))
+}
+
+func deviceSize(f *os.File) (int64, error) {
+	// Seeking works for both block devices and regular files.
+	size, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(0, os.SEEK_SET)
+	return size, err
+}
+
+// rawLayout returns the number of slots, and the offsets of the slot map and
+// the first slot, for a device of size bytes.
+func rawLayout(size int64, blocksize int64) (uint64, int64, int64) {
+	n := (size - rawSectorSize) / (blocksize + rawMapEntrySize)
+	for ; n > 0; n-- {
+		data := alignUp(rawSectorSize+n*rawMapEntrySize, rawSectorSize)
+		if data+n*blocksize <= size {
+			return uint64(n), rawSectorSize, data
+		}
+	}
+	return 0, rawSectorSize, rawSectorSize
+}
+
+func newRawDeviceBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata) (torus.BlockStore, error) {
+	if cfg.DevicePath == "" {
+		return nil, errors.New("raw: no device path given")
+	}
+	if meta.BlockSize%rawSectorSize != 0 {
+		return nil, errRawBlockSize
+	}
+	f, err := openDirect(cfg.DevicePath)
+	if err != nil {
+		return nil, err
+	}
+	r := &rawDevice{
+		f:         f,
+		path:      cfg.DevicePath,
+		name:      name,
+		blocksize: meta.BlockSize,
+		refIndex:  make(map[torus.BlockRef]int),
+		bufs:      make(map[torus.BlockRef]*rawBuf),
+		filling:   make(map[torus.BlockRef]bool),
+	}
+	err = r.open(cfg.StorageSize)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	promBytesPerBlock.Set(float64(meta.BlockSize))
+	promBlocksAvail.WithLabelValues(name).Set(float64(r.nSlots))
+	promBlocks.WithLabelValues(name).Set(float64(len(r.refIndex)))
+	return r, nil
+}
+
+// open reads the superblock and slot map, formatting the device first if
+// it's blank.
+func (r *rawDevice) open(maxSize uint64) error {
+	sb := alignedBuf(rawSectorSize)
+	_, err := r.f.ReadAt(sb, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if binary.LittleEndian.Uint64(sb[rawSuperMagic:]) != rawMagic {
+		if !isZero(sb) {
+			return errRawNotFormatted
+		}
+		err = r.format(maxSize)
+		if err != nil {
+			return err
+		}
+	} else {
+		sum := binary.LittleEndian.Uint32(sb[rawSuperChecksum:])
+		if crc32.Checksum(sb[:rawSuperChecksum], rawCastagnoli) != sum {
+			return errors.New("raw: superblock is corrupt")
+		}
+		if v := binary.LittleEndian.Uint64(sb[rawSuperVersion:]); v != rawVersion {
+			return fmt.Errorf("raw: unknown on-disk version %d", v)
+		}
+		if bs := binary.LittleEndian.Uint64(sb[rawSuperBlockSize:]); bs != r.blocksize {
+			return fmt.Errorf("raw: device was formatted with block size %d, not %d", bs, r.blocksize)
+		}
+		r.nSlots = binary.LittleEndian.Uint64(sb[rawSuperSlots:])
+		r.mapOffset = int64(binary.LittleEndian.Uint64(sb[rawSuperMap:]))
+		r.dataOffset = int64(binary.LittleEndian.Uint64(sb[rawSuperData:]))
+	}
+	r.slotMap = alignedBuf(int(r.dataOffset - r.mapOffset))
+	_, err = r.f.ReadAt(r.slotMap, r.mapOffset)
+	if err != nil {
+		return err
+	}
+	for i := int(r.nSlots) - 1; i >= 0; i-- {
+		e := r.mapEntry(i)
+		if bytes.Equal(e[:torus.BlockRefByteSize], blankRefBytes) {
+			r.free = append(r.free, i)
+			continue
+		}
+		r.refIndex[torus.BlockRefFromBytes(e[:torus.BlockRefByteSize])] = i
+	}
+	return nil
+}
+
+func (r *rawDevice) format(maxSize uint64) error {
+	size, err := deviceSize(r.f)
+	if err != nil {
+		return err
+	}
+	if maxSize != 0 && int64(maxSize) < size {
+		size = int64(maxSize)
+	}
+	r.nSlots, r.mapOffset, r.dataOffset = rawLayout(size, int64(r.blocksize))
+	if r.nSlots == 0 {
+		return torus.ErrOutOfSpace
+	}
+	clog.Infof("raw: formatting %s with %d blocks", r.path, r.nSlots)
+	// Clear the slot map, then write the superblock.
+	zeros := alignedBuf(rawSectorSize)
+	for off := r.mapOffset; off < r.dataOffset; off += rawSectorSize {
+		_, err = r.f.WriteAt(zeros, off)
+		if err != nil {
+			return err
+		}
+	}
+	err = r.f.Sync()
+	if err != nil {
+		return err
+	}
+	sb := alignedBuf(rawSectorSize)
+	binary.LittleEndian.PutUint64(sb[rawSuperMagic:], rawMagic)
+	binary.LittleEndian.PutUint64(sb[rawSuperVersion:], rawVersion)
+	binary.LittleEndian.PutUint64(sb[rawSuperBlockSize:], r.blocksize)
+	binary.LittleEndian.PutUint64(sb[rawSuperSlots:], r.nSlots)
+	binary.LittleEndian.PutUint64(sb[rawSuperMap:], uint64(r.mapOffset))
+	binary.LittleEndian.PutUint64(sb[rawSuperData:], uint64(r.dataOffset))
+	binary.LittleEndian.PutUint32(sb[rawSuperChecksum:], crc32.Checksum(sb[:rawSuperChecksum], rawCastagnoli))
+	_, err = r.f.WriteAt(sb, 0)
+	if err != nil {
+		return err
+	}
+	return r.f.Sync()
+}
+
+func (r *rawDevice) mapEntry(slot int) []byte {
+	off := slot * rawMapEntrySize
+	return r.slotMap[off : off+rawMapEntrySize]
+}
+
+// writeMapEntry updates the entry for slot, and writes out the sector
+// holding it.
+func (r *rawDevice) writeMapEntry(slot int, ref []byte, sum uint32) error {
+	e := r.mapEntry(slot)
+	copy(e, ref)
+	binary.LittleEndian.PutUint32(e[torus.BlockRefByteSize:], sum)
+	// Entries evenly divide sectors, so this is the only sector touched.
+	sector := int64(slot*rawMapEntrySize) / rawSectorSize * rawSectorSize
+	_, err := r.f.WriteAt(r.slotMap[sector:sector+rawSectorSize], r.mapOffset+sector)
+	return err
+}
+
+func (r *rawDevice) slotOffset(slot int) int64 {
+	return r.dataOffset + int64(slot)*int64(r.blocksize)
+}
+
+func (r *rawDevice) writeSlot(slot int, s torus.BlockRef, data []byte) error {
+	buf := data
+	if uintptrOf(data)%rawSectorSize != 0 || uint64(len(data)) != r.blocksize {
+		buf = alignedBuf(int(r.blocksize))
+		copy(buf, data)
+	}
+	_, err := r.f.WriteAt(buf, r.slotOffset(slot))
+	if err != nil {
+		return err
+	}
+	// The data must be written before the map entry pointing at it.
+	return r.writeMapEntry(slot, s.ToBytes(), crc32.Checksum(buf, rawCastagnoli))
+}
+
+func (r *rawDevice) Kind() string      { return "raw" }
+func (r *rawDevice) BlockSize() uint64 { return r.blocksize }
+
+func (r *rawDevice) NumBlocks() uint64 {
+	return r.nSlots
+}
+
+func (r *rawDevice) UsedBlocks() uint64 {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return uint64(len(r.refIndex))
+}
+
+func (r *rawDevice) Flush() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.closed {
+		return torus.ErrClosed
+	}
+	return r.flush(false)
+}
+
+// flush writes out the blocks from WriteBuf that are done being filled, or
+// all of them, and syncs the device.
+func (r *rawDevice) flush(all bool) error {
+	for ref, b := range r.bufs {
+		if r.filling[ref] && !all {
+			continue
+		}
+		err := r.writeSlot(b.slot, ref, b.data)
+		if err != nil {
+			return err
+		}
+		delete(r.bufs, ref)
+	}
+	r.filling = make(map[torus.BlockRef]bool)
+	for ref := range r.bufs {
+		r.filling[ref] = true
+	}
+	err := r.f.Sync()
+	if err != nil {
+		return err
+	}
+	promStorageFlushes.WithLabelValues(r.name).Inc()
+	return nil
+}
+
+func (r *rawDevice) Close() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.closed {
+		return nil
+	}
+	err := r.flush(true)
+	if err != nil {
+		return err
+	}
+	r.closed = true
+	return r.f.Close()
+}
+
+func (r *rawDevice) HasBlock(_ context.Context, s torus.BlockRef) (bool, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	_, ok := r.refIndex[s]
+	return ok, nil
+}
+
+func (r *rawDevice) GetBlock(_ context.Context, s torus.BlockRef) ([]byte, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	if r.closed {
+		promBlocksFailed.WithLabelValues(r.name).Inc()
+		return nil, torus.ErrClosed
+	}
+	slot, ok := r.refIndex[s]
+	if !ok {
+		promBlocksFailed.WithLabelValues(r.name).Inc()
+		return nil, torus.ErrBlockNotExist
+	}
+	if b, ok := r.bufs[s]; ok {
+		promBlocksRetrieved.WithLabelValues(r.name).Inc()
+		return b.data, nil
+	}
+	if clog.LevelAt(capnslog.TRACE) {
+		clog.Tracef("raw: getting block %s at slot %d", s, slot)
+	}
+	buf := alignedBuf(int(r.blocksize))
+	_, err := r.f.ReadAt(buf, r.slotOffset(slot))
+	if err != nil {
+		promBlocksFailed.WithLabelValues(r.name).Inc()
+		return nil, err
+	}
+	sum := binary.LittleEndian.Uint32(r.mapEntry(slot)[torus.BlockRefByteSize:])
+	if crc32.Checksum(buf, rawCastagnoli) != sum {
+		clog.Errorf("raw: block %s at slot %d is corrupt", s, slot)
+		promBlocksFailed.WithLabelValues(r.name).Inc()
+		return nil, torus.ErrBlockUnavailable
+	}
+	promBlocksRetrieved.WithLabelValues(r.name).Inc()
+	return buf, nil
+}
+
+func (r *rawDevice) allocate() int {
+	if len(r.free) == 0 {
+		return -1
+	}
+	slot := r.free[len(r.free)-1]
+	r.free = r.free[:len(r.free)-1]
+	return slot
+}
+
+func (r *rawDevice) WriteBlock(ctx context.Context, s torus.BlockRef, data []byte) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.closed {
+		promBlockWritesFailed.WithLabelValues(r.name).Inc()
+		return torus.ErrClosed
+	}
+	if uint64(len(data)) > r.blocksize {
+		promBlockWritesFailed.WithLabelValues(r.name).Inc()
+		return torus.ErrInvalid
+	}
+	if _, ok := r.refIndex[s]; ok {
+		clog.Debug("raw: block already exists: ", s)
+		return nil
+	}
+	slot := r.allocate()
+	if slot == -1 {
+		clog.Error("raw: out of space")
+		promBlockWritesFailed.WithLabelValues(r.name).Inc()
+		return torus.ErrOutOfSpace
+	}
+	err := r.writeSlot(slot, s, data)
+	if err != nil {
+		r.free = append(r.free, slot)
+		promBlockWritesFailed.WithLabelValues(r.name).Inc()
+		return err
+	}
+	r.refIndex[s] = slot
+	promBlocks.WithLabelValues(r.name).Inc()
+	promBlocksWritten.WithLabelValues(r.name).Inc()
+	return nil
+}
+
+func (r *rawDevice) WriteBuf(_ context.Context, s torus.BlockRef) ([]byte, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.closed {
+		promBlockWritesFailed.WithLabelValues(r.name).Inc()
+		return nil, torus.ErrClosed
+	}
+	if _, ok := r.refIndex[s]; ok {
+		clog.Debug("raw: block already exists: ", s)
+		return nil, torus.ErrExists
+	}
+	slot := r.allocate()
+	if slot == -1 {
+		clog.Error("raw: out of space")
+		promBlockWritesFailed.WithLabelValues(r.name).Inc()
+		return nil, torus.ErrOutOfSpace
+	}
+	b := &rawBuf{
+		slot: slot,
+		data: alignedBuf(int(r.blocksize)),
+	}
+	r.bufs[s] = b
+	r.filling[s] = true
+	r.refIndex[s] = slot
+	promBlocks.WithLabelValues(r.name).Inc()
+	promBlocksWritten.WithLabelValues(r.name).Inc()
+	return b.data, nil
+}
+
+func (r *rawDevice) DeleteBlock(_ context.Context, s torus.BlockRef) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.closed {
+		promBlockDeletesFailed.WithLabelValues(r.name).Inc()
+		return torus.ErrClosed
+	}
+	slot, ok := r.refIndex[s]
+	if !ok {
+		promBlockDeletesFailed.WithLabelValues(r.name).Inc()
+		clog.Errorf("raw: deleting non-existent thing? %s", s)
+		return torus.ErrBlockNotExist
+	}
+	if _, ok := r.bufs[s]; ok {
+		delete(r.bufs, s)
+		delete(r.filling, s)
+	} else {
+		err := r.writeMapEntry(slot, blankRefBytes, 0)
+		if err != nil {
+			promBlockDeletesFailed.WithLabelValues(r.name).Inc()
+			return err
+		}
+	}
+	delete(r.refIndex, s)
+	r.free = append(r.free, slot)
+	promBlocks.WithLabelValues(r.name).Dec()
+	promBlocksDeleted.WithLabelValues(r.name).Inc()
+	return nil
+}
+
+func (r *rawDevice) BlockIterator() torus.BlockIterator {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	l := make([]torus.BlockRef, 0, len(r.refIndex))
+	for k := range r.refIndex {
+		l = append(l, k)
+	}
+	return &mfileIterator{
+		set: l,
+		i:   -1,
+	}
+}
@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirect opens a device for unbuffered I/O. Not every filesystem
+// supports O_DIRECT (tmpfs, for one), so image files on those are opened
+// normally.
+func openDirect(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_DIRECT, 0)
+	if err == nil {
+		return f, nil
+	}
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.EINVAL {
+		return nil, err
+	}
+	clog.Warningf("raw: %s doesn't support O_DIRECT; using buffered I/O", path)
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+const rawTestBlockSize = 16 * 1024
+
+func makeTestImage(t *testing.T, size int64) string {
+	f, err := ioutil.TempFile("", "torus-raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// A sparse image stands in for a device.
+	err = f.Truncate(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func openTestRaw(t *testing.T, path string) *rawDevice {
+	s, err := newRawDeviceBlockStore("test", torus.Config{DevicePath: path}, torus.GlobalMetadata{BlockSize: rawTestBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*rawDevice)
+}
+
+func TestRawDevice(t *testing.T) {
+	path := makeTestImage(t, 1<<20)
+	defer os.Remove(path)
+	r := openTestRaw(t, path)
+	if r.NumBlocks() == 0 || r.NumBlocks() > (1<<20)/rawTestBlockSize {
+		t.Fatalf("unexpected number of blocks: %d", r.NumBlocks())
+	}
+	ctx := context.TODO()
+	for i := 0; i < 8; i++ {
+		err := r.WriteBlock(ctx, testRef(i), testData(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf, err := r.WriteBuf(ctx, testRef(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(buf, testData(8))
+	err = r.DeleteBlock(ctx, testRef(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = openTestRaw(t, path)
+	defer r.Close()
+	if r.UsedBlocks() != 8 {
+		t.Fatalf("expected 8 blocks, got %d", r.UsedBlocks())
+	}
+	for i := 0; i < 9; i++ {
+		data, err := r.GetBlock(ctx, testRef(i))
+		if i == 3 {
+			if err != torus.ErrBlockNotExist {
+				t.Fatal("deleted block still exists")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, testData(i)) {
+			t.Fatalf("block %d has the wrong data", i)
+		}
+	}
+
+	// Corrupt a block behind the store's back.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("corruption"), r.slotOffset(r.refIndex[testRef(0)]))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.GetBlock(ctx, testRef(0))
+	if err != torus.ErrBlockUnavailable {
+		t.Fatalf("expected corruption to be detected, got %v", err)
+	}
+}
+
+func TestRawDeviceRefusesData(t *testing.T) {
+	path := makeTestImage(t, 1<<20)
+	defer os.Remove(path)
+	err := ioutil.WriteFile(path, []byte("some filesystem"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Truncate(path, 1<<20)
+	_, err = newRawDeviceBlockStore("test", torus.Config{DevicePath: path}, torus.GlobalMetadata{BlockSize: rawTestBlockSize})
+	if err != errRawNotFormatted {
+		t.Fatalf("expected refusal to format, got %v", err)
+	}
+}
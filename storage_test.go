@@ -0,0 +1,52 @@
+package torus_test
+
+import (
+	"testing"
+
+	"github.com/coreos/torus"
+)
+
+func TestQuorumSize(t *testing.T) {
+	for _, x := range []struct{ n, rep, want int }{
+		{0, 3, 2},
+		{0, 2, 2},
+		{0, 1, 1},
+		{1, 3, 1},
+		{3, 3, 3},
+		{4, 3, 3},
+		{3, 2, 2},
+	} {
+		if got := torus.QuorumSize(x.n, x.rep); got != x.want {
+			t.Errorf("QuorumSize(%d, %d): expected %d, got %d", x.n, x.rep, x.want, got)
+		}
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	for s, want := range map[string]torus.WriteLevel{
+		"quorum": torus.WriteQuorum,
+		"all":    torus.WriteAll,
+		"one":    torus.WriteOne,
+		"local":  torus.WriteLocal,
+	} {
+		if got, err := torus.ParseWriteLevel(s); err != nil || got != want {
+			t.Errorf("ParseWriteLevel(%q): expected %v, got %v, %v", s, want, got, err)
+		}
+	}
+	if _, err := torus.ParseWriteLevel("most"); err == nil {
+		t.Error("expected an unknown write level to be refused")
+	}
+	for s, want := range map[string]torus.ReadLevel{
+		"quorum": torus.ReadQuorum,
+		"block":  torus.ReadBlock,
+		"seq":    torus.ReadSequential,
+		"spread": torus.ReadSpread,
+	} {
+		if got, err := torus.ParseReadLevel(s); err != nil || got != want {
+			t.Errorf("ParseReadLevel(%q): expected %v, got %v, %v", s, want, got, err)
+		}
+	}
+	if _, err := torus.ParseReadLevel("most"); err == nil {
+		t.Error("expected an unknown read level to be refused")
+	}
+}